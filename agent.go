@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// agentSocketName is the file name of the agent socket, next to the default
+// server socket
+const agentSocketName = "opfwd-agent.sock"
+
+// clientAgent relays the requests of local clients to the server over a
+// single upstream connection it keeps open, so repeated client invocations
+// don't each pay for connecting to a server that may be at the end of an
+// SSH forward. Requests are sent upstream one at a time.
+type clientAgent struct {
+	// upstream are the server sockets tried in order when connecting
+	upstream []string
+
+	// maxCommands is how many commands an upstream connection carries
+	// before the agent reconnects, the server's max_commands_per_conn
+	maxCommands int
+
+	// wait is how long to wait for the server socket when connecting
+	wait time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	sent int
+
+	// dials counts the upstream connections made
+	dials int
+}
+
+// runAgent implements the agent subcommand, which serves the client protocol
+// on a local socket and forwards every request over a kept-open connection
+func runAgent(args []string) int {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	socket := fs.String("socket", "", "Socket to serve clients on, instead of "+agentSocketName+" next to the default socket")
+	upstream := fs.String("upstream", "", "Server socket to forward to, instead of OPFWD_SOCKET_PATH or the default")
+	maxCommands := fs.Int("max-commands", defaultMaxCommandsPerConn, "Commands to send per upstream connection, at most the server's max_commands_per_conn")
+	wait := fs.Duration("wait", 0, "Wait up to this long for the server socket when connecting")
+	_ = fs.Parse(args)
+
+	if *maxCommands <= 0 {
+		fmt.Fprintln(os.Stderr, "-max-commands must be positive")
+		return 1
+	}
+
+	socketPath := *socket
+	if socketPath == "" {
+		defaultPath, err := getDefaultSocketPath()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting default socket path: %v\n", err)
+			return 1
+		}
+		socketPath = filepath.Join(filepath.Dir(defaultPath), agentSocketName)
+	}
+
+	upstreamPaths := []string{*upstream}
+	if *upstream == "" {
+		paths, err := clientSocketPaths()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting default socket path: %v\n", err)
+			return 1
+		}
+		// OPFWD_SOCKET_PATH may already point at the agent
+		upstreamPaths = slices.DeleteFunc(paths, func(p string) bool { return p == socketPath })
+		if len(upstreamPaths) == 0 {
+			fmt.Fprintln(os.Stderr, "No server socket to forward to, set -upstream")
+			return 1
+		}
+	}
+
+	listener, err := setupSocket(socketPath, defaultSocketMode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up agent socket: %v\n", err)
+		return 1
+	}
+	l := newSocketListener(listener, socketPath, nil)
+	defer l.cleanup()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		l.cleanup()
+	}()
+
+	// Like ssh-agent, print the environment pointing clients at the agent
+	fmt.Printf("OPFWD_SOCKET_PATH=%s; export OPFWD_SOCKET_PATH;\n", socketPath)
+	log.Printf("Agent listening on %s, forwarding to %v", socketPath, upstreamPaths)
+
+	a := &clientAgent{upstream: upstreamPaths, maxCommands: *maxCommands, wait: *wait}
+	a.serve(l)
+	a.stop()
+	return 0
+}
+
+// serve accepts local clients until l is closed
+func (a *clientAgent) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error accepting connection: %v", err)
+			}
+			return
+		}
+		go a.handleConn(conn)
+	}
+}
+
+// handleConn answers the requests of a local client, compressed and framed
+// as it asks, like the server would
+func (a *clientAgent) handleConn(conn net.Conn) {
+	defer conn.Close()
+	logger := log.Default()
+
+	r := bufio.NewReaderSize(conn, maxRequestLine)
+	for n := 1; ; n++ {
+		req, err := readRequest(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Printf("Error reading from connection: %v", err)
+				_, _ = conn.Write([]byte(fmt.Sprintf("Error: Invalid request: %v\n", err)))
+			}
+			return
+		}
+		// Ending the client's connection mustn't end the upstream one
+		if strings.TrimSpace(req.Command) == endCommand {
+			return
+		}
+		// The agent speaks the protocol itself, so it answers the hello
+		// rather than passing it on
+		if n == 1 && isHello(req.Command) {
+			if _, err := answerHello(conn, req.Command, logger); err != nil {
+				return
+			}
+			continue
+		}
+
+		out, done := openResponse(conn, req, logger)
+		exitCode, err := a.forward(req, out)
+		if err != nil {
+			logger.Printf("Error forwarding command: %v", err)
+			if err := out.fail(exitServerError, "%v\n", err); err != nil {
+				logger.Printf("Error writing response: %v", err)
+			}
+		}
+		done(exitCode)
+		if !req.hasFlag(statusFlag) {
+			return
+		}
+	}
+}
+
+// forward sends req upstream and relays the response to out. It returns the
+// exit code the server reported. When the kept-open connection turns out to
+// be closed before the server answered, the request is sent again on a new
+// one.
+func (a *clientAgent) forward(req request, out *response) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// The agent decodes the response itself, whatever the client asked for
+	up := req
+	up.Flags = slices.DeleteFunc(slices.Clone(req.Flags), func(f string) bool { return f == gzipFlag || f == statusFlag })
+	up.Flags = append(up.Flags, gzipFlag, statusFlag)
+
+	for attempt := 1; ; attempt++ {
+		if a.conn == nil || a.sent >= a.maxCommands {
+			if err := a.reconnect(); err != nil {
+				return 1, err
+			}
+		}
+		a.sent++
+
+		if err := writeRequest(a.conn, up); err != nil {
+			a.close()
+			if attempt == 1 {
+				continue
+			}
+			return 1, fmt.Errorf("Error sending command: %v", err)
+		}
+
+		// Nothing at all coming back means the server closed the connection
+		// while it was idle, not that it ran the command
+		if _, err := a.r.Peek(1); err != nil {
+			a.close()
+			if attempt == 1 {
+				continue
+			}
+			return 1, fmt.Errorf("Error reading response: %v", err)
+		}
+
+		exitCode, err := a.relay(out)
+		if err != nil {
+			a.close()
+			return 1, fmt.Errorf("Error reading response: %v", err)
+		}
+		return exitCode, nil
+	}
+}
+
+// relay copies a single framed response from the upstream connection to out,
+// server errors included
+func (a *clientAgent) relay(out *response) (int, error) {
+	body, err := readResponse(a.r)
+	if err != nil {
+		return 1, err
+	}
+	frames, fr, err := openFrames(body)
+	if err != nil {
+		return 1, err
+	}
+	if fr == nil {
+		return 1, errors.New("server did not send a framed response")
+	}
+
+	var errs bytes.Buffer
+	fr.errs = &errs
+	if _, err := io.Copy(out, frames); err != nil {
+		return 1, err
+	}
+	// Read the end of a compressed stream, so the next response starts at
+	// the right place
+	if zr, ok := body.(*gzip.Reader); ok {
+		if _, err := io.Copy(io.Discard, zr); err != nil {
+			return 1, err
+		}
+	}
+
+	if errs.Len() > 0 {
+		if err := out.fail(fr.exitCode, "%s", errs.String()); err != nil {
+			return 1, err
+		}
+	}
+	return fr.exitCode, nil
+}
+
+// reconnect replaces the upstream connection with a new one
+func (a *clientAgent) reconnect() error {
+	a.close()
+	conn, _, err := dialServer(a.upstream, a.wait)
+	if err != nil {
+		return err
+	}
+	a.conn = conn
+	a.r = bufio.NewReader(conn)
+	a.sent = 0
+	a.dials++
+	return nil
+}
+
+// stop drops the upstream connection once the agent no longer serves, so the
+// server's handler for it finishes
+func (a *clientAgent) stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.close()
+}
+
+// close drops the upstream connection, for callers holding a.mu
+func (a *clientAgent) close() {
+	if a.conn != nil {
+		a.conn.Close()
+	}
+	a.conn = nil
+	a.r = nil
+}
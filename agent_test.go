@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// startTestAgent runs an agent forwarding to upstream until the test finishes
+// and returns it along with its socket path
+func startTestAgent(t *testing.T, upstream string, maxCommands int) (*clientAgent, string) {
+	t.Helper()
+
+	socketPath := filepath.Join(filepath.Dir(upstream), "agent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen on agent socket: %v", err)
+	}
+	a := &clientAgent{upstream: []string{upstream}, maxCommands: maxCommands}
+	go a.serve(listener)
+	t.Cleanup(func() {
+		listener.Close()
+		a.stop()
+	})
+	return a, socketPath
+}
+
+// agentDials returns how many upstream connections a has made
+func agentDials(a *clientAgent) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.dials
+}
+
+// TestAgentReusesConnection tests that the agent serves sequential client
+// invocations over a single upstream connection, compressed responses and
+// denials included
+func TestAgentReusesConnection(t *testing.T) {
+	large := strings.Repeat("x", 2*gzipThreshold)
+	fake := installFakeOp(t, func(inv opInvocation) int {
+		if slices.Contains(inv.args, "document") {
+			fmt.Fprint(inv.stdout, large)
+			return 0
+		}
+		fmt.Fprintf(inv.stdout, "op %s\n", strings.Join(inv.args, " "))
+		return 0
+	})
+	cfg := loadTestConfig(t, `
+max_commands_per_conn: 10
+allowed_prefixes:
+  - "item get"
+  - "document get"
+`)
+	serveConfig(t, cfg)
+	a, socketPath := startTestAgent(t, cfg.SocketPath, 10)
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"item get foo", "op --account test-account item get foo\n"},
+		{"document get big", large},
+		{"item get bar", "op --account test-account item get bar\n"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		exitCode, err := forwardCommand(&out, socketPath, tt.command, clientOptions{})
+		if err != nil || exitCode != 0 {
+			t.Fatalf("Expected %s to succeed, got exit %d: %v", tt.command, exitCode, err)
+		}
+		if out.String() != tt.want {
+			t.Errorf("Unexpected output for %s: %.40q", tt.command, out.String())
+		}
+	}
+	if items, docs := fake.callCount("item get"), fake.callCount("document get"); items != 2 || docs != 1 {
+		t.Errorf("Expected op to run every command once, got %d item and %d document runs", items, docs)
+	}
+	if n := agentDials(a); n != 1 {
+		t.Errorf("Expected a single upstream connection, got %d", n)
+	}
+
+	var out, errs bytes.Buffer
+	exitCode, err := forwardCommand(&out, socketPath, "vault list", clientOptions{jsonErrors: &errs})
+	if err != nil || exitCode != exitPolicy {
+		t.Errorf("Expected the denial to be relayed with exit %d, got %d: %v", exitPolicy, exitCode, err)
+	}
+	if !strings.Contains(errs.String(), `"kind":"policy"`) || out.Len() != 0 {
+		t.Errorf("Expected a policy error kept out of the output, got %q and %q", errs.String(), out.String())
+	}
+}
+
+// TestAgentReconnects tests that the agent opens a new upstream connection
+// once one has carried max-commands commands, and when the server closed it
+func TestAgentReconnects(t *testing.T) {
+	installFakeOp(t, nil)
+	cfg := loadTestConfig(t, `
+max_commands_per_conn: 2
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+	a, socketPath := startTestAgent(t, cfg.SocketPath, 2)
+
+	for i := 0; i < 3; i++ {
+		if exitCode, err := forwardCommand(&bytes.Buffer{}, socketPath, "item get foo", clientOptions{}); err != nil || exitCode != 0 {
+			t.Fatalf("Expected command %d to succeed, got exit %d: %v", i, exitCode, err)
+		}
+	}
+	if n := agentDials(a); n != 2 {
+		t.Errorf("Expected 2 upstream connections, got %d", n)
+	}
+
+	// A connection the server dropped while idle is replaced transparently
+	a.mu.Lock()
+	a.conn.Close()
+	a.mu.Unlock()
+	if exitCode, err := forwardCommand(&bytes.Buffer{}, socketPath, "item get foo", clientOptions{}); err != nil || exitCode != 0 {
+		t.Fatalf("Expected the command to succeed after a reconnect, got exit %d: %v", exitCode, err)
+	}
+}
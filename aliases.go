@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// aliasCommand runs the command an alias in the server config stands for,
+// as `@alias NAME`. The client sends it when invoked through a symlink such
+// as get-db-password, so the symlink can only ever run that one command.
+const aliasCommand = "@alias"
+
+// errClientUsage is returned when the client is given nothing to send
+var errClientUsage = errors.New("Usage: opfwd <command> [arguments]")
+
+// isAliasCommand reports whether a command asks for an alias
+func isAliasCommand(input string) bool {
+	return input == aliasCommand || strings.HasPrefix(input, aliasCommand+" ")
+}
+
+// clientCommand returns the command the client sends when invoked as argv0
+// with args. Invoked as opfwd or op it forwards args, under any other name
+// it asks the server for the alias of that name and takes no arguments.
+func clientCommand(argv0 string, args []string) (string, error) {
+	name := filepath.Base(argv0)
+	if strings.HasPrefix(name, "opfwd") || name == "op" {
+		if len(args) == 0 {
+			return "", errClientUsage
+		}
+		return strings.Join(args, " "), nil
+	}
+	if len(args) > 0 {
+		return "", fmt.Errorf("Error: %s is an opfwd alias and takes no arguments", name)
+	}
+	return aliasCommand + " " + name, nil
+}
+
+// resolveAlias returns the command the alias named in input stands for
+func resolveAlias(aliases map[string]string, input string) (string, error) {
+	name := strings.TrimSpace(strings.TrimPrefix(input, aliasCommand))
+	if name == "" {
+		return "", fmt.Errorf("Usage: %s NAME", aliasCommand)
+	}
+	command, ok := aliases[name]
+	if !ok {
+		return "", fmt.Errorf("Unknown alias: %s", name)
+	}
+	return command, nil
+}
+
+// validateAliases checks that every alias has a name usable as a file name
+// and stands for an op command rather than another server command
+func validateAliases(aliases map[string]string) error {
+	for name, command := range aliases {
+		if name == "" || strings.ContainsAny(name, " \t\n/") || strings.HasPrefix(name, "opfwd") || name == "op" {
+			return fmt.Errorf("invalid alias name %q, expected a single word other than op or opfwd", name)
+		}
+		if strings.TrimSpace(command) == "" {
+			return fmt.Errorf("alias %s has no command", name)
+		}
+		if strings.HasPrefix(command, controlPrefix) && !isBundleCommand(command) {
+			return fmt.Errorf("alias %s: %q is not an op command or bundle", name, command)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestClientAlias tests that a client invoked through an alias symlink sends
+// the alias, and the server runs the command it stands for under the rules
+func TestClientAlias(t *testing.T) {
+	fake := installFakeOp(t, func(inv opInvocation) int {
+		inv.stdout.Write([]byte("db-secret\n"))
+		return 0
+	})
+	cfg := loadTestConfig(t, `
+allowed_commands:
+  - "read op://App/db/password"
+aliases:
+  get-db-password: "read op://App/db/password"
+  get-ssh-key: "read op://Personal/ssh/private_key"
+`)
+	serveConfig(t, cfg)
+
+	command, err := clientCommand("/usr/local/bin/get-db-password", nil)
+	if err != nil || command != "@alias get-db-password" {
+		t.Fatalf("Expected the alias to be sent, got %q: %v", command, err)
+	}
+	var out bytes.Buffer
+	code, err := forwardCommand(&out, cfg.SocketPath, command, clientOptions{})
+	if err != nil || code != 0 || out.String() != "db-secret\n" {
+		t.Errorf("Expected the aliased command to run, got %q (exit %d): %v", out.String(), code, err)
+	}
+	if n := fake.callCount("read op://App/db/password"); n != 1 {
+		t.Errorf("Expected op to read the aliased reference once, got %d calls", n)
+	}
+
+	// The command an alias stands for still has to pass the rules
+	out.Reset()
+	code, err = forwardCommand(&out, cfg.SocketPath, "@alias get-ssh-key", clientOptions{})
+	if err != nil || code != exitPolicy || !strings.Contains(out.String(), "Command not allowed") {
+		t.Errorf("Expected the aliased command to be denied, got %q (exit %d): %v", out.String(), code, err)
+	}
+
+	out.Reset()
+	code, err = forwardCommand(&out, cfg.SocketPath, "@alias missing", clientOptions{})
+	if err != nil || code != exitPolicy || !strings.Contains(out.String(), "Unknown alias: missing") {
+		t.Errorf("Expected an unknown alias error, got %q (exit %d): %v", out.String(), code, err)
+	}
+}
+
+// TestClientCommand tests how the client builds its command from the name it
+// was invoked as
+func TestClientCommand(t *testing.T) {
+	tests := []struct {
+		argv0   string
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{"opfwd", []string{"read", "op://App/db/password"}, "read op://App/db/password", false},
+		{"/usr/bin/op", []string{"vault", "list"}, "vault list", false},
+		{"opfwd", nil, "", true},
+		{"get-db-password", nil, "@alias get-db-password", false},
+		{"get-db-password", []string{"--reveal"}, "", true},
+	}
+	for _, tt := range tests {
+		got, err := clientCommand(tt.argv0, tt.args)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("clientCommand(%q, %q) = %q, %v", tt.argv0, tt.args, got, err)
+		}
+	}
+}
+
+// TestInvalidAliases tests that aliases are checked at load
+func TestInvalidAliases(t *testing.T) {
+	tests := map[string]string{
+		"op name":      `{op: "vault list"}`,
+		"spaced name":  `{"get db": "vault list"}`,
+		"empty":        `{get-db: ""}`,
+		"control":      `{stop: "@reload"}`,
+		"nested alias": `{get-db: "@alias other"}`,
+	}
+	for name, aliases := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := writeTestConfig(t, "account: \"test-account\"\naliases: "+aliases+"\n")
+			if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "alias") {
+				t.Errorf("Expected alias error, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// approveCommand is the control command approving a held request
+	approveCommand = "@approve"
+
+	// defaultApprovalTimeout is how long a command waits for its approval
+	// when ApprovalTimeout is unset
+	defaultApprovalTimeout = 2 * time.Minute
+)
+
+// pendingApprovals are the requests held until an @approve arrives, keyed by
+// request ID
+var pendingApprovals = struct {
+	mu      sync.Mutex
+	waiting map[string]chan struct{}
+}{waiting: make(map[string]chan struct{})}
+
+// approvalTimeout returns how long a command waits for its approval
+func (cfg *Config) approvalTimeout() time.Duration {
+	if cfg.ApprovalTimeout > 0 {
+		return cfg.ApprovalTimeout
+	}
+	return defaultApprovalTimeout
+}
+
+// awaitApproval holds the request reqID until it is approved on the control
+// socket, and reports whether that happened within timeout
+func awaitApproval(logger *log.Logger, reqID string, timeout time.Duration) bool {
+	approved := make(chan struct{})
+	pendingApprovals.mu.Lock()
+	pendingApprovals.waiting[reqID] = approved
+	pendingApprovals.mu.Unlock()
+	defer func() {
+		pendingApprovals.mu.Lock()
+		delete(pendingApprovals.waiting, reqID)
+		pendingApprovals.mu.Unlock()
+	}()
+
+	logger.Printf("Command held for approval for up to %s, approve it with: %s %s", timeout, approveCommand, reqID)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-approved:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// isApproveCommand reports whether input is an @approve control command
+func isApproveCommand(input string) bool {
+	name, _, _ := strings.Cut(input, " ")
+	return name == approveCommand
+}
+
+// approveRequest implements @approve, releasing the held request whose ID
+// is given
+func approveRequest(logger *log.Logger, reqID string) (string, error) {
+	reqID = strings.TrimSpace(reqID)
+	if reqID == "" {
+		return "", errors.New("usage: @approve <request-id>")
+	}
+
+	pendingApprovals.mu.Lock()
+	defer pendingApprovals.mu.Unlock()
+	approved, ok := pendingApprovals.waiting[reqID]
+	if !ok {
+		return "", fmt.Errorf("no command is waiting for approval with request ID %s", reqID)
+	}
+	close(approved)
+	delete(pendingApprovals.waiting, reqID)
+	logger.Printf("Approved request %s", reqID)
+	return fmt.Sprintf("Approved request %s\n", reqID), nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// approvalPattern finds the request ID of a held command in the log
+var approvalPattern = regexp.MustCompile(`approve it with: @approve (\S+)`)
+
+// TestRequireApproval tests that a command of a require_approval rule only
+// runs once it is approved, while other rules are unaffected
+func TestRequireApproval(t *testing.T) {
+	fake := installFakeOp(t, nil)
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+control_socket_path: %q
+allowed_prefixes:
+  - "item get"
+  - match: "read op://BreakGlass/"
+    require_approval: true
+`, filepath.Join(t.TempDir(), "control.sock")))
+	serveConfig(t, cfg)
+	logs := captureLog(t)
+
+	if response, err := sendCommand(t, cfg.SocketPath, "item get foo"); err != nil || strings.Contains(response, "Error") {
+		t.Fatalf("Expected item get to run without approval, got %q: %v", response, err)
+	}
+
+	type result struct {
+		response string
+		err      error
+	}
+	held := make(chan result, 1)
+	go func() {
+		response, err := sendCommand(t, cfg.SocketPath, "read op://BreakGlass/root/password")
+		held <- result{response, err}
+	}()
+
+	var reqID string
+	deadline := time.Now().Add(5 * time.Second)
+	for reqID == "" && time.Now().Before(deadline) {
+		if m := approvalPattern.FindStringSubmatch(logs.String()); m != nil {
+			reqID = m[1]
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if reqID == "" {
+		t.Fatalf("Expected the command to be held for approval, got %q", logs.String())
+	}
+	if n := fake.callCount("BreakGlass"); n != 0 {
+		t.Fatalf("Expected op not to run before the approval, ran %d times", n)
+	}
+
+	// The client waiting can't approve its own command on the command socket
+	if response, err := sendCommand(t, cfg.SocketPath, "@approve "+reqID); err != nil || !strings.Contains(response, "Control commands are only accepted on the control socket") {
+		t.Errorf("Expected an approval on the command socket to be refused, got %q: %v", response, err)
+	}
+	if response, err := sendCommand(t, cfg.ControlSocketPath, "@approve nope"); err != nil || !strings.Contains(response, "no command is waiting for approval") {
+		t.Errorf("Expected an unknown request ID to be refused, got %q: %v", response, err)
+	}
+	if response, err := sendCommand(t, cfg.ControlSocketPath, "@approve "+reqID); err != nil || response != "Approved request "+reqID+"\n" {
+		t.Errorf("Expected the approval to be acknowledged, got %q: %v", response, err)
+	}
+
+	res := <-held
+	if want := "op --account test-account read op://BreakGlass/root/password\n"; res.err != nil || res.response != want {
+		t.Errorf("Expected the approved command to run, got %q: %v", res.response, res.err)
+	}
+}
+
+// TestApprovalTimeout tests that a command nobody approves is denied once
+// approval_timeout has passed
+func TestApprovalTimeout(t *testing.T) {
+	fake := installFakeOp(t, nil)
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+control_socket_path: %q
+approval_timeout: 50ms
+allowed_commands:
+  - match: "read op://BreakGlass/root/password"
+    require_approval: true
+`, filepath.Join(t.TempDir(), "control.sock")))
+	serveConfig(t, cfg)
+
+	response, err := sendCommand(t, cfg.SocketPath, "read op://BreakGlass/root/password")
+	if want := "Error: Command not approved within 50ms: read op://BreakGlass/root/password\n"; err != nil || response != want {
+		t.Errorf("Expected %q, got %q: %v", want, response, err)
+	}
+	if n := fake.callCount("BreakGlass"); n != 0 {
+		t.Errorf("Expected op not to run, ran %d times", n)
+	}
+}
+
+// TestRequireApprovalNeedsControlSocket tests that require_approval is
+// refused without a control socket to approve on, and that @approve is never
+// taken on a command socket
+func TestRequireApprovalNeedsControlSocket(t *testing.T) {
+	for _, rules := range []string{
+		"allowed_prefixes:\n  - match: \"read op://BreakGlass/\"\n    require_approval: true\n",
+		"listeners:\n  - path: \"/tmp/opfwd-group.sock\"\n    allowed_globs:\n      - match: \"read op://BreakGlass/*/password\"\n        require_approval: true\n",
+	} {
+		path := writeTestConfig(t, "account: \"test-account\"\n"+rules)
+		if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "require_approval needs control_socket_path") {
+			t.Errorf("Expected require_approval without a control socket to be refused, got %v", err)
+		}
+	}
+
+	installFakeOp(t, nil)
+	cfg := loadTestConfig(t, "allowed_prefixes:\n  - \"item get\"\n")
+	serveConfig(t, cfg)
+	if response, err := sendCommand(t, cfg.SocketPath, "@approve 1234"); err != nil || !strings.Contains(response, "Control commands are only accepted on the control socket") {
+		t.Errorf("Expected @approve to be refused on the command socket, got %q: %v", response, err)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditEntry is a line of the JSON audit log, one per finished request
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Command   string    `json:"command"`
+	Decision  string    `json:"decision"`
+	ExitCode  int       `json:"exit_code"`
+
+	// The client process, when LogClientProcess is set
+	ClientPID  int    `json:"client_pid,omitempty"`
+	ClientComm string `json:"client_comm,omitempty"`
+	ClientExe  string `json:"client_exe,omitempty"`
+}
+
+// auditMu serializes writes to the audit log
+var auditMu sync.Mutex
+
+// writeAuditEntry appends e to the audit log, when one is configured. The file
+// is opened per entry, so a rotated log is picked up without a restart.
+func writeAuditEntry(logger *log.Logger, e auditEntry) {
+	if config.AuditLog == "" {
+		return
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		logger.Printf("Error encoding audit entry: %v", err)
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	f, err := os.OpenFile(config.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		logger.Printf("Error opening audit log: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		logger.Printf("Error writing audit log: %v", err)
+	}
+}
+
+// auditFilter selects the audit entries printed by the audit subcommand
+type auditFilter struct {
+	since      time.Time
+	deniedOnly bool
+	command    string
+}
+
+// matches reports whether e passes the filter
+func (f auditFilter) matches(e auditEntry) bool {
+	if !f.since.IsZero() && e.Time.Before(f.since) {
+		return false
+	}
+	if f.deniedOnly && e.Decision != "denied" {
+		return false
+	}
+	return strings.Contains(e.Command, f.command)
+}
+
+// runAudit is the entry point of the audit subcommand
+func runAudit(args []string) int {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to the config file naming the audit log")
+	fs.StringVar(&configProfile, "profile", "", "Use this profile of the config file")
+	file := fs.String("file", "", "Path to the audit log, instead of audit_log from the config")
+	since := fs.String("since", "", "Only show entries from this long ago (e.g. 1h) or this RFC 3339 time on")
+	deniedOnly := fs.Bool("denied-only", false, "Only show denied commands")
+	command := fs.String("command", "", "Only show commands containing this string")
+	_ = fs.Parse(args)
+
+	filter := auditFilter{deniedOnly: *deniedOnly, command: *command}
+	if *since != "" {
+		t, err := parseSince(*since, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -since: %v\n", err)
+			return 1
+		}
+		filter.since = t
+	}
+
+	path := *file
+	if path == "" {
+		if *configPath == "" {
+			defaultPath, err := getDefaultConfigPath()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to get default config path: %v\n", err)
+				return 1
+			}
+			*configPath = defaultPath
+		}
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+			return 1
+		}
+		if cfg.AuditLog == "" {
+			fmt.Fprintf(os.Stderr, "No audit_log in %s, pass -file\n", *configPath)
+			return 1
+		}
+		path = cfg.AuditLog
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open audit log: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	if err := printAudit(os.Stdout, os.Stderr, f, filter); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read audit log: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// parseSince parses a -since value, either a duration back from now or an
+// RFC 3339 time
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a duration nor an RFC 3339 time", s)
+	}
+	return t, nil
+}
+
+// printAudit reads the audit log from r a line at a time and writes the
+// entries passing filter to w in readable form. Malformed lines are reported
+// to errw and skipped.
+func printAudit(w, errw io.Writer, r io.Reader, filter auditFilter) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxRequestLine+64*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			fmt.Fprintf(errw, "Skipping malformed audit log line %d: %v\n", lineNo, err)
+			continue
+		}
+		if !filter.matches(e) {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s  %-12s  %s  %s (exit %d)\n",
+			e.Time.Format(time.RFC3339), e.Decision, e.RequestID, e.Command, e.ExitCode); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
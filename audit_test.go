@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAuditLog = `{"time":"2026-03-02T09:00:00Z","request_id":"aaaa","command":"read op://Employee/GitHub/password","decision":"allowed","exit_code":0}
+{"time":"2026-03-02T10:00:00Z","request_id":"bbbb","command":"item delete GitHub","decision":"denied","exit_code":-1}
+not json
+{"time":"2026-03-02T11:00:00Z","request_id":"cccc","command":"item list","decision":"rate_limited","exit_code":-1}
+{"time":"2026-03-02T12:00:00Z","request_id":"dddd","command":"read op://Personal/SSH/passphrase","decision":"denied","exit_code":-1}
+`
+
+// TestPrintAuditFilters tests that the audit filters select the right entries
+func TestPrintAuditFilters(t *testing.T) {
+	tests := map[string]struct {
+		filter auditFilter
+		want   []string
+	}{
+		"all":         {auditFilter{}, []string{"aaaa", "bbbb", "cccc", "dddd"}},
+		"denied only": {auditFilter{deniedOnly: true}, []string{"bbbb", "dddd"}},
+		"since":       {auditFilter{since: time.Date(2026, 3, 2, 10, 30, 0, 0, time.UTC)}, []string{"cccc", "dddd"}},
+		"command":     {auditFilter{command: "op://Employee"}, []string{"aaaa"}},
+		"combined":    {auditFilter{deniedOnly: true, command: "read"}, []string{"dddd"}},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var out, errOut bytes.Buffer
+			if err := printAudit(&out, &errOut, strings.NewReader(testAuditLog), tt.filter); err != nil {
+				t.Fatalf("Failed to read audit log: %v", err)
+			}
+
+			lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			if len(lines) != len(tt.want) {
+				t.Fatalf("Expected %d entries, got:\n%s", len(tt.want), out.String())
+			}
+			for i, id := range tt.want {
+				if !strings.Contains(lines[i], id) {
+					t.Errorf("Expected entry %d to be %s, got %q", i, id, lines[i])
+				}
+			}
+			if !strings.Contains(errOut.String(), "malformed audit log line 3") {
+				t.Errorf("Expected the malformed line to be reported, got %q", errOut.String())
+			}
+		})
+	}
+}
+
+// TestParseSince tests parsing -since as a duration or a time
+func TestParseSince(t *testing.T) {
+	at := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	if got, err := parseSince("90m", at); err != nil || !got.Equal(at.Add(-90*time.Minute)) {
+		t.Errorf("Expected 90 minutes ago, got %v: %v", got, err)
+	}
+	if got, err := parseSince("2026-03-01T00:00:00Z", at); err != nil || !got.Equal(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the given time, got %v: %v", got, err)
+	}
+	if _, err := parseSince("yesterday", at); err == nil {
+		t.Error("Expected an error for an invalid -since")
+	}
+}
+
+// TestAuditLogWritten tests that the server appends an entry per request,
+// stamped with the server's clock
+func TestAuditLogWritten(t *testing.T) {
+	installFakeOp(t, nil)
+	setClock(t, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+audit_log: %q
+allowed_prefixes:
+  - "item get"
+`, auditPath))
+	serveConfig(t, cfg)
+
+	for _, command := range []string{"item get foo", "item delete foo"} {
+		if _, err := sendCommand(t, cfg.SocketPath, command); err != nil {
+			t.Fatalf("Failed to send command: %v", err)
+		}
+	}
+
+	f, err := os.Open(auditPath)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer f.Close()
+
+	var out bytes.Buffer
+	if err := printAudit(&out, &out, f, auditFilter{}); err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	for _, want := range []string{"2026-03-01T12:00:00Z  allowed", "item get foo (exit 0)", "2026-03-01T12:00:00Z  denied", "item delete foo (exit -1)"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected audit output to contain %q, got:\n%s", want, out.String())
+		}
+	}
+}
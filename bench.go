@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchResult holds the latencies of a benchmark run
+type benchResult struct {
+	// latencies of the successful iterations, sorted
+	latencies []time.Duration
+	errors    int
+}
+
+// runBench implements the bench subcommand, which sends an allowed command
+// to the server repeatedly and reports the end-to-end latency
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	socket := fs.String("socket", "", "Socket to send the command to, instead of OPFWD_SOCKET_PATH or the default")
+	n := fs.Int("n", 10, "Number of times to send the command")
+	concurrency := fs.Int("concurrency", 1, "Number of commands in flight at once")
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: opfwd bench [-n N] [-concurrency C] [-socket PATH] <command> [arguments]")
+		return 1
+	}
+	if *n <= 0 || *concurrency <= 0 {
+		fmt.Fprintln(os.Stderr, "-n and -concurrency must be positive")
+		return 1
+	}
+
+	socketPath := *socket
+	if socketPath == "" {
+		var err error
+		if socketPath, err = clientSocketPath(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting default socket path: %v\n", err)
+			return 1
+		}
+	}
+
+	result := bench(socketPath, strings.Join(fs.Args(), " "), *n, *concurrency)
+	result.print(os.Stdout)
+	if result.errors > 0 {
+		return 1
+	}
+	return 0
+}
+
+// bench sends command n times with up to concurrency in flight at once and
+// measures how long each takes. Commands that fail or exit non-zero count
+// as errors.
+func bench(socketPath, command string, n, concurrency int) benchResult {
+	var mu sync.Mutex
+	var result benchResult
+
+	jobs := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < min(n, concurrency); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				start := time.Now()
+				exitCode, err := forwardCommand(io.Discard, socketPath, command, clientOptions{})
+				elapsed := time.Since(start)
+
+				mu.Lock()
+				if err != nil || exitCode != 0 {
+					result.errors++
+				} else {
+					result.latencies = append(result.latencies, elapsed)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+
+	slices.Sort(result.latencies)
+	return result
+}
+
+// percentile returns the latency below which p percent of the successful
+// iterations fall, zero when none succeeded
+func (r benchResult) percentile(p int) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := (len(r.latencies)*p + 99) / 100
+	return r.latencies[max(i-1, 0)]
+}
+
+// print writes a summary of the run to w
+func (r benchResult) print(w io.Writer) {
+	fmt.Fprintf(w, "iterations: %d ok, %d errors\n", len(r.latencies), r.errors)
+	if len(r.latencies) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "latency: min=%s median=%s p95=%s max=%s\n",
+		r.latencies[0], r.percentile(50), r.percentile(95), r.latencies[len(r.latencies)-1])
+}
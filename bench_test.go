@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBench tests that bench sends the command the given number of times
+// and reports every iteration
+func TestBench(t *testing.T) {
+	fake := installFakeOp(t, nil)
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	result := bench(cfg.SocketPath, "item get foo", 20, 4)
+	if len(result.latencies) != 20 || result.errors != 0 {
+		t.Fatalf("Expected 20 successful iterations, got %d with %d errors", len(result.latencies), result.errors)
+	}
+	if n := fake.callCount("item get foo"); n != 20 {
+		t.Errorf("Expected op to run 20 times, got %d", n)
+	}
+
+	var out bytes.Buffer
+	result.print(&out)
+	if !strings.HasPrefix(out.String(), "iterations: 20 ok, 0 errors\nlatency: min=") {
+		t.Errorf("Unexpected summary %q", out.String())
+	}
+
+	// Denied commands are errors
+	result = bench(cfg.SocketPath, "vault list", 3, 1)
+	if len(result.latencies) != 0 || result.errors != 3 {
+		t.Errorf("Expected 3 errors, got %d ok and %d errors", len(result.latencies), result.errors)
+	}
+}
+
+// TestBenchPercentile tests the latency percentiles
+func TestBenchPercentile(t *testing.T) {
+	var r benchResult
+	for i := 1; i <= 100; i++ {
+		r.latencies = append(r.latencies, time.Duration(i)*time.Millisecond)
+	}
+	if got := r.percentile(50); got != 50*time.Millisecond {
+		t.Errorf("Expected median 50ms, got %s", got)
+	}
+	if got := r.percentile(95); got != 95*time.Millisecond {
+		t.Errorf("Expected p95 95ms, got %s", got)
+	}
+	if got := (benchResult{latencies: []time.Duration{time.Second}}).percentile(95); got != time.Second {
+		t.Errorf("Expected p95 of one iteration to be it, got %s", got)
+	}
+}
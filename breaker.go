@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// defaultRateLimitPatterns are the fragments of op errors that mean 1Password
+// is rate limiting the account, used when RateLimitPatterns is empty
+var defaultRateLimitPatterns = []string{
+	"too many requests",
+	"rate limit",
+}
+
+// defaultRateLimitCooldown is how long commands are refused after op reports
+// a rate limit, when RateLimitCooldown is zero
+const defaultRateLimitCooldown = time.Minute
+
+// rateLimitPatterns returns the patterns marking an op rate limit error
+func (cfg *Config) rateLimitPatterns() []string {
+	if len(cfg.RateLimitPatterns) > 0 {
+		return cfg.RateLimitPatterns
+	}
+	return defaultRateLimitPatterns
+}
+
+// rateLimitCooldown returns how long the breaker stays open
+func (cfg *Config) rateLimitCooldown() time.Duration {
+	if cfg.RateLimitCooldown > 0 {
+		return cfg.RateLimitCooldown
+	}
+	return defaultRateLimitCooldown
+}
+
+// upstreamBreaker stops the server from running op while 1Password rate
+// limits the account, as more requests would only extend the limit. It opens
+// when op reports a rate limit, refuses commands for the cooldown, then lets
+// a single command through to probe. The probe closes it again, unless it is
+// rate limited too.
+var upstreamBreaker struct {
+	mu sync.Mutex
+
+	// openUntil is when the cooldown ends, zero while the breaker is closed
+	openUntil time.Time
+
+	// probing is set while the command probing a half-open breaker runs
+	probing bool
+}
+
+// allowUpstream reports whether op may be run at t, and if so whether the
+// command is the probe of a half-open breaker. Otherwise it returns how long
+// the client should wait before retrying.
+func allowUpstream(t time.Time) (ok, probe bool, retry time.Duration) {
+	upstreamBreaker.mu.Lock()
+	defer upstreamBreaker.mu.Unlock()
+
+	switch {
+	case upstreamBreaker.openUntil.IsZero():
+		return true, false, 0
+	case t.Before(upstreamBreaker.openUntil):
+		return false, false, upstreamBreaker.openUntil.Sub(t)
+	case upstreamBreaker.probing:
+		return false, false, time.Second
+	}
+	upstreamBreaker.probing = true
+	return true, true, 0
+}
+
+// releaseProbe gives up the probe of a half-open breaker that never got to
+// run op, leaving the breaker half-open for the next command to probe
+func releaseProbe() {
+	upstreamBreaker.mu.Lock()
+	defer upstreamBreaker.mu.Unlock()
+	upstreamBreaker.probing = false
+}
+
+// recordUpstream records whether an op run started at t was rate limited,
+// opening the breaker when it was and closing it when a probe wasn't
+func recordUpstream(logger *log.Logger, rateLimited bool, t time.Time) {
+	upstreamBreaker.mu.Lock()
+	defer upstreamBreaker.mu.Unlock()
+
+	if rateLimited {
+		cooldown := config.rateLimitCooldown()
+		logger.Printf("1Password rate limited op, refusing commands for %s", cooldown)
+		upstreamBreaker.openUntil = t.Add(cooldown)
+		upstreamBreaker.probing = false
+		return
+	}
+	if upstreamBreaker.probing {
+		logger.Println("1Password no longer rate limits op, accepting commands again")
+		upstreamBreaker.openUntil = time.Time{}
+		upstreamBreaker.probing = false
+	}
+}
+
+// resetUpstreamBreaker closes the breaker
+func resetUpstreamBreaker() {
+	upstreamBreaker.mu.Lock()
+	defer upstreamBreaker.mu.Unlock()
+	upstreamBreaker.openUntil = time.Time{}
+	upstreamBreaker.probing = false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestUpstreamBreaker tests that a rate limit error from op opens the
+// breaker, which refuses commands until a probe after the cooldown succeeds
+func TestUpstreamBreaker(t *testing.T) {
+	var limited atomic.Bool
+	limited.Store(true)
+	fake := installFakeOp(t, func(inv opInvocation) int {
+		if strings.Contains(strings.Join(inv.args, " "), "account get") {
+			return 0
+		}
+		if limited.Load() {
+			fmt.Fprintln(inv.stderr, "[ERROR] 2024/01/01 00:00:00 Too many requests, please try again later")
+			return 1
+		}
+		fmt.Fprintln(inv.stdout, "ok")
+		return 0
+	})
+	t.Cleanup(resetUpstreamBreaker)
+	cfg := loadTestConfig(t, `
+rate_limit_cooldown: 300ms
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	if response, err := sendCommand(t, cfg.SocketPath, "item get foo"); err != nil || !strings.Contains(response, "Too many requests") {
+		t.Fatalf("Expected op's rate limit error, got %q: %v", response, err)
+	}
+	before := fake.callCount("item get")
+	response, err := sendCommand(t, cfg.SocketPath, "item get foo")
+	if err != nil || !strings.Contains(response, "upstream rate limited, retry after 1s") {
+		t.Errorf("Expected the open breaker to refuse the command, got %q: %v", response, err)
+	}
+	if n := fake.callCount("item get") - before; n != 0 {
+		t.Errorf("Expected op not to run while the breaker is open, got %d calls", n)
+	}
+
+	// After the cooldown a probe goes through and closes the breaker
+	limited.Store(false)
+	time.Sleep(400 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if response, err := sendCommand(t, cfg.SocketPath, "item get foo"); err != nil || response != "ok\n" {
+			t.Errorf("Expected command %d to run once the breaker recovered, got %q: %v", i+1, response, err)
+		}
+	}
+}
+
+// TestUpstreamBreakerProbe tests that a half-open breaker lets one probe
+// through at a time, and opens again when the probe is rate limited
+func TestUpstreamBreakerProbe(t *testing.T) {
+	prev := config
+	t.Cleanup(func() {
+		config = prev
+		resetUpstreamBreaker()
+	})
+	config = loadTestConfig(t, "rate_limit_cooldown: 10s\n")
+	logger := log.New(&lockedBuffer{}, "", 0)
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	recordUpstream(logger, true, start)
+	if ok, _, retry := allowUpstream(start.Add(4 * time.Second)); ok || retry != 6*time.Second {
+		t.Errorf("Expected the breaker to be open for another 6s, got %v, %s", ok, retry)
+	}
+
+	half := start.Add(11 * time.Second)
+	if ok, _, _ := allowUpstream(half); !ok {
+		t.Fatal("Expected a probe to be let through after the cooldown")
+	}
+	if ok, _, _ := allowUpstream(half); ok {
+		t.Error("Expected a second command to wait for the probe")
+	}
+	recordUpstream(logger, true, half)
+	if ok, _, _ := allowUpstream(half.Add(time.Second)); ok {
+		t.Error("Expected a rate limited probe to open the breaker again")
+	}
+
+	later := half.Add(11 * time.Second)
+	if ok, _, _ := allowUpstream(later); !ok {
+		t.Fatal("Expected another probe after the second cooldown")
+	}
+	recordUpstream(logger, false, later)
+	if ok, _, _ := allowUpstream(later); !ok {
+		t.Error("Expected a successful probe to close the breaker")
+	}
+}
+
+// TestUpstreamBreakerProbeSigninFailure tests that a probe failing to sign in
+// leaves the breaker half-open for the next command, as op never ran
+func TestUpstreamBreakerProbeSigninFailure(t *testing.T) {
+	installFakeOp(t, func(inv opInvocation) int {
+		fmt.Fprintln(inv.stderr, "[ERROR] not signed in")
+		return 1
+	})
+	t.Cleanup(resetUpstreamBreaker)
+	cfg := loadTestConfig(t, `
+rate_limit_cooldown: 10s
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	// Opened long enough ago for the next command to probe
+	recordUpstream(log.New(&lockedBuffer{}, "", 0), true, time.Now().Add(-time.Minute))
+
+	for i := 0; i < 2; i++ {
+		response, err := sendCommand(t, cfg.SocketPath, "item get foo")
+		if err != nil || !strings.Contains(response, "Error: Could not sign in to 1Password") {
+			t.Fatalf("Expected probe %d to fail signing in, got %q: %v", i+1, response, err)
+		}
+	}
+
+	upstreamBreaker.mu.Lock()
+	defer upstreamBreaker.mu.Unlock()
+	if upstreamBreaker.openUntil.IsZero() || upstreamBreaker.probing {
+		t.Errorf("Expected the breaker to stay half-open, got open until %s, probing %v", upstreamBreaker.openUntil, upstreamBreaker.probing)
+	}
+}
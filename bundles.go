@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+)
+
+// bundleCommand asks for every secret of a bundle at once, as `@bundle NAME`.
+// Unlike the control commands it reads secrets rather than managing the
+// server, so it is served on the command sockets under their rules.
+const bundleCommand = "@bundle"
+
+// isBundleCommand reports whether a command asks for a bundle
+func isBundleCommand(input string) bool {
+	return input == bundleCommand || strings.HasPrefix(input, bundleCommand+" ")
+}
+
+// handleBundle resolves every reference of the bundle named in input and
+// replies with a JSON object of reference to value. The bundle fails as a
+// whole if the rules deny any of its references or any of them can't be
+// read. It returns the decision and exit code for the request.
+func handleBundle(conn net.Conn, out *response, rules *Rules, input, reqID string, logger *log.Logger) (string, int) {
+	fail := func(status int, format string, args ...any) {
+		if err := out.fail(status, format, args...); err != nil {
+			logger.Printf("Error writing response: %v", err)
+		}
+	}
+
+	name := strings.TrimSpace(strings.TrimPrefix(input, bundleCommand))
+	if name == "" {
+		fail(exitPolicy, "Error: Usage: %s NAME\n", bundleCommand)
+		return "denied", -1
+	}
+	refs, ok := config.Bundles[name]
+	if !ok {
+		logger.Printf("Unknown bundle: %s", name)
+		fail(exitPolicy, "Error: Unknown bundle: %s\n", name)
+		return "denied", -1
+	}
+
+	// Every reference must be allowed before any of them is read
+	var matches []ruleMatch
+	for _, ref := range refs {
+		matched, ok := matchRule(rules, bundleReadCommand(ref), logger)
+		if !ok {
+			logger.Printf("Bundle %s refused, %s is not allowed", name, ref)
+			fail(exitPolicy, "Error: Bundle %s not allowed, %s is denied by the rules\n", name, ref)
+			return "denied", -1
+		}
+		matches = append(matches, matched)
+	}
+	for i, matched := range matches {
+		if !matched.allow(now()) {
+			logger.Printf("Bundle %s refused, rate limit of rule %s exceeded", name, matched.rule)
+			fail(exitTempFail, "Error: Rate limit exceeded for %s in bundle %s\n", refs[i], name)
+			return "rate_limited", -1
+		}
+	}
+	// Every reference counts as a distinct secret, all of them or none
+	commands := make([]string, len(refs))
+	for i, ref := range refs {
+		commands[i] = bundleReadCommand(ref)
+	}
+	if decision, ok := limitDistinct(conn, out, input, commands, logger); !ok {
+		return decision, -1
+	}
+	// A single approval covers every reference needing one
+	if slices.ContainsFunc(matches, ruleMatch.requiresApproval) {
+		if timeout := config.approvalTimeout(); !awaitApproval(logger, reqID, timeout) {
+			logger.Printf("Bundle %s not approved within %s", name, timeout)
+			fail(exitPolicy, "Error: Bundle %s not approved within %s\n", name, timeout)
+			return "denied", -1
+		}
+		logger.Printf("Bundle %s approved", name)
+	}
+	logger.Printf("Bundle %s allowed, reading %d references", name, len(refs))
+
+	if config.NoExecute {
+		logger.Printf("No-execute mode, would read bundle %s", name)
+		_, _ = out.Write([]byte(noExecuteMarker))
+		return "allowed", 0
+	}
+
+	values := make(map[string]string, len(refs))
+	for i, ref := range refs {
+		exitCode, status := 0, 0
+		withSecretBuffer(func(buf *secretBuffer) {
+			resp := newResponse(buf, false)
+			exitCode = executeCommand(resp, request{Command: bundleReadCommand(ref)}, matches[i].appendArgs(), logger)
+			if status = resp.exitStatus(exitCode); status != 0 {
+				logger.Printf("Bundle %s failed reading %s", name, ref)
+				fail(status, "Error: Bundle %s failed reading %s: %s\n", name, ref, bytes.TrimSpace(buf.Bytes()))
+				return
+			}
+			values[ref] = string(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+		})
+		if status != 0 {
+			return "allowed", exitCode
+		}
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		fail(exitServerError, "Error: %v\n", err)
+		return "allowed", -1
+	}
+	defer wipe(data)
+	line := append(data, '\n')
+	defer wipe(line)
+	if _, err := out.Write(line); err != nil {
+		logger.Printf("Error writing response: %v", err)
+	}
+	return "allowed", 0
+}
+
+// bundleReadCommand is the op command reading a bundle reference
+func bundleReadCommand(ref string) string {
+	return "read " + ref
+}
+
+// validateBundles checks that every bundle has a single-word name and lists
+// op:// references
+func validateBundles(bundles map[string][]string) error {
+	for name, refs := range bundles {
+		if name == "" || len(strings.Fields(name)) != 1 || strings.TrimSpace(name) != name {
+			return fmt.Errorf("invalid bundle name %q, expected a single word", name)
+		}
+		if len(refs) == 0 {
+			return fmt.Errorf("bundle %s has no references", name)
+		}
+		for _, ref := range refs {
+			if !strings.HasPrefix(ref, "op://") || strings.ContainsAny(ref, " \t\n") {
+				return fmt.Errorf("bundle %s: invalid reference %q, expected op://vault/item/field", name, ref)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestBundle tests that @bundle reads every reference of an allowed bundle
+// and fails as a whole when the rules deny any of them
+func TestBundle(t *testing.T) {
+	fake := installFakeOp(t, func(inv opInvocation) int {
+		args := strings.Join(inv.args, " ")
+		if ref, ok := strings.CutPrefix(args, "--account test-account read "); ok {
+			fmt.Fprintf(inv.stdout, "secret of %s\n", ref)
+		}
+		return 0
+	})
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "read op://App/"
+bundles:
+  app-boot:
+    - "op://App/db/password"
+    - "op://App/api/token"
+  mixed:
+    - "op://App/db/password"
+    - "op://Personal/ssh/private_key"
+`)
+	serveConfig(t, cfg)
+
+	response, err := sendCommand(t, cfg.SocketPath, "@bundle app-boot")
+	if err != nil {
+		t.Fatalf("Failed to send bundle request: %v", err)
+	}
+	var values map[string]string
+	if err := json.Unmarshal([]byte(response), &values); err != nil {
+		t.Fatalf("Expected a JSON object, got %q: %v", response, err)
+	}
+	want := map[string]string{
+		"op://App/db/password": "secret of op://App/db/password",
+		"op://App/api/token":   "secret of op://App/api/token",
+	}
+	if len(values) != len(want) || values["op://App/db/password"] != want["op://App/db/password"] || values["op://App/api/token"] != want["op://App/api/token"] {
+		t.Errorf("Expected %v, got %v", want, values)
+	}
+
+	before := fake.callCount("read")
+	response, err = sendCommand(t, cfg.SocketPath, "@bundle mixed")
+	if err != nil || !strings.Contains(response, "Bundle mixed not allowed, op://Personal/ssh/private_key is denied") {
+		t.Errorf("Expected the bundle to be denied, got %q: %v", response, err)
+	}
+	if n := fake.callCount("read") - before; n != 0 {
+		t.Errorf("Expected no reference of a denied bundle to be read, got %d reads", n)
+	}
+
+	response, err = sendCommand(t, cfg.SocketPath, "@bundle missing")
+	if err != nil || !strings.Contains(response, "Unknown bundle: missing") {
+		t.Errorf("Expected an unknown bundle error, got %q: %v", response, err)
+	}
+}
+
+// TestInvalidBundles tests that malformed bundles are rejected at load
+func TestInvalidBundles(t *testing.T) {
+	for name, bundles := range map[string]string{
+		"empty":         `{app: []}`,
+		"not reference": `{app: ["Employee/GitHub/token"]}`,
+		"with flag":     `{app: ["op://App/db/password --account other"]}`,
+		"bad name":      `{"app boot": ["op://App/db/password"]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := writeTestConfig(t, "account: \"test-account\"\nbundles: "+bundles+"\n")
+			if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "bundle") {
+				t.Errorf("Expected bundle error, got %v", err)
+			}
+		})
+	}
+}
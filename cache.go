@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readCache holds the output of recent cacheable commands by command, so a
+// read repeated within ReadCacheTTL doesn't run op again. Only successful
+// runs are stored.
+var readCache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+// cacheEntry is the output of a command and when it stops being served
+type cacheEntry struct {
+	output  []byte
+	expires time.Time
+	scope   cacheScope
+}
+
+// cacheScope is the vault and item a command reads or writes, each empty
+// when the command doesn't name exactly one
+type cacheScope struct {
+	vault string
+	item  string
+}
+
+// overlaps reports whether two scopes may cover the same item. An unknown
+// vault or item could be any, and names are compared ignoring case like op
+// does. op takes a vault or item by name or by ID, and a name says nothing
+// about the ID it has, so only names or only IDs are compared with each
+// other.
+func (s cacheScope) overlaps(other cacheScope) bool {
+	same := func(a, b string) bool {
+		return a == "" || b == "" || isOpID(a) != isOpID(b) || strings.EqualFold(a, b)
+	}
+	return same(s.vault, other.vault) && same(s.item, other.item)
+}
+
+// isOpID reports whether s looks like the ID 1Password gives vaults and
+// items, 26 lowercase letters and digits
+func isOpID(s string) bool {
+	if len(s) != 26 {
+		return false
+	}
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// commandScope returns the vault and item a command names: the segments of
+// its op:// reference, its --vault flag, the item following a subcommand
+// like `item get` and, for `item create`, its --title
+func commandScope(command string) cacheScope {
+	var scope cacheScope
+	if vaults := commandVaults(command); len(vaults) > 0 {
+		scope.vault = vaults[0]
+		for _, vault := range vaults[1:] {
+			if !strings.EqualFold(vault, scope.vault) {
+				scope.vault = ""
+				break
+			}
+		}
+	}
+
+	args := strings.Fields(command)
+	for i, arg := range args {
+		arg = strings.Trim(arg, `"'`)
+		if _, ref, ok := strings.Cut(arg, opRefPrefix); ok {
+			ref, _, _ = strings.Cut(ref, "?")
+			if segments := strings.Split(ref, "/"); len(segments) >= 2 {
+				scope.item = segments[1]
+			}
+			return scope
+		}
+		if value, ok := strings.CutPrefix(arg, "--title="); ok {
+			scope.item = strings.Trim(value, `"'`)
+			return scope
+		} else if arg == "--title" && i+1 < len(args) {
+			scope.item = strings.Trim(args[i+1], `"'`)
+			return scope
+		}
+	}
+	if len(args) >= 3 && (args[0] == "item" || args[0] == "document") && args[1] != "create" && !strings.HasPrefix(args[2], "-") {
+		scope.item = strings.Trim(args[2], `"'`)
+	}
+	return scope
+}
+
+// cacheable reports whether the output of command may be cached, which only
+// commands starting with one of CacheablePrefixes may
+func (cfg *Config) cacheable(command string) bool {
+	if cfg.ReadCacheTTL <= 0 {
+		return false
+	}
+	command = canonicalizeCommand(command)
+	for _, prefix := range cfg.CacheablePrefixes {
+		if strings.HasPrefix(command, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidatesCache reports whether command may change what cached commands
+// read, which commands starting with one of InvalidatingPrefixes may
+func (cfg *Config) invalidatesCache(command string) bool {
+	if cfg.ReadCacheTTL <= 0 {
+		return false
+	}
+	command = canonicalizeCommand(command)
+	for _, prefix := range cfg.InvalidatingPrefixes {
+		if strings.HasPrefix(command, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedOutput returns a copy of the output cached for command, if it is
+// still fresh at t. The caller wipes the copy once it is sent.
+func cachedOutput(command string, t time.Time) ([]byte, bool) {
+	readCache.mu.Lock()
+	defer readCache.mu.Unlock()
+
+	entry, ok := readCache.entries[command]
+	if !ok || !t.Before(entry.expires) {
+		return nil, false
+	}
+	return bytes.Clone(entry.output), true
+}
+
+// storeOutput caches a copy of the output of a command that succeeded at t
+// for ReadCacheTTL, dropping the entries that have expired meanwhile. Dropped
+// and replaced outputs are wiped.
+func storeOutput(command string, output []byte, t time.Time) {
+	readCache.mu.Lock()
+	defer readCache.mu.Unlock()
+
+	if readCache.entries == nil {
+		readCache.entries = make(map[string]cacheEntry)
+	}
+	for key, entry := range readCache.entries {
+		if !t.Before(entry.expires) || key == command {
+			wipe(entry.output)
+			delete(readCache.entries, key)
+		}
+	}
+	readCache.entries[command] = cacheEntry{output: bytes.Clone(output), expires: t.Add(config.ReadCacheTTL), scope: commandScope(command)}
+}
+
+// invalidateCache wipes and drops the cached outputs of every command that
+// may read what command writes, and returns how many it dropped
+func invalidateCache(command string) int {
+	readCache.mu.Lock()
+	defer readCache.mu.Unlock()
+
+	scope := commandScope(command)
+	dropped := 0
+	for key, entry := range readCache.entries {
+		if entry.scope.overlaps(scope) {
+			wipe(entry.output)
+			delete(readCache.entries, key)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// clearReadCache wipes and drops every cached output
+func clearReadCache() {
+	readCache.mu.Lock()
+	defer readCache.mu.Unlock()
+	for _, entry := range readCache.entries {
+		wipe(entry.output)
+	}
+	clear(readCache.entries)
+}
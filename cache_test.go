@@ -0,0 +1,189 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestReadCache tests that a cacheable read repeated within the TTL is served
+// without running op, while failures and other commands never are
+func TestReadCache(t *testing.T) {
+	fake := installFakeOp(t, func(inv opInvocation) int {
+		if strings.Contains(strings.Join(inv.args, " "), "missing") {
+			inv.stderr.Write([]byte("[ERROR] item not found\n"))
+			return 1
+		}
+		inv.stdout.Write([]byte("secret\n"))
+		return 0
+	})
+	t.Cleanup(clearReadCache)
+	cfg := loadTestConfig(t, `
+read_cache_ttl: 300ms
+cacheable_prefixes:
+  - "read op://"
+allowed_prefixes:
+  - "read op://"
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	send := func(command string) string {
+		t.Helper()
+		response, err := sendCommand(t, cfg.SocketPath, command)
+		if err != nil {
+			t.Fatalf("Failed to send command: %v", err)
+		}
+		return response
+	}
+
+	for i := 0; i < 3; i++ {
+		if response := send("read op://App/db/password"); response != "secret\n" {
+			t.Errorf("Expected read %d to return the secret, got %q", i+1, response)
+		}
+	}
+	if n := fake.callCount("read op://App/db/password"); n != 1 {
+		t.Errorf("Expected op to run once for repeated reads, got %d", n)
+	}
+
+	// Commands not marked cacheable always run op
+	send("item get foo")
+	send("item get foo")
+	if n := fake.callCount("item get foo"); n != 2 {
+		t.Errorf("Expected op to run for every uncacheable command, got %d", n)
+	}
+
+	// Failures are never cached
+	send("read op://App/missing/password")
+	send("read op://App/missing/password")
+	if n := fake.callCount("read op://App/missing/password"); n != 2 {
+		t.Errorf("Expected failed reads to run op every time, got %d", n)
+	}
+
+	// Once the TTL has passed op runs again
+	time.Sleep(400 * time.Millisecond)
+	send("read op://App/db/password")
+	if n := fake.callCount("read op://App/db/password"); n != 2 {
+		t.Errorf("Expected op to run again after the TTL, got %d", n)
+	}
+}
+
+// TestReadCacheInvalidation tests that a read right after a write to the
+// same item runs op again instead of serving the stale cached output, while
+// reads of other items are still served from the cache
+func TestReadCacheInvalidation(t *testing.T) {
+	var mu sync.Mutex
+	password := "old"
+	fake := installFakeOp(t, func(inv opInvocation) int {
+		mu.Lock()
+		defer mu.Unlock()
+		if slices.Contains(inv.args, "create") {
+			password = "new"
+		}
+		inv.stdout.Write([]byte(password + "\n"))
+		return 0
+	})
+	t.Cleanup(clearReadCache)
+	cfg := loadTestConfig(t, `
+read_cache_ttl: 1m
+cacheable_prefixes:
+  - "read op://"
+invalidating_prefixes:
+  - "item create"
+allowed_prefixes:
+  - "read op://"
+  - "item create"
+`)
+	serveConfig(t, cfg)
+
+	send := func(command string) string {
+		t.Helper()
+		response, err := sendCommand(t, cfg.SocketPath, command)
+		if err != nil {
+			t.Fatalf("Failed to send command: %v", err)
+		}
+		return response
+	}
+
+	send("read op://App/db/password")
+	send("read op://Other/db/password")
+	send("item create --vault App --title db password=new")
+	if response := send("read op://App/db/password"); response != "new\n" {
+		t.Errorf("Expected the read after the write to return fresh data, got %q", response)
+	}
+	if n := fake.callCount("read op://App/db/password"); n != 2 {
+		t.Errorf("Expected the read after the write to miss the cache, got %d runs", n)
+	}
+	if response := send("read op://Other/db/password"); response != "old\n" {
+		t.Errorf("Expected the read of another vault to be served from the cache, got %q", response)
+	}
+	if n := fake.callCount("read op://Other/db/password"); n != 1 {
+		t.Errorf("Expected the read of another vault to hit the cache, got %d runs", n)
+	}
+}
+
+// TestCommandScope tests the vault and item commands are scoped to, and which
+// scopes a write drops the cached reads of
+func TestCommandScope(t *testing.T) {
+	tests := []struct {
+		command string
+		want    cacheScope
+	}{
+		{"read op://App/db/password", cacheScope{"App", "db"}},
+		{"read op://App/db/section/password?attribute=otp", cacheScope{"App", "db"}},
+		{"item get db --vault App --fields password", cacheScope{"App", "db"}},
+		{"item get db", cacheScope{"", "db"}},
+		{"item create --vault=App --title db password=x", cacheScope{"App", "db"}},
+		{"item create --vault App --category login", cacheScope{"App", ""}},
+		{"item edit db --vault App password=x", cacheScope{"App", "db"}},
+		{"item get db --vault App --vault Other", cacheScope{"", "db"}},
+		{"item list", cacheScope{}},
+	}
+	for _, tt := range tests {
+		if got := commandScope(tt.command); got != tt.want {
+			t.Errorf("%s: expected %+v, got %+v", tt.command, tt.want, got)
+		}
+	}
+
+	write := commandScope("item edit db --vault App")
+	for _, read := range []string{"read op://app/DB/password", "item get db", "item list --vault App"} {
+		if !commandScope(read).overlaps(write) {
+			t.Errorf("Expected the write to drop %s", read)
+		}
+	}
+	for _, read := range []string{"read op://Other/db/password", "read op://App/api/token"} {
+		if commandScope(read).overlaps(write) {
+			t.Errorf("Expected the write to keep %s", read)
+		}
+	}
+
+	// A write by ID may change an item read by its title, and the other way
+	// around, while another ID is another item
+	const itemID = "ptk6vrgv7zcb4lvdm2yyqhxmxq"
+	byID := commandScope("item edit " + itemID + " --vault App password=x")
+	for _, read := range []string{"read op://App/db/password", "item get db --vault App"} {
+		if !commandScope(read).overlaps(byID) {
+			t.Errorf("Expected the write by ID to drop %s", read)
+		}
+	}
+	if !commandScope("read op://App/" + itemID + "/password").overlaps(write) {
+		t.Error("Expected the write by title to drop the read by ID")
+	}
+	if commandScope("read op://App/lgnmc2hrbhqy5tx4xz2qf3vpfa/password").overlaps(byID) {
+		t.Error("Expected the write by ID to keep the read of another ID")
+	}
+	if commandScope("read op://Other/db/password").overlaps(byID) {
+		t.Error("Expected the write by ID to keep the read of another vault")
+	}
+}
+
+// TestReadCacheNeedsPrefixes tests that a cache TTL without cacheable
+// prefixes is rejected at load
+func TestReadCacheNeedsPrefixes(t *testing.T) {
+	path := writeTestConfig(t, "account: \"test-account\"\nread_cache_ttl: 1m\n")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "cacheable_prefixes") {
+		t.Errorf("Expected cacheable_prefixes error, got %v", err)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// dialBackoffMin and dialBackoffMax bound the delay between connection
+	// attempts while waiting for the server
+	dialBackoffMin = 50 * time.Millisecond
+	dialBackoffMax = time.Second
+)
+
+// clientOptions holds the client mode flags
+type clientOptions struct {
+	// wait is how long to keep retrying while the server socket isn't up,
+	// zero fails immediately
+	wait time.Duration
+
+	// raw strips the trailing newline from the output
+	raw bool
+
+	// field prints only the named field of a JSON response
+	field string
+
+	// metadata receives the line the server sends about which rule allowed
+	// the command and the account used, nil to not ask for it
+	metadata io.Writer
+
+	// jsonErrors receives server and op errors as a clientError JSON object,
+	// nil to print them along with the output
+	jsonErrors io.Writer
+
+	// fallbacks are further sockets tried in order when the one given isn't
+	// there or doesn't accept the connection
+	fallbacks []string
+
+	// out is a file the output is written to with outMode instead of
+	// stdout, only when the command succeeds. Empty prints the output.
+	out     string
+	outMode string
+
+	// signingKey is a file holding the key requests are signed with, for
+	// servers reached through something other than their Unix socket.
+	// Empty sends them unsigned.
+	signingKey string
+
+	// progress receives a line counting the bytes received so far, nil to
+	// not report progress
+	progress io.Writer
+}
+
+// clientError is an error reported to programs driving the client
+type clientError struct {
+	Error    string `json:"error"`
+	ExitCode int    `json:"exit_code"`
+	Kind     string `json:"kind"`
+}
+
+// errorKind names the kind of failure an exit code stands for
+func errorKind(exitCode int) string {
+	switch exitCode {
+	case exitPolicy:
+		return "policy"
+	case exitTempFail:
+		return "rate_limit"
+	case exitTimeout:
+		return "timeout"
+	case exitServerError:
+		return "server"
+	default:
+		return "op"
+	}
+}
+
+// writeJSONError writes e as a single JSON line to w
+func writeJSONError(w io.Writer, e clientError) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "%s\n", data)
+}
+
+// runClient handles the client mode of the application
+func runClient(args []string, opts clientOptions) {
+	command, err := clientCommand(os.Args[0], args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	socketPaths, err := clientSocketPaths()
+	if err != nil {
+		fmt.Printf("Error getting default socket path: %v\n", err)
+		os.Exit(1)
+	}
+	opts.fallbacks = socketPaths[1:]
+
+	var exitCode int
+	if opts.out != "" {
+		var mode os.FileMode
+		if mode, err = parseOutMode(opts.outMode); err == nil {
+			exitCode, err = forwardToFile(os.Stdout, socketPaths[0], command, opts, opts.out, mode)
+		}
+	} else {
+		exitCode, err = forwardCommand(os.Stdout, socketPaths[0], command, opts)
+	}
+	if err != nil {
+		if opts.jsonErrors != nil {
+			writeJSONError(opts.jsonErrors, clientError{Error: err.Error(), ExitCode: 1, Kind: "client"})
+		} else {
+			fmt.Println(err)
+		}
+		os.Exit(1)
+	}
+	os.Exit(exitCode)
+}
+
+// clientSocketPaths returns the sockets the client tries in order: those of
+// the colon separated OPFWD_SOCKET_PATH, then the default socket path, then
+// ~/.ssh/opfwd.sock where forwards set up before XDG_RUNTIME_DIR was honored
+// still point
+func clientSocketPaths() ([]string, error) {
+	var paths []string
+	if val := os.Getenv("OPFWD_SOCKET_PATH"); val != "" {
+		paths = filepath.SplitList(val)
+	}
+	socketPath, err := getDefaultSocketPath()
+	if err != nil && len(paths) == 0 {
+		return nil, err
+	}
+	if err == nil {
+		paths = append(paths, socketPath)
+	}
+	if home, err := getHomeSocketPath(); err == nil {
+		paths = append(paths, home)
+	}
+	return appendMissing(nil, paths), nil
+}
+
+// clientSocketPath returns the first of the client sockets that exists, or
+// the first of them when none does
+func clientSocketPath() (string, error) {
+	paths, err := clientSocketPaths()
+	if err != nil {
+		return "", err
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil || isAbstractSocket(path) {
+			return path, nil
+		}
+	}
+	return paths[0], nil
+}
+
+// forwardCommand sends command to the server listening on socketPath, copies
+// the response to w and returns the exit code the server reported: op's own,
+// or one of the exit* codes when the server stopped the command. Servers that
+// predate response frames always report 0.
+func forwardCommand(w io.Writer, socketPath, command string, opts clientOptions) (int, error) {
+	req := request{Command: command, Flags: []string{gzipFlag, statusFlag}}
+	if opts.metadata != nil {
+		req.Flags = append(req.Flags, verboseFlag)
+
+		// The banner is meant for people, not for raw output fed to scripts
+		if !opts.raw {
+			req.Flags = append(req.Flags, bannerFlag)
+		}
+	}
+	if opts.signingKey != "" {
+		key, err := loadSigningKey(opts.signingKey)
+		if err != nil {
+			return 1, err
+		}
+		if err := signRequest(&req, key); err != nil {
+			return 1, err
+		}
+	}
+
+	// Send the command to the socket, or the first fallback that accepts
+	conn, r, connected, err := sendRequest(append([]string{socketPath}, opts.fallbacks...), opts.wait, req)
+	if err != nil {
+		return 1, err
+	}
+	defer conn.Close()
+	if opts.metadata != nil && len(opts.fallbacks) > 0 {
+		fmt.Fprintf(opts.metadata, "%ssocket=%s\n", metadataPrefix, connected)
+	}
+
+	// Read and display the response
+	response, err := readResponse(r)
+	if err != nil {
+		return 1, fmt.Errorf("Error reading response: %v", err)
+	}
+	response, frames, err := openFrames(response)
+	if err != nil {
+		return 1, fmt.Errorf("Error reading response: %v", err)
+	}
+	exitCode := func() int {
+		if frames == nil {
+			return 0
+		}
+		return frames.exitCode
+	}
+
+	// Errors raised by the server go to jsonErrors instead of the output,
+	// once the exit code says what kind they are
+	var errs bytes.Buffer
+	if frames != nil && opts.jsonErrors != nil {
+		frames.errs = &errs
+	}
+	finish := func() (int, error) {
+		code := exitCode()
+		if code == 0 || opts.jsonErrors == nil || frames == nil {
+			return code, nil
+		}
+		msg := strings.TrimPrefix(strings.TrimSpace(errs.String()), "Error: ")
+		if msg == "" {
+			msg = fmt.Sprintf("op exited with status %d", code)
+		}
+		writeJSONError(opts.jsonErrors, clientError{Error: msg, ExitCode: code, Kind: errorKind(code)})
+		return code, nil
+	}
+	if opts.metadata != nil {
+		if response, err = splitMetadata(response, opts.metadata); err != nil {
+			return 1, fmt.Errorf("Error reading response: %v", err)
+		}
+	}
+	if opts.progress != nil {
+		progress := newProgressReader(response, opts.progress)
+		defer progress.finish()
+		response = progress
+	}
+	if !opts.raw && opts.field == "" {
+		if _, err := io.Copy(w, response); err != nil {
+			return 1, fmt.Errorf("Error reading response: %v", err)
+		}
+		return finish()
+	}
+
+	// Formatting needs the whole response
+	data, err := io.ReadAll(response)
+	if err != nil {
+		return 1, fmt.Errorf("Error reading response: %v", err)
+	}
+	if opts.field != "" && exitCode() == 0 {
+		value, err := extractField(data, opts.field)
+		if err != nil {
+			// Pass on what the server said along with the error
+			_, _ = w.Write(data)
+			return 1, fmt.Errorf("Error: %v", err)
+		}
+		data = append(value, '\n')
+	}
+	if opts.raw {
+		data = bytes.TrimSuffix(data, []byte("\n"))
+		data = bytes.TrimSuffix(data, []byte("\r"))
+	}
+	if _, err := w.Write(data); err != nil {
+		return 1, err
+	}
+	return finish()
+}
+
+// extractField returns the named field of a JSON object. Top-level keys are
+// looked up first, then the entries of an op item's "fields" list by id or
+// label. Strings are returned as is, other values as JSON.
+func extractField(data []byte, name string) ([]byte, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("response is not a JSON object, cannot extract field %s", name)
+	}
+
+	value, ok := obj[name]
+	if !ok {
+		var fields []struct {
+			ID    string          `json:"id"`
+			Label string          `json:"label"`
+			Value json.RawMessage `json:"value"`
+		}
+		if raw, ok := obj["fields"]; ok && json.Unmarshal(raw, &fields) == nil {
+			for _, f := range fields {
+				if f.ID == name || f.Label == name {
+					value = f.Value
+					break
+				}
+			}
+		}
+	}
+	if value == nil {
+		return nil, fmt.Errorf("field %s not found in response", name)
+	}
+
+	var s string
+	if json.Unmarshal(value, &s) == nil {
+		return []byte(s), nil
+	}
+	return value, nil
+}
+
+// splitMetadata copies the metadata lines at the start of a verbose response
+// to w, and returns the remaining op output. Responses without any are
+// returned untouched.
+func splitMetadata(r io.Reader, w io.Writer) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	for {
+		prefix, err := br.Peek(len(metadataPrefix))
+		if err != nil || string(prefix) != metadataPrefix {
+			// Short responses are simply passed on
+			return br, nil
+		}
+
+		line, err := br.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		if _, err := io.WriteString(w, line); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sendRequest connects to the first of socketPaths that accepts and sends
+// req behind a hello. A server that predates the hello refuses it and closes
+// the connection, so req is then sent again on a new connection without one.
+// It returns the connection, a reader for the response and the socket path
+// connected to.
+func sendRequest(socketPaths []string, wait time.Duration, req request) (net.Conn, *bufio.Reader, string, error) {
+	conn, connected, err := dialServer(socketPaths, wait)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	// The request follows right away, as a server answering the hello
+	// goes on to read it
+	err = sayHello(conn)
+	if err == nil {
+		err = writeRequest(conn, req)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, "", fmt.Errorf("Error sending command: %v", err)
+	}
+
+	r := bufio.NewReader(conn)
+	_, err = readHello(r)
+	switch {
+	case errors.Is(err, errNoHello):
+		conn.Close()
+		if conn, err = dialSocket(connected); err != nil {
+			return nil, nil, "", err
+		}
+		if err := writeRequest(conn, req); err != nil {
+			conn.Close()
+			return nil, nil, "", fmt.Errorf("Error sending command: %v", err)
+		}
+		return conn, bufio.NewReader(conn), connected, nil
+	case err != nil:
+		conn.Close()
+		return nil, nil, "", fmt.Errorf("Error negotiating protocol: %v", err)
+	}
+	return conn, r, connected, nil
+}
+
+// dialServer connects to the first of socketPaths that accepts, and returns
+// which one it connected to. With a positive wait it polls for the sockets
+// and retries with backoff until the deadline instead of failing on the first
+// round. The error is that of the first socket.
+func dialServer(socketPaths []string, wait time.Duration) (net.Conn, string, error) {
+	deadline := time.Now().Add(wait)
+	backoff := dialBackoffMin
+
+	for {
+		var firstErr error
+		for _, socketPath := range socketPaths {
+			conn, err := dialSocket(socketPath)
+			if err == nil {
+				return conn, socketPath, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, "", firstErr
+		}
+
+		time.Sleep(min(backoff, remaining))
+		backoff = min(backoff*2, dialBackoffMax)
+	}
+}
+
+// dialSocket makes a single attempt to connect to the server socket
+func dialSocket(socketPath string) (net.Conn, error) {
+	// Check if the socket exists, abstract sockets have no file to check
+	if _, err := os.Stat(socketPath); err != nil && !isAbstractSocket(socketPath) {
+		return nil, errors.New("Error: Socket " + socketPath + " not found.\n" +
+			"Make sure the opfwd server is running and the socket is accessible.")
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to socket: %v", err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestClientWaitsForServer tests that -wait retries until the server comes up
+func TestClientWaitsForServer(t *testing.T) {
+	installFakeOp(t, nil)
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "item get"
+`)
+
+	type result struct {
+		out string
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var out bytes.Buffer
+		_, err := forwardCommand(&out, cfg.SocketPath, "item get foo", clientOptions{wait: 5 * time.Second})
+		done <- result{out.String(), err}
+	}()
+
+	// Bring the server up after the client started polling
+	time.Sleep(200 * time.Millisecond)
+	serveConfig(t, cfg)
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatalf("Expected command to succeed, got: %v", res.err)
+		}
+		if want := "op --account test-account item get foo\n"; res.out != want {
+			t.Errorf("Expected output %q, got %q", want, res.out)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Client did not finish after the server came up")
+	}
+}
+
+// TestClientFailsFastWithoutWait tests that a missing socket fails immediately by default
+func TestClientFailsFastWithoutWait(t *testing.T) {
+	env := setupTestEnvironment(t)
+
+	start := time.Now()
+	_, err := forwardCommand(&bytes.Buffer{}, env.socketPath, "item get foo", clientOptions{})
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected socket not found error, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected to fail fast, took %s", elapsed)
+	}
+}
+
+// TestClientWaitTimesOut tests that -wait gives up at the deadline
+func TestClientWaitTimesOut(t *testing.T) {
+	env := setupTestEnvironment(t)
+
+	start := time.Now()
+	_, err := forwardCommand(&bytes.Buffer{}, env.socketPath, "item get foo", clientOptions{wait: 300 * time.Millisecond})
+	if err == nil {
+		t.Fatal("Expected error when the server never comes up")
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected to give up after about 300ms, took %s", elapsed)
+	}
+}
+
+// TestClientVerboseMetadata tests that the decision metadata is only sent to
+// verbose clients and kept out of the op output
+func TestClientVerboseMetadata(t *testing.T) {
+	installFakeOp(t, nil)
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+	want := "op --account test-account item get foo\n"
+
+	var out, meta bytes.Buffer
+	if _, err := forwardCommand(&out, cfg.SocketPath, "item get foo", clientOptions{metadata: &meta}); err != nil {
+		t.Fatalf("Expected command to succeed, got: %v", err)
+	}
+	if out.String() != want {
+		t.Errorf("Expected output %q, got %q", want, out.String())
+	}
+	if !strings.HasPrefix(meta.String(), metadataPrefix+`account=test-account rule="prefix item get" request=`) {
+		t.Errorf("Expected metadata line, got %q", meta.String())
+	}
+
+	out.Reset()
+	if _, err := forwardCommand(&out, cfg.SocketPath, "item get foo", clientOptions{}); err != nil {
+		t.Fatalf("Expected command to succeed, got: %v", err)
+	}
+	if out.String() != want {
+		t.Errorf("Expected no metadata without verbose, got %q", out.String())
+	}
+
+	// Denials carry no metadata and reach the output as before
+	out.Reset()
+	meta.Reset()
+	if _, err := forwardCommand(&out, cfg.SocketPath, "item delete foo", clientOptions{metadata: &meta}); err != nil {
+		t.Fatalf("Expected denial to be forwarded, got: %v", err)
+	}
+	if !strings.Contains(out.String(), "Command not allowed") || meta.Len() != 0 {
+		t.Errorf("Expected plain denial, got output %q and metadata %q", out.String(), meta.String())
+	}
+}
+
+// TestClientFieldAndRaw tests the client-side -field and -raw formatting
+func TestClientFieldAndRaw(t *testing.T) {
+	installFakeOp(t, func(inv opInvocation) int {
+		if strings.Contains(strings.Join(inv.args, " "), "--format json") {
+			fmt.Fprintln(inv.stdout, `{"id": "abc", "title": "GitHub", "version": 3, "fields": [{"id": "password", "label": "password", "value": "s3cret"}, {"id": "u1", "label": "username", "value": "octocat"}]}`)
+		} else {
+			fmt.Fprintln(inv.stdout, "s3cret")
+		}
+		return 0
+	})
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "item get"
+  - "read"
+`)
+	serveConfig(t, cfg)
+
+	tests := []struct {
+		command string
+		opts    clientOptions
+		want    string
+	}{
+		{"item get GitHub --format json", clientOptions{field: "title"}, "GitHub\n"},
+		{"item get GitHub --format json", clientOptions{field: "version"}, "3\n"},
+		{"item get GitHub --format json", clientOptions{field: "username"}, "octocat\n"},
+		{"item get GitHub --format json", clientOptions{field: "password", raw: true}, "s3cret"},
+		{"read op://Employee/GitHub/password", clientOptions{raw: true}, "s3cret"},
+		{"read op://Employee/GitHub/password", clientOptions{}, "s3cret\n"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if _, err := forwardCommand(&out, cfg.SocketPath, tt.command, tt.opts); err != nil {
+			t.Fatalf("%s %+v: expected success, got: %v", tt.command, tt.opts, err)
+		}
+		if out.String() != tt.want {
+			t.Errorf("%s %+v: expected %q, got %q", tt.command, tt.opts, tt.want, out.String())
+		}
+	}
+
+	var out bytes.Buffer
+	_, err := forwardCommand(&out, cfg.SocketPath, "item get GitHub --format json", clientOptions{field: "notes"})
+	if err == nil || !strings.Contains(err.Error(), "field notes not found") {
+		t.Errorf("Expected missing field error, got: %v", err)
+	}
+	_, err = forwardCommand(&out, cfg.SocketPath, "read op://Employee/GitHub/password", clientOptions{field: "password"})
+	if err == nil || !strings.Contains(err.Error(), "not a JSON object") {
+		t.Errorf("Expected non-JSON error, got: %v", err)
+	}
+}
+
+// TestClientBanner tests that the banner only reaches clients asking for
+// metadata, outside of raw mode, and never the op output
+func TestClientBanner(t *testing.T) {
+	installFakeOp(t, nil)
+	cfg := loadTestConfig(t, `
+banner: "Access logged"
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+	want := "op --account test-account item get foo\n"
+	banner := metadataPrefix + "banner=\"Access logged\"\n"
+
+	tests := []struct {
+		name       string
+		opts       clientOptions
+		wantBanner bool
+	}{
+		{"plain", clientOptions{}, false},
+		{"verbose", clientOptions{metadata: &bytes.Buffer{}}, true},
+		{"verbose raw", clientOptions{metadata: &bytes.Buffer{}, raw: true}, false},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if _, err := forwardCommand(&out, cfg.SocketPath, "item get foo", tt.opts); err != nil {
+			t.Fatalf("%s: expected command to succeed, got: %v", tt.name, err)
+		}
+		if got := strings.TrimSuffix(out.String(), "\n"); got != strings.TrimSuffix(want, "\n") {
+			t.Errorf("%s: expected output %q, got %q", tt.name, want, out.String())
+		}
+
+		var meta string
+		if tt.opts.metadata != nil {
+			meta = tt.opts.metadata.(*bytes.Buffer).String()
+		}
+		if got := strings.HasPrefix(meta, banner); got != tt.wantBanner {
+			t.Errorf("%s: expected banner %v, got metadata %q", tt.name, tt.wantBanner, meta)
+		}
+	}
+
+	// Clients that don't ask get no metadata at all
+	response, err := sendCommand(t, cfg.SocketPath, "item get foo")
+	if err != nil || response != want {
+		t.Errorf("Expected legacy client to get plain output, got %q: %v", response, err)
+	}
+}
+
+// TestClientJSONErrors tests that -json-errors reports server errors as JSON
+// on the error stream and keeps them out of the output
+func TestClientJSONErrors(t *testing.T) {
+	installFakeOp(t, func(inv opInvocation) int {
+		fmt.Fprintf(inv.stdout, "op %s\n", strings.Join(inv.args, " "))
+		if strings.Contains(strings.Join(inv.args, " "), "missing") {
+			return 1
+		}
+		return 0
+	})
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	var out, errs bytes.Buffer
+	code, err := forwardCommand(&out, cfg.SocketPath, "vault list", clientOptions{jsonErrors: &errs})
+	if err != nil {
+		t.Fatalf("Expected denial to be forwarded, got: %v", err)
+	}
+	if code != exitPolicy || out.Len() != 0 {
+		t.Errorf("Expected exit code %d and no output, got %d and %q", exitPolicy, code, out.String())
+	}
+	var got clientError
+	if err := json.Unmarshal(errs.Bytes(), &got); err != nil {
+		t.Fatalf("Expected a JSON error, got %q: %v", errs.String(), err)
+	}
+	if want := (clientError{Error: "Command not allowed: vault list", ExitCode: exitPolicy, Kind: "policy"}); got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+
+	// op failures keep their output and get an error of kind op
+	out.Reset()
+	errs.Reset()
+	code, err = forwardCommand(&out, cfg.SocketPath, "item get missing", clientOptions{jsonErrors: &errs})
+	if err != nil || code != 1 {
+		t.Fatalf("Expected op's exit code 1, got %d: %v", code, err)
+	}
+	if out.String() != "op --account test-account item get missing\n" {
+		t.Errorf("Expected op output verbatim, got %q", out.String())
+	}
+	if want := `{"error":"op exited with status 1","exit_code":1,"kind":"op"}` + "\n"; errs.String() != want {
+		t.Errorf("Expected %s, got %q", want, errs.String())
+	}
+
+	// Successful commands report nothing
+	errs.Reset()
+	if code, err := forwardCommand(&bytes.Buffer{}, cfg.SocketPath, "item get foo", clientOptions{jsonErrors: &errs}); err != nil || code != 0 || errs.Len() != 0 {
+		t.Errorf("Expected no error, got %d %q: %v", code, errs.String(), err)
+	}
+}
+
+// TestClientSocketFallback tests that the client connects to the first
+// candidate socket that accepts, and says which under verbose
+func TestClientSocketFallback(t *testing.T) {
+	installFakeOp(t, nil)
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+	missing := filepath.Join(t.TempDir(), "opfwd.sock")
+
+	var out, meta bytes.Buffer
+	opts := clientOptions{metadata: &meta, fallbacks: []string{cfg.SocketPath}}
+	if _, err := forwardCommand(&out, missing, "item get foo", opts); err != nil {
+		t.Fatalf("Expected the client to fall back to the second socket, got: %v", err)
+	}
+	if want := "op --account test-account item get foo\n"; out.String() != want {
+		t.Errorf("Expected output %q, got %q", want, out.String())
+	}
+	if !strings.HasPrefix(meta.String(), metadataPrefix+"socket="+cfg.SocketPath+"\n") {
+		t.Errorf("Expected the socket used in the metadata, got %q", meta.String())
+	}
+
+	// Without a fallback the missing socket is reported
+	if _, err := forwardCommand(&bytes.Buffer{}, missing, "item get foo", clientOptions{}); err == nil || !strings.Contains(err.Error(), missing) {
+		t.Errorf("Expected the missing socket to be reported, got: %v", err)
+	}
+}
+
+// TestClientSocketPaths tests the order in which the client tries sockets
+func TestClientSocketPaths(t *testing.T) {
+	runtimeDir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+	t.Setenv("OPFWD_SOCKET_PATH", "/tmp/a.sock:/tmp/b.sock")
+	home, err := getHomeSocketPath()
+	if err != nil {
+		t.Fatalf("Failed to get home socket path: %v", err)
+	}
+
+	paths, err := clientSocketPaths()
+	if err != nil {
+		t.Fatalf("Failed to get socket paths: %v", err)
+	}
+	want := []string{"/tmp/a.sock", "/tmp/b.sock", filepath.Join(runtimeDir, "opfwd.sock"), home}
+	if !slices.Equal(paths, want) {
+		t.Errorf("Expected socket paths %q, got %q", want, paths)
+	}
+}
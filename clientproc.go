@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// clientProcess identifies the local process on the other end of a
+// connection. Fields that couldn't be resolved are left empty.
+type clientProcess struct {
+	PID  int
+	Comm string
+	Exe  string
+}
+
+// String describes the process for logs
+func (p clientProcess) String() string {
+	return fmt.Sprintf("pid=%d comm=%s exe=%s", p.PID, orUnknown(p.Comm), orUnknown(p.Exe))
+}
+
+// orUnknown returns s, or "unknown" when it is empty
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// lookupClientProcess resolves the process behind a connection. It is a
+// variable so tests can substitute fake peer credentials.
+var lookupClientProcess = func(conn net.Conn) (clientProcess, error) {
+	pid, err := peerPID(conn)
+	if err != nil {
+		return clientProcess{}, err
+	}
+	return processInfo(pid), nil
+}
+
+// processInfo reads the command name and executable of pid from /proc,
+// leaving them empty where /proc isn't available, like on macOS, or the
+// process has already exited
+func processInfo(pid int) clientProcess {
+	p := clientProcess{PID: pid}
+	dir := "/proc/" + strconv.Itoa(pid)
+	if data, err := os.ReadFile(dir + "/comm"); err == nil {
+		p.Comm = strings.TrimSpace(string(data))
+	}
+	if exe, err := os.Readlink(dir + "/exe"); err == nil {
+		p.Exe = exe
+	}
+	return p
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestClientProcessLogged tests that the client process resolved from the
+// peer credentials shows up in the request log and the audit entry
+func TestClientProcessLogged(t *testing.T) {
+	installFakeOp(t, nil)
+	prev := lookupClientProcess
+	lookupClientProcess = func(conn net.Conn) (clientProcess, error) {
+		return clientProcess{PID: 4242, Comm: "deploy.sh", Exe: "/usr/bin/bash"}, nil
+	}
+	t.Cleanup(func() { lookupClientProcess = prev })
+
+	logs := captureLog(t)
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+log_client_process: true
+audit_log: %q
+allowed_prefixes:
+  - "item get"
+`, auditPath))
+	serveConfig(t, cfg)
+
+	if _, err := sendCommand(t, cfg.SocketPath, "item get foo"); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if !strings.Contains(logs.String(), "Client process: pid=4242 comm=deploy.sh exe=/usr/bin/bash") {
+		t.Errorf("Expected the client process in the log, got:\n%s", logs.String())
+	}
+
+	data, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	var entry auditEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("Failed to decode audit entry %q: %v", data, err)
+	}
+	if entry.ClientPID != 4242 || entry.ClientComm != "deploy.sh" || entry.ClientExe != "/usr/bin/bash" {
+		t.Errorf("Expected the client process in the audit entry, got %+v", entry)
+	}
+}
+
+// TestProcessInfo tests reading the command name and executable from /proc
+func TestProcessInfo(t *testing.T) {
+	if _, err := os.Stat("/proc/self/comm"); err != nil {
+		t.Skip("no /proc on this platform")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Failed to get executable: %v", err)
+	}
+
+	p := processInfo(os.Getpid())
+	if p.PID != os.Getpid() || p.Comm == "" || p.Exe != exe {
+		t.Errorf("Expected pid %d with a comm and exe %s, got %+v", os.Getpid(), exe, p)
+	}
+	if p := processInfo(-1); p.Comm != "" || p.Exe != "" {
+		t.Errorf("Expected nothing for a missing process, got %+v", p)
+	}
+}
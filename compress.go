@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// gzipFlag is the request flag a client sets to accept a compressed response
+	gzipFlag = "gzip"
+
+	// gzipThreshold is how much output the server buffers before deciding to
+	// compress the rest of the response
+	gzipThreshold = 32 * 1024
+
+	// Marker bytes sent ahead of the response to a client that set gzipFlag
+	responsePlain = 'p'
+	responseGzip  = 'z'
+)
+
+// compressWriter writes a response for a client that accepts gzip. Output is
+// buffered until it exceeds gzipThreshold; a larger response is gzipped, a
+// smaller one is sent as is. Either way the response starts with a marker byte
+// telling the client which one it got. It is safe for concurrent use, as op's
+// stdout and stderr are copied to it from separate goroutines.
+type compressWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf secretBuffer
+	gz  *gzip.Writer
+}
+
+// newCompressWriter returns a compressWriter sending the response to w
+func newCompressWriter(w io.Writer) *compressWriter {
+	return &compressWriter{w: w}
+}
+
+// Write buffers p, switching to gzip once the buffered output is large
+// enough. Compressed output is flushed after every write, so the client
+// receives a long response as it is produced.
+func (c *compressWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gz != nil {
+		n, err := c.gz.Write(p)
+		if err != nil {
+			return n, err
+		}
+		return n, c.gz.Flush()
+	}
+
+	c.buf.Write(p)
+	if c.buf.Len() < gzipThreshold {
+		return len(p), nil
+	}
+
+	traceMarker("send", responseGzip)
+	if _, err := c.w.Write([]byte{responseGzip}); err != nil {
+		return 0, err
+	}
+	c.gz = gzip.NewWriter(c.w)
+	_, err := c.gz.Write(c.buf.Bytes())
+	c.buf.wipe()
+	if err == nil {
+		err = c.gz.Flush()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends whatever is still buffered and terminates the gzip stream. It
+// doesn't close the underlying writer.
+func (c *compressWriter) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gz != nil {
+		return c.gz.Close()
+	}
+
+	traceMarker("send", responsePlain)
+	data := append([]byte{responsePlain}, c.buf.Bytes()...)
+	defer wipe(data)
+	c.buf.wipe()
+	_, err := c.w.Write(data)
+	return err
+}
+
+// readResponse returns a reader for the response the server sent to a request
+// with gzipFlag set, decompressing it when needed
+func readResponse(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	marker, err := br.ReadByte()
+	if errors.Is(err, io.EOF) {
+		return br, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	traceMarker("recv", marker)
+
+	switch marker {
+	case responsePlain:
+		return br, nil
+	case responseGzip:
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		// The connection may carry further responses, so stop at the end of this one
+		zr.Multistream(false)
+		return zr, nil
+	default:
+		return nil, fmt.Errorf("unknown response encoding %q", marker)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestGzipResponseRoundTrip tests that a large response is compressed on the
+// wire and decompressed by the client
+func TestGzipResponseRoundTrip(t *testing.T) {
+	payload := strings.Repeat(`{"id": "abc123", "title": "Example item", "vault": "Employee"}`+"\n", 4096)
+	installFakeOp(t, func(inv opInvocation) int {
+		io.WriteString(inv.stdout, payload)
+		return 0
+	})
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "item list"
+`)
+	serveConfig(t, cfg)
+
+	var out bytes.Buffer
+	if _, err := forwardCommand(&out, cfg.SocketPath, "item list --format json", clientOptions{}); err != nil {
+		t.Fatalf("Expected command to succeed, got: %v", err)
+	}
+	if out.String() != payload {
+		t.Errorf("Expected %d bytes of decompressed output, got %d", len(payload), out.Len())
+	}
+
+	// Check what actually went over the socket
+	conn, err := net.Dial("unix", cfg.SocketPath)
+	if err != nil {
+		t.Fatalf("Failed to connect to socket: %v", err)
+	}
+	defer conn.Close()
+	if err := writeRequest(conn, request{Command: "item list --format json", Flags: []string{gzipFlag}}); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	raw, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if len(raw) == 0 || raw[0] != responseGzip {
+		t.Fatalf("Expected a gzip response marker, got %q", raw[:min(len(raw), 1)])
+	}
+	if len(raw) >= len(payload)/10 {
+		t.Errorf("Expected a compressed response, got %d bytes for a %d byte payload", len(raw), len(payload))
+	}
+}
+
+// TestGzipSmallResponsePlain tests that responses under the threshold are
+// sent uncompressed, and that clients without the flag get no marker
+func TestGzipSmallResponsePlain(t *testing.T) {
+	installFakeOp(t, nil)
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	var out bytes.Buffer
+	if _, err := forwardCommand(&out, cfg.SocketPath, "item get foo", clientOptions{}); err != nil {
+		t.Fatalf("Expected command to succeed, got: %v", err)
+	}
+	if want := "op --account test-account item get foo\n"; out.String() != want {
+		t.Errorf("Expected output %q, got %q", want, out.String())
+	}
+
+	out.Reset()
+	if _, err := forwardCommand(&out, cfg.SocketPath, "item delete foo", clientOptions{}); err != nil {
+		t.Fatalf("Expected denied command to be forwarded, got: %v", err)
+	}
+	if !strings.Contains(out.String(), "Command not allowed") {
+		t.Errorf("Expected deny message, got %q", out.String())
+	}
+
+	response, err := sendCommand(t, cfg.SocketPath, "item get foo")
+	if err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if want := "op --account test-account item get foo\n"; response != want {
+		t.Errorf("Expected legacy response %q, got %q", want, response)
+	}
+}
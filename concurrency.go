@@ -0,0 +1,53 @@
+package main
+
+import "context"
+
+// handlerSlots limits how many connections are handled at once to
+// MaxConcurrent, a nil handlerSlots handles every connection right away.
+// Either way it keeps the queue depth and handler counts of metrics.
+type handlerSlots chan struct{}
+
+// newHandlerSlots returns the slots for n concurrent handlers, nil when n
+// isn't positive
+func newHandlerSlots(n int) handlerSlots {
+	if n <= 0 {
+		return nil
+	}
+	return make(handlerSlots, n)
+}
+
+// acquire waits for a free slot, counting the connection as queued while it
+// waits. It returns false when ctx ends first.
+func (s handlerSlots) acquire(ctx context.Context) bool {
+	if s != nil {
+		select {
+		case s <- struct{}{}:
+		default:
+			metrics.queuedConns.Add(1)
+			select {
+			case s <- struct{}{}:
+				metrics.queuedConns.Add(-1)
+			case <-ctx.Done():
+				metrics.queuedConns.Add(-1)
+				return false
+			}
+		}
+	}
+
+	running := metrics.runningHandlers.Add(1)
+	for {
+		peak := metrics.peakHandlers.Load()
+		if running <= peak || metrics.peakHandlers.CompareAndSwap(peak, running) {
+			break
+		}
+	}
+	return true
+}
+
+// release frees the slot taken by acquire
+func (s handlerSlots) release() {
+	metrics.runningHandlers.Add(-1)
+	if s != nil {
+		<-s
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMaxConcurrent tests that connections over max_concurrent wait for a
+// handler, and that @status reports them queued while the control socket
+// still answers
+func TestMaxConcurrent(t *testing.T) {
+	release := make(chan struct{})
+	fake := installFakeOp(t, func(inv opInvocation) int {
+		if strings.Contains(strings.Join(inv.args, " "), "item get slow") {
+			<-release
+		}
+		return 0
+	})
+	cfg := loadTestConfig(t, `
+max_concurrent: 1
+allowed_prefixes:
+  - "item get"
+`)
+	cfg.ControlSocketPath = filepath.Join(filepath.Dir(cfg.SocketPath), "control.sock")
+	serveConfig(t, cfg)
+
+	done := make(chan error, 2)
+	send := func(command string) {
+		_, err := sendCommand(t, cfg.SocketPath, command)
+		done <- err
+	}
+	go send("item get slow")
+	waitFor(t, func() bool { return fake.callCount("item get slow") == 1 })
+	go send("item get fast")
+	waitFor(t, func() bool { return metrics.queuedConns.Load() == 1 })
+
+	response, err := sendCommand(t, cfg.ControlSocketPath, "@status")
+	if err != nil || !strings.Contains(response, "queue_depth: 1\n") {
+		t.Errorf("Expected status to report a queued connection, got %q: %v", response, err)
+	}
+	if n := fake.callCount("item get fast"); n != 0 {
+		t.Errorf("Expected the queued command to wait, ran %d times", n)
+	}
+	if peak := metrics.peakHandlers.Load(); peak < 1 {
+		t.Errorf("Expected a peak of at least 1 handler, got %d", peak)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("Expected both commands to finish, got %v", err)
+		}
+	}
+	if n := fake.callCount("item get fast"); n != 1 {
+		t.Errorf("Expected the queued command to run once a handler was free, ran %d times", n)
+	}
+	if n := metrics.queuedConns.Load(); n != 0 {
+		t.Errorf("Expected an empty queue, got %d", n)
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
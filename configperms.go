@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// insecureConfigOK downgrades the refusal of a config file other users can
+// read or write to a warning, set by -insecure-config
+var insecureConfigOK bool
+
+// checkConfigPerms refuses a config file that its group or other users can
+// read or write. The config names the account and the rules guarding it, so
+// only its owner should see or change it.
+func checkConfigPerms(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	perm := fi.Mode().Perm()
+	if perm&0066 == 0 {
+		return nil
+	}
+
+	err = fmt.Errorf("config file %s is accessible by other users (%04o), restrict it with: chmod 600 %s", path, perm, path)
+	if insecureConfigOK {
+		log.Printf("Warning: %v", err)
+		return nil
+	}
+	return err
+}
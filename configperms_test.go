@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestConfigPerms tests that a config other users can read or write is
+// refused, or only warned about with -insecure-config
+func TestConfigPerms(t *testing.T) {
+	path := writeTestConfig(t, "account: \"test-account\"\n")
+	if _, err := loadConfig(path); err != nil {
+		t.Fatalf("Expected a 0600 config to load, got %v", err)
+	}
+
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatalf("Failed to chmod config: %v", err)
+	}
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "chmod 600 "+path) {
+		t.Errorf("Expected a 0644 config to be refused with a chmod hint, got %v", err)
+	}
+
+	prev := insecureConfigOK
+	insecureConfigOK = true
+	t.Cleanup(func() { insecureConfigOK = prev })
+	logs := captureLog(t)
+	if _, err := loadConfig(path); err != nil {
+		t.Errorf("Expected -insecure-config to load the config, got %v", err)
+	}
+	if !strings.Contains(logs.String(), "Warning: config file "+path+" is accessible by other users (0644)") {
+		t.Errorf("Expected a warning, got %q", logs.String())
+	}
+}
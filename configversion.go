@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+)
+
+// currentConfigVersion is the config format this binary reads natively.
+// Configs without a version are version 1.
+//
+// When a setting is renamed or replaced, bump it and map the old setting to
+// the new one in migrateConfig, in the top-level settings and in every
+// profile, as any of them may still use it.
+const currentConfigVersion = 1
+
+// migrateConfig brings cfg up to currentConfigVersion. Versions newer than
+// this binary are refused. Version 1 is the only version so far, so there is
+// nothing to migrate yet.
+func migrateConfig(cfg *Config) error {
+	if cfg.Version < 0 || cfg.Version > currentConfigVersion {
+		return fmt.Errorf("config version %d is not supported, this opfwd reads versions up to %d, upgrade it", cfg.Version, currentConfigVersion)
+	}
+	cfg.Version = currentConfigVersion
+	return nil
+}
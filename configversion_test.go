@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestConfigVersion tests that configs with the current version, or none,
+// load without warnings, and that other versions are refused
+func TestConfigVersion(t *testing.T) {
+	for _, header := range []string{"", "version: 1\n"} {
+		logs := captureLog(t)
+		path := writeTestConfig(t, header+"account: \"test-account\"\nauth_failure_threshold: 3\n")
+		cfg, err := loadConfig(path)
+		if err != nil {
+			t.Fatalf("Failed to load config: %v", err)
+		}
+		if cfg.Version != currentConfigVersion || cfg.AuthFailureThreshold != 3 {
+			t.Errorf("Expected version %d with auth_failure_threshold 3, got version %d with %d", currentConfigVersion, cfg.Version, cfg.AuthFailureThreshold)
+		}
+		if strings.Contains(logs.String(), "Warning") {
+			t.Errorf("Expected no warnings for a current config, got %q", logs.String())
+		}
+	}
+
+	tests := map[string]string{
+		"version: 2\naccount: \"test-account\"\n":  "config version 2 is not supported",
+		"version: -1\naccount: \"test-account\"\n": "config version -1 is not supported",
+	}
+	for config, want := range tests {
+		if _, err := loadConfig(writeTestConfig(t, config)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error %q for %q, got %v", want, config, err)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// controlPrefix starts a control command, which the server handles itself
+// instead of running op
+const controlPrefix = "@"
+
+// controlCommands are the control commands by name, each getting whatever
+// follows its name. They are only accepted from the users ControlCommands
+// allows, the server's own user by default. It is filled in by init, as
+// @reload-rules loads the config that is checked against it.
+var controlCommands map[string]func(logger *log.Logger, arg string) (string, error)
+
+func init() {
+	controlCommands = map[string]func(logger *log.Logger, arg string) (string, error){
+		approveCommand:  approveRequest,
+		"@metrics":      noArg(metricsJSON),
+		"@ping":         noArg(ping),
+		"@reload-rules": noArg(reloadRules),
+		"@status":       noArg(serverStatus),
+	}
+}
+
+// ControlCommandConfig enables a control command for the users in UIDs, or
+// only for the server's user when UIDs is empty
+type ControlCommandConfig struct {
+	Name string `yaml:"name"`
+	UIDs []int  `yaml:"uids"`
+}
+
+// controlCommandUIDs returns the users cfg allows to run the control command
+// name, and false when cfg disables it
+func (cfg *Config) controlCommandUIDs(name string) ([]int, bool) {
+	if cfg.ControlCommands == nil {
+		return []int{os.Geteuid()}, true
+	}
+	for _, c := range cfg.ControlCommands {
+		if c.Name != name {
+			continue
+		}
+		if len(c.UIDs) == 0 {
+			return []int{os.Geteuid()}, true
+		}
+		return c.UIDs, true
+	}
+	return nil, false
+}
+
+// validateControlCommands checks that every enabled control command exists
+// and is listed once
+func validateControlCommands(commands []ControlCommandConfig) error {
+	seen := make(map[string]bool)
+	for i, c := range commands {
+		if _, ok := controlCommands[c.Name]; !ok {
+			return fmt.Errorf("control_commands[%d]: unknown control command %q", i, c.Name)
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("control_commands[%d]: %s is listed twice", i, c.Name)
+		}
+		seen[c.Name] = true
+	}
+	return nil
+}
+
+// noArg adapts a control command taking no argument
+func noArg(run func(logger *log.Logger) (string, error)) func(logger *log.Logger, arg string) (string, error) {
+	return func(logger *log.Logger, arg string) (string, error) {
+		if arg != "" {
+			return "", fmt.Errorf("unexpected argument %q", arg)
+		}
+		return run(logger)
+	}
+}
+
+// loadedConfigPath is the config file the server was started with
+var loadedConfigPath string
+
+// serverStarted is when the server started accepting connections
+var serverStarted time.Time
+
+// activeListeners are the listeners of the running server
+var activeListeners struct {
+	mu   sync.Mutex
+	list []*serverListener
+}
+
+// isControlCommand reports whether a command is meant for the server itself
+func isControlCommand(input string) bool {
+	return strings.HasPrefix(input, controlPrefix) && !isBundleCommand(input) && !isAliasCommand(input)
+}
+
+// handleControl runs a control command and writes its result to w
+func handleControl(conn net.Conn, resp *response, input string, logger *log.Logger) {
+	reply := func(format string, args ...any) {
+		if _, err := fmt.Fprintf(resp, format, args...); err != nil {
+			logger.Printf("Error writing response: %v", err)
+		}
+	}
+	fail := func(status int, format string, args ...any) {
+		if err := resp.fail(status, format, args...); err != nil {
+			logger.Printf("Error writing response: %v", err)
+		}
+	}
+
+	uid, err := peerUID(conn)
+	if err != nil {
+		logger.Printf("Control command %s refused, could not identify the client: %v", input, err)
+		fail(exitPolicy, "Error: Control commands need the client's credentials: %v\n", err)
+		return
+	}
+
+	name, arg, _ := strings.Cut(input, " ")
+	run, ok := controlCommands[name]
+	if !ok {
+		logger.Printf("Unknown control command: %s", input)
+		fail(exitPolicy, "Error: Unknown control command: %s\n", input)
+		return
+	}
+
+	uids, enabled := config.controlCommandUIDs(name)
+	if !enabled {
+		logger.Printf("Control command %s refused, it is disabled", input)
+		fail(exitPolicy, "Error: Control command %s is disabled on this server\n", name)
+		return
+	}
+	if !slices.Contains(uids, uid) {
+		logger.Printf("Control command %s refused for uid %d", input, uid)
+		if config.ControlCommands == nil {
+			fail(exitPolicy, "Error: Control commands are only accepted from the server's user\n")
+		} else {
+			fail(exitPolicy, "Error: Control command %s is not allowed for uid %d\n", name, uid)
+		}
+		return
+	}
+
+	logger.Printf("Running control command: %s", input)
+	result, err := run(logger, strings.TrimSpace(arg))
+	if err != nil {
+		logger.Printf("Control command %s failed: %v", input, err)
+		fail(exitServerError, "Error: %v\n", err)
+		return
+	}
+	reply("%s", result)
+}
+
+// ping answers that the server is up and handling commands
+func ping(logger *log.Logger) (string, error) {
+	return "pong\n", nil
+}
+
+// reloadRules re-reads the config file and swaps in the allow rules of every
+// listener, leaving the sockets, account and other settings as they are
+func reloadRules(logger *log.Logger) (string, error) {
+	if loadedConfigPath == "" {
+		return "", errors.New("the server was not started from a config file")
+	}
+	cfg, err := loadConfig(loadedConfigPath)
+	if err != nil {
+		return "", fmt.Errorf("reloading rules: %w", err)
+	}
+
+	activeListeners.mu.Lock()
+	defer activeListeners.mu.Unlock()
+
+	var summary strings.Builder
+	for _, l := range activeListeners.list {
+		if l.control {
+			continue
+		}
+		rules := cfg.rulesFor(l.path)
+		if rules == nil {
+			fmt.Fprintf(&summary, "%s: not in config, rules unchanged\n", l.path)
+			continue
+		}
+
+		l.rules.Store(rules)
+		logger.Printf("Reloaded rules for %s", l.path)
+		fmt.Fprintf(&summary, "%s: %d exact, %d prefix, %d glob, %d template, %d subcommand\n", l.path,
+			len(rules.AllowedCommands), len(rules.AllowedPrefixes), len(rules.AllowedGlobs), len(rules.AllowedTemplates), len(rules.AllowedSubcommands))
+	}
+	return summary.String(), nil
+}
+
+// serverStatus reports the version, uptime, sockets and request counters of
+// the running server
+func serverStatus(logger *log.Logger) (string, error) {
+	activeListeners.mu.Lock()
+	var sockets []string
+	for _, l := range activeListeners.list {
+		sockets = append(sockets, config.logPath(l.path))
+	}
+	activeListeners.mu.Unlock()
+
+	snap := metrics.snapshot()
+	var status strings.Builder
+	fmt.Fprintf(&status, "version: %s\n", version)
+	fmt.Fprintf(&status, "uptime: %s\n", time.Since(serverStarted).Round(time.Second))
+	fmt.Fprintf(&status, "account: %s\n", maskAccount(config.Account))
+	if id, err := opWhoami(logger); err != nil {
+		logger.Printf("Could not tell who the account is signed in as: %v", err)
+		fmt.Fprintf(&status, "whoami: %v\n", err)
+	} else {
+		fmt.Fprintf(&status, "whoami: %s\n", id)
+	}
+	fmt.Fprintf(&status, "sockets: %s\n", strings.Join(sockets, ", "))
+	fmt.Fprintf(&status, "active_connections: %d\n", snap.ActiveConnections)
+	fmt.Fprintf(&status, "queue_depth: %d\n", snap.QueueDepth)
+	fmt.Fprintf(&status, "peak_handlers: %d\n", snap.PeakHandlers)
+	fmt.Fprintf(&status, "requests: allowed=%d denied=%d rate_limited=%d\n",
+		snap.Requests.Allowed, snap.Requests.Denied, snap.Requests.RateLimited)
+	fmt.Fprintf(&status, "accept_errors: %d\n", snap.AcceptErrors)
+	return status.String(), nil
+}
+
+// handleReloadSignal reopens the log file and reloads the rules each time the
+// process receives SIGHUP, until ctx is cancelled
+func handleReloadSignal(ctx context.Context) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(sigChan)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigChan:
+				reopenLogFile()
+				if summary, err := reloadRules(log.Default()); err != nil {
+					log.Printf("Reloading rules on SIGHUP failed, keeping the old rules: %v", err)
+				} else {
+					log.Printf("Reloaded rules on SIGHUP: %s", strings.ReplaceAll(strings.TrimSpace(summary), "\n", "; "))
+				}
+			}
+		}
+	}()
+}
+
+// rulesFor returns the rules cfg serves on the socket at path, nil when cfg
+// has no such socket
+func (cfg *Config) rulesFor(path string) *Rules {
+	if cfg.SocketPath == path {
+		return &cfg.Rules
+	}
+	for i := range cfg.Listeners {
+		if cfg.Listeners[i].Path == path {
+			return &cfg.Listeners[i].Rules
+		}
+	}
+	return nil
+}
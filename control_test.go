@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestReloadRules tests that @reload-rules swaps in the rules from disk
+func TestReloadRules(t *testing.T) {
+	installFakeOp(t, nil)
+	env := setupTestEnvironment(t)
+	base := fmt.Sprintf("account: %q\nsocket_path: %q\n", env.account, env.socketPath)
+
+	path := writeTestConfig(t, base+"allowed_prefixes:\n  - \"item get\"\n")
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	loadedConfigPath = path
+	t.Cleanup(func() { loadedConfigPath = "" })
+	serveConfig(t, cfg)
+
+	response, err := sendCommand(t, env.socketPath, "vault list")
+	if err != nil || !strings.Contains(response, "Command not allowed") {
+		t.Fatalf("Expected vault list to be denied before the reload, got %q: %v", response, err)
+	}
+
+	// Push new rules, including an account change that must not apply
+	rules := "account: \"other-account\"\nsocket_path: " + fmt.Sprintf("%q", env.socketPath) + "\n" +
+		"allowed_prefixes:\n  - \"item get\"\n  - \"vault list\"\nallowed_commands:\n  - \"whoami\"\n"
+	if err := os.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatalf("Failed to update config: %v", err)
+	}
+
+	response, err = sendCommand(t, env.socketPath, "@reload-rules")
+	if err != nil {
+		t.Fatalf("Failed to send control command: %v", err)
+	}
+	if want := env.socketPath + ": 1 exact, 2 prefix, 0 glob, 0 template, 0 subcommand\n"; response != want {
+		t.Errorf("Expected summary %q, got %q", want, response)
+	}
+
+	response, err = sendCommand(t, env.socketPath, "vault list")
+	if err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if want := "op --account test-account vault list\n"; response != want {
+		t.Errorf("Expected newly allowed command to run on the original account, got %q", response)
+	}
+}
+
+// TestReloadRulesInvalidConfig tests that a broken config leaves the rules in place
+func TestReloadRulesInvalidConfig(t *testing.T) {
+	installFakeOp(t, nil)
+	env := setupTestEnvironment(t)
+	path := writeTestConfig(t, fmt.Sprintf("account: %q\nsocket_path: %q\nallowed_prefixes:\n  - \"item get\"\n", env.account, env.socketPath))
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	loadedConfigPath = path
+	t.Cleanup(func() { loadedConfigPath = "" })
+	serveConfig(t, cfg)
+
+	if err := os.WriteFile(path, []byte("allowed_globs: [\"[\"]\n"), 0600); err != nil {
+		t.Fatalf("Failed to update config: %v", err)
+	}
+	response, err := sendCommand(t, env.socketPath, "@reload-rules")
+	if err != nil || !strings.HasPrefix(response, "Error: reloading rules") {
+		t.Errorf("Expected reload error, got %q: %v", response, err)
+	}
+
+	response, err = sendCommand(t, env.socketPath, "item get foo")
+	if err != nil || response != "op --account test-account item get foo\n" {
+		t.Errorf("Expected the old rules to stay in place, got %q: %v", response, err)
+	}
+}
+
+// TestControlCommandsPolicy tests that control_commands only enables the
+// listed control commands, each for its own users
+func TestControlCommandsPolicy(t *testing.T) {
+	installFakeOp(t, nil)
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+control_commands:
+  - name: "@ping"
+  - name: "@reload-rules"
+    uids: [%d]
+`, os.Geteuid()+1))
+	serveConfig(t, cfg)
+
+	tests := map[string]string{
+		"@ping":         "pong\n",
+		"@status":       "Error: Control command @status is disabled on this server\n",
+		"@reload-rules": fmt.Sprintf("Error: Control command @reload-rules is not allowed for uid %d\n", os.Geteuid()),
+		"@shutdown":     "Error: Unknown control command: @shutdown\n",
+	}
+	for command, want := range tests {
+		response, err := sendCommand(t, cfg.SocketPath, command)
+		if err != nil || response != want {
+			t.Errorf("%s: expected %q, got %q: %v", command, want, response, err)
+		}
+	}
+
+	path := writeTestConfig(t, "account: \"test-account\"\ncontrol_commands: [{name: \"@shutdown\"}]\n")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "unknown control command") {
+		t.Errorf("Expected an unknown control command error, got %v", err)
+	}
+}
+
+// TestMetricsJSON tests that @metrics reports the request counters as JSON,
+// matching what @status reports
+func TestMetricsJSON(t *testing.T) {
+	installFakeOp(t, nil)
+	cfg := loadTestConfig(t, "allowed_prefixes:\n  - \"item get\"\n")
+	serveConfig(t, cfg)
+
+	before := metrics.snapshot()
+	for _, command := range []string{"item get foo", "item get bar", "vault list"} {
+		if _, err := sendCommand(t, cfg.SocketPath, command); err != nil {
+			t.Fatalf("Failed to send %s: %v", command, err)
+		}
+	}
+
+	response, err := sendCommand(t, cfg.SocketPath, "@metrics")
+	if err != nil {
+		t.Fatalf("Failed to send @metrics: %v", err)
+	}
+	var got metricsSnapshot
+	if err := json.Unmarshal([]byte(response), &got); err != nil {
+		t.Fatalf("Expected a JSON object, got %q: %v", response, err)
+	}
+	if got.Requests.Allowed-before.Requests.Allowed != 2 || got.Requests.Denied-before.Requests.Denied != 1 {
+		t.Errorf("Expected 2 more allowed and 1 more denied requests, got %+v after %+v", got.Requests, before.Requests)
+	}
+	if r := got.Requests; r.Total != r.Allowed+r.Denied+r.RateLimited {
+		t.Errorf("Expected the total to sum up the decisions, got %+v", r)
+	}
+	if !strings.Contains(response, `"requests":{"total":`) || !strings.HasSuffix(response, "}\n") {
+		t.Errorf("Expected the counters under requests on a single line, got %q", response)
+	}
+
+	status, err := sendCommand(t, cfg.SocketPath, "@status")
+	if err != nil {
+		t.Fatalf("Failed to send @status: %v", err)
+	}
+	want := fmt.Sprintf("requests: allowed=%d denied=%d rate_limited=%d\n", got.Requests.Allowed, got.Requests.Denied, got.Requests.RateLimited)
+	if !strings.Contains(status, want) {
+		t.Errorf("Expected @status to report %q, got %q", want, status)
+	}
+}
+
+// TestUnknownControlCommand tests that unknown control commands are refused
+// and never reach op
+func TestUnknownControlCommand(t *testing.T) {
+	fake := installFakeOp(t, nil)
+	cfg := loadTestConfig(t, `
+allowed_globs:
+  - "*"
+`)
+	serveConfig(t, cfg)
+
+	response, err := sendCommand(t, cfg.SocketPath, "@shutdown")
+	if err != nil || response != "Error: Unknown control command: @shutdown\n" {
+		t.Errorf("Expected unknown control command error, got %q: %v", response, err)
+	}
+	if len(fake.calls) != 0 {
+		t.Errorf("Expected op not to run, got %v", fake.calls)
+	}
+}
+
+// TestPeerUID tests reading the credentials of a socket peer
+func TestPeerUID(t *testing.T) {
+	env := setupTestEnvironment(t)
+	listener, err := net.Listen("unix", env.socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		if conn, err := net.Dial("unix", env.socketPath); err == nil {
+			defer conn.Close()
+			conn.Read(make([]byte, 1))
+		}
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer conn.Close()
+
+	uid, err := peerUID(conn)
+	if err != nil {
+		t.Fatalf("Failed to read peer credentials: %v", err)
+	}
+	if uid != os.Geteuid() {
+		t.Errorf("Expected peer uid %d, got %d", os.Geteuid(), uid)
+	}
+	if pid, err := peerPID(conn); err != nil || pid != os.Getpid() {
+		t.Errorf("Expected peer pid %d, got %d: %v", os.Getpid(), pid, err)
+	}
+}
+
+// TestControlSocket tests that status queries go to the control socket, which
+// refuses op commands, while the command socket refuses control commands
+func TestControlSocket(t *testing.T) {
+	installFakeOp(t, nil)
+	cfg := loadTestConfig(t, "allowed_prefixes:\n  - \"item get\"\n")
+	cfg.ControlSocketPath = filepath.Join(filepath.Dir(cfg.SocketPath), "control.sock")
+	serveConfig(t, cfg)
+
+	fi, err := os.Stat(cfg.ControlSocketPath)
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("Expected the control socket with mode 0600, got %v: %v", fi, err)
+	}
+
+	if _, err := sendCommand(t, cfg.SocketPath, "item get foo"); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	response, err := sendCommand(t, cfg.ControlSocketPath, "@status")
+	if err != nil {
+		t.Fatalf("Failed to send status query: %v", err)
+	}
+	for _, want := range []string{"version: " + version + "\n", "account: te***\n", "requests: allowed=", "active_connections: 1\n", cfg.ControlSocketPath} {
+		if !strings.Contains(response, want) {
+			t.Errorf("Expected status to contain %q, got %q", want, response)
+		}
+	}
+
+	response, err = sendCommand(t, cfg.ControlSocketPath, "item get foo")
+	if err != nil || !strings.Contains(response, "Only control commands are accepted on the control socket") {
+		t.Errorf("Expected op commands to be refused on the control socket, got %q: %v", response, err)
+	}
+	response, err = sendCommand(t, cfg.SocketPath, "@status")
+	if err != nil || !strings.Contains(response, "Control commands are only accepted on the control socket") {
+		t.Errorf("Expected control commands to be refused on the command socket, got %q: %v", response, err)
+	}
+}
+
+// TestControlSocketPathConflict tests that the control socket can't share a
+// path with a command socket
+func TestControlSocketPathConflict(t *testing.T) {
+	path := writeTestConfig(t, "account: \"test-account\"\nsocket_path: \"/tmp/opfwd-a.sock\"\ncontrol_socket_path: \"/tmp/opfwd-a.sock\"\n")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "already used as socket_path") {
+		t.Errorf("Expected a path conflict error, got %v", err)
+	}
+}
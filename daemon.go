@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// daemonStartTimeout is how long -daemonize waits for the detached server to
+// write its PID file before leaving it to start on its own
+const daemonStartTimeout = 10 * time.Second
+
+// daemonize starts the server again with args, minus -daemonize, detached
+// from the terminal and with its output going to the log file of the config.
+// It returns the exit code for the foreground process. With a PID file configured it waits for the server
+// to write it, so a server failing at startup is reported here.
+func daemonize(configPath string, args []string) int {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+	if err := checkPidFile(cfg.PidFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start: %v\n", err)
+		return 1
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to find the opfwd binary: %v\n", err)
+		return 1
+	}
+	cmd, err := startDetached(exe, daemonArgs(args), cfg.LogFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start server in the background: %v\n", err)
+		return 1
+	}
+	pid := cmd.Process.Pid
+
+	if cfg.PidFile != "" {
+		if err := waitForPidFile(cmd, cfg.PidFile, daemonStartTimeout); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start server in the background: %v\n", err)
+			return 1
+		}
+	}
+	fmt.Printf("opfwd server running in the background (pid %d)\n", pid)
+	return 0
+}
+
+// daemonArgs returns the command line args without -daemonize, for the
+// detached server
+func daemonArgs(args []string) []string {
+	var out []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") && flagName(strings.TrimLeft(arg, "-")) == "daemonize" {
+			continue
+		}
+		out = append(out, arg)
+	}
+	return out
+}
+
+// startDetached starts exe in a session of its own, reading from /dev/null
+// and writing to logPath, or /dev/null when empty
+func startDetached(exe string, args []string, logPath string) (*exec.Cmd, error) {
+	stdin, err := os.Open(os.DevNull)
+	if err != nil {
+		return nil, err
+	}
+	defer stdin.Close()
+
+	outPath := logPath
+	if outPath == "" {
+		outPath = os.DevNull
+	}
+	out, err := os.OpenFile(outPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening log file: %w", err)
+	}
+	defer out.Close()
+
+	cmd := exec.Command(exe, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// waitForPidFile waits until the server started as cmd has written its PID
+// to path, failing when it exits first or doesn't within timeout
+func waitForPidFile(cmd *exec.Cmd, path string, timeout time.Duration) error {
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if pid, err := readPidFile(path); err == nil && pid == cmd.Process.Pid {
+			return nil
+		}
+		select {
+		case err := <-exited:
+			return fmt.Errorf("server exited during startup (%v), see its log", err)
+		case <-deadline.C:
+			return fmt.Errorf("server did not write %s within %s", path, timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// pidFile is the PID file written by a running server
+type pidFile struct {
+	path string
+}
+
+// writePidFile records the PID of the server in path, refusing when the
+// file names a process that is still running
+func writePidFile(path string) (*pidFile, error) {
+	if err := checkPidFile(path); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return nil, fmt.Errorf("writing pid file: %w", err)
+	}
+	return &pidFile{path: path}, nil
+}
+
+// remove deletes the PID file, unless another server has taken it over
+func (p *pidFile) remove() {
+	if pid, err := readPidFile(p.path); err == nil && pid == os.Getpid() {
+		os.Remove(p.path)
+	}
+}
+
+// checkPidFile fails when the PID file at path names a running process. A
+// missing file, or one left behind by a server that is gone, is fine.
+func checkPidFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading pid file: %w", err)
+	}
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && pid > 0 && processAlive(pid) {
+		return fmt.Errorf("another opfwd server is already running (pid %d, pid file %s)", pid, path)
+	}
+	return nil
+}
+
+// readPidFile returns the PID recorded in path
+func readPidFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid pid file %s", path)
+	}
+	return pid, nil
+}
+
+// processAlive reports whether a process with the given PID exists
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// daemonTestConfigEnv passes the config of TestDaemonize to the server it
+// starts in the background, a copy of the test binary
+const daemonTestConfigEnv = "OPFWD_TEST_DAEMON_CONFIG"
+
+// TestDaemonChild is the server started by TestDaemonize, skipped otherwise
+func TestDaemonChild(t *testing.T) {
+	path := os.Getenv(daemonTestConfigEnv)
+	if path == "" {
+		t.Skip("only runs as the server of TestDaemonize")
+	}
+	os.Exit(runServer(path, serverOptions{}))
+}
+
+// TestDaemonize tests that -daemonize leaves a server running with its PID
+// file written, refuses to start a second one and that the PID file is
+// removed when the server shuts down
+func TestDaemonize(t *testing.T) {
+	installFakeOpScript(t, fakeOpScript)
+	dir, err := os.MkdirTemp("", "opfwd-daemon-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+
+	pidPath := filepath.Join(dir, "opfwd.pid")
+	path := writeTestConfig(t, "account: \"test-account\"\n"+
+		"socket_path: \""+filepath.Join(dir, "opfwd.sock")+"\"\n"+
+		"log_file: \""+filepath.Join(dir, "opfwd.log")+"\"\n"+
+		"pid_file: \""+pidPath+"\"\n"+
+		"allowed_commands: [\"whoami\"]\n")
+	t.Setenv(daemonTestConfigEnv, path)
+
+	args := []string{"-test.run=^TestDaemonChild$", "-daemonize"}
+	if code := daemonize(path, args); code != 0 {
+		log, _ := os.ReadFile(filepath.Join(dir, "opfwd.log"))
+		t.Fatalf("daemonize exited with %d, server log:\n%s", code, log)
+	}
+	pid, err := readPidFile(pidPath)
+	if err != nil || pid == os.Getpid() || !processAlive(pid) {
+		t.Fatalf("Expected the pid file to name the running server, got %d: %v", pid, err)
+	}
+	t.Cleanup(func() { _ = syscall.Kill(pid, syscall.SIGKILL) })
+
+	if code := daemonize(path, args); code == 0 {
+		t.Errorf("Expected a second server to be refused while the first runs")
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		t.Fatalf("Failed to stop the server: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := os.Stat(pidPath); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the pid file to be removed on shutdown")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// A pid file left behind by a server that is gone doesn't block a start
+	if err := os.WriteFile(pidPath, []byte("999999999\n"), 0644); err != nil {
+		t.Fatalf("Failed to write pid file: %v", err)
+	}
+	if err := checkPidFile(pidPath); err != nil {
+		t.Errorf("Expected a stale pid file to be ignored, got %v", err)
+	}
+}
+
+// TestDaemonArgs tests that the detached server isn't asked to daemonize again
+func TestDaemonArgs(t *testing.T) {
+	got := daemonArgs([]string{"-server", "--daemonize", "-config", "c.yaml", "-daemonize=true"})
+	if want := []string{"-server", "-config", "c.yaml"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("daemonArgs() = %q, want %q", got, want)
+	}
+}
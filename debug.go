@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+)
+
+// handleDebugSignal logs a dump of the server state each time the process
+// receives SIGUSR1, until ctx is cancelled
+func handleDebugSignal(ctx context.Context) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1)
+
+	go func() {
+		defer signal.Stop(sigChan)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigChan:
+				logDebugDump()
+			}
+		}
+	}()
+}
+
+// logDebugDump logs a summary of the config and the current server counters.
+// It only reads atomics and the loaded config, so it is safe to call at any time.
+func logDebugDump() {
+	log.Printf("Debug dump: account=%s socket=%s listeners=%d op_path=%s no_execute=%v",
+		config.Account, config.SocketPath, len(config.Listeners), opBinary(), config.NoExecute)
+	log.Printf("Debug dump: active connections=%d queued=%d peak handlers=%d goroutines=%d",
+		metrics.activeConns.Load(), metrics.queuedConns.Load(), metrics.peakHandlers.Load(), runtime.NumGoroutine())
+	log.Printf("Debug dump: requests allowed=%d denied=%d rate_limited=%d accept_errors=%d",
+		metrics.allowed.Load(), metrics.denied.Load(), metrics.rateLimited.Load(), metrics.acceptErrors.Load())
+}
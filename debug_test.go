@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestDebugDumpOnSIGUSR1 tests that SIGUSR1 logs the server state, repeatedly
+func TestDebugDumpOnSIGUSR1(t *testing.T) {
+	installFakeOp(t, nil)
+	logs := captureLog(t)
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	if _, err := sendCommand(t, cfg.SocketPath, "item get foo"); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleDebugSignal(ctx)
+
+	for i := 1; i <= 2; i++ {
+		if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+			t.Fatalf("Failed to send SIGUSR1: %v", err)
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for strings.Count(logs.String(), "Debug dump: active connections=") < i {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected debug dump %d in logs, got:\n%s", i, logs.String())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	out := logs.String()
+	for _, want := range []string{"Debug dump: account=test-account socket=" + cfg.SocketPath, "goroutines=", "requests allowed="} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in debug dump, got:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "requests allowed=0 ") {
+		t.Errorf("Expected the allowed request to be counted, got:\n%s", out)
+	}
+}
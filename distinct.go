@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultDistinctWindow is the window MaxDistinctSecrets applies to when
+// DistinctWindow is unset
+const defaultDistinctWindow = time.Hour
+
+// distinctSecrets holds, for each user, when each distinct command was last
+// allowed within the window
+var distinctSecrets = struct {
+	mu   sync.Mutex
+	seen map[int]map[string]time.Time
+}{seen: make(map[int]map[string]time.Time)}
+
+// distinctWindow returns the window the distinct secrets of a user are
+// counted over
+func (cfg *Config) distinctWindow() time.Duration {
+	if cfg.DistinctWindow > 0 {
+		return cfg.DistinctWindow
+	}
+	return defaultDistinctWindow
+}
+
+// limitDistinct checks commands, all run for input, against
+// MaxDistinctSecrets for the client on conn and counts them when they fit. It
+// fails the response and returns the decision to record when they don't, or
+// when the client can't be identified.
+func limitDistinct(conn net.Conn, out *response, input string, commands []string, logger *log.Logger) (string, bool) {
+	if config.MaxDistinctSecrets <= 0 {
+		return "", true
+	}
+	fail := func(status int, format string, args ...any) {
+		if err := out.fail(status, format, args...); err != nil {
+			logger.Printf("Error writing response: %v", err)
+		}
+	}
+
+	uid, err := peerUID(conn)
+	if err != nil {
+		logger.Printf("Command refused, could not identify the client for max_distinct_secrets: %v", err)
+		fail(exitPolicy, "Error: Command not allowed, the server limits secrets per user but could not identify the client: %s\n", input)
+		return "denied", false
+	}
+	window := config.distinctWindow()
+	if !allowDistinctAll(uid, commands, config.MaxDistinctSecrets, window, now()) {
+		logger.Printf("Uid %d exceeded %d distinct secrets in %s: %s", uid, config.MaxDistinctSecrets, window, input)
+		fail(exitTempFail, "Error: Too many distinct secrets requested, at most %d are allowed per %s: %s\n", config.MaxDistinctSecrets, window, input)
+		return "rate_limited", false
+	}
+	return "", true
+}
+
+// allowDistinct reports whether uid may run command at t without going over
+// max distinct commands within window, and if so counts it. Commands the
+// user already ran within the window are always allowed again.
+func allowDistinct(uid int, command string, max int, window time.Duration, t time.Time) bool {
+	return allowDistinctAll(uid, []string{command}, max, window, t)
+}
+
+// allowDistinctAll is allowDistinct for several commands run together, which
+// are counted only when all of them fit
+func allowDistinctAll(uid int, commands []string, max int, window time.Duration, t time.Time) bool {
+	distinctSecrets.mu.Lock()
+	defer distinctSecrets.mu.Unlock()
+
+	// Forget the commands that have left the window
+	seen := distinctSecrets.seen[uid]
+	cutoff := t.Add(-window)
+	for cmd, last := range seen {
+		if !last.After(cutoff) {
+			delete(seen, cmd)
+		}
+	}
+
+	keys := make(map[string]bool, len(commands))
+	added := 0
+	for _, command := range commands {
+		key := strings.Join(strings.Fields(command), " ")
+		if _, ok := seen[key]; !ok && !keys[key] {
+			added++
+		}
+		keys[key] = true
+	}
+	if added > 0 && len(seen)+added > max {
+		return false
+	}
+	if seen == nil {
+		seen = make(map[string]time.Time)
+		distinctSecrets.seen[uid] = seen
+	}
+	for key := range keys {
+		seen[key] = t
+	}
+	return true
+}
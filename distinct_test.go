@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetDistinctSecrets forgets the secrets counted so far, before and after
+// the test
+func resetDistinctSecrets(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		distinctSecrets.mu.Lock()
+		defer distinctSecrets.mu.Unlock()
+		clear(distinctSecrets.seen)
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// TestMaxDistinctSecrets tests that a client pulling one secret more than
+// max_distinct_secrets is refused, while secrets it already read still are
+// served
+func TestMaxDistinctSecrets(t *testing.T) {
+	installFakeOp(t, nil)
+	resetDistinctSecrets(t)
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "read op://"
+max_distinct_secrets: 2
+distinct_window: 1h
+`)
+	serveConfig(t, cfg)
+
+	tests := []struct {
+		command string
+		allowed bool
+	}{
+		{"read op://App/db/password", true},
+		{"read op://App/api/token", true},
+		{"read op://App/db/password", true},
+		{"read  op://App/api/token", true},
+		{"read op://App/ssh/key", false},
+		{"read op://App/api/token", true},
+	}
+	for _, tt := range tests {
+		response, err := sendCommand(t, cfg.SocketPath, tt.command)
+		if err != nil {
+			t.Fatalf("Failed to send %s: %v", tt.command, err)
+		}
+		refused := strings.HasPrefix(response, "Error: Too many distinct secrets requested, at most 2 are allowed per 1h0m0s")
+		if refused == tt.allowed {
+			t.Errorf("%s: expected allowed=%v, got %q", tt.command, tt.allowed, response)
+		}
+	}
+}
+
+// TestMaxDistinctSecretsBundle tests that every reference of a bundle counts
+// against max_distinct_secrets, and that a bundle going over it is refused
+// before any of its references is read or counted
+func TestMaxDistinctSecretsBundle(t *testing.T) {
+	fake := installFakeOp(t, nil)
+	resetDistinctSecrets(t)
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "read op://"
+max_distinct_secrets: 3
+bundles:
+  small:
+    - "op://App/db/password"
+    - "op://App/api/token"
+  large:
+    - "op://App/db/password"
+    - "op://App/ssh/key"
+    - "op://App/tls/cert"
+`)
+	serveConfig(t, cfg)
+
+	response, err := sendCommand(t, cfg.SocketPath, "@bundle small")
+	if err != nil || strings.HasPrefix(response, "Error") {
+		t.Fatalf("Expected the first bundle to be read, got %q: %v", response, err)
+	}
+	response, err = sendCommand(t, cfg.SocketPath, "@bundle large")
+	if want := "Error: Too many distinct secrets requested, at most 3 are allowed per 1h0m0s: @bundle large\n"; err != nil || response != want {
+		t.Errorf("Expected %q, got %q: %v", want, response, err)
+	}
+	if n := fake.callCount("op://App/ssh/key"); n != 0 {
+		t.Errorf("Expected no reference of the refused bundle to be read, got %d reads", n)
+	}
+
+	// Only the references of the first bundle were counted
+	response, err = sendCommand(t, cfg.SocketPath, "read op://App/ssh/key")
+	if err != nil || strings.HasPrefix(response, "Error") {
+		t.Errorf("Expected a third secret to be allowed, got %q: %v", response, err)
+	}
+	response, err = sendCommand(t, cfg.SocketPath, "read op://App/tls/cert")
+	if err != nil || !strings.HasPrefix(response, "Error: Too many distinct secrets requested") {
+		t.Errorf("Expected a fourth secret to be refused, got %q: %v", response, err)
+	}
+}
+
+// TestAllowDistinctWindow tests that the count of distinct commands is kept
+// per user and drops as the window slides past them
+func TestAllowDistinctWindow(t *testing.T) {
+	resetDistinctSecrets(t)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	window := 10 * time.Minute
+
+	if !allowDistinct(1000, "read op://a", 1, window, start) {
+		t.Fatal("Expected the first secret to be allowed")
+	}
+	if allowDistinct(1000, "read op://b", 1, window, start.Add(time.Minute)) {
+		t.Error("Expected a second secret within the window to be refused")
+	}
+	if !allowDistinct(1001, "read op://b", 1, window, start.Add(time.Minute)) {
+		t.Error("Expected another user to have a count of their own")
+	}
+	if !allowDistinct(1000, "read op://b", 1, window, start.Add(window+time.Second)) {
+		t.Error("Expected a second secret to be allowed once the first left the window")
+	}
+	if allowDistinct(1000, "read op://a", 1, window, start.Add(window+2*time.Second)) {
+		t.Error("Expected the first secret to count as new again")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// errSkipped marks a doctor check that couldn't run because an earlier one failed
+var errSkipped = errors.New("skipped")
+
+// doctorCheck is a single diagnostic run by `opfwd doctor`
+type doctorCheck struct {
+	name string
+
+	// critical checks make doctor exit non-zero when they fail
+	critical bool
+
+	// run returns a short detail on success
+	run func() (string, error)
+}
+
+// runDoctor is the entry point of the doctor subcommand
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to the config file")
+	fs.StringVar(&configProfile, "profile", "", "Use this profile of the config file")
+	_ = fs.Parse(args)
+
+	if *configPath == "" {
+		defaultPath, err := getDefaultConfigPath()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get default config path: %v\n", err)
+			return 1
+		}
+		*configPath = defaultPath
+	}
+
+	return doctor(os.Stdout, *configPath)
+}
+
+// doctor runs every setup check against the config at configPath, printing a
+// line per check and an overall verdict. It returns 1 if a critical check failed.
+func doctor(w io.Writer, configPath string) int {
+	var cfg Config
+	var cfgErr error = errSkipped
+
+	checks := []doctorCheck{
+		{name: "config parses", critical: true, run: func() (string, error) {
+			cfg, cfgErr = loadConfig(configPath)
+			if cfgErr != nil {
+				return "", cfgErr
+			}
+			// The op checks run the binary the server would, op_path included
+			config = cfg
+			return configPath, nil
+		}},
+		{name: "op installed", critical: true, run: checkOpInstalled},
+		{name: "socket directory", run: func() (string, error) {
+			if cfgErr != nil {
+				return "", errSkipped
+			}
+			return checkSocketDir(cfg.SocketPath)
+		}},
+		{name: "server listening", run: func() (string, error) {
+			if cfgErr != nil {
+				return "", errSkipped
+			}
+			return checkServerListening(cfg.SocketPath)
+		}},
+		{name: "account authenticated", run: func() (string, error) {
+			if cfgErr != nil {
+				return "", errSkipped
+			}
+			return checkAccountAuthenticated(cfg.Account, cfg.OpConfigDir)
+		}},
+	}
+
+	failed, criticalFailed := 0, false
+	for _, check := range checks {
+		detail, err := check.run()
+		switch {
+		case errors.Is(err, errSkipped):
+			fmt.Fprintf(w, "[SKIP] %s\n", check.name)
+		case err != nil:
+			failed++
+			if check.critical {
+				criticalFailed = true
+			}
+			fmt.Fprintf(w, "[FAIL] %s: %v\n", check.name, err)
+		default:
+			fmt.Fprintf(w, "[PASS] %s: %s\n", check.name, detail)
+		}
+	}
+
+	switch {
+	case criticalFailed:
+		fmt.Fprintf(w, "\n%d check(s) failed, opfwd will not work until the critical ones are fixed\n", failed)
+		return 1
+	case failed > 0:
+		fmt.Fprintf(w, "\n%d check(s) failed, opfwd may not work as expected\n", failed)
+	default:
+		fmt.Fprintln(w, "\nAll checks passed")
+	}
+	return 0
+}
+
+// checkOpInstalled checks that the op the server runs, op_path or op in
+// PATH, is there and reports its version
+func checkOpInstalled() (string, error) {
+	path, err := exec.LookPath(opBinary())
+	if err != nil {
+		if config.OpPath != "" {
+			return "", fmt.Errorf("op_path %s not found: %w", config.OpPath, err)
+		}
+		return "", fmt.Errorf("op not found in PATH: %w", err)
+	}
+
+	var output bytes.Buffer
+	exitCode, err := opRunner(context.Background(), opInvocation{args: []string{"--version"}, stdout: &output})
+	if err == nil && exitCode != 0 {
+		err = fmt.Errorf("exit status %d", exitCode)
+	}
+	if err != nil {
+		return "", fmt.Errorf("running op --version: %w", err)
+	}
+
+	return fmt.Sprintf("%s (version %s)", path, strings.TrimSpace(output.String())), nil
+}
+
+// checkSocketDir checks that the socket directory isn't writable by other users
+func checkSocketDir(socketPath string) (string, error) {
+	if isAbstractSocket(socketPath) {
+		return socketPath + " is an abstract socket, no directory needed", nil
+	}
+
+	dir := filepath.Dir(socketPath)
+	info, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return dir + " does not exist yet and will be created", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	if perm := info.Mode().Perm(); perm&0022 != 0 {
+		return "", fmt.Errorf("%s has permissions %04o, it should not be writable by group or others (chmod 700 %s)", dir, perm, dir)
+	}
+	return fmt.Sprintf("%s (%04o)", dir, info.Mode().Perm()), nil
+}
+
+// checkServerListening checks whether a server already accepts connections on the socket
+func checkServerListening(socketPath string) (string, error) {
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		return "", fmt.Errorf("no server listening on %s", socketPath)
+	}
+	conn.Close()
+	return "server is listening on " + socketPath, nil
+}
+
+// checkAccountAuthenticated checks that op is signed in to the account, using
+// opConfigDir as op's config directory when set
+func checkAccountAuthenticated(account, opConfigDir string) (string, error) {
+	var output bytes.Buffer
+	args := []string{"--account", account, "account", "get"}
+	inv := opInvocation{args: args, stderr: &output}
+	if opConfigDir != "" {
+		inv.env = []string{"OP_CONFIG_DIR=" + opConfigDir}
+	}
+	exitCode, err := opRunner(context.Background(), inv)
+	if err == nil && exitCode != 0 {
+		err = fmt.Errorf("exit status %d", exitCode)
+		if msg := strings.TrimSpace(output.String()); msg != "" {
+			err = errors.New(msg)
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("account %s is not signed in: %w", account, err)
+	}
+	return account, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// fakeOpScript answers op --version and account get like a signed in op
+const fakeOpScript = `case "$*" in
+  --version) echo 2.30.3 ;;
+  *"account get"*) echo "ID: ABC" ;;
+  *) exit 1 ;;
+esac
+`
+
+// TestDoctorOpInstalled tests the op presence check against a fake op
+func TestDoctorOpInstalled(t *testing.T) {
+	path := installFakeOpScript(t, fakeOpScript)
+
+	detail, err := checkOpInstalled()
+	if err != nil {
+		t.Fatalf("Expected op check to pass, got: %v", err)
+	}
+	if !strings.Contains(detail, path) || !strings.Contains(detail, "2.30.3") {
+		t.Errorf("Expected detail with path and version, got %q", detail)
+	}
+}
+
+// TestDoctorOpMissing tests the op presence check without op in PATH
+func TestDoctorOpMissing(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	if _, err := checkOpInstalled(); err == nil || !strings.Contains(err.Error(), "op not found in PATH") {
+		t.Errorf("Expected op not found error, got: %v", err)
+	}
+}
+
+// TestDoctorOpPath tests that the op check looks at op_path, the binary the
+// server runs, rather than op in PATH
+func TestDoctorOpPath(t *testing.T) {
+	path := installFakeOpScript(t, fakeOpScript)
+	t.Setenv("PATH", t.TempDir())
+	prev := config
+	t.Cleanup(func() { config = prev })
+	env := setupTestEnvironment(t)
+
+	var out bytes.Buffer
+	doctor(&out, writeTestConfig(t, "account: test-account\nsocket_path: "+env.socketPath+"\nop_path: "+path+"\n"))
+	if want := "[PASS] op installed: " + path + " (version 2.30.3)"; !strings.Contains(out.String(), want) {
+		t.Errorf("Expected output to contain %q, got:\n%s", want, out.String())
+	}
+
+	out.Reset()
+	missing := path + "-missing"
+	doctor(&out, writeTestConfig(t, "account: test-account\nsocket_path: "+env.socketPath+"\nop_path: "+missing+"\n"))
+	if want := "[FAIL] op installed: op_path " + missing + " not found"; !strings.Contains(out.String(), want) {
+		t.Errorf("Expected output to contain %q, got:\n%s", want, out.String())
+	}
+}
+
+// TestDoctorAllChecks tests a full doctor run against a valid config and fake op
+func TestDoctorAllChecks(t *testing.T) {
+	installFakeOpScript(t, fakeOpScript)
+	prev := config
+	t.Cleanup(func() { config = prev })
+	env := setupTestEnvironment(t)
+	path := writeTestConfig(t, "account: test-account\nsocket_path: "+env.socketPath+"\n")
+
+	var out bytes.Buffer
+	if code := doctor(&out, path); code != 0 {
+		t.Errorf("Expected exit code 0, got %d:\n%s", code, out.String())
+	}
+
+	for _, want := range []string{
+		"[PASS] op installed",
+		"[PASS] config parses",
+		"[PASS] socket directory",
+		"[FAIL] server listening",
+		"[PASS] account authenticated: test-account",
+		"1 check(s) failed",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, out.String())
+		}
+	}
+}
+
+// TestDoctorInvalidConfig tests that a config that doesn't parse fails doctor
+func TestDoctorInvalidConfig(t *testing.T) {
+	installFakeOpScript(t, fakeOpScript)
+	path := writeTestConfig(t, "allowed_commands: [\n")
+
+	var out bytes.Buffer
+	if code := doctor(&out, path); code != 1 {
+		t.Errorf("Expected exit code 1, got %d", code)
+	}
+
+	for _, want := range []string{
+		"[FAIL] config parses: parsing config file",
+		"[SKIP] socket directory",
+		"[SKIP] account authenticated",
+		"opfwd will not work until the critical ones are fixed",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// commandFields returns the fields a command targets, from the field segment
+// of its op:// references and the values of its --field and --fields flags.
+// A reference names its field last, after the vault, the item and an
+// optional section.
+func commandFields(command string) []string {
+	var fields []string
+	args := strings.Fields(command)
+	for i, arg := range args {
+		arg = strings.Trim(arg, `"'`)
+		if _, ref, ok := strings.Cut(arg, opRefPrefix); ok {
+			ref, _, _ = strings.Cut(ref, "?")
+			if segments := strings.Split(ref, "/"); len(segments) >= 3 {
+				fields = append(fields, segments[len(segments)-1])
+			}
+			continue
+		}
+
+		var value string
+		switch name := flagName(arg); {
+		case name != "--field" && name != "--fields":
+			continue
+		case strings.Contains(arg, "="):
+			_, value, _ = strings.Cut(arg, "=")
+		case i+1 < len(args):
+			value = args[i+1]
+		}
+		fields = append(fields, fieldSelectors(strings.Trim(value, `"'`))...)
+	}
+	return fields
+}
+
+// fieldSelectors returns the field names of a --fields value like
+// "label=username,password". Selectors by field type name no field.
+func fieldSelectors(value string) []string {
+	var fields []string
+	for _, selector := range strings.Split(value, ",") {
+		if strings.HasPrefix(selector, "type=") {
+			continue
+		}
+		selector = strings.TrimPrefix(selector, "label=")
+		if selector != "" {
+			fields = append(fields, selector)
+		}
+	}
+	return fields
+}
+
+// findDeniedField returns the first field a command targets that is in
+// denied, compared ignoring case like op does. An `item get` that doesn't
+// name its fields prints all of them, so it targets the first denied field.
+func findDeniedField(command string, denied []string) (string, bool) {
+	if len(denied) == 0 {
+		return "", false
+	}
+	if printsUnnamedFields(command) {
+		return denied[0], true
+	}
+	for _, field := range commandFields(command) {
+		for _, d := range denied {
+			if strings.EqualFold(field, d) {
+				return field, true
+			}
+		}
+	}
+	return "", false
+}
+
+// printsUnnamedFields reports whether command is an `item get` printing
+// fields it doesn't name: every field without --field or --fields, or every
+// field of a type with a `type=` selector
+func printsUnnamedFields(command string) bool {
+	args := strings.Fields(command)
+	if len(args) < 2 || args[0] != "item" || args[1] != "get" {
+		return false
+	}
+	named := false
+	for i, arg := range args {
+		var value string
+		switch name := flagName(arg); {
+		case name != "--field" && name != "--fields":
+			continue
+		case strings.Contains(arg, "="):
+			_, value, _ = strings.Cut(arg, "=")
+		case i+1 < len(args):
+			value = args[i+1]
+		}
+		for _, selector := range strings.Split(strings.Trim(value, `"'`), ",") {
+			if strings.HasPrefix(selector, "type=") {
+				return true
+			}
+		}
+		named = true
+	}
+	return !named
+}
+
+// validateDeniedFields checks that every denied field names a field
+func validateDeniedFields(fields []string) error {
+	for i, field := range fields {
+		if strings.TrimSpace(field) == "" {
+			return fmt.Errorf("denied_fields[%d]: field name is required", i)
+		}
+		if strings.ContainsAny(field, "/,") {
+			return fmt.Errorf("denied_fields[%d]: invalid field name %q", i, field)
+		}
+	}
+	return nil
+}
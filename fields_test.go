@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestDeniedFields tests that reads of a denied field are refused whatever
+// the rules allow, while the other fields of the item can still be read
+func TestDeniedFields(t *testing.T) {
+	fake := installFakeOp(t, nil)
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "read "
+  - "item get"
+denied_fields: ["recovery-codes", "private_key"]
+`)
+	serveConfig(t, cfg)
+
+	response, err := sendCommand(t, cfg.SocketPath, "read op://Employee/GitHub/password")
+	if err != nil || response != "op --account test-account read op://Employee/GitHub/password\n" {
+		t.Errorf("Expected the password read to run, got %q: %v", response, err)
+	}
+
+	for _, command := range []string{
+		"read op://Employee/GitHub/recovery-codes",
+		"read op://Employee/GitHub/Security/Recovery-Codes",
+		"read 'op://Employee/SSH/private_key?ssh-format=openssh'",
+		"item get SSH --fields private_key",
+		"item get SSH --fields=label=username,label=private_key",
+		"item get SSH",
+		"item get SSH --format json",
+		"item get SSH --fields type=sshkey",
+	} {
+		response, err := sendCommand(t, cfg.SocketPath, command)
+		if err != nil || !strings.Contains(response, "is denied") {
+			t.Errorf("%s: expected denial, got %q: %v", command, response, err)
+		}
+		if validateCommand(&cfg.Rules, command) {
+			t.Errorf("%s: expected validateCommand to deny", command)
+		}
+	}
+	if n := fake.callCount("private_key") + fake.callCount("recovery"); n != 0 {
+		t.Errorf("Expected op never to read a denied field, ran %d times", n)
+	}
+
+	response, err = sendCommand(t, cfg.SocketPath, "item get GitHub --fields username,password")
+	if err != nil || response != "op --account test-account item get GitHub --fields username,password\n" {
+		t.Errorf("Expected an item get naming allowed fields to run, got %q: %v", response, err)
+	}
+
+	path := writeTestConfig(t, "account: \"test-account\"\ndenied_fields: [\"\"]\n")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "denied_fields[0]") {
+		t.Errorf("Expected denied_fields error, got %v", err)
+	}
+}
+
+// TestCommandFields tests extracting the fields a command targets
+func TestCommandFields(t *testing.T) {
+	tests := map[string][]string{
+		"read op://Employee/GitHub/password":                {"password"},
+		"read op://Employee/GitHub/Login/otp?attribute=otp": {"otp"},
+		"read op://Employee/GitHub":                         nil,
+		"item get GitHub --fields label=username,password":  {"username", "password"},
+		"item get GitHub --field=username":                  {"username"},
+		"item get GitHub --fields type=concealed":           nil,
+		"item list --vault Employee":                        nil,
+	}
+	for command, want := range tests {
+		if got := commandFields(command); !reflect.DeepEqual(got, want) {
+			t.Errorf("commandFields(%q) = %q, want %q", command, got, want)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// statusFlag is the request flag a client sets to receive a framed response
+// ending with an exit code
+const statusFlag = "status"
+
+// Frame types of a framed response. Each frame is the type byte, the payload
+// length as a 4-byte big-endian integer, and the payload. The types are
+// control characters, so a client can tell a framed response from the plain
+// text sent by servers that predate frames.
+const (
+	// frameOutput carries op output and other text for the user
+	frameOutput = 0x01
+
+	// frameError carries an error raised by the server itself, like a denial
+	frameError = 0x02
+
+	// frameExit carries the exit code as decimal text and ends the response
+	frameExit = 0x03
+)
+
+// maxOutputChunk is the most output sent in a single write or frame, so
+// large outputs like documents are streamed to the client as op produces
+// them rather than held until they are complete. Clients refuse larger frames.
+const maxOutputChunk = 32 * 1024
+
+// Exit codes for requests the server stopped before op completed. Commands op
+// ran to completion pass on op's own exit code.
+const (
+	// exitTempFail is for rate limited commands worth retrying later
+	exitTempFail = 75
+
+	// exitTimeout is for commands that ran longer than command_timeout
+	exitTimeout = 124
+
+	// exitServerError is for commands the server failed to run, e.g. because
+	// signing in to 1Password failed
+	exitServerError = 125
+
+	// exitPolicy is for commands denied by the rules, time windows or flag checks
+	exitPolicy = 126
+)
+
+// response writes the reply to a request. For a client that set statusFlag
+// every write becomes a frame and close sends the exit code; other clients
+// get plain text as before. It is safe for concurrent use, as op's stdout and
+// stderr are copied to it from separate goroutines.
+type response struct {
+	mu     sync.Mutex
+	w      io.Writer
+	framed bool
+	status int
+	failed bool
+
+	// writeErr is the first error writing to the client. Once the client is
+	// gone nothing more is written.
+	writeErr error
+}
+
+// newResponse returns a response writing to w
+func newResponse(w io.Writer, framed bool) *response {
+	return &response{w: w, framed: framed}
+}
+
+// Write sends p as output, in pieces of at most maxOutputChunk so a large
+// write reaches the client bit by bit
+func (r *response) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		if r.writeErr != nil {
+			return written, r.writeErr
+		}
+		chunk := p[:min(len(p), maxOutputChunk)]
+		if !r.framed {
+			n, err := r.w.Write(chunk)
+			written += n
+			r.writeErr = err
+		} else if err := writeFrame(r.w, frameOutput, chunk); err != nil {
+			r.writeErr = err
+		} else {
+			written += len(chunk)
+		}
+		p = p[len(chunk):]
+	}
+	return written, r.writeErr
+}
+
+// broken reports whether writing to the client has failed
+func (r *response) broken() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writeErr != nil
+}
+
+// fail sends an error raised by the server and sets the exit code the client
+// exits with to status
+func (r *response) fail(status int, format string, args ...any) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.status = status
+	r.failed = true
+	if r.writeErr != nil {
+		return r.writeErr
+	}
+	msg := fmt.Sprintf(format, args...)
+	if !r.framed {
+		_, r.writeErr = io.WriteString(r.w, msg)
+		return r.writeErr
+	}
+	for p := []byte(msg); len(p) > 0 && r.writeErr == nil; p = p[min(len(p), maxOutputChunk):] {
+		r.writeErr = writeFrame(r.w, frameError, p[:min(len(p), maxOutputChunk)])
+	}
+	return r.writeErr
+}
+
+// close ends a framed response with the exit code: the status of the last
+// fail, or else exitCode, the op exit code. A negative exitCode means op
+// didn't run to completion and is reported as a server error.
+func (r *response) close(exitCode int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.framed || r.writeErr != nil {
+		return nil
+	}
+	r.writeErr = writeFrame(r.w, frameExit, []byte(strconv.Itoa(r.statusLocked(exitCode))))
+	return r.writeErr
+}
+
+// exitStatus returns the exit code close reports for exitCode
+func (r *response) exitStatus(exitCode int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.statusLocked(exitCode)
+}
+
+// statusLocked is exitStatus for callers holding r.mu
+func (r *response) statusLocked(exitCode int) int {
+	if r.failed {
+		return r.status
+	}
+	if exitCode < 0 {
+		return exitServerError
+	}
+	return exitCode
+}
+
+// writeFrame writes a single frame in one call, so frames written from
+// different goroutines never interleave
+func writeFrame(w io.Writer, typ byte, payload []byte) error {
+	frame := make([]byte, 5, 5+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	frame = append(frame, payload...)
+	defer wipe(frame)
+	traceFrame("send", typ, payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// frameReader reads the output and error frames of a framed response as a
+// single stream, and records the exit code once it reaches the exit frame
+type frameReader struct {
+	r        *bufio.Reader
+	pending  []byte
+	exitCode int
+	done     bool
+
+	// errs collects the payloads of error frames when set, keeping them out
+	// of the output
+	errs *bytes.Buffer
+}
+
+// openFrames returns a reader for the output of a response to a request with
+// statusFlag set. fr is nil when the server sent plain text, in which case
+// out returns it untouched.
+func openFrames(r io.Reader) (out io.Reader, fr *frameReader, err error) {
+	br := bufio.NewReader(r)
+	first, err := br.Peek(1)
+	if errors.Is(err, io.EOF) {
+		return br, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if first[0] < frameOutput || first[0] > frameExit {
+		return br, nil, nil
+	}
+	fr = &frameReader{r: br}
+	return fr, fr, nil
+}
+
+// Read returns the payloads of output and error frames in order. It returns
+// io.EOF after the exit frame and io.ErrUnexpectedEOF if the response ends
+// without one.
+func (f *frameReader) Read(p []byte) (int, error) {
+	for len(f.pending) == 0 {
+		if f.done {
+			return 0, io.EOF
+		}
+		if err := f.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+// next reads one frame
+func (f *frameReader) next() error {
+	var header [5]byte
+	if _, err := io.ReadFull(f.r, header[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	// Check the length before allocating, so a bad header can't claim
+	// gigabytes
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > maxOutputChunk {
+		return fmt.Errorf("invalid frame length %d, frames carry at most %d bytes", n, maxOutputChunk)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(f.r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	traceFrame("recv", header[0], payload)
+	switch header[0] {
+	case frameOutput:
+		f.pending = payload
+	case frameError:
+		if f.errs != nil {
+			f.errs.Write(payload)
+			break
+		}
+		f.pending = payload
+	case frameExit:
+		code, err := strconv.Atoi(string(payload))
+		if err != nil {
+			return fmt.Errorf("invalid exit code %q", payload)
+		}
+		f.exitCode = code
+		f.done = true
+	default:
+		return fmt.Errorf("unknown response frame type %#x", header[0])
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestExitCodes tests that clients can tell a denial, a timeout and an op
+// failure apart by their exit codes, while still getting the error text
+func TestExitCodes(t *testing.T) {
+	installFakeOpScript(t, `case "$*" in
+*"account get"*) exit 0;;
+*"item get slow"*) exec sleep 30;;
+*"item get broken"*) echo "[ERROR] item not found" >&2; exit 3;;
+esac
+echo "op $*"
+`)
+	resetRateLimits(t)
+	cfg := loadTestConfig(t, `
+command_timeout: 200ms
+allowed_prefixes:
+  - "item get"
+  - match: "item list"
+    rate_limit: 1
+`)
+	serveConfig(t, cfg)
+
+	tests := []struct {
+		command  string
+		wantCode int
+		wantOut  string
+	}{
+		{"item get foo", 0, "op --account test-account item get foo\n"},
+		{"item get broken", 3, "[ERROR] item not found\n"},
+		{"item delete foo", exitPolicy, "Error: Command not allowed: item delete foo\n"},
+		{"item get foo --account other", exitPolicy, "Error: Command not allowed, --account is set by the server"},
+		{"item get slow", exitTimeout, "Error: Command timed out after 200ms\n"},
+		{"item list", 0, "op --account test-account item list\n"},
+		{"item list", exitTempFail, "Error: Rate limit for this command exceeded"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		start := time.Now()
+		code, err := forwardCommand(&out, cfg.SocketPath, tt.command, clientOptions{})
+		if err != nil {
+			t.Fatalf("%s: expected the response to be read, got: %v", tt.command, err)
+		}
+		if code != tt.wantCode {
+			t.Errorf("%s: expected exit code %d, got %d", tt.command, tt.wantCode, code)
+		}
+		if !strings.HasPrefix(out.String(), tt.wantOut) {
+			t.Errorf("%s: expected output starting with %q, got %q", tt.command, tt.wantOut, out.String())
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: took %s", tt.command, elapsed)
+		}
+	}
+}
+
+// TestFrameReader tests reading a framed response and passing plain text through
+func TestFrameReader(t *testing.T) {
+	var buf bytes.Buffer
+	resp := newResponse(&buf, true)
+	resp.Write([]byte("partial "))
+	resp.Write([]byte("output\n"))
+	resp.fail(exitServerError, "Error: %s\n", "sign in failed")
+	resp.close(0)
+
+	out, fr, err := openFrames(&buf)
+	if err != nil || fr == nil {
+		t.Fatalf("Expected a framed response, got %v: %v", fr, err)
+	}
+	data, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatalf("Failed to read frames: %v", err)
+	}
+	if want := "partial output\nError: sign in failed\n"; string(data) != want {
+		t.Errorf("Expected %q, got %q", want, data)
+	}
+	if fr.exitCode != exitServerError {
+		t.Errorf("Expected exit code %d, got %d", exitServerError, fr.exitCode)
+	}
+
+	// Responses from servers without frames are passed through
+	out, fr, err = openFrames(strings.NewReader("op output\n"))
+	if err != nil || fr != nil {
+		t.Fatalf("Expected a plain response, got %v: %v", fr, err)
+	}
+	if data, _ := io.ReadAll(out); string(data) != "op output\n" {
+		t.Errorf("Expected plain output, got %q", data)
+	}
+
+	// A response cut short has no exit code
+	buf.Reset()
+	newResponse(&buf, true).Write([]byte("output"))
+	out, _, _ = openFrames(&buf)
+	if _, err := io.ReadAll(out); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected unexpected EOF, got %v", err)
+	}
+
+	// A long error is split into frames the client accepts
+	buf.Reset()
+	long := strings.Repeat("x", 2*maxOutputChunk+1)
+	resp = newResponse(&buf, true)
+	resp.fail(exitPolicy, "%s", long)
+	resp.close(0)
+	out, _, _ = openFrames(&buf)
+	if data, err := io.ReadAll(out); err != nil || string(data) != long {
+		t.Errorf("Expected the long error to be read whole, got %d bytes: %v", len(data), err)
+	}
+
+	// A frame claiming more than a chunk is refused before it is read
+	out, _, _ = openFrames(bytes.NewReader([]byte{frameOutput, 0xff, 0xff, 0xff, 0xff}))
+	if _, err := io.ReadAll(out); err == nil || !strings.Contains(err.Error(), "invalid frame length 4294967295") {
+		t.Errorf("Expected the oversized frame to be refused, got %v", err)
+	}
+}
+
+// readFramedResponses sends commands on a single connection with statusFlag
+// set and returns the output and exit code of each response, stopping when
+// the server closes the connection
+func readFramedResponses(t *testing.T, socketPath string, commands ...string) (outputs []string, codes []int) {
+	t.Helper()
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to connect to socket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for _, command := range commands {
+		if err := writeRequest(conn, request{Command: command, Flags: []string{statusFlag}}); err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		if _, err := r.Peek(1); err != nil {
+			return outputs, codes
+		}
+		fr := &frameReader{r: r}
+		out, err := io.ReadAll(fr)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		outputs = append(outputs, string(out))
+		codes = append(codes, fr.exitCode)
+	}
+}
+
+// TestMaxCommandsPerConn tests that a connection may only send as many
+// commands as max_commands_per_conn allows
+func TestMaxCommandsPerConn(t *testing.T) {
+	installFakeOp(t, nil)
+
+	tests := []struct {
+		name    string
+		limit   string
+		allowed int
+	}{
+		{"default", "", 1},
+		{"configured", "max_commands_per_conn: 3\n", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, tt.limit+`
+allowed_prefixes:
+  - "item get"
+`)
+			serveConfig(t, cfg)
+
+			commands := []string{"item get a", "item get b", "item get c", "item get d"}
+			outputs, codes := readFramedResponses(t, cfg.SocketPath, commands...)
+			if len(outputs) != tt.allowed+1 {
+				t.Fatalf("Expected %d responses, got %d: %q", tt.allowed+1, len(outputs), outputs)
+			}
+			for i := 0; i < tt.allowed; i++ {
+				if want := "op --account test-account " + commands[i] + "\n"; outputs[i] != want || codes[i] != 0 {
+					t.Errorf("Expected response %d to be %q, got %q (exit %d)", i, want, outputs[i], codes[i])
+				}
+			}
+			last := outputs[tt.allowed]
+			if !strings.Contains(last, "commands are allowed per connection") || codes[tt.allowed] != exitPolicy {
+				t.Errorf("Expected the command over the limit to be refused, got %q (exit %d)", last, codes[tt.allowed])
+			}
+		})
+	}
+}
+
+// TestEndCommand tests that a connection carrying several commands gets a
+// framed response to each, in order, and is closed by the server on @end
+func TestEndCommand(t *testing.T) {
+	fake := installFakeOp(t, nil)
+	cfg := loadTestConfig(t, `
+max_commands_per_conn: 3
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	outputs, codes := readFramedResponses(t, cfg.SocketPath, "item get a", "vault list", "item get c", endCommand, "item get d")
+	if len(outputs) != 3 {
+		t.Fatalf("Expected 3 responses, got %d: %q", len(outputs), outputs)
+	}
+	if want := "op --account test-account item get a\n"; outputs[0] != want || codes[0] != 0 {
+		t.Errorf("Expected response 0 to be %q, got %q (exit %d)", want, outputs[0], codes[0])
+	}
+	if !strings.Contains(outputs[1], "not allowed") || codes[1] != exitPolicy {
+		t.Errorf("Expected the denied command to be refused, got %q (exit %d)", outputs[1], codes[1])
+	}
+	if want := "op --account test-account item get c\n"; outputs[2] != want || codes[2] != 0 {
+		t.Errorf("Expected response 2 to be %q, got %q (exit %d)", want, outputs[2], codes[2])
+	}
+	if n := fake.callCount("item get d"); n != 0 {
+		t.Errorf("Expected nothing after @end to run, ran %d times", n)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// commandHash returns the hex SHA-256 digest of command in canonical form,
+// as listed in allowed_hashes
+func commandHash(command string) string {
+	sum := sha256.Sum256([]byte(canonicalizeCommand(command)))
+	return hex.EncodeToString(sum[:])
+}
+
+// matchHash returns the allowed hash equal to the digest of command. Hashes
+// only stand in for exact rules: the whole canonical command is hashed, so
+// there is no prefix, glob or case-insensitive matching.
+func matchHash(hashes []string, command string) (string, bool) {
+	if len(hashes) == 0 {
+		return "", false
+	}
+	digest := commandHash(command)
+	for _, h := range hashes {
+		if strings.EqualFold(h, digest) {
+			return h, true
+		}
+	}
+	return "", false
+}
+
+// validateHashes checks that every allowed hash is a hex SHA-256 digest
+func validateHashes(hashes []string) error {
+	for i, h := range hashes {
+		if b, err := hex.DecodeString(h); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("allowed_hashes[%d]: invalid SHA-256 digest %q, expected %d hex characters", i, h, 2*sha256.Size)
+		}
+	}
+	return nil
+}
+
+// runHash prints the allowed_hashes entry for the command in args
+func runHash(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: opfwd hash <op command>")
+		return 1
+	}
+	fmt.Println(commandHash(strings.Join(args, " ")))
+	return 0
+}
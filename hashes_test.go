@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestAllowedHashes tests that a command is allowed when the digest of its
+// canonical form is listed, and only then
+func TestAllowedHashes(t *testing.T) {
+	allowed := "read op://Employee/GitHub/password"
+	cfg := loadTestConfig(t, fmt.Sprintf("allowed_hashes:\n  - %q\n", strings.ToUpper(commandHash(allowed))))
+
+	tests := map[string]bool{
+		allowed: true,
+		"  read   op://Employee/GitHub/password ":     true,
+		"read op://Employee/GitHub/password --reveal": false,
+		"read op://Employee/GitLab/password":          false,
+		"READ op://Employee/GitHub/password":          false,
+	}
+	for input, want := range tests {
+		if got := validateCommand(&cfg.Rules, input); got != want {
+			t.Errorf("validateCommand(%q) = %v, want %v", input, got, want)
+		}
+	}
+
+	matched, ok := matchRule(&cfg.Rules, allowed, nil)
+	if !ok || matched.kind != "hash" || matched.rule != nil {
+		t.Errorf("Expected a hash match, got %v", matched)
+	}
+}
+
+// TestInvalidHashes tests that malformed digests are rejected at load
+func TestInvalidHashes(t *testing.T) {
+	tests := map[string]string{
+		"not hex":   strings.Repeat("z", 64),
+		"too short": commandHash("read op://Employee/GitHub/password")[:40],
+		"empty":     "",
+	}
+	for name, digest := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := writeTestConfig(t, fmt.Sprintf("account: \"test-account\"\nallowed_hashes: [%q]\n", digest))
+			if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "allowed_hashes[0]: invalid SHA-256 digest") {
+				t.Errorf("Expected allowed_hashes error, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// helloCommand opens a connection with the protocol version the client
+// speaks, as "@hello <version>". The server answers with the same line
+// holding the version both sides then use, the lower of the two. Clients
+// that start with a request instead speak version 1.
+const helloCommand = "@hello"
+
+const (
+	// protocolVersion is the newest protocol version this build speaks.
+	// Version 1 is the line protocol of JSON envelopes and framed responses.
+	protocolVersion = 1
+
+	// minProtocolVersion is the oldest protocol version this build speaks
+	minProtocolVersion = 1
+)
+
+// errNoHello is returned by readHello when the server answered the hello
+// with something else, as servers that predate it do
+var errNoHello = errors.New("server does not support @hello")
+
+// isHello reports whether command is a hello
+func isHello(command string) bool {
+	fields := strings.Fields(command)
+	return len(fields) > 0 && fields[0] == helloCommand
+}
+
+// parseHello returns the protocol version a hello line offers
+func parseHello(line string) (int, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 || fields[0] != helloCommand {
+		return 0, fmt.Errorf("expected %q, got %q", helloCommand+" <version>", line)
+	}
+	version, err := strconv.Atoi(fields[1])
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid protocol version %q", fields[1])
+	}
+	return version, nil
+}
+
+// negotiateVersion returns the protocol version to use with a peer
+// offering offered, the newest both speak
+func negotiateVersion(offered int) (int, error) {
+	if offered < minProtocolVersion {
+		return 0, fmt.Errorf("unsupported protocol version %d, this server speaks versions %d to %d", offered, minProtocolVersion, protocolVersion)
+	}
+	return min(offered, protocolVersion), nil
+}
+
+// answerHello replies to the hello a client opened its connection with. It
+// returns the negotiated version, or an error after telling the client
+// there is no version both speak.
+func answerHello(w io.Writer, command string, logger *log.Logger) (int, error) {
+	offered, err := parseHello(command)
+	if err == nil {
+		var version int
+		if version, err = negotiateVersion(offered); err == nil {
+			logger.Printf("Client offered protocol version %d, using %d", offered, version)
+			line := fmt.Sprintf("%s %d\n", helloCommand, version)
+			traceHello("send", line)
+			_, err = io.WriteString(w, line)
+			return version, err
+		}
+	}
+	logger.Printf("Refusing hello: %v", err)
+	_, _ = fmt.Fprintf(w, "Error: Invalid hello: %v\n", err)
+	return 0, err
+}
+
+// sayHello sends the hello offering protocolVersion
+func sayHello(w io.Writer) error {
+	line := fmt.Sprintf("%s %d\n", helloCommand, protocolVersion)
+	traceHello("send", line)
+	_, err := io.WriteString(w, line)
+	return err
+}
+
+// readHello reads the server's answer to a hello and returns the negotiated
+// version. It returns errNoHello when the server answered with something
+// else.
+func readHello(r *bufio.Reader) (int, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return 0, err
+	}
+	if !isHello(line) {
+		return 0, errNoHello
+	}
+	traceHello("recv", line)
+	version, err := parseHello(line)
+	if err != nil {
+		return 0, err
+	}
+	if version < minProtocolVersion || version > protocolVersion {
+		return 0, fmt.Errorf("server chose unsupported protocol version %d", version)
+	}
+	return version, nil
+}
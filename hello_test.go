@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// exchange sends data on a new connection to socketPath, closes its side
+// and returns everything the server sends back
+func exchange(t *testing.T, socketPath, data string) string {
+	t.Helper()
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, data); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	conn.(*net.UnixConn).CloseWrite()
+	out, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return string(out)
+}
+
+// TestHelloNegotiation tests that the server answers a hello with the newest
+// version both sides speak and then serves the request following it
+func TestHelloNegotiation(t *testing.T) {
+	installFakeOp(t, nil)
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	tests := []struct {
+		name string
+		send string
+		want string
+	}{
+		{"same version", "@hello 1\nitem get foo\n", "@hello 1\nop --account test-account item get foo\n"},
+		{"newer client", "@hello 7\nitem get foo\n", "@hello 1\nop --account test-account item get foo\n"},
+		{"unsupported version", "@hello 0\nitem get foo\n", "Error: Invalid hello: invalid protocol version \"0\"\n"},
+		{"hello only", "@hello 1\n", "@hello 1\n"},
+	}
+	for _, tt := range tests {
+		if got := exchange(t, cfg.SocketPath, tt.send); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+// TestHelloLegacyClient tests that a client starting with a request instead
+// of a hello is served with the line protocol as before
+func TestHelloLegacyClient(t *testing.T) {
+	installFakeOp(t, nil)
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	if got, want := exchange(t, cfg.SocketPath, "item get foo\n"), "op --account test-account item get foo\n"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+// TestHelloLegacyServer tests that the client sends its request again
+// without a hello to a server that refuses the hello
+func TestHelloLegacyServer(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "legacy.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	received := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// Like servers that predate the hello, treat the first line as
+			// the command and answer in plain text
+			line, _ := readLine(bufio.NewReader(conn))
+			received <- line
+			if isHello(line) {
+				io.WriteString(conn, "Error: Command not allowed: @hello 1\n")
+			} else {
+				io.WriteString(conn, string(responsePlain)+"legacy output\n")
+			}
+			conn.Close()
+		}
+	}()
+
+	var out bytes.Buffer
+	code, err := forwardCommand(&out, socketPath, "item get foo", clientOptions{})
+	if err != nil || code != 0 || out.String() != "legacy output\n" {
+		t.Fatalf("Expected the legacy output, got %q with exit code %d: %v", out.String(), code, err)
+	}
+	if first := <-received; first != "@hello 1\n" {
+		t.Errorf("Expected the client to open with a hello, got %q", first)
+	}
+	if second := <-received; isHello(second) {
+		t.Errorf("Expected the request without a hello on the second connection, got %q", second)
+	}
+}
+
+// TestParseHello tests the hello lines the server accepts
+func TestParseHello(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    int
+		wantErr bool
+	}{
+		{"@hello 1", 1, false},
+		{"@hello 12", 12, false},
+		{"@hello", 0, true},
+		{"@hello x", 0, true},
+		{"@hello -1", 0, true},
+		{"@hello 1 2", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseHello(tt.line)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseHello(%q) = %d, %v; want %d, error %v", tt.line, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
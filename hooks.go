@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// defaultPostHookTimeout bounds a post hook run when PostHookTimeout is unset
+const defaultPostHookTimeout = 10 * time.Second
+
+// postHookEvent describes a finished request passed to the post hook
+type postHookEvent struct {
+	reqID    string
+	command  string
+	decision string
+	exitCode int
+}
+
+// runPostHook runs the configured post hook in the background. The request
+// is passed through OPFWD_* environment variables; hook failures are logged
+// and never affect the client response.
+func runPostHook(logger *log.Logger, ev postHookEvent) {
+	hook := config.PostHook
+	if hook == "" {
+		return
+	}
+
+	timeout := config.PostHookTimeout
+	if timeout <= 0 {
+		timeout = defaultPostHookTimeout
+	}
+
+	env := append(os.Environ(),
+		"OPFWD_REQUEST_ID="+ev.reqID,
+		"OPFWD_COMMAND="+ev.command,
+		"OPFWD_DECISION="+ev.decision,
+		"OPFWD_EXIT_CODE="+strconv.Itoa(ev.exitCode),
+		"OPFWD_ACCOUNT="+config.Account,
+	)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		hookCmd := exec.CommandContext(ctx, hook)
+		hookCmd.Env = env
+		if output, err := hookCmd.CombinedOutput(); err != nil {
+			logger.Printf("Post hook %s failed: %v, output: %s", hook, err, output)
+		}
+	}()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForFile waits for a file to appear and returns its contents
+func waitForFile(t *testing.T, path string, timeout time.Duration) string {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if data, err := os.ReadFile(path); err == nil {
+			return string(data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("File %s did not appear within %s", path, timeout)
+	return ""
+}
+
+// writeHookScript writes a post hook that records its environment to out
+func writeHookScript(t *testing.T, out string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$OPFWD_DECISION $OPFWD_EXIT_CODE $OPFWD_ACCOUNT $OPFWD_COMMAND\" > %[1]s.tmp && mv %[1]s.tmp %[1]s\n", out)
+	if err := os.WriteFile(path, []byte(script), 0700); err != nil {
+		t.Fatalf("Failed to write hook: %v", err)
+	}
+	return path
+}
+
+// TestPostHookReceivesExitCode tests that the post hook runs with the op exit code
+func TestPostHookReceivesExitCode(t *testing.T) {
+	installFakeOp(t, func(inv opInvocation) int {
+		if strings.Contains(strings.Join(inv.args, " "), "account get") {
+			return 0
+		}
+		fmt.Fprintln(inv.stderr, "[ERROR] item not found")
+		return 3
+	})
+
+	out := filepath.Join(t.TempDir(), "hook.out")
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+post_hook: %q
+allowed_prefixes:
+  - "item get"
+`, writeHookScript(t, out)))
+	serveConfig(t, cfg)
+
+	if _, err := sendCommand(t, cfg.SocketPath, "item get missing"); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+
+	got := strings.TrimSpace(waitForFile(t, out, 5*time.Second))
+	if want := "allowed 3 test-account item get missing"; got != want {
+		t.Errorf("Expected hook to record %q, got %q", want, got)
+	}
+}
+
+// TestPostHookDenied tests that the post hook is told about denied commands
+func TestPostHookDenied(t *testing.T) {
+	fake := installFakeOp(t, nil)
+
+	out := filepath.Join(t.TempDir(), "hook.out")
+	cfg := loadTestConfig(t, fmt.Sprintf("post_hook: %q\n", writeHookScript(t, out)))
+	serveConfig(t, cfg)
+
+	response, err := sendCommand(t, cfg.SocketPath, "item delete everything")
+	if err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if !strings.Contains(response, "Error: Command not allowed") {
+		t.Errorf("Expected denial, got %q", response)
+	}
+
+	got := strings.TrimSpace(waitForFile(t, out, 5*time.Second))
+	if want := "denied -1 test-account item delete everything"; got != want {
+		t.Errorf("Expected hook to record %q, got %q", want, got)
+	}
+	if n := fake.callCount("item delete"); n != 0 {
+		t.Errorf("Expected denied command not to reach op, got %d calls", n)
+	}
+}
+
+// TestPostHookFailureIgnored tests that a failing hook doesn't affect the response
+func TestPostHookFailureIgnored(t *testing.T) {
+	installFakeOp(t, nil)
+	logs := captureLog(t)
+
+	cfg := loadTestConfig(t, `
+post_hook: "/nonexistent/hook"
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	response, err := sendCommand(t, cfg.SocketPath, "item get foo")
+	if err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if want := "op --account test-account item get foo\n"; response != want {
+		t.Errorf("Expected response %q, got %q", want, response)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), "Post hook /nonexistent/hook failed") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected hook failure to be logged, got:\n%s", logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
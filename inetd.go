@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// runInetd serves a single connection on stdin and stdout and returns the
+// exit code of its last command, for super-servers like inetd or systemd
+// socket activation with Accept=yes that start a process per connection.
+// There is no socket to set up and no account lock, as these processes run
+// side by side.
+func runInetd(configPath string, opts serverOptions) int {
+	closeLogging := loadServerConfig(configPath, opts)
+	defer closeLogging()
+
+	// systemd hands over the accepted socket itself, which keeps the peer
+	// credentials available to the control commands
+	if conn, err := net.FileConn(os.Stdin); err == nil {
+		return handleConnection(conn, &config.Rules)
+	}
+	return serveStdio(os.Stdin, os.Stdout)
+}
+
+// serveStdio handles one connection read from in and answered on out, with
+// the rules of the main socket
+func serveStdio(in io.Reader, out io.Writer) int {
+	return handleConnection(stdioConn{r: in, w: out}, &config.Rules)
+}
+
+// stdioConn is a connection made of a reader and a writer, like the stdin and
+// stdout of a process started by inetd. It has no addresses or deadlines.
+type stdioConn struct {
+	r io.Reader
+	w io.Writer
+}
+
+func (c stdioConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c stdioConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+// Close closes the reader and the writer when they can be closed
+func (c stdioConn) Close() error {
+	if closer, ok := c.r.(io.Closer); ok {
+		closer.Close()
+	}
+	if closer, ok := c.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c stdioConn) LocalAddr() net.Addr                { return stdioAddr{} }
+func (c stdioConn) RemoteAddr() net.Addr               { return stdioAddr{} }
+func (c stdioConn) SetDeadline(t time.Time) error      { return nil }
+func (c stdioConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c stdioConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// stdioAddr is the address of both ends of a stdioConn
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
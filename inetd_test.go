@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestServeStdio tests that inetd mode answers the command read from stdin
+// on stdout and returns op's exit code
+func TestServeStdio(t *testing.T) {
+	installFakeOp(t, func(inv opInvocation) int {
+		if strings.Contains(strings.Join(inv.args, " "), "item get missing") {
+			fmt.Fprintln(inv.stderr, "[ERROR] item not found")
+			return 3
+		}
+		fmt.Fprintf(inv.stdout, "op %s\n", strings.Join(inv.args, " "))
+		return 0
+	})
+	prev := config
+	t.Cleanup(func() { config = prev })
+	config = loadTestConfig(t, `
+allowed_prefixes:
+  - "item get"
+`)
+
+	tests := []struct {
+		command  string
+		want     string
+		wantCode int
+	}{
+		{"item get foo", "op --account test-account item get foo\n", 0},
+		{"item get missing", "[ERROR] item not found\n", 3},
+		{"vault list", "Error: Command not allowed: vault list\n", exitPolicy},
+	}
+	for _, tt := range tests {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatalf("Failed to create pipe: %v", err)
+		}
+		fmt.Fprintf(w, "%s\n", tt.command)
+		w.Close()
+
+		var out bytes.Buffer
+		code := serveStdio(r, &out)
+		if out.String() != tt.want || code != tt.wantCode {
+			t.Errorf("%s: expected %q with exit code %d, got %q with %d", tt.command, tt.want, tt.wantCode, out.String(), code)
+		}
+	}
+}
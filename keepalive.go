@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// keepSessionWarm checks the 1Password session right away and then every
+// interval until ctx ends, signing in again when it has expired, so the
+// first command after a quiet spell doesn't wait for op to set up a session.
+// Failures are logged and retried at the next tick. The returned channel is
+// closed once it has stopped.
+func keepSessionWarm(ctx context.Context, interval time.Duration) <-chan struct{} {
+	stopped := make(chan struct{})
+	if interval <= 0 {
+		close(stopped)
+		return stopped
+	}
+
+	logger := newRequestLogger("keepalive")
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := ensureLoggedIn(ctx, logger); err != nil && ctx.Err() == nil {
+				logger.Printf("Warning: Keeping the 1Password session warm failed: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return stopped
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestKeepSessionWarm tests that the session is probed at startup and again
+// every keep_alive_interval, that failures are logged, and that it stops
+// with its context
+func TestKeepSessionWarm(t *testing.T) {
+	fake := installFakeOp(t, func(inv opInvocation) int {
+		// Signed out, with auto_signin off nothing signs in again
+		return 1
+	})
+	prev := config
+	t.Cleanup(func() { config = prev })
+	config = loadTestConfig(t, `
+keep_alive_interval: 20ms
+auto_signin: false
+`)
+	logs := captureLog(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := keepSessionWarm(ctx, config.KeepAliveInterval)
+
+	waitFor(t, func() bool { return fake.callCount("account get") >= 2 })
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the keep-alive to stop with its context")
+	}
+
+	calls := fake.callCount("account get")
+	time.Sleep(60 * time.Millisecond)
+	if after := fake.callCount("account get"); after != calls {
+		t.Errorf("Expected no probes after stopping, got %d more", after-calls)
+	}
+	if got := logs.String(); !strings.Contains(got, "[keepalive] Warning: Keeping the 1Password session warm failed: "+errSigninDisabled.Error()) {
+		t.Errorf("Expected the failed probe to be logged, got %q", got)
+	}
+}
+
+// TestKeepSessionWarmDisabled tests that nothing is probed without an interval
+func TestKeepSessionWarmDisabled(t *testing.T) {
+	fake := installFakeOp(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	<-keepSessionWarm(ctx, 0)
+	if calls := fake.callCount("account get"); calls != 0 {
+		t.Errorf("Expected no probes, got %d", calls)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// limitWriter passes at most limit bytes on to w. The write that reaches the
+// limit is cut short and followed by a truncation notice, after which onLimit
+// is called once and everything else is discarded. It is safe for concurrent
+// use, as op's stdout and stderr are copied to it from separate goroutines.
+type limitWriter struct {
+	mu        sync.Mutex
+	w         io.Writer
+	limit     int64
+	written   int64
+	truncated bool
+	onLimit   func()
+}
+
+// newLimitWriter returns a limitWriter passing limit bytes on to w
+func newLimitWriter(w io.Writer, limit int64, onLimit func()) *limitWriter {
+	return &limitWriter{w: w, limit: limit, onLimit: onLimit}
+}
+
+// Write passes p on up to the limit. Output past the limit is reported as
+// written, so op's output keeps draining until it is stopped.
+func (l *limitWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.truncated {
+		return len(p), nil
+	}
+
+	if remaining := l.limit - l.written; int64(len(p)) > remaining {
+		l.truncated = true
+		n, err := l.w.Write(p[:remaining])
+		l.written += int64(n)
+		if err == nil {
+			_, err = fmt.Fprintf(l.w, "\nopfwd: response truncated at %d bytes\n", l.limit)
+		}
+		l.onLimit()
+		if err != nil {
+			return n, err
+		}
+		return len(p), nil
+	}
+
+	n, err := l.w.Write(p)
+	l.written += int64(n)
+	return n, err
+}
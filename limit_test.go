@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMaxResponseBytes tests that oversized output is truncated and op stopped
+func TestMaxResponseBytes(t *testing.T) {
+	// Signs in fine, then writes output forever
+	installFakeOpScript(t, `case "$*" in *"account get"*) exit 0;; esac
+exec yes 0123456789
+`)
+	cfg := loadTestConfig(t, `
+max_response_bytes: 1000
+allowed_prefixes:
+  - "document get"
+`)
+	serveConfig(t, cfg)
+
+	start := time.Now()
+	response, err := sendCommand(t, cfg.SocketPath, "document get huge")
+	if err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected op to be stopped at the limit, took %s", elapsed)
+	}
+
+	trailer := "\nopfwd: response truncated at 1000 bytes\n"
+	if !strings.HasSuffix(response, trailer) {
+		t.Fatalf("Expected truncation trailer, got %d bytes ending in %q", len(response), response[max(0, len(response)-60):])
+	}
+	body := strings.TrimSuffix(response, trailer)
+	if len(body) != 1000 || !strings.HasPrefix(body, "0123456789\n0123456789\n") {
+		t.Errorf("Expected the first 1000 bytes of output, got %d bytes", len(body))
+	}
+}
+
+// TestLimitWriterUnderLimit tests that output within the limit passes untouched
+func TestLimitWriterUnderLimit(t *testing.T) {
+	var buf strings.Builder
+	called := false
+	w := newLimitWriter(&buf, 10, func() { called = true })
+
+	for _, chunk := range []string{"0123", "45678", "9"} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatalf("Unexpected write error: %v", err)
+		}
+	}
+	if buf.String() != "0123456789" || called {
+		t.Errorf("Expected untruncated output, got %q (limit hit: %v)", buf.String(), called)
+	}
+
+	w.Write([]byte("x"))
+	w.Write([]byte("y"))
+	if want := "0123456789\nopfwd: response truncated at 10 bytes\n"; buf.String() != want || !called {
+		t.Errorf("Expected %q after the limit, got %q", want, buf.String())
+	}
+}
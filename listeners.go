@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultSocketMode only allows the current user to connect
+const defaultSocketMode os.FileMode = 0600
+
+// ListenerConfig defines an additional socket the server accepts commands on,
+// with its own permissions and allow rules
+type ListenerConfig struct {
+	Path  string `yaml:"path"`
+	Mode  string `yaml:"mode"`
+	Rules `yaml:",inline"`
+}
+
+// serverListener is a socket the server accepts connections on, along with
+// the rules applied to the commands arriving on it
+type serverListener struct {
+	net.Listener
+	path string
+
+	// rules are swapped as a whole when the rules are reloaded
+	rules atomic.Pointer[Rules]
+
+	// control marks the control socket, which has no rules and only takes
+	// control commands
+	control bool
+
+	// socketFile is the socket file the server created at path, nil for
+	// listeners without a file of ours to remove
+	socketFile  os.FileInfo
+	cleanupOnce sync.Once
+}
+
+// newServerListener wraps a listener serving rules
+func newServerListener(listener net.Listener, path string, rules *Rules) *serverListener {
+	l := &serverListener{Listener: listener, path: path}
+	l.rules.Store(rules)
+	return l
+}
+
+// newSocketListener wraps a Unix socket listener the server created at path
+func newSocketListener(listener net.Listener, path string, rules *Rules) *serverListener {
+	l := newServerListener(listener, path, rules)
+	if isAbstractSocket(path) {
+		return l
+	}
+	if fi, err := os.Stat(path); err == nil {
+		l.socketFile = fi
+	}
+	return l
+}
+
+// cleanup closes the listener and removes its socket file. Only the file the
+// server created is removed, so a socket another server has since put at the
+// same path is left alone. It is safe to call more than once and from
+// several goroutines.
+func (l *serverListener) cleanup() {
+	l.cleanupOnce.Do(func() {
+		if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Failed to close listener on %s: %v", l.path, err)
+		}
+		if l.socketFile == nil {
+			return
+		}
+
+		fi, err := os.Stat(l.path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Failed to remove socket during cleanup: %v", err)
+			}
+			return
+		}
+		if !os.SameFile(fi, l.socketFile) {
+			log.Printf("Not removing %s, it was replaced by another process", l.path)
+			return
+		}
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove socket during cleanup: %v", err)
+		}
+	})
+}
+
+// cleanupListeners closes every listener and removes the socket files the
+// server created
+func cleanupListeners(listeners []*serverListener) {
+	log.Println("Cleaning up and removing sockets...")
+	for _, l := range listeners {
+		l.cleanup()
+	}
+}
+
+// isAbstractSocket reports whether path names a socket in the Linux abstract
+// namespace, which has no file on disk
+func isAbstractSocket(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// parseSocketMode parses an octal permission string like "0660", defaulting to 0600
+func parseSocketMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return defaultSocketMode, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode&^0777 != 0 {
+		return 0, fmt.Errorf("invalid socket mode %q", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// validateListeners checks the listener definitions
+func validateListeners(listeners []ListenerConfig) error {
+	seen := make(map[string]bool)
+	for i, l := range listeners {
+		if l.Path == "" {
+			return fmt.Errorf("listeners[%d]: path is required", i)
+		}
+		if seen[l.Path] {
+			return fmt.Errorf("listeners[%d]: duplicate path %s", i, l.Path)
+		}
+		seen[l.Path] = true
+
+		if _, err := parseSocketMode(l.Mode); err != nil {
+			return fmt.Errorf("listeners[%d]: %w", i, err)
+		}
+
+		if err := l.Rules.validate(); err != nil {
+			return fmt.Errorf("listeners[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// expandSocketPath replaces the {user} and {uid} placeholders in path with
+// username and uid
+func expandSocketPath(path, username string, uid int) string {
+	return strings.NewReplacer("{user}", username, "{uid}", strconv.Itoa(uid)).Replace(path)
+}
+
+// expandSocketPaths expands the placeholders in the socket paths of cfg for
+// the user running the server, so a config shared by several users gives
+// each of them sockets of their own
+func expandSocketPaths(cfg *Config) error {
+	paths := []*string{&cfg.SocketPath, &cfg.ControlSocketPath}
+	for i := range cfg.Listeners {
+		paths = append(paths, &cfg.Listeners[i].Path)
+	}
+
+	// Only look the user up when a path needs the name
+	var username string
+	for _, path := range paths {
+		if !strings.Contains(*path, "{user}") {
+			continue
+		}
+		usr, err := user.Current()
+		if err != nil {
+			return fmt.Errorf("expanding {user} in %s: %w", *path, err)
+		}
+		username = usr.Username
+		break
+	}
+
+	for _, path := range paths {
+		*path = expandSocketPath(*path, username, os.Getuid())
+	}
+	return nil
+}
+
+// validateControlSocket checks the control socket settings. Its path must
+// not be shared with a command socket, and require_approval rules need it,
+// as a client of a command socket could otherwise approve its own command.
+func validateControlSocket(cfg *Config) error {
+	if cfg.ControlSocketPath == "" {
+		if cfg.Rules.requireApproval() || slices.ContainsFunc(cfg.Listeners, func(l ListenerConfig) bool { return l.Rules.requireApproval() }) {
+			return fmt.Errorf("require_approval needs control_socket_path, approvals are only accepted on the control socket")
+		}
+		return nil
+	}
+	if _, err := parseSocketMode(cfg.ControlSocketMode); err != nil {
+		return fmt.Errorf("control_socket_mode: %w", err)
+	}
+	if cfg.ControlSocketPath == cfg.SocketPath {
+		return fmt.Errorf("control_socket_path %s is already used as socket_path", cfg.ControlSocketPath)
+	}
+	for i, l := range cfg.Listeners {
+		if l.Path == cfg.ControlSocketPath {
+			return fmt.Errorf("control_socket_path %s is already used by listeners[%d]", cfg.ControlSocketPath, i)
+		}
+	}
+	return nil
+}
+
+// setupListeners creates the main socket and every additional listener in cfg
+func setupListeners(cfg *Config) ([]*serverListener, error) {
+	var listeners []*serverListener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.cleanup()
+		}
+	}
+
+	listener, err := setupSocket(cfg.SocketPath, defaultSocketMode)
+	if err != nil {
+		return nil, err
+	}
+	listeners = append(listeners, newSocketListener(listener, cfg.SocketPath, &cfg.Rules))
+
+	for i := range cfg.Listeners {
+		l := &cfg.Listeners[i]
+		if l.Path == cfg.SocketPath {
+			closeAll()
+			return nil, fmt.Errorf("listener path %s is already used as socket_path", l.Path)
+		}
+
+		mode, err := parseSocketMode(l.Mode)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		listener, err := setupSocket(l.Path, mode)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		listeners = append(listeners, newSocketListener(listener, l.Path, &l.Rules))
+	}
+
+	if cfg.ControlSocketPath != "" {
+		mode, err := parseSocketMode(cfg.ControlSocketMode)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		listener, err := setupSocket(cfg.ControlSocketPath, mode)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		control := newSocketListener(listener, cfg.ControlSocketPath, nil)
+		control.control = true
+		listeners = append(listeners, control)
+	}
+
+	return listeners, nil
+}
+
+// socketCheckInterval is how often the server checks its socket files are
+// still in place
+const socketCheckInterval = 10 * time.Second
+
+// watchSocketFiles checks every interval that the socket files the server
+// created still exist. A socket removed under a running server, e.g. when
+// the OS cleans up XDG_RUNTIME_DIR, leaves it listening where no client can
+// connect, so stop is called to shut it down for a supervisor to restart it
+// with a fresh socket. The same goes for a socket replaced by another
+// process. Nothing happens once ctx is cancelled.
+func watchSocketFiles(ctx context.Context, interval time.Duration, listeners []*serverListener, stop func()) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			for _, l := range listeners {
+				if l.socketFile == nil {
+					continue
+				}
+				fi, err := os.Stat(l.path)
+				switch {
+				case errors.Is(err, os.ErrNotExist):
+					log.Printf("Socket file %s was removed while the server was running, shutting down so it can be restarted", l.path)
+				case err == nil && !os.SameFile(fi, l.socketFile):
+					log.Printf("Socket file %s was replaced by another process, shutting down so it can be restarted", l.path)
+				default:
+					continue
+				}
+				stop()
+				return
+			}
+		}
+	}()
+}
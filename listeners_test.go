@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMultipleListeners tests that each listener enforces its own rules and mode
+func TestMultipleListeners(t *testing.T) {
+	installFakeOp(t, nil)
+	groupSocket := filepath.Join(setupTestEnvironment(t).socketPath + ".group")
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+allowed_prefixes:
+  - "item get"
+listeners:
+  - path: %q
+    mode: "0660"
+    allowed_prefixes:
+      - "read op://Shared/"
+`, groupSocket))
+	serveConfig(t, cfg)
+
+	tests := []struct {
+		socket  string
+		command string
+		allowed bool
+	}{
+		{cfg.SocketPath, "item get foo", true},
+		{cfg.SocketPath, "read op://Shared/db/password", false},
+		{groupSocket, "item get foo", false},
+		{groupSocket, "read op://Shared/db/password", true},
+	}
+	for _, tt := range tests {
+		response, err := sendCommand(t, tt.socket, tt.command)
+		if err != nil {
+			t.Fatalf("Failed to send command: %v", err)
+		}
+		denied := strings.Contains(response, "Error: Command not allowed")
+		if denied == tt.allowed {
+			t.Errorf("Command %q on %s: expected allowed=%v, got response %q", tt.command, tt.socket, tt.allowed, response)
+		}
+	}
+
+	for socket, want := range map[string]os.FileMode{cfg.SocketPath: 0600, groupSocket: 0660} {
+		info, err := os.Stat(socket)
+		if err != nil {
+			t.Fatalf("Failed to stat socket: %v", err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("Expected %s to have mode %04o, got %04o", socket, want, got)
+		}
+	}
+}
+
+// TestInvalidListeners tests that malformed listener definitions are rejected at load
+func TestInvalidListeners(t *testing.T) {
+	tests := map[string]string{
+		"missing path":   "listeners:\n  - mode: \"0600\"\n",
+		"invalid mode":   "listeners:\n  - path: /tmp/a.sock\n    mode: \"rw\"\n",
+		"mode too wide":  "listeners:\n  - path: /tmp/a.sock\n    mode: \"4777\"\n",
+		"duplicate path": "listeners:\n  - path: /tmp/a.sock\n  - path: /tmp/a.sock\n",
+		"invalid glob":   "listeners:\n  - path: /tmp/a.sock\n    allowed_globs: [\"[\"]\n",
+	}
+	for name, listeners := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := writeTestConfig(t, "account: test-account\n"+listeners)
+			if _, err := loadConfig(path); err == nil {
+				t.Errorf("Expected error for %s, got nil", name)
+			}
+		})
+	}
+}
+
+// TestCleanupRemovesSocketOnce tests that concurrent cleanups remove each
+// socket exactly once without logging errors
+func TestCleanupRemovesSocketOnce(t *testing.T) {
+	env := setupTestEnvironment(t)
+	cfg := Config{SocketPath: env.socketPath, Account: env.account}
+
+	listeners, err := setupListeners(&cfg)
+	if err != nil {
+		t.Fatalf("Failed to set up socket: %v", err)
+	}
+	logs := captureLog(t)
+
+	// Signal handling and the panic recovery in runServer may both clean up
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cleanupListeners(listeners)
+		}()
+	}
+	wg.Wait()
+
+	if _, err := os.Stat(env.socketPath); !os.IsNotExist(err) {
+		t.Errorf("Expected socket to be removed, stat returned: %v", err)
+	}
+	if strings.Contains(logs.String(), "Failed") {
+		t.Errorf("Expected no cleanup errors, got logs:\n%s", logs.String())
+	}
+}
+
+// TestCleanupKeepsReplacedSocket tests that a socket file another process put
+// at the same path is not removed
+func TestCleanupKeepsReplacedSocket(t *testing.T) {
+	env := setupTestEnvironment(t)
+	cfg := Config{SocketPath: env.socketPath, Account: env.account}
+
+	listeners, err := setupListeners(&cfg)
+	if err != nil {
+		t.Fatalf("Failed to set up socket: %v", err)
+	}
+
+	if err := os.Remove(env.socketPath); err != nil {
+		t.Fatalf("Failed to remove socket: %v", err)
+	}
+	if err := os.WriteFile(env.socketPath, nil, 0600); err != nil {
+		t.Fatalf("Failed to replace socket: %v", err)
+	}
+
+	cleanupListeners(listeners)
+	if _, err := os.Stat(env.socketPath); err != nil {
+		t.Errorf("Expected replaced socket to be kept, stat returned: %v", err)
+	}
+}
+
+// TestCleanupTCPListener tests that cleaning up a listener without a socket
+// file of ours closes it without removing anything
+func TestCleanupTCPListener(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	// A file at the listener's path must survive cleanup
+	path := filepath.Join(t.TempDir(), "not-ours")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	l := newServerListener(tcp, path, &Rules{})
+	l.cleanup()
+	l.cleanup()
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected file to be kept, stat returned: %v", err)
+	}
+	if _, err := tcp.Accept(); err == nil {
+		t.Error("Expected listener to be closed")
+	}
+}
+
+// TestWatchSocketFiles tests that the server is stopped once its socket file
+// is removed from under it, and only then
+func TestWatchSocketFiles(t *testing.T) {
+	cfg := loadTestConfig(t, "")
+	listener, err := setupSocket(cfg.SocketPath, defaultSocketMode)
+	if err != nil {
+		t.Fatalf("Failed to set up socket: %v", err)
+	}
+	l := newSocketListener(listener, cfg.SocketPath, &cfg.Rules)
+	t.Cleanup(l.cleanup)
+	logs := captureLog(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stopped := make(chan struct{})
+	watchSocketFiles(ctx, 10*time.Millisecond, []*serverListener{l}, func() { close(stopped) })
+
+	select {
+	case <-stopped:
+		t.Fatal("Expected the server to keep running while its socket is in place")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := os.Remove(cfg.SocketPath); err != nil {
+		t.Fatalf("Failed to remove socket: %v", err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the server to stop once its socket was removed")
+	}
+	if want := "Socket file " + cfg.SocketPath + " was removed while the server was running"; !strings.Contains(logs.String(), want) {
+		t.Errorf("Expected the log to contain %q, got %q", want, logs.String())
+	}
+}
+
+// TestExpandSocketPath tests that the socket path placeholders expand to the
+// user given, so users sharing a config get sockets of their own
+func TestExpandSocketPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		username string
+		uid      int
+		want     string
+	}{
+		{"/run/opfwd/{user}.sock", "alice", 1000, "/run/opfwd/alice.sock"},
+		{"/run/user/{uid}/opfwd.sock", "alice", 1000, "/run/user/1000/opfwd.sock"},
+		{"/tmp/opfwd-{user}-{uid}/{user}.sock", "bob", 1001, "/tmp/opfwd-bob-1001/bob.sock"},
+		{"/tmp/opfwd.sock", "bob", 1001, "/tmp/opfwd.sock"},
+		{"/tmp/{home}.sock", "bob", 1001, "/tmp/{home}.sock"},
+	}
+	for _, tt := range tests {
+		if got := expandSocketPath(tt.path, tt.username, tt.uid); got != tt.want {
+			t.Errorf("expandSocketPath(%q, %q, %d) = %q, want %q", tt.path, tt.username, tt.uid, got, tt.want)
+		}
+	}
+
+	template := "/run/opfwd/{user}-{uid}.sock"
+	if alice, bob := expandSocketPath(template, "alice", 1000), expandSocketPath(template, "bob", 1001); alice == bob {
+		t.Errorf("Expected two users to get different sockets, both got %s", alice)
+	}
+}
+
+// TestSocketPathPlaceholders tests that loading a config expands the
+// placeholders of every socket path for the user running the server
+func TestSocketPathPlaceholders(t *testing.T) {
+	usr, err := user.Current()
+	if err != nil {
+		t.Skipf("Cannot look up the current user: %v", err)
+	}
+	dir := t.TempDir()
+	path := writeTestConfig(t, fmt.Sprintf(`
+account: test-account
+socket_path: %q
+control_socket_path: %q
+listeners:
+  - path: %q
+`, dir+"/{user}.sock", dir+"/{uid}-control.sock", dir+"/{user}-{uid}-group.sock"))
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	uid := strconv.Itoa(os.Getuid())
+	if want := dir + "/" + usr.Username + ".sock"; cfg.SocketPath != want {
+		t.Errorf("Expected socket_path %s, got %s", want, cfg.SocketPath)
+	}
+	if want := dir + "/" + uid + "-control.sock"; cfg.ControlSocketPath != want {
+		t.Errorf("Expected control_socket_path %s, got %s", want, cfg.ControlSocketPath)
+	}
+	if want := dir + "/" + usr.Username + "-" + uid + "-group.sock"; cfg.Listeners[0].Path != want {
+		t.Errorf("Expected listener path %s, got %s", want, cfg.Listeners[0].Path)
+	}
+}
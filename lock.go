@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// accountLock is held by a running server for its account, so a second
+// server for the same account doesn't sign in over the first one's session
+type accountLock struct {
+	file *os.File
+}
+
+// getLockDir returns the directory holding the account lock files,
+// $XDG_RUNTIME_DIR/opfwd when set and the config directory otherwise
+func getLockDir() (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "opfwd"), nil
+	}
+	return getConfigDir()
+}
+
+// accountLockPath returns the lock file of account
+func accountLockPath(account string) (string, error) {
+	dir, err := getLockDir()
+	if err != nil {
+		return "", err
+	}
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, account)
+	return filepath.Join(dir, name+".lock"), nil
+}
+
+// acquireAccountLock takes the lock of account, failing with the PID of the
+// server holding it when another server runs for the same account
+func acquireAccountLock(account string) (*accountLock, error) {
+	path, err := accountLockPath(account)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("creating lock directory: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening lock file: %w", err)
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			data, _ := os.ReadFile(path)
+			pid := strings.TrimSpace(string(data))
+			if pid == "" {
+				pid = "unknown"
+			}
+			return nil, fmt.Errorf("another opfwd server is already running for account %s (pid %s, lock file %s)", account, pid, path)
+		}
+		return nil, fmt.Errorf("locking %s: %w", path, err)
+	}
+
+	// Record who holds the lock for the error message above
+	if err := file.Truncate(0); err == nil {
+		_, _ = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &accountLock{file: file}, nil
+}
+
+// release gives up the lock
+func (l *accountLock) release() {
+	_ = syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+}
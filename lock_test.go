@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestAccountLock tests that a second server for the same account is refused
+func TestAccountLock(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	first, err := acquireAccountLock("my-account")
+	if err != nil {
+		t.Fatalf("Failed to acquire lock: %v", err)
+	}
+
+	_, err = acquireAccountLock("my-account")
+	if err == nil {
+		t.Fatal("Expected a second lock for the same account to fail")
+	}
+	if want := fmt.Sprintf("already running for account my-account (pid %d", os.Getpid()); !strings.Contains(err.Error(), want) {
+		t.Errorf("Expected error pointing at the running server, got: %v", err)
+	}
+
+	// Other accounts are unaffected
+	other, err := acquireAccountLock("other-account")
+	if err != nil {
+		t.Fatalf("Expected lock for another account, got: %v", err)
+	}
+	other.release()
+
+	// The lock can be taken again once released
+	first.release()
+	again, err := acquireAccountLock("my-account")
+	if err != nil {
+		t.Fatalf("Expected lock after release, got: %v", err)
+	}
+	again.release()
+}
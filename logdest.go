@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"os"
+	"sync"
+)
+
+// logFile is a log file that can be reopened under the same path, so the
+// server follows logrotate moving the old file away
+type logFile struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// openLogFile opens path for appending, creating it readable only by the
+// server's user
+func openLogFile(path string) (*logFile, error) {
+	l := &logFile{path: path}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Write appends p to the file currently open
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(p)
+}
+
+// reopen opens the file at path again and closes the previous one
+func (l *logFile) reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("opening log file: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f = f
+	return nil
+}
+
+// Close closes the file currently open
+func (l *logFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// activeLogFile is the log file of the running server, nil when it doesn't
+// log to a file
+var activeLogFile struct {
+	mu   sync.Mutex
+	file *logFile
+}
+
+// setupLogging points the standard logger at the log file and syslog when cfg
+// asks for them, instead of stderr. The returned function closes them again.
+func setupLogging(cfg *Config) (func(), error) {
+	if cfg.LogFile == "" && !cfg.Syslog {
+		return func() {}, nil
+	}
+
+	var writers []io.Writer
+	var closers []io.Closer
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	if cfg.LogFile != "" {
+		file, err := openLogFile(cfg.LogFile)
+		if err != nil {
+			return nil, err
+		}
+		writers = append(writers, file)
+		closers = append(closers, file)
+	}
+	if cfg.Syslog {
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "opfwd")
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("connecting to syslog: %w", err)
+		}
+		writers = append(writers, w)
+		closers = append(closers, w)
+	}
+
+	activeLogFile.mu.Lock()
+	activeLogFile.file, _ = writers[0].(*logFile)
+	activeLogFile.mu.Unlock()
+
+	prev := log.Writer()
+	log.SetOutput(io.MultiWriter(writers...))
+	return func() {
+		log.SetOutput(prev)
+		activeLogFile.mu.Lock()
+		activeLogFile.file = nil
+		activeLogFile.mu.Unlock()
+		closeAll()
+	}, nil
+}
+
+// reopenLogFile reopens the log file of the running server, if any, after
+// logrotate has moved it away
+func reopenLogFile() {
+	activeLogFile.mu.Lock()
+	file := activeLogFile.file
+	activeLogFile.mu.Unlock()
+	if file == nil {
+		return
+	}
+
+	if err := file.reopen(); err != nil {
+		log.Printf("Failed to reopen the log file, still writing to the old one: %v", err)
+		return
+	}
+	log.Printf("Reopened log file %s", file.path)
+}
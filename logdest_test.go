@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestLogFile tests that a configured log file receives the logs, is created
+// private and is reopened on SIGHUP after being moved away
+func TestLogFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "opfwd.log")
+	closeLogging, err := setupLogging(&Config{LogFile: path})
+	if err != nil {
+		t.Fatalf("Failed to set up logging: %v", err)
+	}
+	t.Cleanup(closeLogging)
+
+	log.Println("first line")
+	data, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(data), "first line") {
+		t.Fatalf("Expected the log file to receive the line, got %q: %v", data, err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected the log file with mode 0600, got %v: %v", fi, err)
+	}
+
+	// Rotate the file the way logrotate does, then signal the server
+	rotated := path + ".1"
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatalf("Failed to rotate the log file: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleReloadSignal(ctx)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("Failed to send SIGHUP: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if data, err := os.ReadFile(path); err == nil && strings.Contains(string(data), "Reopened log file") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the log file to be reopened")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	log.Println("second line")
+	data, err = os.ReadFile(path)
+	if err != nil || !strings.Contains(string(data), "second line") {
+		t.Errorf("Expected the reopened log file to receive the line, got %q: %v", data, err)
+	}
+	if old, _ := os.ReadFile(rotated); strings.Contains(string(old), "second line") {
+		t.Errorf("Expected the rotated file to get no further lines, got %q", old)
+	}
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -17,7 +22,10 @@ import (
 	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"text/template"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -54,12 +62,267 @@ func initVersion() {
 	}
 }
 
+// versionInfo is the machine-readable form of the version information
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+// printVersion writes the version information to w, as a JSON object when
+// asJSON is set
+func printVersion(w io.Writer, asJSON bool) error {
+	if asJSON {
+		return json.NewEncoder(w).Encode(versionInfo{
+			Version:   version,
+			Commit:    commit,
+			BuildDate: buildDate,
+			GoVersion: goVersion,
+		})
+	}
+
+	fmt.Fprintf(w, "opfwd version %s\n", version)
+	fmt.Fprintf(w, "Commit: %s\n", commit)
+	if buildDate != "" {
+		fmt.Fprintf(w, "Build Date: %s\n", buildDate)
+	}
+	fmt.Fprintf(w, "Go Version: %s\n", goVersion)
+	return nil
+}
+
+// printPaths writes the default config and socket paths to w, as resolved
+// from the XDG base directories and the home directory
+func printPaths(w io.Writer) error {
+	configPath, err := getDefaultConfigPath()
+	if err != nil {
+		return err
+	}
+	socketPath, err := getDefaultSocketPath()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "config: %s\n", configPath)
+	fmt.Fprintf(w, "socket: %s\n", socketPath)
+	return nil
+}
+
 // Config holds the server configuration
 type Config struct {
-	SocketPath      string   `yaml:"socket_path"`
-	Account         string   `yaml:"account"`
-	AllowedCommands []string `yaml:"allowed_commands"`
-	AllowedPrefixes []string `yaml:"allowed_prefixes"`
+	// Version is the config format version, see currentConfigVersion
+	Version int `yaml:"version"`
+
+	// Profiles are named sets of settings, one of which -profile merges over
+	// the top-level settings, so one file can serve several accounts
+	Profiles map[string]yaml.Node `yaml:"profiles"`
+
+	// SocketPath is where the server listens. {user} and {uid} in it, and
+	// in the paths of the other sockets, are replaced with the name and ID
+	// of the user running the server.
+	SocketPath  string `yaml:"socket_path"`
+	Account     string `yaml:"account"`
+	Rules       `yaml:",inline"`
+	DenyMessage string `yaml:"deny_message"`
+
+	// RulesDir is a directory of *.yaml files whose rules are merged into
+	// the rules of the main socket, relative to the config file
+	RulesDir string `yaml:"rules_dir"`
+
+	// CaseInsensitive matches exact and prefix rules ignoring case. op
+	// itself may still treat the names in op:// references as case-sensitive.
+	CaseInsensitive bool `yaml:"case_insensitive"`
+
+	// Banner is a one-line notice, like "Access logged", sent to clients
+	// that ask for metadata
+	Banner string `yaml:"banner"`
+
+	// Listeners are additional sockets served with their own permissions and rules
+	Listeners []ListenerConfig `yaml:"listeners"`
+
+	// ControlSocketPath is a socket serving only the control commands, which
+	// the command sockets then refuse. ControlSocketMode sets its permissions.
+	ControlSocketPath string `yaml:"control_socket_path"`
+	ControlSocketMode string `yaml:"control_socket_mode"`
+
+	// ControlCommands enables control commands by name, each for its own
+	// users. Nil enables every control command for the server's user.
+	ControlCommands []ControlCommandConfig `yaml:"control_commands"`
+
+	// MinOpVersion is the oldest op version the server runs against. Older
+	// versions are logged as a warning, or refused when RequireOpVersion is set.
+	MinOpVersion     string `yaml:"min_op_version"`
+	RequireOpVersion bool   `yaml:"require_op_version"`
+
+	// LogFormat is the format of structured log events like the startup
+	// summary, "text" (the default) or "json"
+	LogFormat string `yaml:"log_format"`
+
+	// LogFile is a file the server logs to instead of stderr, reopened on
+	// SIGHUP. Syslog sends the logs to the system logger, along with LogFile
+	// when both are set.
+	LogFile string `yaml:"log_file"`
+	Syslog  bool   `yaml:"syslog"`
+
+	// MaskPaths logs socket paths by their file name only, for shared hosts
+	MaskPaths bool `yaml:"mask_paths"`
+
+	// LogClientProcess logs the PID of the local process behind each
+	// request, with its command name and executable on Linux, and adds them
+	// to the audit log
+	LogClientProcess bool `yaml:"log_client_process"`
+
+	// StartupCheck makes the server check it is signed in to 1Password
+	// before accepting commands. A failure is logged as a warning, or stops
+	// the server when RequireStartupCheck is set.
+	StartupCheck        bool `yaml:"startup_check"`
+	RequireStartupCheck bool `yaml:"require_startup_check"`
+
+	// VerifyAccount makes the server check at startup that Account is one of
+	// the accounts `op account list` shows. A failure is a warning, or stops
+	// the server when RequireStartupCheck is set.
+	VerifyAccount bool `yaml:"verify_account"`
+
+	// AutoSignin lets the server run `op signin` when the account isn't
+	// signed in, nil for the default of true
+	AutoSignin *bool `yaml:"auto_signin"`
+
+	// KeepAliveInterval is how often the server checks its 1Password session
+	// between commands, signing in again when it expired, so commands don't
+	// wait for op to set one up. Zero only checks when a command arrives.
+	KeepAliveInterval time.Duration `yaml:"keep_alive_interval"`
+
+	// AuthFailureThreshold is the number of consecutive op auth failures after
+	// which the server signs in afresh before the next command, zero to never
+	AuthFailureThreshold int `yaml:"auth_failure_threshold"`
+
+	// RateLimitPatterns are fragments of op errors meaning 1Password rate
+	// limits the account, matched case-insensitively, defaultRateLimitPatterns
+	// when empty. Commands are then refused for RateLimitCooldown, or
+	// defaultRateLimitCooldown when zero.
+	RateLimitPatterns []string      `yaml:"rate_limit_patterns"`
+	RateLimitCooldown time.Duration `yaml:"rate_limit_cooldown"`
+
+	// ReadCacheTTL is how long the output of a command starting with one of
+	// CacheablePrefixes is served again without running op, zero to never
+	// cache. Failed commands are never cached.
+	ReadCacheTTL      time.Duration `yaml:"read_cache_ttl"`
+	CacheablePrefixes []string      `yaml:"cacheable_prefixes"`
+
+	// InvalidatingPrefixes mark commands that write to 1Password, like
+	// `item create`. Once one has run, the cached outputs of commands that
+	// may read the vault and item it names are dropped, so a read right
+	// after it sees the change.
+	InvalidatingPrefixes []string `yaml:"invalidating_prefixes"`
+
+	// PostHook is a command run in the background after each request
+	PostHook        string        `yaml:"post_hook"`
+	PostHookTimeout time.Duration `yaml:"post_hook_timeout"`
+
+	// AuditLog is the file every finished request is appended to as a JSON
+	// line, empty to not keep one
+	AuditLog string `yaml:"audit_log"`
+
+	// ShutdownGrace is how long a shutdown waits for the commands in flight,
+	// defaultShutdownGrace when zero
+	ShutdownGrace time.Duration `yaml:"shutdown_grace"`
+
+	// PidFile is where the server records its PID while running, empty to
+	// not write one. A server refuses to start while the file names a
+	// running process.
+	PidFile string `yaml:"pid_file"`
+
+	// ApprovalTimeout is how long a command of a require_approval rule waits
+	// for its approval, defaultApprovalTimeout when zero
+	ApprovalTimeout time.Duration `yaml:"approval_timeout"`
+
+	// MaxUptime makes the server shut down gracefully after running this
+	// long, for a supervisor to restart it. Zero runs it indefinitely.
+	MaxUptime time.Duration `yaml:"max_uptime"`
+
+	// MaxConcurrent is how many connections are handled at once, further
+	// ones wait for a handler to finish. Zero handles them all at once.
+	MaxConcurrent int `yaml:"max_concurrent"`
+
+	// MaxDistinctSecrets is how many distinct commands a single user may run
+	// within DistinctWindow, defaultDistinctWindow when zero, to limit what
+	// a compromised client can pull. Zero doesn't limit them.
+	MaxDistinctSecrets int           `yaml:"max_distinct_secrets"`
+	DistinctWindow     time.Duration `yaml:"distinct_window"`
+
+	// MaxCommandsPerConn is how many commands a client may send on one
+	// connection, defaultMaxCommandsPerConn when zero
+	MaxCommandsPerConn int `yaml:"max_commands_per_conn"`
+
+	// CommandTimeout bounds how long op may run for a single command, zero
+	// for no limit
+	CommandTimeout time.Duration `yaml:"command_timeout"`
+
+	// DefaultOpArgs are flags added to every op command the client didn't
+	// set itself, like ["--format", "json"]. DefaultOpArgsPosition puts
+	// them after the command ("append", the default) or before it ("prepend").
+	DefaultOpArgs         []string `yaml:"default_op_args"`
+	DefaultOpArgsPosition string   `yaml:"default_op_args_position"`
+
+	// MaxResponseBytes caps the op output sent to the client, op is stopped
+	// once it is reached. Zero means unlimited.
+	MaxResponseBytes int64 `yaml:"max_response_bytes"`
+
+	// NoExecute validates and logs commands without ever running op, for
+	// trying out rule changes against real traffic
+	NoExecute bool `yaml:"no_execute"`
+
+	// Quiet leaves the informational lines out of the log of each request,
+	// like the command received and the op arguments, and only keeps
+	// denials, warnings and errors
+	Quiet bool `yaml:"quiet"`
+
+	// OpPath is the op binary to run, "op" from PATH when empty
+	OpPath string `yaml:"op_path"`
+
+	// OpConfigDir is passed to op as OP_CONFIG_DIR, so the sessions of
+	// servers for different accounts don't collide. Empty leaves op's default.
+	OpConfigDir string `yaml:"op_config_dir"`
+
+	// OpWrapper is a command and arguments op is run under when executing
+	// client commands, like ["nice", "-n", "10"]
+	OpWrapper []string `yaml:"op_wrapper"`
+
+	// TimeWindows restricts commands to the listed times, always allowed when empty
+	TimeWindows []TimeWindow `yaml:"time_windows"`
+
+	// Bundles map a name to the op:// references `@bundle NAME` reads at once
+	Bundles map[string][]string `yaml:"bundles"`
+
+	// Aliases map a name to the command `@alias NAME` runs, which the client
+	// sends when invoked through a symlink of that name
+	Aliases map[string]string `yaml:"aliases"`
+
+	// Rewrites turn commands in an older op syntax into the one the rules
+	// are written for, applied in order before the rules are checked
+	Rewrites []Rewrite `yaml:"rewrites"`
+
+	// DeniedFields are field names no command may target through an op://
+	// reference or --fields, whatever the rules allow
+	DeniedFields []string `yaml:"denied_fields"`
+
+	// SigningKeyFile is a file holding a key shared with the clients, which
+	// must then sign every request arriving other than on a Unix socket.
+	// SigningMaxSkew is how far their timestamps may be from the server's
+	// clock, defaultSigningMaxSkew when zero.
+	SigningKeyFile string        `yaml:"signing_key_file"`
+	SigningMaxSkew time.Duration `yaml:"signing_max_skew"`
+
+	// signingKey is the key read from SigningKeyFile, nil when unset
+	signingKey []byte
+
+	// denyTemplate is the parsed DenyMessage, nil when unset
+	denyTemplate *template.Template
+}
+
+// denyMessageData is the data available to the DenyMessage template
+type denyMessageData struct {
+	Command   string
+	RequestID string
 }
 
 // Global config for access in functions
@@ -67,6 +330,9 @@ var config Config
 
 // loadConfig loads configuration from YAML file
 func loadConfig(path string) (Config, error) {
+	if err := checkConfigPerms(path); err != nil {
+		return Config{}, err
+	}
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return Config{}, fmt.Errorf("reading config file: %w", err)
@@ -76,204 +342,992 @@ func loadConfig(path string) (Config, error) {
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return Config{}, fmt.Errorf("parsing config file: %w", err)
 	}
+	if err := applyProfile(&cfg, configProfile); err != nil {
+		return Config{}, err
+	}
+	if err := migrateConfig(&cfg); err != nil {
+		return Config{}, err
+	}
 
 	// Validate required fields
 	if cfg.Account == "" {
 		return Config{}, fmt.Errorf("account is required in config")
 	}
 
+	if cfg.RulesDir != "" {
+		if !filepath.IsAbs(cfg.RulesDir) {
+			cfg.RulesDir = filepath.Join(filepath.Dir(path), cfg.RulesDir)
+		}
+		if cfg.Rules, err = loadRulesDir(cfg.Rules, cfg.RulesDir); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if err := cfg.Rules.validate(); err != nil {
+		return Config{}, err
+	}
+	if err := validateListeners(cfg.Listeners); err != nil {
+		return Config{}, err
+	}
+	if err := validateTimeWindows(cfg.TimeWindows); err != nil {
+		return Config{}, err
+	}
+	if err := validateDefaultOpArgs(cfg.DefaultOpArgs, cfg.DefaultOpArgsPosition); err != nil {
+		return Config{}, err
+	}
+	socketRules := []*Rules{&cfg.Rules}
+	for i := range cfg.Listeners {
+		socketRules = append(socketRules, &cfg.Listeners[i].Rules)
+	}
+	if err := validateDefaultOpArgsRules(cfg.DefaultOpArgs, socketRules...); err != nil {
+		return Config{}, err
+	}
+	if strings.ContainsAny(cfg.Banner, "\r\n") {
+		return Config{}, fmt.Errorf("banner must be a single line")
+	}
+	if cfg.MaxResponseBytes < 0 {
+		return Config{}, fmt.Errorf("max_response_bytes must not be negative")
+	}
+	if cfg.CommandTimeout < 0 {
+		return Config{}, fmt.Errorf("command_timeout must not be negative")
+	}
+	if err := validateLogFormat(cfg.LogFormat); err != nil {
+		return Config{}, err
+	}
+	if cfg.MaxConcurrent < 0 {
+		return Config{}, fmt.Errorf("max_concurrent must not be negative")
+	}
+	if cfg.MaxDistinctSecrets < 0 {
+		return Config{}, fmt.Errorf("max_distinct_secrets must not be negative")
+	}
+	if cfg.DistinctWindow < 0 {
+		return Config{}, fmt.Errorf("distinct_window must not be negative")
+	}
+	if cfg.MaxCommandsPerConn < 0 {
+		return Config{}, fmt.Errorf("max_commands_per_conn must not be negative")
+	}
+	if cfg.ApprovalTimeout < 0 {
+		return Config{}, fmt.Errorf("approval_timeout must not be negative")
+	}
+	if cfg.ShutdownGrace < 0 {
+		return Config{}, fmt.Errorf("shutdown_grace must not be negative")
+	}
+	if cfg.MaxUptime < 0 {
+		return Config{}, fmt.Errorf("max_uptime must not be negative")
+	}
+	if cfg.OpConfigDir != "" && !filepath.IsAbs(cfg.OpConfigDir) {
+		return Config{}, fmt.Errorf("op_config_dir must be an absolute path")
+	}
+	if cfg.KeepAliveInterval < 0 {
+		return Config{}, fmt.Errorf("keep_alive_interval must not be negative")
+	}
+	if cfg.AuthFailureThreshold < 0 {
+		return Config{}, fmt.Errorf("auth_failure_threshold must not be negative")
+	}
+	if cfg.RateLimitCooldown < 0 {
+		return Config{}, fmt.Errorf("rate_limit_cooldown must not be negative")
+	}
+	if cfg.ReadCacheTTL < 0 {
+		return Config{}, fmt.Errorf("read_cache_ttl must not be negative")
+	}
+	if cfg.ReadCacheTTL > 0 && len(cfg.CacheablePrefixes) == 0 {
+		return Config{}, fmt.Errorf("read_cache_ttl is set but no cacheable_prefixes mark commands as cacheable")
+	}
+	if err := validateAliases(cfg.Aliases); err != nil {
+		return Config{}, err
+	}
+	if err := validateBundles(cfg.Bundles); err != nil {
+		return Config{}, err
+	}
+	if err := validateRewrites(cfg.Rewrites); err != nil {
+		return Config{}, err
+	}
+	if err := validateDeniedFields(cfg.DeniedFields); err != nil {
+		return Config{}, err
+	}
+	if err := validateControlCommands(cfg.ControlCommands); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.SigningMaxSkew < 0 {
+		return Config{}, fmt.Errorf("signing_max_skew must not be negative")
+	}
+	if cfg.SigningKeyFile != "" {
+		if !filepath.IsAbs(cfg.SigningKeyFile) {
+			cfg.SigningKeyFile = filepath.Join(filepath.Dir(path), cfg.SigningKeyFile)
+		}
+		if cfg.signingKey, err = loadSigningKey(cfg.SigningKeyFile); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if cfg.DenyMessage != "" {
+		tmpl, err := template.New("deny_message").Parse(cfg.DenyMessage)
+		if err != nil {
+			return Config{}, fmt.Errorf("parsing deny_message: %w", err)
+		}
+		cfg.denyTemplate = tmpl
+	}
+
 	// Set default socket path if not specified
 	if cfg.SocketPath == "" {
-		usr, err := user.Current()
+		socketPath, err := getDefaultSocketPath()
 		if err != nil {
-			return Config{}, fmt.Errorf("getting current user: %w", err)
+			return Config{}, err
 		}
-		cfg.SocketPath = filepath.Join(usr.HomeDir, ".ssh", "opfwd.sock")
+		cfg.SocketPath = socketPath
+	}
+	if err := expandSocketPaths(&cfg); err != nil {
+		return Config{}, err
+	}
+	if err := validateControlSocket(&cfg); err != nil {
+		return Config{}, err
+	}
+
+	// Index large rule sets once instead of scanning them for every command
+	cfg.Rules.buildIndex(cfg.CaseInsensitive)
+	for i := range cfg.Listeners {
+		cfg.Listeners[i].Rules.buildIndex(cfg.CaseInsensitive)
 	}
 
 	return cfg, nil
 }
 
-// validateCommand checks if a command is allowed based on exact matches or prefix matches
-func validateCommand(input string) bool {
-	// Get the full command for validation
-	cmdWithArgs := strings.TrimSpace(input)
+// validateCommand checks if a command is allowed by rules based on exact, prefix or glob matches
+func validateCommand(rules *Rules, input string) bool {
+	_, ok := matchRule(rules, input, nil)
+	return ok
+}
+
+// ruleMatch identifies the rule that allowed a command
+type ruleMatch struct {
+	// kind is exact, prefix, glob, template, hash or subcommand
+	kind  string
+	match string
+
+	// rule is the matched rule, nil for hash and subcommand tree matches
+	rule *Rule
+}
+
+// requiresApproval reports whether the matched rule holds its commands until
+// they are approved
+func (m ruleMatch) requiresApproval() bool {
+	return m.rule != nil && m.rule.RequireApproval
+}
+
+// appendArgs returns the args the matched rule adds to the command
+func (m ruleMatch) appendArgs() []string {
+	if m.rule == nil {
+		return nil
+	}
+	return m.rule.AppendArgs
+}
+
+// String describes the match for logs and verbose clients
+func (m ruleMatch) String() string {
+	return m.kind + " " + m.match
+}
+
+// matchRule returns the rule allowing a command and whether it is allowed.
+// Expired rules it skips are logged to logger, if not nil.
+func matchRule(rules *Rules, input string, logger *log.Logger) (ruleMatch, bool) {
+	// Get the full command for validation, in canonical form
+	cmdWithArgs := canonicalizeCommand(input)
+
+	// Clients can't escape the account pinned by the server
+	if _, found := findServerManagedFlag(cmdWithArgs); found {
+		return ruleMatch{}, false
+	}
+
+	// Nor add a blocked flag to a command that is otherwise allowed
+	if _, found := rules.findBlockedFlag(cmdWithArgs); found {
+		return ruleMatch{}, false
+	}
+
+	// Nor read a field denied globally
+	if _, found := findDeniedField(cmdWithArgs, config.DeniedFields); found {
+		return ruleMatch{}, false
+	}
+
+	// Subcommands denied in the tree are never allowed, whatever the flat lists say
+	treeAllowed, treeDenied := rules.matchSubcommand(cmdWithArgs)
+	if treeDenied {
+		return ruleMatch{}, false
+	}
+
+	// Expired rules are treated as absent, so temporary grants lapse without a
+	// reload, and so are rules restricted to another vault than the command's
+	t := now()
+	usable := func(kind string, rule *Rule) bool {
+		if rule.expired(t) {
+			if logger != nil {
+				logger.Printf("Skipping expired %s rule: %s", kind, rule)
+			}
+			return false
+		}
+		return rule.allowsVaults(cmdWithArgs)
+	}
+
+	// Exact and prefix rules compare lowercased commands when case is ignored
+	fold := func(s string) string { return s }
+	if config.CaseInsensitive {
+		fold = strings.ToLower
+	}
+	folded := fold(cmdWithArgs)
+
+	// Large lists only have the rules their index points at checked
+	var exact, prefixes []int
+	if idx := rules.usableIndex(); idx != nil {
+		exact, prefixes = idx.exactCandidates(folded), idx.prefixCandidates(folded)
+	} else {
+		exact, prefixes = allPositions(len(rules.AllowedCommands)), allPositions(len(rules.AllowedPrefixes))
+	}
 
 	// Check for exact matches against the allowed commands
-	for _, allowed := range config.AllowedCommands {
-		if cmdWithArgs == allowed {
-			return true
+	for _, i := range exact {
+		allowed := rules.AllowedCommands[i]
+		if folded == fold(allowed.Match) && usable("exact", &rules.AllowedCommands[i]) {
+			return ruleMatch{kind: "exact", match: allowed.Match, rule: &rules.AllowedCommands[i]}, true
 		}
 	}
 
+	// Check for exact matches against the allowed hashes
+	if digest, ok := matchHash(rules.AllowedHashes, cmdWithArgs); ok {
+		return ruleMatch{kind: "hash", match: digest}, true
+	}
+
 	// Check for prefix matches
-	for _, prefix := range config.AllowedPrefixes {
-		if strings.HasPrefix(cmdWithArgs, prefix) {
-			return true
+	for _, i := range prefixes {
+		prefix := rules.AllowedPrefixes[i]
+		if strings.HasPrefix(folded, fold(prefix.Match)) && prefix.hasMinArgs(cmdWithArgs) && usable("prefix", &rules.AllowedPrefixes[i]) {
+			return ruleMatch{kind: "prefix", match: prefix.Match, rule: &rules.AllowedPrefixes[i]}, true
+		}
+	}
+
+	// Check for glob matches, patterns were validated when loading the config
+	for i, glob := range rules.AllowedGlobs {
+		if matchGlob(glob.Match, cmdWithArgs) && usable("glob", &rules.AllowedGlobs[i]) {
+			return ruleMatch{kind: "glob", match: glob.Match, rule: &rules.AllowedGlobs[i]}, true
 		}
 	}
 
-	return false
+	// Check for template matches, templates were compiled when loading the config
+	for i, tmpl := range rules.AllowedTemplates {
+		if tmpl.template == nil {
+			continue
+		}
+		if _, matched := tmpl.template.match(cmdWithArgs); matched && usable("template", &rules.AllowedTemplates[i]) {
+			return ruleMatch{kind: "template", match: tmpl.Match, rule: &rules.AllowedTemplates[i]}, true
+		}
+	}
+
+	if treeAllowed {
+		tokens := strings.Fields(cmdWithArgs)
+		return ruleMatch{kind: "subcommand", match: strings.Join(tokens[:min(len(tokens), 2)], " ")}, true
+	}
+	return ruleMatch{}, false
+}
+
+// denyMessage renders the response sent to the client when a command is denied
+func denyMessage(logger *log.Logger, input, reqID string) string {
+	fallback := fmt.Sprintf("Error: Command not allowed: %s\n", input)
+	if config.denyTemplate == nil {
+		return fallback
+	}
+
+	var buf bytes.Buffer
+	if err := config.denyTemplate.Execute(&buf, denyMessageData{Command: input, RequestID: reqID}); err != nil {
+		logger.Printf("Error rendering deny message: %v", err)
+		return fallback
+	}
+
+	msg := buf.String()
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+	return msg
+}
+
+// newRequestID returns a short random ID used to correlate the log lines of a connection
+func newRequestID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "00000000"
+	}
+	return hex.EncodeToString(b)
 }
 
-// handleConnection processes a single client connection
-func handleConnection(conn net.Conn) {
+// newRequestLogger returns a logger that prefixes every line with the request
+// ID, and drops the informational lines when Quiet is set
+func newRequestLogger(reqID string) *log.Logger {
+	w := log.Writer()
+	if config.Quiet {
+		w = quietWriter{w}
+	}
+	return log.New(w, "["+reqID+"] ", log.Flags()|log.Lmsgprefix)
+}
+
+// defaultMaxCommandsPerConn is the number of commands a connection may send
+// when MaxCommandsPerConn is unset
+const defaultMaxCommandsPerConn = 1
+
+// handleConnection processes a single client connection, validating its
+// commands against the rules of the listener it arrived on. Clients that set
+// statusFlag can tell where a response ends, so they may send further
+// commands on the same connection, up to MaxCommandsPerConn. It returns the
+// exit code reported for the last command.
+func handleConnection(conn net.Conn, rules *Rules) (exitCode int) {
+	logger := log.Default()
+
 	// Recover from panics in the connection handler
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Recovered from panic in connection handler: %v", r)
+			logger.Printf("Recovered from panic in connection handler: %v", r)
 			conn.Close()
+			exitCode = exitServerError
 		}
 	}()
 
 	defer conn.Close()
 
-	// Read the command with a scanner to handle arbitrary length commands
-	scanner := bufio.NewScanner(conn)
-	if !scanner.Scan() {
-		log.Printf("Error reading from connection: %v", scanner.Err())
+	maxCommands := config.MaxCommandsPerConn
+	if maxCommands <= 0 {
+		maxCommands = defaultMaxCommandsPerConn
+	}
+
+	r := bufio.NewReaderSize(conn, maxRequestLine)
+	greeted := false
+	for n := 1; ; n++ {
+		reqID := newRequestID()
+		logger = newRequestLogger(reqID)
+
+		// Read the request, either a JSON envelope or a bare command line
+		req, err := readRequest(r)
+		if err != nil {
+			if (n > 1 || greeted) && errors.Is(err, io.EOF) {
+				// The client is done with the connection
+				return exitCode
+			}
+			logger.Printf("Error reading from connection: %v", err)
+			if !errors.Is(err, io.EOF) {
+				_, _ = conn.Write([]byte(fmt.Sprintf("Error: Invalid request: %v\n", err)))
+			}
+			return exitPolicy
+		}
+		if strings.TrimSpace(req.Command) == endCommand {
+			return exitCode
+		}
+		if n == 1 && !greeted && isHello(req.Command) {
+			if _, err := answerHello(conn, req.Command, logger); err != nil {
+				return exitPolicy
+			}
+			greeted = true
+			n-- // The hello isn't one of the commands
+			continue
+		}
+		if signingRequired(conn) {
+			maxSkew := config.SigningMaxSkew
+			if maxSkew == 0 {
+				maxSkew = defaultSigningMaxSkew
+			}
+			path, err := noncePath()
+			if err == nil {
+				err = verifyRequest(req, config.signingKey, maxSkew, path)
+			}
+			if err != nil {
+				logger.Printf("Refusing request with a bad signature: %v", err)
+				out, done := openResponse(conn, req, logger)
+				if err := out.fail(exitPolicy, "Error: Invalid request signature: %v\n", err); err != nil {
+					logger.Printf("Error writing response: %v", err)
+				}
+				done(-1)
+				return exitPolicy
+			}
+		}
+
+		if n > maxCommands {
+			logger.Printf("Connection sent more than %d commands, closing it: %s", maxCommands, req.Command)
+			out, done := openResponse(conn, req, logger)
+			if err := out.fail(exitPolicy, "Error: Only %d commands are allowed per connection, reconnect to send more\n", maxCommands); err != nil {
+				logger.Printf("Error writing response: %v", err)
+			}
+			done(-1)
+			return exitPolicy
+		}
+
+		exitCode = handleRequest(conn, req, rules, reqID, logger)
+		if !req.hasFlag(statusFlag) {
+			// Only the end of the connection ends this response
+			return exitCode
+		}
+	}
+}
+
+// openResponse sets up the response to req on conn, compressed and framed
+// as the client asked. done ends it with the exit code of the request.
+func openResponse(conn net.Conn, req request, logger *log.Logger) (out *response, done func(exitCode int)) {
+	// Compress the response if the client accepts it
+	var w io.Writer = conn
+	var cw *compressWriter
+	if req.hasFlag(gzipFlag) {
+		cw = newCompressWriter(conn)
+		w = cw
+	}
+
+	// Frame the response if the client wants to know how the request ended,
+	// the exit frame goes out before the compressed stream is closed
+	out = newResponse(w, req.hasFlag(statusFlag))
+	return out, func(exitCode int) {
+		if err := out.close(exitCode); err != nil {
+			logger.Printf("Error writing response: %v", err)
+		}
+		if cw == nil || out.broken() {
+			return
+		}
+		if err := cw.Close(); err != nil {
+			logger.Printf("Error writing response: %v", err)
+		}
+	}
+}
+
+// handleRequest validates a single command and runs it if it is allowed. It
+// returns the exit code reported to the client.
+func handleRequest(conn net.Conn, req request, rules *Rules, reqID string, logger *log.Logger) (exitStatus int) {
+	input := req.Command
+	received := now()
+	logger.Printf("Received input: %s", input)
+
+	// Tell which local process sent the command, as far as the platform allows
+	var client clientProcess
+	if config.LogClientProcess {
+		var err error
+		if client, err = lookupClientProcess(conn); err != nil {
+			logger.Printf("Could not identify the client process: %v", err)
+		} else {
+			logger.Printf("Client process: %s", client)
+		}
+	}
+
+	// finish records the decision on the request
+	opExitCode := 0
+	finish := func(decision string, exitCode int) {
+		opExitCode = exitCode
+		metrics.recordDecision(decision)
+		writeAuditEntry(logger, auditEntry{Time: received, RequestID: reqID, Command: input, Decision: decision, ExitCode: exitCode,
+			ClientPID: client.PID, ClientComm: client.Comm, ClientExe: client.Exe})
+		runPostHook(logger, postHookEvent{reqID: reqID, command: input, decision: decision, exitCode: exitCode})
+	}
+
+	out, done := openResponse(conn, req, logger)
+	defer func() {
+		done(opExitCode)
+		exitStatus = out.exitStatus(opExitCode)
+	}()
+
+	// Send the banner first, as a metadata line the client keeps out of the output
+	if config.Banner != "" && req.hasFlag(bannerFlag) {
+		if _, err := fmt.Fprintf(out, "%sbanner=%q\n", metadataPrefix, config.Banner); err != nil {
+			logger.Printf("Error writing response: %v", err)
+		}
+	}
+
+	// The control socket has no rules and only takes control commands, and
+	// once there is one the command sockets take none. @approve is never
+	// taken on a command socket, whose clients include the one waiting.
+	if rules == nil && !isControlCommand(input) {
+		logger.Printf("Command refused on the control socket: %s", input)
+		if err := out.fail(exitPolicy, "Error: Only control commands are accepted on the control socket\n"); err != nil {
+			logger.Printf("Error writing response: %v", err)
+		}
+		return
+	}
+	if rules != nil && isControlCommand(input) && (config.ControlSocketPath != "" || isApproveCommand(input)) {
+		logger.Printf("Control command refused on a command socket: %s", input)
+		if err := out.fail(exitPolicy, "Error: Control commands are only accepted on the control socket\n"); err != nil {
+			logger.Printf("Error writing response: %v", err)
+		}
+		return
+	}
+
+	// Control commands are handled by the server itself
+	if isControlCommand(input) {
+		handleControl(conn, out, input, logger)
+		return
+	}
+
+	// Only run commands during the permitted hours
+	if !withinTimeWindows(config.TimeWindows, now()) {
+		logger.Printf("Command outside permitted hours: %s", input)
+		err := out.fail(exitPolicy, "Error: Command not allowed outside permitted hours: %s\n", input)
+		if err != nil {
+			logger.Printf("Error writing response: %v", err)
+		}
+		finish("denied", -1)
 		return
 	}
 
-	input := strings.TrimSpace(scanner.Text())
-	log.Printf("Received input: %s", input)
+	// An alias stands for a fixed command, which is then checked like any other
+	if isAliasCommand(input) {
+		command, err := resolveAlias(config.Aliases, input)
+		if err != nil {
+			logger.Printf("Alias refused: %v", err)
+			if err := out.fail(exitPolicy, "Error: %v\n", err); err != nil {
+				logger.Printf("Error writing response: %v", err)
+			}
+			finish("denied", -1)
+			return
+		}
+		logger.Printf("Resolved alias %s to: %s", strings.TrimSpace(strings.TrimPrefix(input, aliasCommand)), command)
+		input = command
+		req.Command = command
+	}
+
+	// Bundles check each of their references against the rules themselves
+	if isBundleCommand(input) {
+		finish(handleBundle(conn, out, rules, input, reqID, logger))
+		return
+	}
+
+	// Rewrite commands in an older syntax, the rewritten command is the one
+	// checked and run
+	if rewritten, ok := rewriteCommand(config.Rewrites, input); ok {
+		logger.Printf("Rewrote command %q to %q", input, rewritten)
+		input = rewritten
+		req.Command = rewritten
+	}
+
+	// Refuse attempts to switch account, session or config, whatever the rules say
+	if flag, found := findServerManagedFlag(input); found {
+		logger.Printf("Command sets server managed flag %s: %s", flag, input)
+		err := out.fail(exitPolicy, "Error: Command not allowed, %s is set by the server: %s\n", flag, input)
+		if err != nil {
+			logger.Printf("Error writing response: %v", err)
+		}
+		finish("denied", -1)
+		return
+	}
+
+	// Refuse flags the rules block, like writing op output to a file
+	if flag, found := rules.findBlockedFlag(input); found {
+		logger.Printf("Command sets blocked flag %s: %s", flag, input)
+		err := out.fail(exitPolicy, "Error: Command not allowed, %s is blocked: %s\n", flag, input)
+		if err != nil {
+			logger.Printf("Error writing response: %v", err)
+		}
+		finish("denied", -1)
+		return
+	}
+
+	// Refuse fields denied globally, like recovery codes
+	if field, found := findDeniedField(input, config.DeniedFields); found {
+		logger.Printf("Command targets denied field %s: %s", field, input)
+		err := out.fail(exitPolicy, "Error: Command not allowed, field %s is denied: %s\n", field, input)
+		if err != nil {
+			logger.Printf("Error writing response: %v", err)
+		}
+		finish("denied", -1)
+		return
+	}
 
 	// Validate the full command
-	if !validateCommand(input) {
-		log.Printf("Command not allowed: %s", input)
-		_, err := conn.Write([]byte(fmt.Sprintf("Error: Command not allowed: %s\n", input)))
+	matched, ok := matchRule(rules, input, logger)
+	if !ok {
+		// Tell a command cut short from one no rule allows
+		if rule, short := rules.findShortPrefix(input); short {
+			logger.Printf("Command has too few arguments for rule %s: %s", rule, input)
+			err := out.fail(exitPolicy, "Error: Command not allowed, %q needs at least %d argument(s) after it: %s\n", rule.Match, rule.MinArgs, input)
+			if err != nil {
+				logger.Printf("Error writing response: %v", err)
+			}
+			finish("denied", -1)
+			return
+		}
+		logger.Printf("Command not allowed: %s", input)
+		err := out.fail(exitPolicy, "%s", denyMessage(logger, input, reqID))
 		if err != nil {
-			log.Printf("Error writing response: %v", err)
+			logger.Printf("Error writing response: %v", err)
 		}
+		finish("denied", -1)
 		return
 	}
 
-	executeCommand(conn, input)
-}
+	logger.Printf("Command allowed by %s: %s", matched, input)
+
+	// The args the rule appends are the rule's to set
+	if flag, found := findAppendedFlag(input, matched.appendArgs()); found {
+		logger.Printf("Command sets flag %s appended by the rule: %s", flag, input)
+		err := out.fail(exitPolicy, "Error: Command not allowed, %s is set by the server: %s\n", flag, input)
+		if err != nil {
+			logger.Printf("Error writing response: %v", err)
+		}
+		finish("denied", -1)
+		return
+	}
+
+	// Throttle commands whose rule carries a rate limit
+	if !matched.allow(now()) {
+		logger.Printf("Rate limit of rule %s exceeded: %s", matched.rule, input)
+		err := out.fail(exitTempFail, "Error: Rate limit for this command exceeded: %s\n", input)
+		if err != nil {
+			logger.Printf("Error writing response: %v", err)
+		}
+		finish("rate_limited", -1)
+		return
+	}
 
-// executeCommand runs the op command and pipes output to the connection
-func executeCommand(conn net.Conn, input string) {
-	// Check if we're logged in first
-	if err := ensureLoggedIn(); err != nil {
-		log.Printf("Error ensuring login: %v", err)
-		_, _ = conn.Write([]byte(fmt.Sprintf("Error: Could not sign in to 1Password: %v\n", err)))
+	// Cap the distinct commands each user runs, so a compromised client
+	// can't pull every secret the rules allow
+	if decision, ok := limitDistinct(conn, out, input, []string{input}, logger); !ok {
+		finish(decision, -1)
 		return
 	}
 
+	// Hold the commands of sensitive rules until someone approves them
+	if matched.requiresApproval() {
+		if timeout := config.approvalTimeout(); !awaitApproval(logger, reqID, timeout) {
+			logger.Printf("Command not approved within %s: %s", timeout, input)
+			err := out.fail(exitPolicy, "Error: Command not approved within %s: %s\n", timeout, input)
+			if err != nil {
+				logger.Printf("Error writing response: %v", err)
+			}
+			finish("denied", -1)
+			return
+		}
+		logger.Printf("Command approved: %s", input)
+	}
+
+	// Tell verbose clients how the server decided, ahead of the op output
+	if req.hasFlag(verboseFlag) {
+		if _, err := fmt.Fprintf(out, "%saccount=%s rule=%q request=%s\n", metadataPrefix, config.Account, matched.String(), reqID); err != nil {
+			logger.Printf("Error writing response: %v", err)
+		}
+	}
+	exitCode := executeCommand(out, req, matched.appendArgs(), logger)
+	finish("allowed", exitCode)
+	return
+}
+
+// noExecuteMarker is sent to the client in place of op output for an allowed
+// command in no-execute mode
+const noExecuteMarker = "opfwd: command allowed, not executed (no-execute mode)\n"
+
+// executeCommand runs the op command, with appendArgs added after it, and
+// pipes output to the response. It returns the op exit code, or -1 when op
+// didn't run to completion.
+func executeCommand(resp *response, req request, appendArgs []string, logger *log.Logger) int {
 	// Prepare arguments for op command
 	args := []string{}
 
 	// Always add the account flag
 	args = append(args, "--account", config.Account)
 
-	// Add the validated command
-	cmdParts := strings.Fields(input)
+	// Add the validated command and the args of its rule, with the defaults
+	// neither of them set
+	cmdParts := append(strings.Fields(req.Command), appendArgs...)
+	if len(config.DefaultOpArgs) > 0 {
+		cmdParts = withDefaultOpArgs(cmdParts, config.DefaultOpArgs, config.DefaultOpArgsPosition)
+	}
 	args = append(args, cmdParts...)
 
 	logArgs := make([]string, len(args))
 	for i, arg := range args {
 		logArgs[i] = fmt.Sprintf("'%s'", arg)
 	}
-	log.Printf("Executing op with args: %s", strings.Join(logArgs, " "))
-	opCmd := exec.Command("op", args...)
 
-	// Connect the command's stdout and stderr to the connection
-	stdout, err := opCmd.StdoutPipe()
-	if err != nil {
-		log.Printf("Error creating stdout pipe: %v", err)
-		_, _ = conn.Write([]byte(fmt.Sprintf("Error: %v\n", err)))
-		return
+	// In no-execute mode the command stops here, before op is ever run
+	if config.NoExecute {
+		logger.Printf("No-execute mode, would run op with args: %s", strings.Join(logArgs, " "))
+		_, _ = resp.Write([]byte(noExecuteMarker))
+		return 0
 	}
 
-	stderr, err := opCmd.StderrPipe()
-	if err != nil {
-		log.Printf("Error creating stderr pipe: %v", err)
-		_, _ = conn.Write([]byte(fmt.Sprintf("Error: %v\n", err)))
-		return
+	// Serve reads repeated within the TTL without running op again
+	cacheable := req.stdin == nil && config.cacheable(req.Command)
+	cacheKey := strings.Join(cmdParts, " ")
+	if cacheable {
+		if output, ok := cachedOutput(cacheKey, now()); ok {
+			logger.Printf("Serving cached output for: %s", req.Command)
+			_, _ = resp.Write(output)
+			wipe(output)
+			return 0
+		}
 	}
 
-	// Start the command
-	if err := opCmd.Start(); err != nil {
-		log.Printf("Error starting command: %v", err)
-		_, _ = conn.Write([]byte(fmt.Sprintf("Error: %v\n", err)))
-		return
+	// Leave 1Password alone while it rate limits the account
+	started := now()
+	ok, probe, retry := allowUpstream(started)
+	if !ok {
+		retry = max(retry.Round(time.Second), time.Second)
+		logger.Printf("Upstream rate limited, refusing command for another %s", retry)
+		_ = resp.fail(exitTempFail, "Error: upstream rate limited, retry after %s\n", retry)
+		return -1
 	}
+	// Only a run of op tells whether 1Password still rate limits the
+	// account, so a probe that fails before it gives up its slot instead
+	ran, rateLimited := false, false
+	defer func() {
+		switch {
+		case ran:
+			recordUpstream(logger, rateLimited, started)
+		case probe:
+			releaseProbe()
+		}
+	}()
 
-	// Copy output to connection
-	var wg sync.WaitGroup
-	wg.Add(2)
+	// The timeout covers signing in too, so a stuck sign in can't hold the
+	// request forever
+	ctx, cancel := context.WithCancel(context.Background())
+	if config.CommandTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), config.CommandTimeout)
+	}
+	defer cancel()
 
-	go func() {
-		defer wg.Done()
-		if _, err := io.Copy(conn, stdout); err != nil {
-			log.Printf("Error copying stdout: %v", err)
+	// Check if we're logged in before running the command
+	if err := ensureLoggedIn(ctx, logger); err != nil {
+		if errors.Is(err, errLoginTimedOut) {
+			logger.Printf("Login timed out after %s", config.CommandTimeout)
+			_ = resp.fail(exitTimeout, "Error: Could not sign in to 1Password: login timed out after %s\n", config.CommandTimeout)
+			return -1
 		}
-	}()
-	go func() {
-		defer wg.Done()
-		if _, err := io.Copy(conn, stderr); err != nil {
-			log.Printf("Error copying stderr: %v", err)
+		if isOpNotFound(err) {
+			logger.Printf("Error: 1Password CLI not found at %s: %v", opBinary(), err)
+			_ = resp.fail(exitServerError, "%s", opNotFoundMessage)
+			return -1
 		}
-	}()
+		logger.Printf("Error ensuring login: %v", err)
+		_ = resp.fail(exitServerError, "Error: Could not sign in to 1Password: %v\n", err)
+		return -1
+	}
+
+	logger.Printf("Executing op with args: %s", strings.Join(logArgs, " "))
+
+	// Stop op once the client has gone away, or once it has sent as much as
+	// the client may receive
+	var w io.Writer = &clientGoneWriter{w: resp, onGone: func(err error) {
+		logger.Printf("Client disconnected, stopping op: %v", err)
+		cancel()
+	}}
+	if config.MaxResponseBytes > 0 {
+		w = newLimitWriter(w, config.MaxResponseBytes, func() {
+			logger.Printf("Response truncated at %d bytes, stopping op", config.MaxResponseBytes)
+			cancel()
+		})
+	}
 
-	// Wait for the command to complete
-	if err := opCmd.Wait(); err != nil {
-		log.Printf("Command execution error: %v", err)
-		// Error already sent via stderr pipe
+	// Watch op's errors for auth failures the login check didn't catch, and
+	// for 1Password rate limits
+	var opErrors authErrorScanner
+	defer opErrors.wipe()
+	stdout := w
+	var output secretBuffer
+	defer output.wipe()
+	if cacheable {
+		stdout = io.MultiWriter(w, &output)
+	}
+	inv := opInvocation{args: args, stdout: stdout, stderr: io.MultiWriter(w, &opErrors), env: opEnv(), wrapper: config.OpWrapper, logger: logger}
+	if req.stdin != nil {
+		inv.stdin = bytes.NewReader(req.stdin)
 	}
 
-	// Wait for all output to be copied before closing connection
-	wg.Wait()
+	// Run the command, streaming its output to the response. A write may
+	// have changed 1Password even when op failed or the client went away.
+	exitCode, err := opRunner(ctx, inv)
+	ran = err == nil
+	if config.invalidatesCache(req.Command) {
+		if dropped := invalidateCache(cacheKey); dropped > 0 {
+			logger.Printf("Dropped %d cached outputs after: %s", dropped, req.Command)
+		}
+	}
+	if resp.broken() {
+		return -1
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		logger.Printf("Command timed out after %s", config.CommandTimeout)
+		_ = resp.fail(exitTimeout, "Error: Command timed out after %s\n", config.CommandTimeout)
+		return -1
+	}
+	if isOpNotFound(err) {
+		logger.Printf("Error: 1Password CLI not found at %s: %v", opBinary(), err)
+		_ = resp.fail(exitServerError, "%s", opNotFoundMessage)
+		return -1
+	}
+	if err != nil {
+		logger.Printf("Error running command: %v", err)
+		_ = resp.fail(exitServerError, "Error: %v\n", err)
+		return -1
+	}
+	if exitCode != 0 {
+		// Error already sent via stderr
+		logger.Printf("Command exited with code %d", exitCode)
+		if opErrors.found() {
+			recordAuthFailure(logger)
+		}
+		rateLimited = opErrors.matches(config.rateLimitPatterns())
+	} else {
+		resetAuthFailures()
+		if cacheable && ctx.Err() == nil {
+			storeOutput(cacheKey, output.Bytes(), now())
+		}
+	}
+	return exitCode
 }
 
-// ensureLoggedIn checks if we're logged in to 1Password and attempts to log in if not
-func ensureLoggedIn() error {
-	// Try a simple command to check if we're logged in
-	checkCmd := exec.Command("op", "--account", config.Account, "account", "get")
+// errSigninDisabled is returned by ensureLoggedIn when the account isn't
+// signed in and AutoSignin is off
+var errSigninDisabled = errors.New("not signed in; signin disabled on the server")
 
-	// We don't care about stdout, just if it exits successfully
-	if err := checkCmd.Run(); err == nil {
-		// We're already logged in
-		log.Println("1Password account is already authenticated")
-		return nil
+// errLoginTimedOut is returned by ensureLoggedIn when its context ends
+// before the login check or sign in finished
+var errLoginTimedOut = errors.New("login timed out")
+
+// autoSignin reports whether the server may sign in to 1Password by itself
+func (cfg *Config) autoSignin() bool {
+	return cfg.AutoSignin == nil || *cfg.AutoSignin
+}
+
+// loginCheck is a login check in flight, whose result is shared by every
+// request arriving while it runs
+type loginCheck struct {
+	done chan struct{}
+	err  error
+
+	// waiters is the number of requests waiting on the check
+	waiters int
+}
+
+// loginFlight holds the login check in flight, nil when there is none
+var loginFlight struct {
+	mu      sync.Mutex
+	current *loginCheck
+}
+
+// ensureLoggedIn checks if we're logged in to 1Password and attempts to log in
+// if not. Only one check runs at a time, requests arriving meanwhile wait for
+// its result instead of all probing op at once. The check and the wait for it
+// end with ctx.
+func ensureLoggedIn(ctx context.Context, logger *log.Logger) error {
+	loginFlight.mu.Lock()
+	if c := loginFlight.current; c != nil {
+		c.waiters++
+		loginFlight.mu.Unlock()
+		logger.Println("Waiting for the 1Password login check already in flight")
+		select {
+		case <-c.done:
+			return c.err
+		case <-ctx.Done():
+			return errLoginTimedOut
+		}
 	}
+	c := &loginCheck{done: make(chan struct{})}
+	loginFlight.current = c
+	loginFlight.mu.Unlock()
+
+	c.err = checkLogin(ctx, logger)
+
+	loginFlight.mu.Lock()
+	loginFlight.current = nil
+	loginFlight.mu.Unlock()
+	close(c.done)
+	return c.err
+}
 
-	log.Println("1Password account is not signed in, attempting to sign in")
+// checkLogin probes the 1Password account and signs in if it isn't signed in
+func checkLogin(ctx context.Context, logger *log.Logger) error {
+	// After repeated auth failures the probe can't be trusted, so sign in
+	// again whatever it would say
+	forced := takeForcedSignin()
+	if forced {
+		logger.Println("Recovering from repeated op auth failures, signing in to 1Password afresh")
+	} else {
+		// Try a simple command to check if we're logged in
+		checkArgs := []string{"--account", config.Account, "account", "get"}
+
+		// We don't care about stdout, just if it exits successfully
+		if exitCode, err := opRunner(ctx, opInvocation{args: checkArgs, env: opEnv(), logger: logger}); err == nil && exitCode == 0 {
+			// We're already logged in
+			logger.Println("1Password account is already authenticated")
+			return nil
+		}
+		if ctx.Err() != nil {
+			return errLoginTimedOut
+		}
+	}
 
-	// Try to sign in
-	signinCmd := exec.Command("op", "signin", "--account", config.Account)
-	output, err := signinCmd.CombinedOutput()
+	// Any cached session has expired
+	setSessionToken("")
+	if !config.autoSignin() {
+		logger.Println("1Password account is not signed in and auto_signin is disabled")
+		return errSigninDisabled
+	}
+	logger.Println("1Password account is not signed in, attempting to sign in")
+
+	// Try to sign in, --raw prints just the session token when op uses
+	// token-based sessions and nothing when the desktop app manages them
+	var token, output secretBuffer
+	defer token.wipe()
+	defer output.wipe()
+	signinArgs := []string{"signin", "--account", config.Account, "--raw"}
+	exitCode, err := opRunner(ctx, opInvocation{args: signinArgs, stdout: &token, stderr: &output, env: opEnv(), logger: logger})
+	if ctx.Err() != nil {
+		logger.Println("Sign in to 1Password did not finish in time")
+		return errLoginTimedOut
+	}
+	if err == nil && exitCode != 0 {
+		err = fmt.Errorf("exit status %d", exitCode)
+	}
 
 	if err != nil {
-		log.Printf("Sign in attempt failed, output: %s", string(output))
-		return fmt.Errorf("failed to sign in to 1Password: %v", err)
+		logger.Printf("Sign in attempt failed, output: %s", output.Bytes())
+		return fmt.Errorf("failed to sign in to 1Password: %w", err)
+	}
+
+	if t := string(bytes.TrimSpace(token.Bytes())); t != "" {
+		setSessionToken(t)
+		logger.Println("Successfully signed in to 1Password, reusing the session for later commands")
+		return nil
 	}
 
-	log.Println("Successfully signed in to 1Password")
+	logger.Println("Successfully signed in to 1Password")
 	return nil
 }
 
-// cleanupSocket handles socket removal during cleanup
-func cleanupSocket() {
-	log.Println("Cleaning up and removing socket...")
-	if config.SocketPath != "" {
-		if err := os.Remove(config.SocketPath); err != nil {
-			log.Printf("Failed to remove socket during cleanup: %v", err)
-		}
+// getConfigDir returns the opfwd config directory, $XDG_CONFIG_HOME/opfwd
+// when set and ~/.config/opfwd otherwise
+func getConfigDir() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "opfwd"), nil
 	}
+	usr, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("getting current user: %w", err)
+	}
+	return filepath.Join(usr.HomeDir, ".config", "opfwd"), nil
 }
 
 // getDefaultConfigPath returns the default path to the config file
 func getDefaultConfigPath() (string, error) {
-	usr, err := user.Current()
+	dir, err := getConfigDir()
 	if err != nil {
-		return "", fmt.Errorf("getting current user: %w", err)
+		return "", err
 	}
-	return filepath.Join(usr.HomeDir, ".config", "opfwd", "config.yaml"), nil
+	return filepath.Join(dir, "config.yaml"), nil
 }
 
-// setupSocket creates and configures the Unix domain socket
-func setupSocket(socketPath string) (net.Listener, error) {
+// setupSocket creates and configures the Unix domain socket with the given permissions
+func setupSocket(socketPath string, mode os.FileMode) (net.Listener, error) {
+	// Abstract sockets have no file, so there is nothing to check, create or chmod
+	if isAbstractSocket(socketPath) {
+		if !abstractSocketsSupported {
+			return nil, fmt.Errorf("abstract socket %s is only supported on Linux, use a file path instead", socketPath)
+		}
+		listener, err := net.Listen("unix", socketPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on socket: %v", err)
+		}
+		log.Printf("Warning: abstract socket %s has no file permissions, any local user in the same network namespace can connect", socketPath)
+		return listener, nil
+	}
+
 	// Check if socket file already exists
 	if _, err := os.Stat(socketPath); err == nil {
 		return nil, fmt.Errorf("Socket file already exists at %s. Another server might be running.\n"+
@@ -293,8 +1347,12 @@ func setupSocket(socketPath string) (net.Listener, error) {
 		return nil, fmt.Errorf("failed to listen on socket: %v", err)
 	}
 
-	// Set permissions on socket file to only allow the current user
-	if err := os.Chmod(socketPath, 0600); err != nil {
+	// The socket file is removed by serverListener.cleanup, which checks it
+	// is still ours first
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	// Set permissions on socket file, by default only allowing the current user
+	if err := os.Chmod(socketPath, mode); err != nil {
 		listener.Close()
 		os.Remove(socketPath)
 		return nil, fmt.Errorf("failed to set permissions on socket: %v", err)
@@ -304,7 +1362,7 @@ func setupSocket(socketPath string) (net.Listener, error) {
 }
 
 // setupSignalHandling sets up graceful shutdown on signals
-func setupSignalHandling(cancel context.CancelFunc, listener net.Listener) {
+func setupSignalHandling(cancel context.CancelFunc, listeners []*serverListener) {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
@@ -312,82 +1370,255 @@ func setupSignalHandling(cancel context.CancelFunc, listener net.Listener) {
 		<-sigChan
 		log.Println("Shutting down server...")
 		cancel() // Cancel the context to signal shutdown
-		listener.Close()
-		cleanupSocket()
+		cleanupListeners(listeners)
 	}()
 }
 
-// startServer accepts and handles connections
-func startServer(ctx context.Context, listener net.Listener) {
-	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				if ctx.Err() != nil {
-					// Context was cancelled, server is shutting down
-					return
-				}
-				log.Printf("Error accepting connection: %v", err)
-				continue
+// handlers tracks running connection handlers
+var handlers sync.WaitGroup
+
+// startServer accepts and handles connections on every listener
+func startServer(ctx context.Context, listeners ...*serverListener) {
+	activeListeners.mu.Lock()
+	activeListeners.list = listeners
+	activeListeners.mu.Unlock()
+	serverStarted = time.Now()
+
+	// Control commands like @status must get through a busy server
+	slots := newHandlerSlots(config.MaxConcurrent)
+	for _, listener := range listeners {
+		if listener.control {
+			go acceptConnections(ctx, listener, nil)
+			continue
+		}
+		go acceptConnections(ctx, listener, slots)
+	}
+}
+
+const (
+	// acceptBackoffMin and acceptBackoffMax bound the delay before retrying
+	// after a failed accept
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
+)
+
+// acceptConnections accepts connections on a listener until the server shuts
+// down, handling each once it gets one of slots
+func acceptConnections(ctx context.Context, listener *serverListener, slots handlerSlots) {
+	var backoff time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				// Server is shutting down or the listener is gone
+				return
 			}
 
-			go handleConnection(conn)
+			// Anything else, like running out of file descriptors, may
+			// clear up, so retry without spinning the CPU
+			backoff = min(max(backoff*2, acceptBackoffMin), acceptBackoffMax)
+			n := metrics.acceptErrors.Add(1)
+			log.Printf("Error accepting connection on %s (%d accept errors so far), retrying in %s: %v", listener.path, n, backoff, err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			continue
 		}
-	}()
+		backoff = 0
+
+		handlers.Add(1)
+		metrics.activeConns.Add(1)
+		trackConn(conn)
+		go func() {
+			defer handlers.Done()
+			defer metrics.activeConns.Add(-1)
+			defer untrackConn(conn)
+			if !slots.acquire(ctx) {
+				conn.Close()
+				return
+			}
+			defer slots.release()
+			handleConnection(conn, listener.rules.Load())
+		}()
+	}
+}
+
+// serverOptions holds the server mode flags, which add to the config
+type serverOptions struct {
+	// noExecute validates and logs commands without running op
+	noExecute bool
+
+	// quiet leaves out the informational lines logged for each request
+	quiet bool
 }
 
-// runServer starts the server mode of the application
-func runServer(configPath string) {
+// loadServerConfig loads the config of a server, applies opts to it and
+// sends the logs where it asks for them, then checks op can be run with it.
+// It exits on any problem, and returns the function closing the logs.
+func loadServerConfig(configPath string, opts serverOptions) (closeLogging func()) {
+	// Load configuration
+	var err error
+	config, err = loadConfig(configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	loadedConfigPath = configPath
+	config.NoExecute = config.NoExecute || opts.noExecute
+	config.Quiet = config.Quiet || opts.quiet
+
+	// Send the logs where the config asks for them
+	closeLogging, err = setupLogging(&config)
+	if err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+
+	// Check if the 'op' command exists
+	if _, err := exec.LookPath(opBinary()); err != nil {
+		log.Fatal(opNotFoundGuidance(runtime.GOOS, err))
+	}
+
+	// Give op the account's own config directory
+	if config.OpConfigDir != "" {
+		if err := prepareOpConfigDir(config.OpConfigDir); err != nil {
+			log.Fatalf("Invalid op_config_dir: %v", err)
+		}
+	}
+
+	// Check the op wrapper resolves before accepting commands
+	if err := validateOpWrapper(config.OpWrapper); err != nil {
+		log.Fatalf("Invalid op_wrapper: %v", err)
+	}
+
+	// Check the op version against the configured minimum
+	if err := checkOpVersion(config); err != nil {
+		log.Fatalf("1Password CLI version check failed: %v", err)
+	}
+
+	return closeLogging
+}
+
+// runServer starts the server mode of the application and returns the exit
+// code once it has shut down
+func runServer(configPath string, opts serverOptions) (exitCode int) {
+	var listeners []*serverListener
+
 	// Set up recovery for panics in main
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("Recovered from panic in main: %v", r)
-			cleanupSocket()
+			cleanupListeners(listeners)
+			exitCode = 1
 		}
 	}()
 
-	// Check if the 'op' command exists
-	if _, err := exec.LookPath("op"); err != nil {
-		log.Fatalf("The 1Password CLI (op) command was not found in your system PATH.\n\nTo install it on macOS:\n\nbrew install 1password-cli\n\nError details: %v", err)
-	}
+	// Load the config and check op can be run with it
+	closeLogging := loadServerConfig(configPath, opts)
+	defer closeLogging()
 
-	// Load configuration
-	var err error
-	config, err = loadConfig(configPath)
+	// Only one server may run per account
+	lock, err := acquireAccountLock(config.Account)
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		log.Fatalf("Failed to start: %v", err)
+	}
+	defer lock.release()
+
+	// Record the PID for -daemonize and service managers
+	if config.PidFile != "" {
+		pidFile, err := writePidFile(config.PidFile)
+		if err != nil {
+			log.Fatalf("Failed to start: %v", err)
+		}
+		defer pidFile.remove()
+	}
+
+	// Check 1Password is reachable before accepting commands
+	if err := checkStartup(config); err != nil {
+		log.Fatalf("Startup check failed: %v", err)
 	}
 
-	// Set up the socket
-	listener, err := setupSocket(config.SocketPath)
+	// Set up the sockets
+	listeners, err = setupListeners(&config)
 	if err != nil {
 		log.Fatalf("Failed to set up socket: %v", err)
 	}
-	defer listener.Close()
+	defer cleanupListeners(listeners)
 
 	// Log configuration
-	log.Printf("Server listening on %s", config.SocketPath)
-	log.Printf("Allowed exact commands: %v", config.AllowedCommands)
-	log.Printf("Allowed command prefixes: %v", config.AllowedPrefixes)
+	for _, l := range listeners {
+		if l.control {
+			log.Printf("Control socket listening on %s", config.logPath(l.path))
+			continue
+		}
+		log.Printf("Server listening on %s", config.logPath(l.path))
+		rules := l.rules.Load()
+		log.Printf("Allowed exact commands: %v", rules.AllowedCommands)
+		log.Printf("Allowed command prefixes: %v", rules.AllowedPrefixes)
+		log.Printf("Allowed command globs: %v", rules.AllowedGlobs)
+		log.Printf("Allowed command templates: %v", rules.AllowedTemplates)
+		log.Printf("Allowed command hashes: %d", len(rules.AllowedHashes))
+		log.Printf("Allowed subcommands: %v", rules.AllowedSubcommands)
+	}
 	log.Printf("Using 1Password account: %s", config.Account)
+	log.Printf("Using 1Password CLI version: %s", opVersion)
+	if len(config.OpWrapper) > 0 {
+		log.Printf("Running op under wrapper: %v", config.OpWrapper)
+	}
+	if config.NoExecute {
+		log.Println("No-execute mode: commands are validated and logged but op is never run")
+	}
+	log.Println(newStartupEvent(&config, listeners).format(config.LogFormat))
 
 	// Set up context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	// Set up signal handling for graceful shutdown
-	setupSignalHandling(cancel, listener)
+	setupSignalHandling(cancel, listeners)
+	stopAfterMaxUptime(ctx, config.MaxUptime, cancel, listeners)
+	var socketVanished atomic.Bool
+	watchSocketFiles(ctx, socketCheckInterval, listeners, func() {
+		socketVanished.Store(true)
+		cancel()
+		cleanupListeners(listeners)
+	})
+	handleDebugSignal(ctx)
+	handleReloadSignal(ctx)
+
+	// Keep the op session warm between commands, op never runs in
+	// no-execute mode
+	if !config.NoExecute {
+		keepSessionWarm(ctx, config.KeepAliveInterval)
+	}
 
 	// Start the server
-	startServer(ctx, listener)
+	startServer(ctx, listeners...)
 
-	// Wait for context cancellation (i.e., shutdown signal)
+	// Wait for context cancellation (i.e., shutdown signal), then give the
+	// commands in flight time to finish
 	<-ctx.Done()
+	exitCode = shutdownExitCode()
+	if socketVanished.Load() && exitCode == 0 {
+		exitCode = exitSocketVanished
+	}
 	log.Println("Server shutdown completed")
+	return exitCode
 }
 
-// getDefaultSocketPath returns the default path to the socket file
+// getDefaultSocketPath returns the default path to the socket file,
+// $XDG_RUNTIME_DIR/opfwd.sock when set and ~/.ssh/opfwd.sock otherwise
 func getDefaultSocketPath() (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "opfwd.sock"), nil
+	}
+	return getHomeSocketPath()
+}
+
+// getHomeSocketPath returns ~/.ssh/opfwd.sock, the default socket path
+// used before XDG_RUNTIME_DIR was honored
+func getHomeSocketPath() (string, error) {
 	usr, err := user.Current()
 	if err != nil {
 		return "", fmt.Errorf("getting current user: %w", err)
@@ -395,86 +1626,125 @@ func getDefaultSocketPath() (string, error) {
 	return filepath.Join(usr.HomeDir, ".ssh", "opfwd.sock"), nil
 }
 
-// runClient handles the client mode of the application
-func runClient() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: opfwd <command> [arguments]")
-		os.Exit(1)
-	}
-
-	var socketPath string
-	if val, ok := os.LookupEnv("OPFWD_SOCKET_PATH"); ok && val != "" {
-		socketPath = val
-	} else {
-		if val, err := getDefaultSocketPath(); err != nil {
-			fmt.Printf("Error getting default socket path: %v\n", err)
-			os.Exit(1)
-		} else {
-			socketPath = val
-		}
-	}
-
-	// Check if the socket exists
-	if _, err := os.Stat(socketPath); err != nil {
-		fmt.Printf("Error: Socket %s not found.\n", socketPath)
-		fmt.Println("Make sure the opfwd server is running and the socket is accessible.")
-		os.Exit(1)
-	}
-
-	// Connect to the socket
-	conn, err := net.Dial("unix", socketPath)
-	if err != nil {
-		fmt.Printf("Error connecting to socket: %v\n", err)
-		os.Exit(1)
-	}
-	defer conn.Close()
-
-	// Send the command to the server
-	command := strings.Join(os.Args[1:], " ")
-	if _, err := fmt.Fprintln(conn, command); err != nil {
-		fmt.Printf("Error sending command: %v\n", err)
-		os.Exit(1)
-	}
+// subcommands maps the name of an opfwd subcommand to its entry point, which
+// receives the remaining arguments and returns the exit code
+var subcommands = map[string]func(args []string) int{
+	"agent":     runAgent,
+	"audit":     runAudit,
+	"bench":     runBench,
+	"doctor":    runDoctor,
+	"hash":      runHash,
+	"test-rule": runTestRule,
+}
 
-	// Read and display the response
-	if _, err := io.Copy(os.Stdout, conn); err != nil {
-		fmt.Printf("Error reading response: %v\n", err)
-		os.Exit(1)
-	}
+// isOpfwdInvocation reports whether the binary was invoked by its own name
+// rather than through an op symlink
+func isOpfwdInvocation() bool {
+	return strings.HasPrefix(filepath.Base(os.Args[0]), "opfwd")
 }
 
 func main() {
 	// Define flags
 	serverMode := flag.Bool("server", false, "Run in server mode")
+	daemonMode := flag.Bool("daemonize", false, "Run the server detached in the background, logging to log_file (server mode only)")
+	inetdMode := flag.Bool("inetd", false, "Serve a single connection on stdin and stdout, then exit with its exit code")
 	configPath := flag.String("config", "", "Path to the config file (server mode only)")
 	showVersion := flag.Bool("version", false, "Show version information")
+	jsonOutput := flag.Bool("json", false, "Print -version output as JSON")
+	showPaths := flag.Bool("paths", false, "Print the default config and socket paths and exit")
+	printRulesFlag := flag.Bool("print-rules", false, "Print the effective allow rules from the config and exit")
+	dumpRulesFlag := flag.Bool("dump-rules-json", false, "Print the effective allow rules from the config as JSON and exit")
+	flag.StringVar(&configProfile, "profile", "", "Use this profile of the config file, merged over its top-level settings")
+	flag.BoolVar(&insecureConfigOK, "insecure-config", false, "Only warn about a config file other users can read or write, instead of refusing to load it")
+	var serverOpts serverOptions
+	flag.BoolVar(&serverOpts.noExecute, "no-execute", false, "Validate and log commands without running op (server mode only)")
+	flag.BoolVar(&serverOpts.quiet, "quiet", false, "Log only errors and warnings for each request (server mode only)")
+
+	var clientOpts clientOptions
+	flag.DurationVar(&clientOpts.wait, "wait", 0, "Wait up to this long for the server socket to come up (client mode only)")
+	flag.BoolVar(&clientOpts.raw, "raw", false, "Strip the trailing newline from the output (client mode only)")
+	flag.StringVar(&clientOpts.field, "field", "", "Print only this field of a JSON response (client mode only)")
+	flag.StringVar(&clientOpts.out, "out", "", "Write the output to this file instead of stdout, only if the command succeeds (client mode only)")
+	flag.StringVar(&clientOpts.outMode, "out-mode", "", "Permissions of the -out file, in octal (client mode only, default 0600)")
+	flag.StringVar(&clientOpts.signingKey, "signing-key", "", "Sign requests with the key in this file, for servers with signing_key_file (client mode only)")
+	progress := flag.Bool("progress", false, "Print the number of bytes received so far to stderr (client mode only)")
+	verbose := flag.Bool("verbose", false, "Print which rule allowed the command and the account used to stderr (client mode only)")
+	jsonErrors := flag.Bool("json-errors", false, "Print errors to stderr as JSON objects with error, exit_code and kind (client mode only)")
 	flag.Parse()
 
 	// Initialize version information
 	initVersion()
 
 	if *showVersion {
-		fmt.Printf("opfwd version %s\n", version)
-		fmt.Printf("Commit: %s\n", commit)
-		if buildDate != "" {
-			fmt.Printf("Build Date: %s\n", buildDate)
+		if err := printVersion(os.Stdout, *jsonOutput); err != nil {
+			log.Fatalf("Failed to print version: %v", err)
 		}
-		fmt.Printf("Go Version: %s\n", goVersion)
 		return
 	}
 
-	if *serverMode {
-		// If no config path specified, use default
-		if *configPath == "" {
-			defaultPath, err := getDefaultConfigPath()
-			if err != nil {
-				log.Fatalf("Failed to get default config path: %v", err)
-			}
-			*configPath = defaultPath
+	if *showPaths {
+		if err := printPaths(os.Stdout); err != nil {
+			log.Fatalf("Failed to resolve the default paths: %v", err)
+		}
+		return
+	}
+
+	// Subcommands are only recognized when invoked as opfwd, so that the
+	// same words are still forwarded to the server when invoked as op
+	if args := flag.Args(); len(args) > 0 && isOpfwdInvocation() {
+		if run, ok := subcommands[args[0]]; ok {
+			os.Exit(run(args[1:]))
 		}
-		runServer(*configPath)
+	}
+
+	// If no config path specified, use default
+	if (*serverMode || *inetdMode || *printRulesFlag || *dumpRulesFlag) && *configPath == "" {
+		defaultPath, err := getDefaultConfigPath()
+		if err != nil {
+			log.Fatalf("Failed to get default config path: %v", err)
+		}
+		*configPath = defaultPath
+	}
+
+	if *printRulesFlag {
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+		printRules(os.Stdout, cfg)
+		return
+	}
+
+	if *dumpRulesFlag {
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+		if err := dumpRulesJSON(os.Stdout, cfg); err != nil {
+			log.Fatalf("Failed to dump rules: %v", err)
+		}
+		return
+	}
+
+	if *inetdMode {
+		os.Exit(runInetd(*configPath, serverOpts))
+	}
+	if *serverMode && *daemonMode {
+		os.Exit(daemonize(*configPath, os.Args[1:]))
+	}
+	if *serverMode {
+		os.Exit(runServer(*configPath, serverOpts))
 	} else {
 		// Client mode
-		runClient()
+		if *verbose {
+			clientOpts.metadata = os.Stderr
+		}
+		if *jsonErrors {
+			clientOpts.jsonErrors = os.Stderr
+		}
+		if *progress {
+			clientOpts.progress = os.Stderr
+		}
+		runClient(flag.Args(), clientOpts)
 	}
 }
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -55,36 +62,207 @@ func startTestServer(t *testing.T, cfg TestConfig) (context.CancelFunc, <-chan s
 	// Channel to signal when server is ready
 	ready := make(chan struct{})
 
+	// Channel closed once the server goroutine has cleaned up, so the next
+	// test doesn't race with this one over the global config
+	done := make(chan struct{})
+
 	// Start the server in a goroutine
 	go func() {
+		defer close(done)
+
 		// Set up the global config
 		config = Config{
-			SocketPath:      cfg.socketPath,
-			Account:         cfg.account,
-			AllowedCommands: cfg.allowedCommands,
-			AllowedPrefixes: cfg.allowedPrefixes,
+			SocketPath: cfg.socketPath,
+			Account:    cfg.account,
+			Rules: Rules{
+				AllowedCommands: newRules(cfg.allowedCommands...),
+				AllowedPrefixes: newRules(cfg.allowedPrefixes...),
+			},
 		}
 
 		// Set up the socket
-		listener, err := setupSocket(cfg.socketPath)
+		listener, err := setupSocket(cfg.socketPath, defaultSocketMode)
 		if err != nil {
 			t.Errorf("Failed to set up socket: %v", err)
+			close(ready)
 			return
 		}
-		defer listener.Close()
+		sl := newSocketListener(listener, cfg.socketPath, &config.Rules)
+		defer sl.cleanup()
 
 		// Signal that server is ready
 		close(ready)
 
 		// Start the server
-		startServer(ctx, listener)
+		startServer(ctx, sl)
 
 		// Wait for context cancellation
 		<-ctx.Done()
-		cleanupSocket()
+		sl.cleanup()
+		handlers.Wait()
 	}()
 
-	return cancel, ready
+	stop := func() {
+		cancel()
+		<-done
+	}
+
+	return stop, ready
+}
+
+// newRules returns rules matching each of the given strings without limits
+func newRules(matches ...string) []Rule {
+	rules := make([]Rule, len(matches))
+	for i, m := range matches {
+		rules[i] = Rule{Match: m}
+	}
+	return rules
+}
+
+// writeTestConfig writes a config file with the given contents and returns its path
+func writeTestConfig(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+// loadTestConfig loads a config with a temporary socket path and the test
+// account, followed by the given YAML
+func loadTestConfig(t *testing.T, extra string) Config {
+	t.Helper()
+
+	env := setupTestEnvironment(t)
+	path := writeTestConfig(t, fmt.Sprintf("account: %q\nsocket_path: %q\n%s", env.account, env.socketPath, extra))
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	return cfg
+}
+
+// serveConfig runs a server with cfg until the test finishes
+func serveConfig(t *testing.T, cfg Config) {
+	t.Helper()
+
+	prev := config
+	config = cfg
+	listeners, err := setupListeners(&config)
+	if err != nil {
+		t.Fatalf("Failed to set up socket: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	startServer(ctx, listeners...)
+
+	t.Cleanup(func() {
+		cancel()
+		cleanupListeners(listeners)
+		handlers.Wait()
+		config = prev
+	})
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog redirects the standard logger into a buffer until the test finishes
+func captureLog(t *testing.T) *lockedBuffer {
+	t.Helper()
+
+	buf := &lockedBuffer{}
+	prev := log.Writer()
+	log.SetOutput(buf)
+	t.Cleanup(func() {
+		log.SetOutput(prev)
+	})
+	return buf
+}
+
+// installFakeOpScript puts an executable op shell script with the given body
+// first in PATH until the test finishes
+func installFakeOpScript(t *testing.T, body string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "op")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0700); err != nil {
+		t.Fatalf("Failed to write fake op: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return path
+}
+
+// fakeOp is an opRunner that records invocations and answers them with a
+// handler instead of exec'ing op
+type fakeOp struct {
+	mu      sync.Mutex
+	calls   []string
+	handler func(inv opInvocation) int
+}
+
+// installFakeOp replaces opRunner with a fake until the test finishes. A nil
+// handler succeeds for every invocation and echoes the op arguments to stdout.
+func installFakeOp(t *testing.T, handler func(inv opInvocation) int) *fakeOp {
+	t.Helper()
+
+	if handler == nil {
+		handler = func(inv opInvocation) int {
+			fmt.Fprintf(inv.stdout, "op %s\n", strings.Join(inv.args, " "))
+			return 0
+		}
+	}
+
+	f := &fakeOp{handler: handler}
+	prev := opRunner
+	opRunner = f.run
+	t.Cleanup(func() {
+		opRunner = prev
+		setSessionToken("")
+	})
+	return f
+}
+
+func (f *fakeOp) run(ctx context.Context, inv opInvocation) (int, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, strings.Join(inv.args, " "))
+	f.mu.Unlock()
+
+	inv.stdout = writerOrDiscard(inv.stdout)
+	inv.stderr = writerOrDiscard(inv.stderr)
+	return f.handler(inv), nil
+}
+
+// callCount returns how many invocations contained the given arguments
+func (f *fakeOp) callCount(args string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	count := 0
+	for _, call := range f.calls {
+		if strings.Contains(call, args) {
+			count++
+		}
+	}
+	return count
 }
 
 // sendCommand sends a command to the server and returns the response
@@ -321,3 +499,435 @@ func TestServerCleanupOnShutdown(t *testing.T) {
 		t.Errorf("Socket file still exists after shutdown: %v", err)
 	}
 }
+
+// TestCustomDenyMessage tests that a configured deny message is rendered for denied commands
+func TestCustomDenyMessage(t *testing.T) {
+	cfg := loadTestConfig(t, `
+deny_message: "Denied {{.Command}}, see https://wiki.example.com/opfwd"
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	response, err := sendCommand(t, cfg.SocketPath, "read op://Personal/SSH/passphrase")
+	if err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+
+	want := "Denied read op://Personal/SSH/passphrase, see https://wiki.example.com/opfwd\n"
+	if response != want {
+		t.Errorf("Expected response %q, got %q", want, response)
+	}
+}
+
+// TestInvalidDenyMessage tests that a malformed deny message template is rejected at load
+func TestInvalidDenyMessage(t *testing.T) {
+	path := writeTestConfig(t, `
+account: "test-account"
+deny_message: "Denied {{.Command"
+`)
+	if _, err := loadConfig(path); err == nil {
+		t.Error("Expected error for malformed deny_message, got nil")
+	}
+}
+
+// TestFakeOpCommandFlow tests a full allowed and denied command flow against a fake op
+func TestFakeOpCommandFlow(t *testing.T) {
+	fake := installFakeOp(t, nil)
+	cfg := loadTestConfig(t, `
+allowed_commands:
+  - "read op://Employee/CONFIG/operator"
+`)
+	serveConfig(t, cfg)
+
+	response, err := sendCommand(t, cfg.SocketPath, "read op://Employee/CONFIG/operator")
+	if err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if want := "op --account test-account read op://Employee/CONFIG/operator\n"; response != want {
+		t.Errorf("Expected response %q, got %q", want, response)
+	}
+	if n := fake.callCount("--account test-account account get"); n != 1 {
+		t.Errorf("Expected one login check, got %d", n)
+	}
+
+	response, err = sendCommand(t, cfg.SocketPath, "read op://Personal/SSH/passphrase")
+	if err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if !strings.Contains(response, "Error: Command not allowed") {
+		t.Errorf("Expected denial, got %q", response)
+	}
+	if n := fake.callCount("op://Personal/SSH/passphrase"); n != 0 {
+		t.Errorf("Expected denied command not to reach op, got %d calls", n)
+	}
+}
+
+// TestFakeOpSigninFailure tests that a failed sign in is reported to the client
+func TestFakeOpSigninFailure(t *testing.T) {
+	fake := installFakeOp(t, func(inv opInvocation) int {
+		fmt.Fprintln(inv.stderr, "[ERROR] not signed in")
+		return 1
+	})
+	cfg := loadTestConfig(t, `
+allowed_commands:
+  - "read op://Employee/CONFIG/operator"
+`)
+	serveConfig(t, cfg)
+
+	response, err := sendCommand(t, cfg.SocketPath, "read op://Employee/CONFIG/operator")
+	if err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if !strings.Contains(response, "Error: Could not sign in to 1Password") {
+		t.Errorf("Expected sign in error, got %q", response)
+	}
+	if n := fake.callCount("signin --account test-account"); n != 1 {
+		t.Errorf("Expected one sign in attempt, got %d", n)
+	}
+	if n := fake.callCount("read op://Employee/CONFIG/operator"); n != 0 {
+		t.Errorf("Expected command not to run without sign in, got %d calls", n)
+	}
+}
+
+// TestAutoSigninDisabled tests that the server never runs op signin when
+// auto_signin is off, and tells the client why the command didn't run
+func TestAutoSigninDisabled(t *testing.T) {
+	fake := installFakeOp(t, func(inv opInvocation) int {
+		fmt.Fprintln(inv.stderr, "[ERROR] not signed in")
+		return 1
+	})
+	cfg := loadTestConfig(t, `
+auto_signin: false
+allowed_commands:
+  - "read op://Employee/CONFIG/operator"
+`)
+	serveConfig(t, cfg)
+
+	response, err := sendCommand(t, cfg.SocketPath, "read op://Employee/CONFIG/operator")
+	if err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if !strings.Contains(response, "not signed in; signin disabled") {
+		t.Errorf("Expected signin disabled error, got %q", response)
+	}
+	if n := fake.callCount("account get"); n != 1 {
+		t.Errorf("Expected one sign in probe, got %d", n)
+	}
+	if n := fake.callCount("signin"); n != 0 {
+		t.Errorf("Expected no sign in attempt, got %d", n)
+	}
+	if n := fake.callCount("read op://Employee/CONFIG/operator"); n != 0 {
+		t.Errorf("Expected command not to run without sign in, got %d calls", n)
+	}
+}
+
+// TestSigninTimeout tests that a sign in that never finishes is stopped at
+// command_timeout and reported as a login timeout, without running the command
+func TestSigninTimeout(t *testing.T) {
+	installFakeOpScript(t, `case "$*" in
+*"account get"*) exit 1;;
+*signin*) exec sleep 30;;
+esac
+echo "op $*"
+`)
+	cfg := loadTestConfig(t, `
+command_timeout: 200ms
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	var out bytes.Buffer
+	start := time.Now()
+	code, err := forwardCommand(&out, cfg.SocketPath, "item get foo", clientOptions{})
+	if err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if code != exitTimeout || !strings.Contains(out.String(), "login timed out after 200ms") {
+		t.Errorf("Expected a login timeout, got exit %d: %q", code, out.String())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the sign in to be stopped at the timeout, took %s", elapsed)
+	}
+}
+
+// TestRequestIDInLogs tests that every log line of a request carries the same request ID
+func TestRequestIDInLogs(t *testing.T) {
+	installFakeOp(t, nil)
+	logs := captureLog(t)
+	cfg := loadTestConfig(t, `
+allowed_commands:
+  - "read op://Employee/CONFIG/operator"
+deny_message: "Denied (request {{.RequestID}})"
+`)
+	serveConfig(t, cfg)
+
+	if _, err := sendCommand(t, cfg.SocketPath, "read op://Employee/CONFIG/operator"); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) < 3 {
+		t.Fatalf("Expected log lines for input, decision and op args, got: %v", lines)
+	}
+
+	idPattern := regexp.MustCompile(`\[([0-9a-f]{8})\] `)
+	var reqID string
+	for _, line := range lines {
+		m := idPattern.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("Log line without request ID: %s", line)
+			continue
+		}
+		if reqID == "" {
+			reqID = m[1]
+		} else if m[1] != reqID {
+			t.Errorf("Expected request ID %s, got %s in line: %s", reqID, m[1], line)
+		}
+	}
+	for _, want := range []string{"Received input", "Command allowed", "Executing op with args"} {
+		if !strings.Contains(logs.String(), "["+reqID+"] "+want) {
+			t.Errorf("Expected %q log line tagged with %s, got:\n%s", want, reqID, logs.String())
+		}
+	}
+
+	// The request ID can be echoed back to the client through the deny message
+	response, err := sendCommand(t, cfg.SocketPath, "read op://Personal/SSH/passphrase")
+	if err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	m := regexp.MustCompile(`^Denied \(request ([0-9a-f]{8})\)\n$`).FindStringSubmatch(response)
+	if m == nil {
+		t.Fatalf("Expected deny message with request ID, got %q", response)
+	}
+	if !strings.Contains(logs.String(), "["+m[1]+"] Command not allowed") {
+		t.Errorf("Expected denial logged with request ID %s, got:\n%s", m[1], logs.String())
+	}
+}
+
+// failingListener is a net.Listener whose Accept always fails with err until closed
+type failingListener struct {
+	err     error
+	accepts atomic.Int64
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.accepts.Add(1)
+	select {
+	case <-l.closed:
+		return nil, net.ErrClosed
+	default:
+		return nil, l.err
+	}
+}
+
+func (l *failingListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *failingListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "failing", Net: "unix"}
+}
+
+// TestAcceptBackoff tests that accept errors back off instead of spinning and
+// are counted, and that a closed listener stops the loop
+func TestAcceptBackoff(t *testing.T) {
+	captureLog(t)
+	listener := &failingListener{err: os.NewSyscallError("accept", syscall.EMFILE), closed: make(chan struct{})}
+	before := metrics.acceptErrors.Load()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		acceptConnections(context.Background(), newServerListener(listener, "failing", &Rules{}), nil)
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	listener.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept loop did not stop after the listener was closed")
+	}
+
+	// 5ms doubling up to 300ms allows about 7 attempts, a busy loop millions
+	accepts := listener.accepts.Load()
+	if accepts > 20 {
+		t.Errorf("Expected accept to back off, got %d attempts in 300ms", accepts)
+	}
+	if errs := metrics.acceptErrors.Load() - before; errs == 0 || errs > uint64(accepts) {
+		t.Errorf("Expected accept errors to be counted, got %d for %d attempts", errs, accepts)
+	}
+}
+
+// TestPrintVersionJSON tests the machine-readable version output
+func TestPrintVersionJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := printVersion(&buf, true); err != nil {
+		t.Fatalf("Failed to print version: %v", err)
+	}
+
+	var info map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &info); err != nil {
+		t.Fatalf("Expected valid JSON, got %q: %v", buf.String(), err)
+	}
+	for _, key := range []string{"version", "commit", "buildDate", "goVersion"} {
+		if _, ok := info[key]; !ok {
+			t.Errorf("Expected key %q in %v", key, info)
+		}
+	}
+	if info["version"] != version || info["goVersion"] != goVersion {
+		t.Errorf("Unexpected version info: %v", info)
+	}
+
+	buf.Reset()
+	if err := printVersion(&buf, false); err != nil {
+		t.Fatalf("Failed to print version: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), "opfwd version "+version+"\n") {
+		t.Errorf("Expected plain text version by default, got %q", buf.String())
+	}
+}
+
+// TestNoExecuteMode tests that allowed commands are logged but op never runs
+func TestNoExecuteMode(t *testing.T) {
+	fake := installFakeOp(t, nil)
+	logs := captureLog(t)
+	cfg := loadTestConfig(t, `
+no_execute: true
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	response, err := sendCommand(t, cfg.SocketPath, "item get foo")
+	if err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if response != noExecuteMarker {
+		t.Errorf("Expected no-execute marker %q, got %q", noExecuteMarker, response)
+	}
+
+	response, err = sendCommand(t, cfg.SocketPath, "item delete foo")
+	if err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if !strings.Contains(response, "Command not allowed") {
+		t.Errorf("Expected denied command to still be denied, got %q", response)
+	}
+
+	if len(fake.calls) != 0 {
+		t.Errorf("Expected op never to be spawned, got calls: %v", fake.calls)
+	}
+	if !strings.Contains(logs.String(), "would run op with args: '--account' 'test-account' 'item' 'get' 'foo'") {
+		t.Errorf("Expected would-be argv to be logged, got:\n%s", logs.String())
+	}
+}
+
+// TestDefaultPathsXDG tests that the default paths honor the XDG base
+// directories and fall back to the home directory when they are unset
+func TestDefaultPathsXDG(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", "/tmp/xdg-config")
+	t.Setenv("XDG_RUNTIME_DIR", "/tmp/xdg-runtime")
+	if got, _ := getDefaultConfigPath(); got != "/tmp/xdg-config/opfwd/config.yaml" {
+		t.Errorf("Expected config path under XDG_CONFIG_HOME, got %q", got)
+	}
+	if got, _ := getDefaultSocketPath(); got != "/tmp/xdg-runtime/opfwd.sock" {
+		t.Errorf("Expected socket path under XDG_RUNTIME_DIR, got %q", got)
+	}
+
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	configPath, err := getDefaultConfigPath()
+	if err != nil || !strings.HasSuffix(configPath, filepath.Join(".config", "opfwd", "config.yaml")) {
+		t.Errorf("Expected ~/.config/opfwd/config.yaml, got %q: %v", configPath, err)
+	}
+	socketPath, err := getDefaultSocketPath()
+	if err != nil || !strings.HasSuffix(socketPath, filepath.Join(".ssh", "opfwd.sock")) {
+		t.Errorf("Expected ~/.ssh/opfwd.sock, got %q: %v", socketPath, err)
+	}
+}
+
+// TestPrintPaths tests that -paths prints the default paths as resolved, with
+// and without the XDG base directories set
+func TestPrintPaths(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	for _, xdg := range []string{"", "/tmp/xdg"} {
+		t.Setenv("XDG_CONFIG_HOME", xdg)
+		t.Setenv("XDG_RUNTIME_DIR", xdg)
+
+		var out bytes.Buffer
+		if err := printPaths(&out); err != nil {
+			t.Fatalf("Failed to print paths: %v", err)
+		}
+		configPath, _ := getDefaultConfigPath()
+		socketPath, _ := getDefaultSocketPath()
+		if xdg != "" && (!strings.HasPrefix(configPath, xdg) || !strings.HasPrefix(socketPath, xdg)) {
+			t.Errorf("Expected paths under %s, got %s and %s", xdg, configPath, socketPath)
+		}
+		if want := "config: " + configPath + "\nsocket: " + socketPath + "\n"; out.String() != want {
+			t.Errorf("Expected %q, got %q", want, out.String())
+		}
+	}
+}
+
+// TestLoginSingleFlight tests that concurrent requests share one login probe
+func TestLoginSingleFlight(t *testing.T) {
+	release := make(chan struct{})
+	fake := installFakeOp(t, func(inv opInvocation) int {
+		if strings.Contains(strings.Join(inv.args, " "), "account get") {
+			<-release
+			return 0
+		}
+		fmt.Fprintf(inv.stdout, "op %s\n", strings.Join(inv.args, " "))
+		return 0
+	})
+	cfg := loadTestConfig(t, `
+allowed_commands:
+  - "read op://Employee/CONFIG/operator"
+`)
+	serveConfig(t, cfg)
+
+	const requests = 8
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := sendCommand(t, cfg.SocketPath, "read op://Employee/CONFIG/operator")
+			if err != nil || !strings.Contains(response, "op --account test-account read") {
+				t.Errorf("Expected the command to run, got %q: %v", response, err)
+			}
+		}()
+	}
+
+	// Hold the probe until every other request waits on it
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		loginFlight.mu.Lock()
+		waiting := loginFlight.current != nil && loginFlight.current.waiters == requests-1
+		loginFlight.mu.Unlock()
+		if waiting {
+			break
+		}
+		if time.Now().After(deadline) {
+			close(release)
+			t.Fatal("Timed out waiting for the requests to share the login check")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if n := fake.callCount("account get"); n != 1 {
+		t.Errorf("Expected one login probe, got %d", n)
+	}
+	if n := fake.callCount("read op://Employee/CONFIG/operator"); n != requests {
+		t.Errorf("Expected %d commands to run, got %d", requests, n)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// serverMetrics holds counters operators can use to spot a struggling server
+type serverMetrics struct {
+	// acceptErrors counts failed accepts, such as running out of file descriptors
+	acceptErrors atomic.Uint64
+
+	// activeConns is the number of connections being handled
+	activeConns atomic.Int64
+
+	// queuedConns is the number of connections waiting for a handler slot
+	// when MaxConcurrent is set
+	queuedConns atomic.Int64
+
+	// runningHandlers is the number of connections past the wait for a
+	// slot, peakHandlers the most there were at once
+	runningHandlers atomic.Int64
+	peakHandlers    atomic.Int64
+
+	// Requests by decision since the server started
+	allowed     atomic.Uint64
+	denied      atomic.Uint64
+	rateLimited atomic.Uint64
+}
+
+// metrics are the counters of the running server
+var metrics serverMetrics
+
+// recordDecision counts a request by the decision taken on it
+func (m *serverMetrics) recordDecision(decision string) {
+	switch decision {
+	case "allowed":
+		m.allowed.Add(1)
+	case "denied":
+		m.denied.Add(1)
+	case "rate_limited":
+		m.rateLimited.Add(1)
+	}
+}
+
+// metricsSnapshot is the state of the counters at one point, as @metrics
+// reports it
+type metricsSnapshot struct {
+	UptimeSeconds     int64            `json:"uptime_seconds"`
+	ActiveConnections int64            `json:"active_connections"`
+	QueueDepth        int64            `json:"queue_depth"`
+	PeakHandlers      int64            `json:"peak_handlers"`
+	Requests          requestsSnapshot `json:"requests"`
+	AcceptErrors      uint64           `json:"accept_errors"`
+}
+
+// requestsSnapshot counts the requests by decision
+type requestsSnapshot struct {
+	Total       uint64 `json:"total"`
+	Allowed     uint64 `json:"allowed"`
+	Denied      uint64 `json:"denied"`
+	RateLimited uint64 `json:"rate_limited"`
+}
+
+// snapshot reads the counters
+func (m *serverMetrics) snapshot() metricsSnapshot {
+	requests := requestsSnapshot{
+		Allowed:     m.allowed.Load(),
+		Denied:      m.denied.Load(),
+		RateLimited: m.rateLimited.Load(),
+	}
+	requests.Total = requests.Allowed + requests.Denied + requests.RateLimited
+	return metricsSnapshot{
+		UptimeSeconds:     int64(time.Since(serverStarted) / time.Second),
+		ActiveConnections: m.activeConns.Load(),
+		QueueDepth:        m.queuedConns.Load(),
+		PeakHandlers:      m.peakHandlers.Load(),
+		Requests:          requests,
+		AcceptErrors:      m.acceptErrors.Load(),
+	}
+}
+
+// metricsJSON replies to @metrics with the counters as a JSON object, for
+// monitoring that polls the server without parsing @status
+func metricsJSON(logger *log.Logger) (string, error) {
+	data, err := json.Marshal(metrics.snapshot())
+	if err != nil {
+		return "", err
+	}
+	return string(data) + "\n", nil
+}
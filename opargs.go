@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// serverManagedFlags are op flags that pick the account, session or config
+// op runs with. The server pins these, so neither clients nor the default
+// args may set them.
+var serverManagedFlags = []string{"--account", "--config", "--session"}
+
+// flagName returns the name of a flag like "--format" or "--format=json"
+func flagName(arg string) string {
+	name, _, _ := strings.Cut(arg, "=")
+	return name
+}
+
+// findServerManagedFlag returns the first server managed flag in a command
+func findServerManagedFlag(command string) (string, bool) {
+	for _, arg := range strings.Fields(command) {
+		if name := flagName(arg); slices.Contains(serverManagedFlags, name) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// findBlockedFlag returns the first flag of a command blocked for it by rules.
+// When case is ignored, so is the case of the prefix and the flags, as the
+// rules would otherwise allow a flag they block spelt in capitals.
+func (r *Rules) findBlockedFlag(command string) (string, bool) {
+	command = canonicalizeCommand(command)
+	fold := func(s string) string { return s }
+	if config.CaseInsensitive {
+		fold = strings.ToLower
+	}
+	for _, blocked := range r.BlockedFlags {
+		if !strings.HasPrefix(fold(command), fold(blocked.Prefix)) {
+			continue
+		}
+		for _, arg := range strings.Fields(command) {
+			for _, flag := range blocked.Flags {
+				if flagMatches(fold(arg), fold(flag)) {
+					return flag, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// flagMatches reports whether arg sets flag, including as "--flag=value" and,
+// for a short flag like "-o", with the value attached as in "-o/tmp/x"
+func flagMatches(arg, flag string) bool {
+	if flagName(arg) == flag {
+		return true
+	}
+	return len(flag) == 2 && !strings.HasPrefix(arg, "--") && strings.HasPrefix(arg, flag)
+}
+
+// validateBlockedFlags checks that every blocked flag looks like a flag
+func validateBlockedFlags(rules []BlockedFlagRule) error {
+	for i, rule := range rules {
+		if len(rule.Flags) == 0 {
+			return fmt.Errorf("blocked_flags[%d]: flags is required", i)
+		}
+		for _, flag := range rule.Flags {
+			if !strings.HasPrefix(flag, "-") || flag == "-" || flag == "--" || strings.ContainsAny(flag, "= \t") {
+				return fmt.Errorf("blocked_flags[%d]: invalid flag %q, expected a name like --out-file or -o", i, flag)
+			}
+		}
+	}
+	return nil
+}
+
+// splitFlagGroups splits args into flags, each followed by its value when it
+// is given as a separate argument
+func splitFlagGroups(args []string) ([][]string, error) {
+	var groups [][]string
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			return nil, fmt.Errorf("%q is not a flag", args[i])
+		}
+		group := []string{args[i]}
+		if !strings.Contains(args[i], "=") && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			group = append(group, args[i+1])
+			i++
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// validateDefaultOpArgs checks that the default args are flags the server
+// doesn't manage itself, and that the position is known
+func validateDefaultOpArgs(args []string, position string) error {
+	groups, err := splitFlagGroups(args)
+	if err != nil {
+		return fmt.Errorf("default_op_args: %w", err)
+	}
+	for _, group := range groups {
+		if slices.Contains(serverManagedFlags, flagName(group[0])) {
+			return fmt.Errorf("default_op_args: %s is set by the server", flagName(group[0]))
+		}
+	}
+
+	switch position {
+	case "", "append", "prepend":
+		return nil
+	default:
+		return fmt.Errorf("default_op_args_position must be append or prepend, got %q", position)
+	}
+}
+
+// validateDefaultOpArgsRules checks that no default arg is a flag the rules
+// of any socket block or append themselves. Defaults go on every command, so
+// such a flag would either slip past blocked_flags or meet the rule's own.
+func validateDefaultOpArgsRules(args []string, rules ...*Rules) error {
+	// Defaults were validated before the rules are checked against them
+	groups, _ := splitFlagGroups(args)
+	for _, group := range groups {
+		for _, r := range rules {
+			for _, blocked := range r.BlockedFlags {
+				for _, flag := range blocked.Flags {
+					if flagMatches(group[0], flag) {
+						return fmt.Errorf("default_op_args: %s is blocked by blocked_flags", flag)
+					}
+				}
+			}
+			for _, list := range r.ruleLists() {
+				for _, rule := range list {
+					if flag, found := findAppendedFlag(group[0], rule.AppendArgs); found {
+						return fmt.Errorf("default_op_args: %s is appended by rule %s", flag, rule.Match)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateAppendArgs checks that the args a rule appends are flags the server
+// doesn't manage itself
+func validateAppendArgs(args []string) error {
+	groups, err := splitFlagGroups(args)
+	if err != nil {
+		return fmt.Errorf("append_args: %w", err)
+	}
+	for _, group := range groups {
+		if slices.Contains(serverManagedFlags, flagName(group[0])) {
+			return fmt.Errorf("append_args: %s is set by the server", flagName(group[0]))
+		}
+	}
+	return nil
+}
+
+// findAppendedFlag returns the first flag of a command that the matched rule
+// appends itself, so a client can neither override nor repeat it
+func findAppendedFlag(command string, appendArgs []string) (string, bool) {
+	// Appended args were validated when loading the config
+	groups, _ := splitFlagGroups(appendArgs)
+	for _, arg := range strings.Fields(command) {
+		for _, group := range groups {
+			if name := flagName(group[0]); flagMatches(arg, name) {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// withDefaultOpArgs adds the default args to the command args, skipping every
+// flag the client already set
+func withDefaultOpArgs(cmdArgs, defaults []string, position string) []string {
+	// Defaults were validated when loading the config
+	groups, _ := splitFlagGroups(defaults)
+
+	var extra []string
+	for _, group := range groups {
+		name := flagName(group[0])
+		supplied := slices.ContainsFunc(cmdArgs, func(arg string) bool {
+			return flagName(arg) == name
+		})
+		if !supplied {
+			extra = append(extra, group...)
+		}
+	}
+
+	if position == "prepend" {
+		return append(extra, cmdArgs...)
+	}
+	return append(slices.Clone(cmdArgs), extra...)
+}
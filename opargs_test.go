@@ -0,0 +1,242 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestDefaultOpArgs tests that default args reach op without duplicating
+// flags the client passed
+func TestDefaultOpArgs(t *testing.T) {
+	fake := installFakeOp(t, nil)
+	cfg := loadTestConfig(t, `
+default_op_args: ["--format", "json", "--cache"]
+allowed_prefixes:
+  - "item list"
+`)
+	serveConfig(t, cfg)
+
+	tests := map[string]string{
+		"item list":                     "op --account test-account item list --format json --cache\n",
+		"item list --format human":      "op --account test-account item list --format human --cache\n",
+		"item list --format=human":      "op --account test-account item list --format=human --cache\n",
+		"item list --cache --format=js": "op --account test-account item list --cache --format=js\n",
+	}
+	for command, want := range tests {
+		response, err := sendCommand(t, cfg.SocketPath, command)
+		if err != nil {
+			t.Fatalf("Failed to send command: %v", err)
+		}
+		if response != want {
+			t.Errorf("%s: expected %q, got %q", command, want, response)
+		}
+	}
+
+	// Rules match the command as the client sent it
+	response, err := sendCommand(t, cfg.SocketPath, "vault list")
+	if err != nil || !strings.Contains(response, "Command not allowed") {
+		t.Errorf("Expected vault list to be denied, got %q: %v", response, err)
+	}
+	if n := fake.callCount("vault list"); n != 0 {
+		t.Errorf("Expected denied command not to run, ran %d times", n)
+	}
+}
+
+// TestDefaultOpArgsPrepend tests placing the defaults before the command
+func TestDefaultOpArgsPrepend(t *testing.T) {
+	got := withDefaultOpArgs([]string{"item", "get", "foo"}, []string{"--format=json"}, "prepend")
+	if want := "--format=json item get foo"; strings.Join(got, " ") != want {
+		t.Errorf("Expected %q, got %q", want, strings.Join(got, " "))
+	}
+}
+
+// TestInvalidDefaultOpArgs tests that bad default args are rejected at load time
+func TestInvalidDefaultOpArgs(t *testing.T) {
+	tests := map[string]string{
+		"not a flag":   `default_op_args: ["json"]`,
+		"account":      `default_op_args: ["--account", "other"]`,
+		"bad position": "default_op_args: [\"--cache\"]\ndefault_op_args_position: middle",
+		"blocked":      "default_op_args: [\"--out-file\", \"x\"]\nblocked_flags:\n  - prefix: \"document get\"\n    flags: [\"--out-file\"]",
+		"appended":     "default_op_args: [\"--format=json\"]\nallowed_prefixes:\n  - {match: \"item get\", append_args: [\"--format\", \"human\"]}",
+		"listener":     "default_op_args: [\"-o\", \"x\"]\nlisteners:\n  - path: /tmp/opfwd-l.sock\n    blocked_flags:\n      - flags: [\"-o\"]",
+	}
+	for name, extra := range tests {
+		t.Run(name, func(t *testing.T) {
+			env := setupTestEnvironment(t)
+			path := writeTestConfig(t, "account: "+env.account+"\n"+extra+"\n")
+			if _, err := loadConfig(path); err == nil {
+				t.Errorf("Expected %s to be rejected", name)
+			}
+		})
+	}
+}
+
+// TestRejectServerManagedFlags tests that commands can't switch the account,
+// session or config even when a rule allows their prefix
+func TestRejectServerManagedFlags(t *testing.T) {
+	fake := installFakeOp(t, nil)
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "item get"
+allowed_globs:
+  - "*"
+`)
+	serveConfig(t, cfg)
+
+	for _, command := range []string{
+		"item get foo --account other",
+		"item get foo --account=other",
+		"--account other item get foo",
+		"item get foo --session abc123",
+		"item get foo --config /tmp/op",
+	} {
+		response, err := sendCommand(t, cfg.SocketPath, command)
+		if err != nil {
+			t.Fatalf("Failed to send command: %v", err)
+		}
+		if !strings.Contains(response, "is set by the server") {
+			t.Errorf("%s: expected denial, got %q", command, response)
+		}
+		if validateCommand(&cfg.Rules, command) {
+			t.Errorf("%s: expected validateCommand to deny", command)
+		}
+	}
+	if n := fake.callCount("other"); n != 0 {
+		t.Errorf("Expected op never to run against another account, ran %d times", n)
+	}
+
+	// Lookalike values are fine
+	response, err := sendCommand(t, cfg.SocketPath, "item get --account-notes")
+	if err != nil || strings.Contains(response, "Error") {
+		t.Errorf("Expected unrelated flag to be allowed, got %q: %v", response, err)
+	}
+}
+
+// TestBlockedFlags tests that flags blocked for a prefix are refused on
+// commands the rules otherwise allow
+func TestBlockedFlags(t *testing.T) {
+	fake := installFakeOp(t, nil)
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "item get"
+  - "document get"
+blocked_flags:
+  - prefix: "item get"
+    flags: ["--out-file", "-o"]
+  - flags: ["--force"]
+`)
+	serveConfig(t, cfg)
+
+	response, err := sendCommand(t, cfg.SocketPath, "item get foo")
+	if err != nil || response != "op --account test-account item get foo\n" {
+		t.Errorf("Expected item get foo to run, got %q: %v", response, err)
+	}
+
+	for _, command := range []string{
+		"item get foo --out-file /tmp/x",
+		"item get foo --out-file=/tmp/x",
+		"item get foo -o /tmp/x",
+		"item get foo -o/tmp/x",
+		"document get foo --force",
+	} {
+		response, err := sendCommand(t, cfg.SocketPath, command)
+		if err != nil || !strings.Contains(response, "is blocked") {
+			t.Errorf("%s: expected denial, got %q: %v", command, response, err)
+		}
+		if validateCommand(&cfg.Rules, command) {
+			t.Errorf("%s: expected validateCommand to deny", command)
+		}
+	}
+	if n := fake.callCount("/tmp/x"); n != 0 {
+		t.Errorf("Expected op never to run with a blocked flag, ran %d times", n)
+	}
+
+	// Blocked flags only apply under their prefix, and lookalikes are fine
+	for _, command := range []string{"document get foo --out-file /tmp/doc", "item get foo --otp"} {
+		if !validateCommand(&cfg.Rules, command) {
+			t.Errorf("%s: expected validateCommand to allow", command)
+		}
+	}
+}
+
+// TestBlockedFlagsCaseInsensitive tests that when case is ignored, a blocked
+// flag or its prefix spelt in another case is still refused
+func TestBlockedFlagsCaseInsensitive(t *testing.T) {
+	prev := config
+	t.Cleanup(func() { config = prev })
+	config = loadTestConfig(t, `
+case_insensitive: true
+allowed_prefixes:
+  - "item get"
+blocked_flags:
+  - prefix: "item get"
+    flags: ["--reveal"]
+`)
+
+	for _, command := range []string{"item get foo --REVEAL", "item get foo --Reveal=true", "ITEM GET foo --reveal"} {
+		if flag, found := config.Rules.findBlockedFlag(command); !found || flag != "--reveal" {
+			t.Errorf("%s: expected --reveal to be blocked, got %q, %v", command, flag, found)
+		}
+		if validateCommand(&config.Rules, command) {
+			t.Errorf("%s: expected validateCommand to deny", command)
+		}
+	}
+	if !validateCommand(&config.Rules, "ITEM GET foo") {
+		t.Error("Expected the command without the flag to be allowed")
+	}
+}
+
+// TestInvalidBlockedFlags tests that malformed blocked_flags entries are
+// rejected at load
+func TestInvalidBlockedFlags(t *testing.T) {
+	for name, blocked := range map[string]string{
+		"no flags":   `[{prefix: "item get"}]`,
+		"not a flag": `[{flags: ["out-file"]}]`,
+		"with value": `[{flags: ["--out-file=/tmp/x"]}]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := writeTestConfig(t, "account: \"test-account\"\nblocked_flags: "+blocked+"\n")
+			if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "blocked_flags") {
+				t.Errorf("Expected blocked_flags error, got %v", err)
+			}
+		})
+	}
+}
+
+// TestRuleAppendArgs tests that the append_args of a rule reach op for the
+// commands it matches only, and that clients can't set those flags themselves
+func TestRuleAppendArgs(t *testing.T) {
+	fake := installFakeOp(t, nil)
+	cfg := loadTestConfig(t, `
+default_op_args: ["--cache"]
+allowed_prefixes:
+  - match: "item get"
+    append_args: ["--format", "human", "--no-color"]
+  - "item list"
+`)
+	serveConfig(t, cfg)
+
+	tests := map[string]string{
+		"item get foo":              "op --account test-account item get foo --format human --no-color --cache\n",
+		"item list":                 "op --account test-account item list --cache\n",
+		"item get foo --no-color":   "Error: Command not allowed, --no-color is set by the server: item get foo --no-color\n",
+		"item get foo --format=csv": "Error: Command not allowed, --format is set by the server: item get foo --format=csv\n",
+	}
+	for command, want := range tests {
+		response, err := sendCommand(t, cfg.SocketPath, command)
+		if err != nil {
+			t.Fatalf("Failed to send command: %v", err)
+		}
+		if response != want {
+			t.Errorf("%s: expected %q, got %q", command, want, response)
+		}
+	}
+	if n := fake.callCount("item get"); n != 1 {
+		t.Errorf("Expected only the allowed item get to run, ran %d times", n)
+	}
+
+	path := writeTestConfig(t, "account: test-account\nallowed_commands:\n  - {match: \"vault list\", append_args: [\"--session\", \"x\"]}\n")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "allowed_commands[0]: append_args: --session is set by the server") {
+		t.Errorf("Expected append_args setting a server managed flag to be rejected, got %v", err)
+	}
+}
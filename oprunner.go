@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// opInvocation describes a single run of the op binary
+type opInvocation struct {
+	args   []string
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	// env is added to the environment op inherits from the server
+	env []string
+
+	// wrapper is a command op is run under, like `nice -n 10`, none when empty
+	wrapper []string
+
+	// logger receives errors about the invocation, log.Default() when nil
+	logger *log.Logger
+}
+
+// opRunner runs op to completion and returns its exit code, or -1 when op
+// didn't exit normally. A non-zero exit code is not an error; the error is
+// reserved for op failing to start. It is a variable so tests can substitute
+// a fake that doesn't exec anything.
+var opRunner = realOpRunner
+
+// opWaitDelay is how long op's output is waited for once op has exited or
+// been stopped. A process op left behind holding its stdout or stderr open
+// would otherwise hold the request forever. It is a variable so tests can
+// shorten it.
+var opWaitDelay = 5 * time.Second
+
+// opNotFoundMessage is sent to the client when the op binary is missing
+const opNotFoundMessage = "Error: 1Password CLI not found; is it still installed?\n"
+
+// opNotFoundGuidance is the message the server exits with when op isn't
+// installed, with install instructions for goos and the error of the lookup
+func opNotFoundGuidance(goos string, err error) string {
+	var hint string
+	switch goos {
+	case "darwin":
+		hint = "To install it on macOS:\n\nbrew install 1password-cli"
+	case "linux":
+		hint = "To install it on Linux, add the 1Password apt, dnf or apk repository and install the 1password-cli\n" +
+			"package, or download the binary from https://developer.1password.com/docs/cli/get-started/"
+	default:
+		hint = "To install it, download it from https://developer.1password.com/docs/cli/get-started/"
+	}
+	return fmt.Sprintf("The 1Password CLI (op) command was not found in your system PATH.\n\n%s\n\nError details: %v", hint, err)
+}
+
+// opBinary returns the op binary to run, the configured op_path or op from PATH
+func opBinary() string {
+	if config.OpPath != "" {
+		return config.OpPath
+	}
+	return "op"
+}
+
+// isOpNotFound reports whether err means the op binary doesn't exist, for
+// example because it was uninstalled or moved while the server was running
+func isOpNotFound(err error) bool {
+	return errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist)
+}
+
+// realOpRunner runs the op binary, streaming its output to the
+// invocation's writers
+func realOpRunner(ctx context.Context, inv opInvocation) (int, error) {
+	opCmd := exec.CommandContext(ctx, opBinary(), inv.args...)
+	if len(inv.wrapper) > 0 {
+		args := append(append(inv.wrapper[1:len(inv.wrapper):len(inv.wrapper)], opBinary()), inv.args...)
+		opCmd = exec.CommandContext(ctx, inv.wrapper[0], args...)
+
+		// Wrappers may fork op rather than exec it, so run them in their own
+		// process group and kill the whole group on cancellation
+		opCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		opCmd.Cancel = func() error {
+			return syscall.Kill(-opCmd.Process.Pid, syscall.SIGKILL)
+		}
+	}
+
+	logger := inv.logger
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	// exec copies the output and stops waiting for it opWaitDelay after op
+	// has gone, closing the pipes on whatever op left running
+	opCmd.Stdin = inv.stdin
+	opCmd.Stdout = &outputWriter{w: writerOrDiscard(inv.stdout), stream: "stdout", logger: logger}
+	opCmd.Stderr = &outputWriter{w: writerOrDiscard(inv.stderr), stream: "stderr", logger: logger}
+	opCmd.WaitDelay = opWaitDelay
+	if len(inv.env) > 0 {
+		opCmd.Env = append(os.Environ(), inv.env...)
+	}
+
+	if err := opCmd.Start(); err != nil {
+		return -1, err
+	}
+
+	err := opCmd.Wait()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		return -1, fmt.Errorf("op exited but its output was held open for more than %s", opWaitDelay)
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return -1, err
+	}
+	return opCmd.ProcessState.ExitCode(), nil
+}
+
+// outputWriter passes one of op's output streams on to w. Once writing fails
+// it logs the error, unless the client went away, and drops the rest of the
+// stream, as op is being stopped by then.
+type outputWriter struct {
+	w      io.Writer
+	stream string
+	logger *log.Logger
+	failed bool
+}
+
+// Write passes p on to w until a write fails
+func (o *outputWriter) Write(p []byte) (int, error) {
+	if o.failed {
+		return len(p), nil
+	}
+	if _, err := o.w.Write(p); err != nil {
+		o.failed = true
+		if !errors.Is(err, errClientGone) {
+			o.logger.Printf("Error copying %s: %v", o.stream, err)
+		}
+	}
+	return len(p), nil
+}
+
+// validateOpWrapper checks that the wrapper command can be found
+func validateOpWrapper(wrapper []string) error {
+	if len(wrapper) == 0 {
+		return nil
+	}
+	if _, err := exec.LookPath(wrapper[0]); err != nil {
+		return fmt.Errorf("op_wrapper command %q not found: %w", wrapper[0], err)
+	}
+	return nil
+}
+
+// errClientGone is returned when writing op output fails because the client
+// disconnected, which is a normal end to a request rather than a failure
+var errClientGone = errors.New("client disconnected")
+
+// clientGoneWriter passes op output on to w. The first time writing fails it
+// calls onGone, which stops op, and every failed write returns errClientGone
+// so both of op's streams stop being copied.
+type clientGoneWriter struct {
+	w      io.Writer
+	once   sync.Once
+	onGone func(err error)
+}
+
+// Write passes p on to w
+func (c *clientGoneWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		c.once.Do(func() { c.onGone(err) })
+		return n, fmt.Errorf("%w: %v", errClientGone, err)
+	}
+	return n, nil
+}
+
+// writerOrDiscard returns w, or io.Discard when w is nil
+func writerOrDiscard(w io.Writer) io.Writer {
+	if w == nil {
+		return io.Discard
+	}
+	return w
+}
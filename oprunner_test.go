@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeWrapperScript writes an executable wrapper script and returns its path
+func writeWrapperScript(t *testing.T, body string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "wrap")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0700); err != nil {
+		t.Fatalf("Failed to write wrapper: %v", err)
+	}
+	return path
+}
+
+// TestOpWrapperPassesThrough tests that output and the exit code of op pass
+// through the wrapper
+func TestOpWrapperPassesThrough(t *testing.T) {
+	installFakeOpScript(t, "echo \"op $*\"\necho oops >&2\nexit 3\n")
+	wrapper := writeWrapperScript(t, "echo \"wrapped $1\"\nshift\nexec \"$@\"\n")
+
+	if err := validateOpWrapper([]string{wrapper, "tag"}); err != nil {
+		t.Fatalf("Expected wrapper to resolve, got: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	exitCode, err := realOpRunner(context.Background(), opInvocation{
+		args:    []string{"item", "get", "foo"},
+		stdout:  &stdout,
+		stderr:  &stderr,
+		wrapper: []string{wrapper, "tag"},
+	})
+	if err != nil {
+		t.Fatalf("Expected op to run, got: %v", err)
+	}
+
+	if exitCode != 3 {
+		t.Errorf("Expected exit code 3, got %d", exitCode)
+	}
+	if want := "wrapped tag\nop item get foo\n"; stdout.String() != want {
+		t.Errorf("Expected stdout %q, got %q", want, stdout.String())
+	}
+	if stderr.String() != "oops\n" {
+		t.Errorf("Expected stderr %q, got %q", "oops\n", stderr.String())
+	}
+}
+
+// TestOpWrapperKillsProcessGroup tests that cancelling kills op even when the
+// wrapper forked it instead of exec'ing it
+func TestOpWrapperKillsProcessGroup(t *testing.T) {
+	installFakeOpScript(t, "sleep 30\n")
+	wrapper := writeWrapperScript(t, "\"$@\" &\nwait\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	exitCode, err := realOpRunner(ctx, opInvocation{args: []string{"item", "list"}, wrapper: []string{wrapper}})
+	if err != nil {
+		t.Fatalf("Expected op to start, got: %v", err)
+	}
+	if exitCode != -1 {
+		t.Errorf("Expected a killed op to report -1, got %d", exitCode)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the process group to be killed promptly, took %s", elapsed)
+	}
+}
+
+// TestOpLeftOutputOpen tests that a process op leaves behind holding its
+// output open doesn't hold the request once op has exited
+func TestOpLeftOutputOpen(t *testing.T) {
+	installFakeOpScript(t, "echo \"op $*\"\nsleep 5 &\nexit 0\n")
+	prev := opWaitDelay
+	opWaitDelay = 100 * time.Millisecond
+	t.Cleanup(func() { opWaitDelay = prev })
+
+	var stdout bytes.Buffer
+	start := time.Now()
+	exitCode, err := realOpRunner(context.Background(), opInvocation{args: []string{"item", "list"}, stdout: &stdout})
+	if err == nil || !strings.Contains(err.Error(), "output was held open") || exitCode != -1 {
+		t.Errorf("Expected the held output to be reported, got %d: %v", exitCode, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected op's leftover process not to hold the request, took %s", elapsed)
+	}
+	if stdout.String() != "op item list\n" {
+		t.Errorf("Expected the output written before op exited, got %q", stdout.String())
+	}
+}
+
+// TestInvalidOpWrapper tests that a wrapper that can't be found is rejected
+func TestInvalidOpWrapper(t *testing.T) {
+	if err := validateOpWrapper([]string{"opfwd-no-such-wrapper"}); err == nil {
+		t.Error("Expected missing wrapper to be rejected")
+	}
+	if err := validateOpWrapper(nil); err != nil {
+		t.Errorf("Expected no wrapper to be valid, got: %v", err)
+	}
+}
+
+// TestOpMissingAtRuntime tests that a vanished op binary gets an actionable
+// message instead of the raw exec error
+func TestOpMissingAtRuntime(t *testing.T) {
+	logs := captureLog(t)
+	cfg := loadTestConfig(t, `
+op_path: "/nonexistent/opfwd-test/op"
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	response, err := sendCommand(t, cfg.SocketPath, "item get foo")
+	if err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if response != opNotFoundMessage {
+		t.Errorf("Expected %q, got %q", opNotFoundMessage, response)
+	}
+	if !strings.Contains(logs.String(), "Error: 1Password CLI not found at /nonexistent/opfwd-test/op") {
+		t.Errorf("Expected missing op to be logged, got:\n%s", logs.String())
+	}
+}
+
+// TestClientDisconnectStopsOp tests that op is stopped once the client goes
+// away, without logging the broken pipe as an error
+func TestClientDisconnectStopsOp(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "op.pid")
+	installFakeOpScript(t, `case "$*" in *"account get"*) exit 0;; esac
+echo $$ > `+pidFile+`
+exec yes 0123456789
+`)
+	logs := captureLog(t)
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "document get"
+`)
+	serveConfig(t, cfg)
+
+	conn, err := net.Dial("unix", cfg.SocketPath)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if _, err := conn.Write([]byte("document get huge\n")); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 100)); err != nil {
+		t.Fatalf("Failed to read the start of the output: %v", err)
+	}
+	conn.Close()
+
+	// Wait for the request to finish, which needs op to be gone
+	deadline := time.Now().Add(5 * time.Second)
+	for metrics.activeConns.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for op to be stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("Failed to read op pid: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatalf("Invalid op pid %q: %v", data, err)
+	}
+	if err := syscall.Kill(pid, 0); !errors.Is(err, syscall.ESRCH) {
+		t.Errorf("Expected op (pid %d) to be terminated, got %v", pid, err)
+	}
+
+	out := logs.String()
+	if !strings.Contains(out, "Client disconnected, stopping op") {
+		t.Errorf("Expected the disconnect to be logged, got:\n%s", out)
+	}
+	if strings.Contains(out, "Error") {
+		t.Errorf("Expected no error logged for a client disconnect, got:\n%s", out)
+	}
+}
+
+// TestOpNotFoundGuidance tests that the install instructions for a missing op
+// suit the platform and keep the lookup error
+func TestOpNotFoundGuidance(t *testing.T) {
+	err := errors.New(`exec: "op": executable file not found in $PATH`)
+	darwin := opNotFoundGuidance("darwin", err)
+	linux := opNotFoundGuidance("linux", err)
+
+	if !strings.Contains(darwin, "brew install 1password-cli") {
+		t.Errorf("Expected Homebrew instructions on macOS, got %q", darwin)
+	}
+	if strings.Contains(linux, "brew") || !strings.Contains(linux, "1password-cli") || linux == darwin {
+		t.Errorf("Expected package instructions on Linux, got %q", linux)
+	}
+	for _, msg := range []string{darwin, linux, opNotFoundGuidance("freebsd", err)} {
+		if !strings.Contains(msg, "Error details: "+err.Error()) {
+			t.Errorf("Expected the lookup error to be kept, got %q", msg)
+		}
+	}
+}
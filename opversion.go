@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// defaultMinOpVersion is the oldest op release whose argument syntax the
+// allow rules are written for
+const defaultMinOpVersion = "2.0.0"
+
+// opVersion caches the version reported by op at startup
+var opVersion string
+
+// parseOpVersion parses a version like "2.30.3" or "2.24.0-beta.01" into its
+// major, minor and patch components
+func parseOpVersion(s string) ([3]int, error) {
+	var v [3]int
+
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexAny(s, "-+ "); i >= 0 {
+		s = s[:i]
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return v, fmt.Errorf("invalid version %q", s)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+// compareOpVersions returns -1, 0 or 1 if a is older than, equal to or newer than b
+func compareOpVersions(a, b [3]int) int {
+	for i := range a {
+		switch {
+		case a[i] < b[i]:
+			return -1
+		case a[i] > b[i]:
+			return 1
+		}
+	}
+	return 0
+}
+
+// checkOpVersion runs `op --version` and compares it against the configured
+// minimum. An older op is logged as a warning, or rejected when
+// RequireOpVersion is set. The detected version is cached in opVersion.
+func checkOpVersion(cfg Config) error {
+	minVersion := cfg.MinOpVersion
+	if minVersion == "" {
+		minVersion = defaultMinOpVersion
+	}
+	minimum, err := parseOpVersion(minVersion)
+	if err != nil {
+		return fmt.Errorf("parsing min_op_version: %w", err)
+	}
+
+	var output bytes.Buffer
+	exitCode, err := opRunner(context.Background(), opInvocation{args: []string{"--version"}, stdout: &output})
+	if err == nil && exitCode != 0 {
+		err = fmt.Errorf("exit status %d", exitCode)
+	}
+	if err != nil {
+		if cfg.RequireOpVersion {
+			return fmt.Errorf("running op --version: %w", err)
+		}
+		log.Printf("Warning: could not determine 1Password CLI version: %v", err)
+		return nil
+	}
+
+	opVersion = strings.TrimSpace(output.String())
+	current, err := parseOpVersion(opVersion)
+	if err != nil {
+		log.Printf("Warning: could not parse 1Password CLI version %q: %v", opVersion, err)
+		return nil
+	}
+
+	if compareOpVersions(current, minimum) < 0 {
+		if cfg.RequireOpVersion {
+			return fmt.Errorf("1Password CLI version %s is older than the required minimum %s", opVersion, minVersion)
+		}
+		log.Printf("Warning: 1Password CLI version %s is older than the minimum supported %s, commands may misbehave", opVersion, minVersion)
+	}
+
+	return nil
+}
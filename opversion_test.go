@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestParseOpVersion tests parsing of op version strings
+func TestParseOpVersion(t *testing.T) {
+	tests := map[string][3]int{
+		"2.30.3":         {2, 30, 3},
+		"2.24.0-beta.01": {2, 24, 0},
+		"v1.12":          {1, 12, 0},
+		"2\n":            {2, 0, 0},
+	}
+	for input, want := range tests {
+		got, err := parseOpVersion(input)
+		if err != nil {
+			t.Errorf("parseOpVersion(%q) returned error: %v", input, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("parseOpVersion(%q) = %v, want %v", input, got, want)
+		}
+	}
+
+	for _, input := range []string{"", "two.0.0", "1.2.3.4"} {
+		if _, err := parseOpVersion(input); err == nil {
+			t.Errorf("parseOpVersion(%q) expected error, got nil", input)
+		}
+	}
+}
+
+// TestCheckOpVersionWarnsOnOldVersion tests that an old op logs a warning by default
+func TestCheckOpVersionWarnsOnOldVersion(t *testing.T) {
+	installFakeOpScript(t, "echo 1.12.4\n")
+	logs := captureLog(t)
+
+	if err := checkOpVersion(Config{}); err != nil {
+		t.Fatalf("Expected old version to only warn, got error: %v", err)
+	}
+
+	if opVersion != "1.12.4" {
+		t.Errorf("Expected cached version 1.12.4, got %q", opVersion)
+	}
+	if !strings.Contains(logs.String(), "1Password CLI version 1.12.4 is older than the minimum supported 2.0.0") {
+		t.Errorf("Expected warning about old version, got logs: %s", logs.String())
+	}
+}
+
+// TestCheckOpVersionRefusesOldVersion tests that an old op is refused when required
+func TestCheckOpVersionRefusesOldVersion(t *testing.T) {
+	installFakeOpScript(t, "echo 2.18.0\n")
+
+	err := checkOpVersion(Config{MinOpVersion: "2.20.0", RequireOpVersion: true})
+	if err == nil || !strings.Contains(err.Error(), "older than the required minimum 2.20.0") {
+		t.Errorf("Expected refusal for old version, got: %v", err)
+	}
+}
+
+// TestCheckOpVersionAcceptsNewVersion tests that a recent op passes the check quietly
+func TestCheckOpVersionAcceptsNewVersion(t *testing.T) {
+	installFakeOpScript(t, "echo 2.30.3\n")
+	logs := captureLog(t)
+
+	if err := checkOpVersion(Config{MinOpVersion: "2.20.0", RequireOpVersion: true}); err != nil {
+		t.Fatalf("Expected new version to pass, got: %v", err)
+	}
+	if strings.Contains(logs.String(), "Warning") {
+		t.Errorf("Expected no warning, got logs: %s", logs.String())
+	}
+}
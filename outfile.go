@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// defaultOutMode is the mode of the file -out writes, readable only by the user
+const defaultOutMode os.FileMode = 0600
+
+// parseOutMode parses the octal -out-mode flag, defaultOutMode when empty
+func parseOutMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return defaultOutMode, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode&^0777 != 0 {
+		return 0, fmt.Errorf("invalid -out-mode %q, expected octal permissions like 0600", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// forwardToFile forwards command like forwardCommand, but writes the output
+// to the file at path with the given mode instead of w. The file is only
+// written when the command succeeds; otherwise the output, which then holds
+// the error, goes to w and any existing file is left alone.
+func forwardToFile(w io.Writer, socketPath, command string, opts clientOptions, path string, mode os.FileMode) (int, error) {
+	var output secretBuffer
+	defer output.wipe()
+
+	exitCode, err := forwardCommand(&output, socketPath, command, opts)
+	if err != nil || exitCode != 0 {
+		_, _ = w.Write(output.Bytes())
+		return exitCode, err
+	}
+	if err := writeOutFile(path, mode, output.Bytes()); err != nil {
+		return 1, fmt.Errorf("Error writing %s: %v", path, err)
+	}
+	return 0, nil
+}
+
+// writeOutFile replaces the file at path with data. The data goes to a
+// temporary file with mode set before anything is written, which is renamed
+// over path, so the file is never readable with other permissions or seen
+// half written.
+func writeOutFile(path string, mode os.FileMode, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := tmp.Chmod(mode); err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
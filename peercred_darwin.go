@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// xucred mirrors struct xucred from <sys/ucred.h>
+type xucred struct {
+	version uint32
+	uid     uint32
+	ngroups int16
+	groups  [16]uint32
+}
+
+const (
+	solLocal      = 0 // SOL_LOCAL
+	localPeerCred = 1 // LOCAL_PEERCRED
+	localPeerPID  = 2 // LOCAL_PEERPID
+)
+
+// peerUID returns the user ID of the process on the other end of a Unix
+// socket connection
+func peerUID(conn net.Conn) (int, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return -1, fmt.Errorf("peer credentials need a Unix socket, got %T", conn)
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+
+	var cred xucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(cred))
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, solLocal, localPeerCred,
+			uintptr(unsafe.Pointer(&cred)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			credErr = errno
+		}
+	}); err != nil {
+		return -1, err
+	}
+	if credErr != nil {
+		return -1, fmt.Errorf("reading peer credentials: %w", credErr)
+	}
+	return int(cred.uid), nil
+}
+
+// peerPID returns the process ID of the process on the other end of a Unix
+// socket connection
+func peerPID(conn net.Conn) (int, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return -1, fmt.Errorf("peer credentials need a Unix socket, got %T", conn)
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+
+	var pid int32
+	var pidErr error
+	if err := raw.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(pid))
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, solLocal, localPeerPID,
+			uintptr(unsafe.Pointer(&pid)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			pidErr = errno
+		}
+	}); err != nil {
+		return -1, err
+	}
+	if pidErr != nil {
+		return -1, fmt.Errorf("reading peer pid: %w", pidErr)
+	}
+	return int(pid), nil
+}
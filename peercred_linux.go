@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerUID returns the user ID of the process on the other end of a Unix
+// socket connection
+func peerUID(conn net.Conn) (int, error) {
+	cred, err := peerCred(conn)
+	if err != nil {
+		return -1, err
+	}
+	return int(cred.Uid), nil
+}
+
+// peerPID returns the process ID of the process on the other end of a Unix
+// socket connection
+func peerPID(conn net.Conn) (int, error) {
+	cred, err := peerCred(conn)
+	if err != nil {
+		return -1, err
+	}
+	return int(cred.Pid), nil
+}
+
+// peerCred reads the SO_PEERCRED credentials of a Unix socket connection
+func peerCred(conn net.Conn) (*syscall.Ucred, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("peer credentials need a Unix socket, got %T", conn)
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, fmt.Errorf("reading peer credentials: %w", credErr)
+	}
+	return cred, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configProfile is the profile of the config file to load, set by -profile.
+// Without one only the top-level settings are used.
+var configProfile string
+
+// applyProfile merges the profile called name over cfg, which holds the
+// top-level settings shared by every profile. Settings the profile sets
+// replace the shared ones, except that its maps add to them.
+func applyProfile(cfg *Config, name string) error {
+	if name == "" {
+		return nil
+	}
+	node, ok := cfg.Profiles[name]
+	if !ok {
+		if len(cfg.Profiles) == 0 {
+			return fmt.Errorf("profile %q not found, the config defines no profiles", name)
+		}
+		names := make([]string, 0, len(cfg.Profiles))
+		for profile := range cfg.Profiles {
+			names = append(names, profile)
+		}
+		slices.Sort(names)
+		return fmt.Errorf("profile %q not found, the config defines: %s", name, strings.Join(names, ", "))
+	}
+
+	var nested struct {
+		Profiles yaml.Node `yaml:"profiles"`
+	}
+	if err := node.Decode(&nested); err != nil {
+		return fmt.Errorf("parsing profile %q: %w", name, err)
+	}
+	if !nested.Profiles.IsZero() {
+		return fmt.Errorf("profile %q: profiles can't be nested", name)
+	}
+	if err := node.Decode(cfg); err != nil {
+		return fmt.Errorf("parsing profile %q: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const profilesConfig = `
+socket_path: "/tmp/opfwd-profiles.sock"
+command_timeout: 30s
+allowed_prefixes:
+  - "whoami"
+bundles:
+  shared:
+    - "op://Shared/db/password"
+profiles:
+  work:
+    account: "work.1password.com"
+    allowed_prefixes:
+      - "read op://Work/"
+    bundles:
+      deploy:
+        - "op://Work/deploy/token"
+  personal:
+    account: "my.1password.com"
+    socket_path: "/tmp/opfwd-personal.sock"
+    allowed_prefixes:
+      - "read op://Personal/"
+`
+
+// useProfile selects profile for the configs loaded by the test
+func useProfile(t *testing.T, profile string) {
+	t.Helper()
+	prev := configProfile
+	configProfile = profile
+	t.Cleanup(func() { configProfile = prev })
+}
+
+// TestProfiles tests that both profiles of one file load, each with its own
+// account and rules merged over the shared settings
+func TestProfiles(t *testing.T) {
+	path := writeTestConfig(t, profilesConfig)
+	prev := config
+	t.Cleanup(func() { config = prev })
+
+	tests := []struct {
+		profile    string
+		account    string
+		socketPath string
+		allowed    string
+		denied     string
+	}{
+		{"work", "work.1password.com", "/tmp/opfwd-profiles.sock", "read op://Work/db/password", "read op://Personal/db/password"},
+		{"personal", "my.1password.com", "/tmp/opfwd-personal.sock", "read op://Personal/db/password", "read op://Work/db/password"},
+	}
+	for _, tt := range tests {
+		useProfile(t, tt.profile)
+		cfg, err := loadConfig(path)
+		if err != nil {
+			t.Fatalf("%s: failed to load config: %v", tt.profile, err)
+		}
+
+		if cfg.Account != tt.account {
+			t.Errorf("%s: expected account %q, got %q", tt.profile, tt.account, cfg.Account)
+		}
+		if cfg.SocketPath != tt.socketPath {
+			t.Errorf("%s: expected socket path %q, got %q", tt.profile, tt.socketPath, cfg.SocketPath)
+		}
+		if cfg.CommandTimeout.String() != "30s" {
+			t.Errorf("%s: expected the shared command_timeout, got %s", tt.profile, cfg.CommandTimeout)
+		}
+		if _, ok := cfg.Bundles["shared"]; !ok {
+			t.Errorf("%s: expected the shared bundle, got %v", tt.profile, cfg.Bundles)
+		}
+
+		var out bytes.Buffer
+		if code := testRule(&out, cfg, tt.allowed); code != 0 {
+			t.Errorf("%s: expected %s to be allowed, got %q", tt.profile, tt.allowed, out.String())
+		}
+		out.Reset()
+		if code := testRule(&out, cfg, tt.denied); code == 0 {
+			t.Errorf("%s: expected %s to be denied, got %q", tt.profile, tt.denied, out.String())
+		}
+	}
+
+	useProfile(t, "work")
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if _, ok := cfg.Bundles["deploy"]; !ok {
+		t.Errorf("Expected the profile's bundles to add to the shared ones, got %v", cfg.Bundles)
+	}
+}
+
+// TestProfileErrors tests that a missing profile is refused with the ones
+// the config does define, and that the top-level settings load on their own
+func TestProfileErrors(t *testing.T) {
+	useProfile(t, "home")
+	path := writeTestConfig(t, profilesConfig)
+	_, err := loadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), `profile "home" not found, the config defines: personal, work`) {
+		t.Errorf("Expected the missing profile to be refused, got %v", err)
+	}
+
+	path = writeTestConfig(t, "account: \"test-account\"\n")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "the config defines no profiles") {
+		t.Errorf("Expected a profile of a config without profiles to be refused, got %v", err)
+	}
+
+	useProfile(t, "work")
+	path = writeTestConfig(t, "profiles:\n  work:\n    account: \"work\"\n    profiles:\n      inner: {}\n")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "profiles can't be nested") {
+		t.Errorf("Expected nested profiles to be refused, got %v", err)
+	}
+
+	// Without a profile the shared settings lack an account
+	useProfile(t, "")
+	path = writeTestConfig(t, profilesConfig)
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "account is required") {
+		t.Errorf("Expected the top-level settings alone to need an account, got %v", err)
+	}
+}
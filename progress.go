@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// progressInterval is how often the client rewrites its progress line
+const progressInterval = 250 * time.Millisecond
+
+// progressReader counts the bytes read through it and reports the count on
+// a line of w that it rewrites at most every progressInterval
+type progressReader struct {
+	r     io.Reader
+	w     io.Writer
+	n     int64
+	shown time.Time
+}
+
+// newProgressReader returns a progressReader reading from r and reporting to w
+func newProgressReader(r io.Reader, w io.Writer) *progressReader {
+	return &progressReader{r: r, w: w, shown: now()}
+}
+
+// Read reads from the underlying reader, updating the progress line when it
+// is due
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if t := now(); n > 0 && t.Sub(p.shown) >= progressInterval {
+		p.shown = t
+		fmt.Fprintf(p.w, "\ropfwd: received %s", formatByteCount(p.n))
+	}
+	return n, err
+}
+
+// finish writes the final count and ends the progress line
+func (p *progressReader) finish() {
+	fmt.Fprintf(p.w, "\ropfwd: received %s\n", formatByteCount(p.n))
+}
+
+// formatByteCount formats n bytes with a binary unit, like "3.2 MiB"
+func formatByteCount(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
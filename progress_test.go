@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// notifyWriter collects what is written to it and closes reached once it
+// holds at least want bytes
+type notifyWriter struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	want    int
+	reached chan struct{}
+}
+
+func (w *notifyWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	had := w.buf.Len()
+	w.buf.Write(p)
+	if had < w.want && w.buf.Len() >= w.want {
+		close(w.reached)
+	}
+	return len(p), nil
+}
+
+// TestStreamLargeOutput tests that a large output reaches the client while
+// op is still producing it, compressed and framed as the client asks, and
+// that -progress reports the bytes received
+func TestStreamLargeOutput(t *testing.T) {
+	const first = 40 * 1024
+	const rest = 1024 * 1024
+
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	installFakeOp(t, func(inv opInvocation) int {
+		if !strings.Contains(strings.Join(inv.args, " "), "document get") {
+			return 0
+		}
+		inv.stdout.Write(bytes.Repeat([]byte("x"), first))
+		<-release
+		inv.stdout.Write(bytes.Repeat([]byte("y"), rest))
+		return 0
+	})
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "document get"
+`)
+	serveConfig(t, cfg)
+	// Registered after the server, so op is released before it shuts down
+	t.Cleanup(func() { releaseOnce.Do(func() { close(release) }) })
+
+	out := &notifyWriter{want: first, reached: make(chan struct{})}
+	var progress bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		code, err := forwardCommand(out, cfg.SocketPath, "document get big", clientOptions{progress: &progress})
+		if err == nil && code != 0 {
+			t.Errorf("Expected exit code 0, got %d", code)
+		}
+		done <- err
+	}()
+
+	// The first part must arrive while op is still blocked on the rest
+	select {
+	case <-out.reached:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the first part of the output before op finished")
+	}
+	releaseOnce.Do(func() { close(release) })
+
+	if err := <-done; err != nil {
+		t.Fatalf("Failed to forward command: %v", err)
+	}
+	if out.buf.Len() != first+rest {
+		t.Errorf("Expected %d bytes of output, got %d", first+rest, out.buf.Len())
+	}
+	if got := progress.String(); !strings.HasSuffix(got, "\ropfwd: received 1.0 MiB\n") {
+		t.Errorf("Expected the progress line to end with the total, got %q", got)
+	}
+}
+
+// TestFormatByteCount tests the byte counts shown in the progress line
+func TestFormatByteCount(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 * 1024 * 1024, "5.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+	}
+	for _, tt := range tests {
+		if got := formatByteCount(tt.n); got != tt.want {
+			t.Errorf("formatByteCount(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+// TestResponseChunks tests that a large write is sent as several frames of
+// at most maxOutputChunk
+func TestResponseChunks(t *testing.T) {
+	var buf bytes.Buffer
+	resp := newResponse(&buf, true)
+	data := bytes.Repeat([]byte("z"), 2*maxOutputChunk+10)
+	if n, err := resp.Write(data); err != nil || n != len(data) {
+		t.Fatalf("Expected to write %d bytes, wrote %d: %v", len(data), n, err)
+	}
+
+	var sizes []int
+	for rest := buf.Bytes(); len(rest) > 0; {
+		size := int(rest[1])<<24 | int(rest[2])<<16 | int(rest[3])<<8 | int(rest[4])
+		sizes = append(sizes, size)
+		rest = rest[5+size:]
+	}
+	if len(sizes) != 3 || sizes[0] != maxOutputChunk || sizes[1] != maxOutputChunk || sizes[2] != 10 {
+		t.Errorf("Expected frames of %d, %d and 10 bytes, got %v", maxOutputChunk, maxOutputChunk, sizes)
+	}
+}
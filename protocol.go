@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+const (
+	// maxRequestLine is the longest request line the server accepts
+	maxRequestLine = 64 * 1024
+
+	// maxStdinLen is the most stdin a client may send along with a request
+	maxStdinLen = 1 << 20
+
+	// framedRequestMagic starts a length-prefixed request. It is followed by
+	// the request length as 4 big-endian bytes and exactly that many bytes of
+	// request, so clients don't depend on a trailing newline.
+	framedRequestMagic = 0x00
+)
+
+var errRequestTooLong = errors.New("request line too long")
+
+// endCommand ends a connection carrying several commands, for clients that
+// tell the server they are done rather than closing their side
+const endCommand = "@end"
+
+const (
+	// verboseFlag is the request flag asking the server to send a metadata
+	// line about its decision before the op output
+	verboseFlag = "verbose"
+
+	// bannerFlag is the request flag asking the server to send its banner as
+	// a metadata line before the response
+	bannerFlag = "banner"
+
+	// metadataPrefix starts the metadata lines sent to verbose clients
+	metadataPrefix = "opfwd-meta: "
+)
+
+// request is a single command sent by the client.
+//
+// Clients send it as a JSON envelope on the first line of the connection,
+// followed by exactly StdinLen bytes of stdin for op. Older clients send the
+// bare command line instead, which is treated as a request with only Command set.
+// Either form may instead be sent length-prefixed after framedRequestMagic,
+// for clients that can't guarantee a trailing newline.
+type request struct {
+	Command  string   `json:"command"`
+	StdinLen int      `json:"stdin_len,omitempty"`
+	Flags    []string `json:"flags,omitempty"`
+
+	// Timestamp, Nonce and Signature are set on signed requests, see
+	// signRequest
+	Timestamp int64  `json:"ts,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+	Signature string `json:"sig,omitempty"`
+
+	// stdin holds the StdinLen bytes sent after the envelope
+	stdin []byte
+}
+
+// hasFlag reports whether the client set the named flag
+func (r request) hasFlag(name string) bool {
+	return slices.Contains(r.Flags, name)
+}
+
+// readRequest reads and parses the next request from r
+func readRequest(r *bufio.Reader) (request, error) {
+	var line string
+	if first, err := r.Peek(1); err == nil && first[0] == framedRequestMagic {
+		line, err = readFramed(r)
+		if err != nil {
+			return request{}, err
+		}
+	} else {
+		line, err = readLine(r)
+		if err != nil {
+			return request{}, err
+		}
+	}
+
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "{") {
+		req := request{Command: line}
+		if isHello(line) {
+			traceHello("recv", line)
+		} else {
+			traceRequest("recv", req)
+		}
+		return req, nil
+	}
+
+	var req request
+	if err := json.Unmarshal([]byte(line), &req); err != nil {
+		return request{}, fmt.Errorf("parsing request envelope: %w", err)
+	}
+	req.Command = strings.TrimSpace(req.Command)
+
+	if req.StdinLen < 0 || req.StdinLen > maxStdinLen {
+		return request{}, fmt.Errorf("invalid stdin length %d", req.StdinLen)
+	}
+	if req.StdinLen > 0 {
+		req.stdin = make([]byte, req.StdinLen)
+		if _, err := io.ReadFull(r, req.stdin); err != nil {
+			return request{}, fmt.Errorf("reading request stdin: %w", err)
+		}
+	}
+
+	traceRequest("recv", req)
+	return req, nil
+}
+
+// readFramed reads a single length-prefixed request from r
+func readFramed(r *bufio.Reader) (string, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", fmt.Errorf("reading request length: %w", err)
+	}
+
+	n := binary.BigEndian.Uint32(header[1:])
+	if n == 0 || n > maxRequestLine {
+		return "", fmt.Errorf("invalid request length %d", n)
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", fmt.Errorf("reading request: %w", err)
+	}
+	return string(data), nil
+}
+
+// readLine reads a single newline-terminated line from r. A final line without
+// a newline is returned as is when the client closes its side of the connection.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	switch {
+	case errors.Is(err, bufio.ErrBufferFull):
+		return "", errRequestTooLong
+	case errors.Is(err, io.EOF) && len(line) > 0:
+		return string(line), nil
+	case err != nil:
+		return "", err
+	}
+	return string(line), nil
+}
+
+// writeRequest sends req to the server as a newline-terminated JSON envelope
+func writeRequest(w io.Writer, req request) error {
+	traceRequest("send", req)
+	req.StdinLen = len(req.stdin)
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+	data = append(data, req.stdin...)
+	_, err = w.Write(data)
+	return err
+}
+
+// writeFramedRequest sends req to the server as a length-prefixed JSON envelope
+func writeFramedRequest(w io.Writer, req request) error {
+	traceRequest("send", req)
+	req.StdinLen = len(req.stdin)
+	envelope, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, 5, 5+len(envelope)+len(req.stdin))
+	data[0] = framedRequestMagic
+	binary.BigEndian.PutUint32(data[1:], uint32(len(envelope)))
+	data = append(data, envelope...)
+	data = append(data, req.stdin...)
+	_, err = w.Write(data)
+	return err
+}
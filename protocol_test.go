@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReadRequestEnvelope tests parsing a JSON request envelope with stdin
+func TestReadRequestEnvelope(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeRequest(&buf, request{
+		Command: "item create login",
+		Flags:   []string{"dry-run"},
+		stdin:   []byte("secret payload"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+
+	req, err := readRequest(bufio.NewReaderSize(&buf, maxRequestLine))
+	if err != nil {
+		t.Fatalf("Failed to read request: %v", err)
+	}
+
+	if req.Command != "item create login" {
+		t.Errorf("Expected command %q, got %q", "item create login", req.Command)
+	}
+	if req.StdinLen != len("secret payload") || string(req.stdin) != "secret payload" {
+		t.Errorf("Expected stdin %q, got %q (len %d)", "secret payload", req.stdin, req.StdinLen)
+	}
+	if !req.hasFlag("dry-run") || req.hasFlag("verbose") {
+		t.Errorf("Unexpected flags: %v", req.Flags)
+	}
+}
+
+// TestReadRequestLegacy tests that a bare command line is treated as a request
+func TestReadRequestLegacy(t *testing.T) {
+	r := bufio.NewReaderSize(strings.NewReader("  read op://Employee/CONFIG/operator  \n"), maxRequestLine)
+
+	req, err := readRequest(r)
+	if err != nil {
+		t.Fatalf("Failed to read request: %v", err)
+	}
+
+	if req.Command != "read op://Employee/CONFIG/operator" {
+		t.Errorf("Expected command %q, got %q", "read op://Employee/CONFIG/operator", req.Command)
+	}
+	if req.StdinLen != 0 || req.stdin != nil || len(req.Flags) != 0 {
+		t.Errorf("Expected no stdin or flags for legacy request, got %+v", req)
+	}
+}
+
+// TestRequestWithoutNewline tests that a command the client ends by closing
+// its side of the connection instead of with a newline is still run
+func TestRequestWithoutNewline(t *testing.T) {
+	fake := installFakeOp(t, nil)
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	if got, want := exchange(t, cfg.SocketPath, "item get foo"), "op --account test-account item get foo\n"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if got, want := exchange(t, cfg.SocketPath, `{"command":"item get bar"}`), "op --account test-account item get bar\n"; got != want {
+		t.Errorf("Expected the envelope to be run, %q, got %q", want, got)
+	}
+	if n := fake.callCount("item get"); n != 2 {
+		t.Errorf("Expected op to run for both requests without a newline, got %d runs", n)
+	}
+}
+
+// TestReadRequestInvalid tests that malformed requests are rejected
+func TestReadRequestInvalid(t *testing.T) {
+	tests := map[string]string{
+		"bad json":       "{\"command\": \n",
+		"negative stdin": "{\"command\": \"read\", \"stdin_len\": -1}\n",
+		"short stdin":    "{\"command\": \"read\", \"stdin_len\": 10}\nabc",
+		"too long":       strings.Repeat("a", maxRequestLine+1) + "\n",
+	}
+
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := readRequest(bufio.NewReaderSize(strings.NewReader(input), maxRequestLine)); err == nil {
+				t.Errorf("Expected error for %s request, got nil", name)
+			}
+		})
+	}
+
+	_, err := readRequest(bufio.NewReaderSize(strings.NewReader(strings.Repeat("a", maxRequestLine+1)), maxRequestLine))
+	if !errors.Is(err, errRequestTooLong) {
+		t.Errorf("Expected errRequestTooLong, got %v", err)
+	}
+}
+
+// TestEnvelopeRequestDenied tests that the server applies rules to enveloped requests
+func TestEnvelopeRequestDenied(t *testing.T) {
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	conn, err := net.Dial("unix", cfg.SocketPath)
+	if err != nil {
+		t.Fatalf("Failed to connect to socket: %v", err)
+	}
+	defer conn.Close()
+
+	if err := writeRequest(conn, request{Command: "read op://Personal/SSH/passphrase"}); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+
+	var response bytes.Buffer
+	if _, err := response.ReadFrom(conn); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	if !strings.Contains(response.String(), "Error: Command not allowed: read op://Personal/SSH/passphrase") {
+		t.Errorf("Expected denial for enveloped command, got: %s", response.String())
+	}
+}
+
+// TestReadRequestFramed tests length-prefixed requests, which need no newline
+func TestReadRequestFramed(t *testing.T) {
+	installFakeOp(t, func(inv opInvocation) int {
+		if inv.stdin == nil {
+			return 0
+		}
+		stdin, _ := io.ReadAll(inv.stdin)
+		fmt.Fprintf(inv.stdout, "op %s <%s>", strings.Join(inv.args, " "), stdin)
+		return 0
+	})
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "item create"
+`)
+	serveConfig(t, cfg)
+
+	conn, err := net.Dial("unix", cfg.SocketPath)
+	if err != nil {
+		t.Fatalf("Failed to connect to socket: %v", err)
+	}
+	defer conn.Close()
+
+	// The connection stays open for writing, so only the length ends the request
+	if err := writeFramedRequest(conn, request{Command: "item create login", stdin: []byte("payload")}); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if want := "op --account test-account item create login <payload>"; string(response) != want {
+		t.Errorf("Expected %q, got %q", want, response)
+	}
+
+	// A bare command works framed too
+	var buf bytes.Buffer
+	buf.Write([]byte{framedRequestMagic, 0, 0, 0, 8})
+	buf.WriteString("item get")
+	req, err := readRequest(bufio.NewReaderSize(&buf, maxRequestLine))
+	if err != nil || req.Command != "item get" {
+		t.Errorf("Expected framed bare command, got %+v: %v", req, err)
+	}
+}
+
+// TestReadRequestFramedInvalid tests that malformed lengths are rejected
+func TestReadRequestFramedInvalid(t *testing.T) {
+	tests := map[string][]byte{
+		"zero length":  {framedRequestMagic, 0, 0, 0, 0},
+		"too long":     {framedRequestMagic, 0x7f, 0xff, 0xff, 0xff},
+		"short header": {framedRequestMagic, 0, 0},
+		"short body":   append([]byte{framedRequestMagic, 0, 0, 0, 10}, "item"...),
+	}
+
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := readRequest(bufio.NewReaderSize(bytes.NewReader(input), maxRequestLine)); err == nil {
+				t.Errorf("Expected error for %s request, got nil", name)
+			}
+		})
+	}
+
+	_, err := readRequest(bufio.NewReaderSize(bytes.NewReader([]byte{framedRequestMagic, 0x7f, 0xff, 0xff, 0xff}), maxRequestLine))
+	if err == nil || !strings.Contains(err.Error(), "invalid request length") {
+		t.Errorf("Expected invalid request length error, got %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"io"
+)
+
+// quietInfoPrefixes start the informational lines logged for every request,
+// which quiet mode drops. They tell what each request ran, so they are the
+// bulk of a busy log and show the shape of every command.
+var quietInfoPrefixes = []string{
+	"Received input:",
+	"Resolved alias",
+	"Client process:",
+	"Command allowed by",
+	"Skipping expired",
+	"Running control command:",
+	"Waiting for the 1Password login check",
+	"1Password account is already authenticated",
+	"Serving cached output for:",
+	"Executing op with args:",
+	"No-execute mode, would run op",
+}
+
+// quietWriter drops the informational request lines written by a logger
+// with the Lmsgprefix flag, and passes on everything else
+type quietWriter struct {
+	w io.Writer
+}
+
+// Write passes p on unless it is an informational line
+func (q quietWriter) Write(p []byte) (int, error) {
+	// The request ID prefix ends the header of the line
+	msg := p
+	if _, after, ok := bytes.Cut(p, []byte("] ")); ok {
+		msg = after
+	}
+	for _, prefix := range quietInfoPrefixes {
+		if bytes.HasPrefix(msg, []byte(prefix)) {
+			return len(p), nil
+		}
+	}
+	return q.w.Write(p)
+}
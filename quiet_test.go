@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// TestQuietMode tests that quiet mode drops the informational lines of each
+// request while denials and errors are still logged
+func TestQuietMode(t *testing.T) {
+	var signedOut atomic.Bool
+	installFakeOp(t, func(inv opInvocation) int {
+		args := strings.Join(inv.args, " ")
+		if signedOut.Load() && (strings.Contains(args, "account get") || strings.HasPrefix(args, "signin")) {
+			return 1
+		}
+		return 0
+	})
+	logs := captureLog(t)
+	cfg := loadTestConfig(t, `
+quiet: true
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	if _, err := sendCommand(t, cfg.SocketPath, "item get foo"); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if _, err := sendCommand(t, cfg.SocketPath, "vault list"); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	signedOut.Store(true)
+	if _, err := sendCommand(t, cfg.SocketPath, "item get bar"); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+
+	out := logs.String()
+	for _, line := range []string{"Received input", "Command allowed by", "Executing op", "already authenticated"} {
+		if strings.Contains(out, line) {
+			t.Errorf("Expected no %q lines in quiet mode, got:\n%s", line, out)
+		}
+	}
+	for _, line := range []string{"Command not allowed: vault list", "Error ensuring login"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("Expected %q to still be logged in quiet mode, got:\n%s", line, out)
+		}
+	}
+}
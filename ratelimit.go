@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimitWindow is the period a rule's RateLimit applies to
+const rateLimitWindow = time.Minute
+
+// rateLimitKey identifies a rate limited rule by its kind and match rather
+// than by the loaded Rule, so its quota carries over when the rules reload
+type rateLimitKey struct {
+	kind  string
+	match string
+}
+
+// rateLimits holds the times of the recent commands allowed by each rate
+// limited rule
+var rateLimits = struct {
+	mu     sync.Mutex
+	recent map[rateLimitKey][]time.Time
+}{recent: make(map[rateLimitKey][]time.Time)}
+
+// allow reports whether the matched rule has quota left for a command at t,
+// and if so counts the command against it. Rules without a RateLimit always
+// allow.
+func (m ruleMatch) allow(t time.Time) bool {
+	if m.rule == nil || m.rule.RateLimit <= 0 {
+		return true
+	}
+
+	rateLimits.mu.Lock()
+	defer rateLimits.mu.Unlock()
+
+	// Drop the commands that have left the window, and the rules left with
+	// none, which may no longer be loaded at all
+	cutoff := t.Add(-rateLimitWindow)
+	for key, recent := range rateLimits.recent {
+		i := 0
+		for i < len(recent) && !recent[i].After(cutoff) {
+			i++
+		}
+		if i == len(recent) {
+			delete(rateLimits.recent, key)
+		} else if i > 0 {
+			rateLimits.recent[key] = recent[i:]
+		}
+	}
+
+	key := rateLimitKey{kind: m.kind, match: m.match}
+	recent := rateLimits.recent[key]
+	if len(recent) >= m.rule.RateLimit {
+		return false
+	}
+	rateLimits.recent[key] = append(recent, t)
+	return true
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetRateLimits forgets the commands counted by earlier tests, whose rules
+// may share a kind and match with the test's own
+func resetRateLimits(t *testing.T) {
+	t.Helper()
+	clearRateLimits := func() {
+		rateLimits.mu.Lock()
+		defer rateLimits.mu.Unlock()
+		clear(rateLimits.recent)
+	}
+	clearRateLimits()
+	t.Cleanup(clearRateLimits)
+}
+
+// TestRuleRateLimit tests that a rule hitting its quota doesn't affect other rules
+func TestRuleRateLimit(t *testing.T) {
+	fake := installFakeOp(t, nil)
+	resetRateLimits(t)
+	start := time.Date(2024, time.May, 15, 10, 30, 0, 0, time.UTC)
+	setClock(t, start)
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - match: "item list"
+    rate_limit: 2
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	send := func(command string) string {
+		t.Helper()
+		response, err := sendCommand(t, cfg.SocketPath, command)
+		if err != nil {
+			t.Fatalf("Failed to send command: %v", err)
+		}
+		return response
+	}
+
+	for i := 0; i < 2; i++ {
+		if response := send("item list"); strings.Contains(response, "Error") {
+			t.Fatalf("Expected command %d within the quota to run, got %q", i+1, response)
+		}
+	}
+	if response := send("item list --vault Shared"); !strings.Contains(response, "Rate limit for this command exceeded") {
+		t.Errorf("Expected rate limit error, got %q", response)
+	}
+
+	// The unlimited rule is unaffected
+	for i := 0; i < 5; i++ {
+		if response := send("item get foo"); strings.Contains(response, "Error") {
+			t.Errorf("Expected unlimited rule to keep working, got %q", response)
+		}
+	}
+
+	if n := fake.callCount("item list"); n != 2 {
+		t.Errorf("Expected op to run item list twice, got %d", n)
+	}
+
+	// The quota frees up once the window has passed
+	setClock(t, start.Add(rateLimitWindow+time.Second))
+	if response := send("item list"); strings.Contains(response, "Error") {
+		t.Errorf("Expected quota to reset after a minute, got %q", response)
+	}
+}
+
+// TestRuleForms tests that rules load from plain strings and mappings
+func TestRuleForms(t *testing.T) {
+	cfg := loadTestConfig(t, `
+allowed_commands:
+  - "vault list"
+  - match: "item list"
+    rate_limit: 10
+`)
+
+	want := []Rule{{Match: "vault list"}, {Match: "item list", RateLimit: 10}}
+	if len(cfg.AllowedCommands) != len(want) {
+		t.Fatalf("Expected %d rules, got %v", len(want), cfg.AllowedCommands)
+	}
+	for i, rule := range cfg.AllowedCommands {
+		if !reflect.DeepEqual(rule, want[i]) {
+			t.Errorf("Rule %d: expected %+v, got %+v", i, want[i], rule)
+		}
+	}
+
+	env := setupTestEnvironment(t)
+	path := writeTestConfig(t, "account: "+env.account+"\nallowed_prefixes:\n  - rate_limit: 5\n")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "match is required") {
+		t.Errorf("Expected rule without match to be rejected, got: %v", err)
+	}
+}
+
+// TestRuleRateLimitReload tests that reloading the rules keeps the quota a
+// rate limited rule has used, and forgets the rules whose window is empty
+func TestRuleRateLimitReload(t *testing.T) {
+	installFakeOp(t, nil)
+	resetRateLimits(t)
+	start := time.Date(2024, time.May, 15, 10, 30, 0, 0, time.UTC)
+	setClock(t, start)
+	env := setupTestEnvironment(t)
+	rules := fmt.Sprintf("account: %q\nsocket_path: %q\nallowed_prefixes:\n  - match: \"item list\"\n    rate_limit: 1\n", env.account, env.socketPath)
+
+	path := writeTestConfig(t, rules)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	loadedConfigPath = path
+	t.Cleanup(func() { loadedConfigPath = "" })
+	serveConfig(t, cfg)
+
+	if response, err := sendCommand(t, env.socketPath, "item list"); err != nil || strings.Contains(response, "Error") {
+		t.Fatalf("Expected the first command to run, got %q: %v", response, err)
+	}
+	if err := os.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatalf("Failed to update config: %v", err)
+	}
+	if response, err := sendCommand(t, env.socketPath, "@reload-rules"); err != nil || strings.HasPrefix(response, "Error") {
+		t.Fatalf("Expected the rules to reload, got %q: %v", response, err)
+	}
+	if response, err := sendCommand(t, env.socketPath, "item list"); err != nil || !strings.Contains(response, "Rate limit for this command exceeded") {
+		t.Errorf("Expected the reload to keep the used quota, got %q: %v", response, err)
+	}
+
+	setClock(t, start.Add(rateLimitWindow+time.Second))
+	if !(ruleMatch{kind: "prefix", match: "vault list", rule: &Rule{RateLimit: 1}}).allow(now()) {
+		t.Fatal("Expected vault list to have quota")
+	}
+	rateLimits.mu.Lock()
+	defer rateLimits.mu.Unlock()
+	if _, ok := rateLimits.recent[rateLimitKey{kind: "prefix", match: "item list"}]; ok {
+		t.Errorf("Expected the rule with an empty window to be dropped, got %v", rateLimits.recent)
+	}
+}
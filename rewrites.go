@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Rewrite turns commands matching Pattern, a regular expression that must
+// match the whole canonical command, into Replacement, where $1 or ${name}
+// stand for the groups of the pattern. It lets a server take commands in
+// an older op syntax, like `get item X` for `item get X`.
+type Rewrite struct {
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+
+	// re is the compiled Pattern
+	re *regexp.Regexp
+}
+
+// validateRewrites compiles the pattern of every rewrite
+func validateRewrites(rewrites []Rewrite) error {
+	for i := range rewrites {
+		rw := &rewrites[i]
+		if rw.Pattern == "" {
+			return fmt.Errorf("rewrites[%d]: pattern is required", i)
+		}
+		re, err := regexp.Compile(`^(?:` + rw.Pattern + `)$`)
+		if err != nil {
+			return fmt.Errorf("rewrites[%d]: invalid pattern: %w", i, err)
+		}
+		rw.re = re
+	}
+	return nil
+}
+
+// rewriteCommand applies rewrites in order to the canonical form of
+// command, each to the result of the ones before. It returns command as is,
+// and false, when no rewrite matched.
+func rewriteCommand(rewrites []Rewrite, command string) (string, bool) {
+	rewritten := canonicalizeCommand(command)
+	matched := false
+	for _, rw := range rewrites {
+		if rw.re == nil || !rw.re.MatchString(rewritten) {
+			continue
+		}
+		rewritten = rw.re.ReplaceAllString(rewritten, rw.Replacement)
+		matched = true
+	}
+	if !matched {
+		return command, false
+	}
+	return rewritten, true
+}
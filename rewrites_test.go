@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const rewritesConfig = `
+allowed_prefixes:
+  - "item get"
+  - "document get"
+rewrites:
+  - pattern: 'get item (.+)'
+    replacement: 'item get $1'
+  - pattern: 'get document (?P<name>.+)'
+    replacement: 'document get ${name}'
+`
+
+// TestRewrites tests that a legacy command is rewritten into one a v2 rule
+// allows and run as such, while other commands are left untouched
+func TestRewrites(t *testing.T) {
+	installFakeOp(t, nil)
+	cfg := loadTestConfig(t, rewritesConfig)
+	serveConfig(t, cfg)
+	logs := captureLog(t)
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"get item GitHub", "op --account test-account item get GitHub\n"},
+		{"get   item  GitHub --fields password", "op --account test-account item get GitHub --fields password\n"},
+		{"get document cert.pem", "op --account test-account document get cert.pem\n"},
+		{"item get GitHub", "op --account test-account item get GitHub\n"},
+		{"get vault Private", "Error: Command not allowed: get vault Private\n"},
+		{"list get item GitHub", "Error: Command not allowed: list get item GitHub\n"},
+	}
+	for _, tt := range tests {
+		got, err := sendCommand(t, cfg.SocketPath, tt.command)
+		if err != nil {
+			t.Fatalf("Failed to send %s: %v", tt.command, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.command, tt.want, got)
+		}
+	}
+
+	if !strings.Contains(logs.String(), `Rewrote command "get item GitHub" to "item get GitHub"`) {
+		t.Errorf("Expected the original and rewritten command to be logged, got %q", logs.String())
+	}
+	if strings.Contains(logs.String(), `Rewrote command "item get GitHub"`) {
+		t.Errorf("Expected commands no rewrite matches not to be rewritten, got %q", logs.String())
+	}
+}
+
+// TestRewritesTestRule tests that test-rule checks the rewritten command
+func TestRewritesTestRule(t *testing.T) {
+	prev := config
+	t.Cleanup(func() { config = prev })
+	cfg := loadTestConfig(t, rewritesConfig)
+
+	var out bytes.Buffer
+	if code := testRule(&out, cfg, "get item GitHub"); code != 0 {
+		t.Errorf("Expected the rewritten command to be allowed, got %q", out.String())
+	}
+	if want := "REWRITTEN: item get GitHub\nALLOWED: prefix item get\n"; out.String() != want {
+		t.Errorf("Expected %q, got %q", want, out.String())
+	}
+}
+
+// TestValidateRewrites tests that rewrites need a valid pattern
+func TestValidateRewrites(t *testing.T) {
+	tests := []struct {
+		rewrites []Rewrite
+		wantErr  string
+	}{
+		{[]Rewrite{{Pattern: "get item (.+)", Replacement: "item get $1"}}, ""},
+		{[]Rewrite{{Replacement: "item get"}}, "rewrites[0]: pattern is required"},
+		{[]Rewrite{{Pattern: "x"}, {Pattern: "get (item"}}, "rewrites[1]: invalid pattern"},
+	}
+	for _, tt := range tests {
+		err := validateRewrites(tt.rewrites)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("Expected %v to be valid, got %v", tt.rewrites, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("Expected %q, got %v", tt.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// ruleIndexThreshold is the number of exact or prefix rules above which
+// commands are matched through a ruleIndex instead of scanning the lists
+const ruleIndexThreshold = 64
+
+// ruleIndex finds the exact and prefix rules a command may match without
+// scanning every rule, for configs with thousands of them. It returns rule
+// positions in list order, so the first usable one is the rule a scan of the
+// list would have found.
+type ruleIndex struct {
+	// caseInsensitive is the case_insensitive setting the keys are folded for
+	caseInsensitive bool
+
+	// commands and prefixes are the list lengths indexed, an index built
+	// for other lists is not used
+	commands, prefixes int
+
+	// exact maps the match of the exact rules to their positions
+	exact map[string][]int
+
+	// prefixRoot is a byte trie of the matches of the prefix rules
+	prefixRoot *prefixNode
+}
+
+// prefixNode is a node of the prefix trie, holding the prefix rules whose
+// match ends at it
+type prefixNode struct {
+	children map[byte]*prefixNode
+	rules    []int
+}
+
+// buildIndex indexes the exact and prefix rules of r when there are more
+// than ruleIndexThreshold of either, and drops the index otherwise
+func (r *Rules) buildIndex(caseInsensitive bool) {
+	r.index = nil
+	if len(r.AllowedCommands) <= ruleIndexThreshold && len(r.AllowedPrefixes) <= ruleIndexThreshold {
+		return
+	}
+
+	fold := func(s string) string { return s }
+	if caseInsensitive {
+		fold = strings.ToLower
+	}
+	idx := &ruleIndex{
+		caseInsensitive: caseInsensitive,
+		commands:        len(r.AllowedCommands),
+		prefixes:        len(r.AllowedPrefixes),
+		exact:           make(map[string][]int, len(r.AllowedCommands)),
+		prefixRoot:      &prefixNode{},
+	}
+	for i, rule := range r.AllowedCommands {
+		key := fold(rule.Match)
+		idx.exact[key] = append(idx.exact[key], i)
+	}
+	for i, rule := range r.AllowedPrefixes {
+		node := idx.prefixRoot
+		match := fold(rule.Match)
+		for j := 0; j < len(match); j++ {
+			child := node.children[match[j]]
+			if child == nil {
+				if node.children == nil {
+					node.children = make(map[byte]*prefixNode)
+				}
+				child = &prefixNode{}
+				node.children[match[j]] = child
+			}
+			node = child
+		}
+		node.rules = append(node.rules, i)
+	}
+	r.index = idx
+}
+
+// usableIndex returns the index of r if it still fits the rules and the
+// case_insensitive setting, nil when the lists should be scanned
+func (r *Rules) usableIndex() *ruleIndex {
+	idx := r.index
+	if idx == nil || idx.caseInsensitive != config.CaseInsensitive ||
+		idx.commands != len(r.AllowedCommands) || idx.prefixes != len(r.AllowedPrefixes) {
+		return nil
+	}
+	return idx
+}
+
+// exactCandidates returns the positions of the exact rules whose match is
+// folded, the command folded like the index
+func (idx *ruleIndex) exactCandidates(folded string) []int {
+	return idx.exact[folded]
+}
+
+// prefixCandidates returns the positions of the prefix rules whose match
+// starts folded, in list order
+func (idx *ruleIndex) prefixCandidates(folded string) []int {
+	var candidates []int
+	node := idx.prefixRoot
+	candidates = append(candidates, node.rules...)
+	for i := 0; i < len(folded) && node != nil; i++ {
+		if node = node.children[folded[i]]; node != nil {
+			candidates = append(candidates, node.rules...)
+		}
+	}
+	slices.Sort(candidates)
+	return candidates
+}
+
+// allPositions returns the positions of a list of n rules, for scanning it
+func allPositions(n int) []int {
+	positions := make([]int, n)
+	for i := range positions {
+		positions[i] = i
+	}
+	return positions
+}
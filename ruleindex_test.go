@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// largeRulesConfig returns config YAML with n exact and n prefix rules, some
+// of them restricted to a vault or expired so the first usable rule matters
+func largeRulesConfig(n int) string {
+	var b strings.Builder
+	b.WriteString("allowed_commands:\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "  - \"read op://Vault%d/Item%d/password\"\n", i%10, i)
+	}
+	b.WriteString("  - {match: \"read op://Vault1/Shared/password\", expires_at: 2000-01-01T00:00:00Z}\n")
+	b.WriteString("  - {match: \"read op://Vault1/Shared/password\", rate_limit: 5}\n")
+	b.WriteString("allowed_prefixes:\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "  - \"item get Item%d \"\n", i)
+	}
+	b.WriteString("  - {match: \"item \", vault: Ops}\n")
+	b.WriteString("  - {match: \"item list\", min_args: 1}\n")
+	b.WriteString("  - \"item\"\n")
+	return b.String()
+}
+
+// TestRuleIndex tests that matching through the index of a large rule set
+// finds the same rule as scanning the lists
+func TestRuleIndex(t *testing.T) {
+	commands := []string{
+		"read op://Vault7/Item17/password",
+		"read op://Vault7/Item17/password --reveal",
+		"READ op://Vault7/Item17/password",
+		"read op://Vault1/Shared/password",
+		"read op://Vault9/Missing/password",
+		"item get Item42 --format json",
+		"item get Item4 --format json",
+		"item get Item4",
+		"item list --vault Ops",
+		"item list",
+		"Item get Item42 x",
+		"vault list",
+	}
+	for _, caseInsensitive := range []bool{false, true} {
+		t.Run(fmt.Sprintf("case_insensitive=%v", caseInsensitive), func(t *testing.T) {
+			cfg := loadTestConfig(t, fmt.Sprintf("case_insensitive: %v\n", caseInsensitive)+largeRulesConfig(200))
+			prev := config
+			config = cfg
+			t.Cleanup(func() { config = prev })
+			if cfg.Rules.usableIndex() == nil {
+				t.Fatal("Expected the rules to be indexed")
+			}
+			scanned := cfg.Rules
+			scanned.index = nil
+
+			for _, command := range commands {
+				got, gotOK := matchRule(&cfg.Rules, command, nil)
+				want, wantOK := matchRule(&scanned, command, nil)
+				if gotOK != wantOK || got.kind != want.kind || got.match != want.match || (got.rule == nil) != (want.rule == nil) ||
+					(got.rule != nil && got.rule.String() != want.rule.String()) {
+					t.Errorf("%s: indexed match %v (%v), scanned match %v (%v)", command, got, gotOK, want, wantOK)
+				}
+			}
+		})
+	}
+
+	cfg := loadTestConfig(t, largeRulesConfig(200))
+	if !validateCommand(&cfg.Rules, "read op://Vault3/Item123/password") {
+		t.Error("Expected an indexed exact rule to allow its command")
+	}
+	if validateCommand(&cfg.Rules, "read op://Vault3/Item123/otp") {
+		t.Error("Expected a command without a rule to be denied")
+	}
+}
+
+// BenchmarkMatchRuleLarge measures matching against thousands of exact and
+// prefix rules, with the index and by scanning the lists
+func BenchmarkMatchRuleLarge(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("account: test-account\n"+largeRulesConfig(5000)), 0600); err != nil {
+		b.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	scanned := cfg.Rules
+	scanned.index = nil
+
+	for _, bm := range []struct {
+		name  string
+		rules *Rules
+	}{{"indexed", &cfg.Rules}, {"scanned", &scanned}} {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				matchRule(bm.rules, "item get Item4999 --format json", nil)
+				matchRule(bm.rules, "read op://Vault9/Missing/password", nil)
+			}
+		})
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rules is a set of allow rules applied to the commands arriving on a socket
+type Rules struct {
+	AllowedCommands []Rule `yaml:"allowed_commands" json:"allowed_commands"`
+	AllowedPrefixes []Rule `yaml:"allowed_prefixes" json:"allowed_prefixes"`
+	AllowedGlobs    []Rule `yaml:"allowed_globs" json:"allowed_globs"`
+
+	// AllowedTemplates are commands with `{name}` placeholders, each filled
+	// by a value from the rule's charset
+	AllowedTemplates []Rule `yaml:"allowed_templates" json:"allowed_templates"`
+
+	// AllowedHashes are hex SHA-256 digests of exact commands in canonical
+	// form, for commands that shouldn't appear in the config in plaintext
+	AllowedHashes []string `yaml:"allowed_hashes" json:"allowed_hashes"`
+
+	// AllowedSubcommands maps a top-level op command like `item` to the
+	// subcommands allowed under it
+	AllowedSubcommands map[string]SubcommandRule `yaml:"allowed_subcommands" json:"allowed_subcommands"`
+
+	// BlockedFlags are flags refused on commands the rules above allow
+	BlockedFlags []BlockedFlagRule `yaml:"blocked_flags" json:"blocked_flags"`
+
+	// index speeds up matching large exact and prefix lists, nil to scan them
+	index *ruleIndex
+}
+
+// BlockedFlagRule lists flags refused on the commands starting with Prefix,
+// on every command when Prefix is empty
+type BlockedFlagRule struct {
+	Prefix string   `yaml:"prefix" json:"prefix"`
+	Flags  []string `yaml:"flags" json:"flags"`
+}
+
+// Rule is a single allow rule. In the config it is either the bare string to
+// match, or a mapping with the string under `match` and optional limits.
+type Rule struct {
+	Match string `yaml:"match" json:"match"`
+
+	// RateLimit is the number of commands per minute the rule allows, zero
+	// for unlimited
+	RateLimit int `yaml:"rate_limit" json:"rate_limit,omitempty"`
+
+	// ExpiresAt is when a temporary rule stops matching, nil for never
+	ExpiresAt *time.Time `yaml:"expires_at" json:"expires_at,omitempty"`
+
+	// Charset is the character class placeholder values of a template rule
+	// come from, defaultTemplateCharset when empty
+	Charset string `yaml:"charset" json:"charset,omitempty"`
+
+	// Vault restricts the rule to commands whose op:// references and
+	// --vault flags all name this vault, empty for any vault
+	Vault string `yaml:"vault" json:"vault,omitempty"`
+
+	// AppendArgs are op flags added to the commands the rule allows, which
+	// clients may not set themselves
+	AppendArgs []string `yaml:"append_args" json:"append_args,omitempty"`
+
+	// RequireApproval holds the commands the rule allows until they are
+	// approved on the control socket
+	RequireApproval bool `yaml:"require_approval" json:"require_approval,omitempty"`
+
+	// MinArgs is how many arguments a command needs after the prefix of a
+	// prefix rule for the rule to allow it
+	MinArgs int `yaml:"min_args" json:"min_args,omitempty"`
+
+	// template is the compiled Match of a template rule
+	template *commandTemplate
+}
+
+// UnmarshalYAML accepts a rule as a plain string or a mapping
+func (r *Rule) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&r.Match)
+	}
+	type plain Rule
+	return node.Decode((*plain)(r))
+}
+
+// String returns the rule as shown in logs and rule listings
+func (r Rule) String() string {
+	s := r.Match
+	if r.RateLimit > 0 {
+		s += fmt.Sprintf(" (%d/min)", r.RateLimit)
+	}
+	if r.ExpiresAt != nil {
+		s += fmt.Sprintf(" (expires %s)", r.ExpiresAt.Format(time.RFC3339))
+	}
+	if r.Vault != "" {
+		s += fmt.Sprintf(" (vault %s)", r.Vault)
+	}
+	if len(r.AppendArgs) > 0 {
+		s += fmt.Sprintf(" (append %s)", strings.Join(r.AppendArgs, " "))
+	}
+	if r.RequireApproval {
+		s += " (requires approval)"
+	}
+	if r.MinArgs > 0 {
+		s += fmt.Sprintf(" (min %d args)", r.MinArgs)
+	}
+	return s
+}
+
+// hasMinArgs reports whether a command has at least MinArgs arguments after
+// the prefix of the rule
+func (r *Rule) hasMinArgs(command string) bool {
+	return len(strings.Fields(command))-len(strings.Fields(r.Match)) >= r.MinArgs
+}
+
+// findShortPrefix returns the prefix rule that would allow a command if only
+// it had the arguments the rule asks for
+func (r *Rules) findShortPrefix(command string) (*Rule, bool) {
+	command = canonicalizeCommand(command)
+	fold := func(s string) string { return s }
+	if config.CaseInsensitive {
+		fold = strings.ToLower
+	}
+	t := now()
+	for i, prefix := range r.AllowedPrefixes {
+		rule := &r.AllowedPrefixes[i]
+		if strings.HasPrefix(fold(command), fold(prefix.Match)) && !rule.hasMinArgs(command) && !rule.expired(t) {
+			return rule, true
+		}
+	}
+	return nil, false
+}
+
+// expired reports whether the rule has an expiry at or before t
+func (r *Rule) expired(t time.Time) bool {
+	return r.ExpiresAt != nil && !t.Before(*r.ExpiresAt)
+}
+
+// SubcommandRule lists the subcommands allowed and denied under a top-level
+// command. An empty Allow list allows every subcommand not in Deny.
+type SubcommandRule struct {
+	Allow []string `yaml:"allow" json:"allow"`
+	Deny  []string `yaml:"deny" json:"deny"`
+}
+
+// validate checks that the rules are well-formed
+func (r Rules) validate() error {
+	for _, lists := range []struct {
+		name  string
+		rules []Rule
+	}{
+		{"allowed_commands", r.AllowedCommands},
+		{"allowed_prefixes", r.AllowedPrefixes},
+		{"allowed_globs", r.AllowedGlobs},
+		{"allowed_templates", r.AllowedTemplates},
+	} {
+		for i, rule := range lists.rules {
+			if rule.Match == "" {
+				return fmt.Errorf("%s[%d]: match is required", lists.name, i)
+			}
+			if rule.RateLimit < 0 {
+				return fmt.Errorf("%s[%d]: rate_limit must not be negative", lists.name, i)
+			}
+			if rule.MinArgs < 0 {
+				return fmt.Errorf("%s[%d]: min_args must not be negative", lists.name, i)
+			}
+			if rule.MinArgs > 0 && lists.name != "allowed_prefixes" {
+				return fmt.Errorf("%s[%d]: min_args only applies to allowed_prefixes", lists.name, i)
+			}
+			if rule.Charset != "" && lists.name != "allowed_templates" {
+				return fmt.Errorf("%s[%d]: charset only applies to allowed_templates", lists.name, i)
+			}
+			if strings.ContainsAny(rule.Vault, "/?\"' \t") {
+				return fmt.Errorf("%s[%d]: invalid vault %q, expected a vault name without spaces or a vault ID", lists.name, i, rule.Vault)
+			}
+			if err := validateAppendArgs(rule.AppendArgs); err != nil {
+				return fmt.Errorf("%s[%d]: %w", lists.name, i, err)
+			}
+		}
+	}
+	if err := validateGlobs(r.AllowedGlobs); err != nil {
+		return err
+	}
+	if err := validateTemplates(r.AllowedTemplates); err != nil {
+		return err
+	}
+	if err := validateHashes(r.AllowedHashes); err != nil {
+		return err
+	}
+	if err := validateBlockedFlags(r.BlockedFlags); err != nil {
+		return err
+	}
+	return validateSubcommands(r.AllowedSubcommands)
+}
+
+// ruleLists returns every list of rules that can be written as a mapping
+func (r *Rules) ruleLists() [][]Rule {
+	return [][]Rule{r.AllowedCommands, r.AllowedPrefixes, r.AllowedGlobs, r.AllowedTemplates}
+}
+
+// requireApproval reports whether any rule holds its commands for approval
+func (r *Rules) requireApproval() bool {
+	for _, rules := range r.ruleLists() {
+		if slices.ContainsFunc(rules, func(rule Rule) bool { return rule.RequireApproval }) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSubcommands checks that every command and subcommand in the tree is
+// a single token
+func validateSubcommands(tree map[string]SubcommandRule) error {
+	isToken := func(s string) bool {
+		return s != "" && len(strings.Fields(s)) == 1 && strings.TrimSpace(s) == s
+	}
+	for cmd, rule := range tree {
+		if !isToken(cmd) {
+			return fmt.Errorf("invalid allowed_subcommands command %q, expected a single word", cmd)
+		}
+		for _, sub := range append(slices.Clone(rule.Allow), rule.Deny...) {
+			if !isToken(sub) {
+				return fmt.Errorf("invalid allowed_subcommands entry %q under %s, expected a single word", sub, cmd)
+			}
+		}
+	}
+	return nil
+}
+
+// matchSubcommand walks the subcommand tree for a canonical command. allowed
+// reports whether the tree allows it, denied whether the tree explicitly
+// denies it; commands not in the tree are neither. op also takes flags
+// between a command and its subcommand, as in `item --vault X delete`, and
+// which of them take a value isn't known here, so a flag in that place is
+// denied rather than guessed past.
+func (r Rules) matchSubcommand(command string) (allowed, denied bool) {
+	tokens := strings.Fields(command)
+	if len(tokens) == 0 {
+		return false, false
+	}
+	rule, ok := r.AllowedSubcommands[tokens[0]]
+	if !ok {
+		return false, false
+	}
+
+	var sub string
+	if len(tokens) > 1 {
+		sub = tokens[1]
+	}
+	if strings.HasPrefix(sub, "-") || slices.Contains(rule.Deny, sub) {
+		return false, true
+	}
+	return len(rule.Allow) == 0 || slices.Contains(rule.Allow, sub), false
+}
+
+// canonicalizeCommand returns the form of a command that allow rules are
+// matched against: leading and trailing whitespace is removed and every run
+// of whitespace outside single or double quotes is collapsed to one space.
+func canonicalizeCommand(input string) string {
+	var b strings.Builder
+	var quote rune
+	pendingSpace := false
+
+	for _, r := range strings.TrimSpace(input) {
+		switch {
+		case quote == 0 && unicode.IsSpace(r):
+			pendingSpace = true
+			continue
+		case quote == 0 && (r == '\'' || r == '"'):
+			quote = r
+		case r == quote:
+			quote = 0
+		}
+
+		if pendingSpace {
+			b.WriteByte(' ')
+			pendingSpace = false
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// validateGlobs checks that every allowed glob is a valid path.Match pattern.
+//
+// Globs follow path.Match syntax and are matched word by word, so `*` matches
+// any run of characters except `/` and spaces. A rule like
+// `read op://Employee/*/password` allows the password of any item in the
+// Employee vault, but not fields in nested sections, nor extra arguments
+// slipped into the item name.
+func validateGlobs(globs []Rule) error {
+	for _, glob := range globs {
+		for _, word := range strings.Fields(glob.Match) {
+			if _, err := path.Match(word, ""); err != nil {
+				return fmt.Errorf("invalid allowed_globs pattern %q: %w", glob.Match, err)
+			}
+		}
+	}
+	return nil
+}
+
+// matchGlob reports whether a canonical command has as many words as glob
+// and each of them matches the word of glob in its place. Matching word by
+// word keeps a wildcard from spanning the spaces between arguments, which
+// would let it carry extra arguments and flags.
+func matchGlob(glob, command string) bool {
+	patterns, words := strings.Fields(glob), strings.Fields(command)
+	if len(patterns) != len(words) {
+		return false
+	}
+	for i, pattern := range patterns {
+		if matched, _ := path.Match(pattern, words[i]); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// printRules writes the effective allow rules of cfg as a table, one section
+// per socket
+func printRules(w io.Writer, cfg Config) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOCKET\tTYPE\tRULE")
+	printRuleRows(tw, cfg.SocketPath, cfg.Rules)
+	for _, l := range cfg.Listeners {
+		printRuleRows(tw, l.Path, l.Rules)
+	}
+	tw.Flush()
+}
+
+// rulesDump is the effective rule set of a config as JSON, for tools that
+// generate or audit policy. It has the shape of a config file, so loadConfig
+// reads it back in.
+type rulesDump struct {
+	Account    string `json:"account"`
+	SocketPath string `json:"socket_path"`
+	Rules
+	Listeners []listenerDump `json:"listeners"`
+}
+
+// listenerDump is the JSON form of an additional listener and its rules
+type listenerDump struct {
+	Path string `json:"path"`
+	Mode string `json:"mode,omitempty"`
+	Rules
+}
+
+// dumpRulesJSON writes the effective rules of cfg as JSON. Every list is
+// present even when empty and rules are always objects, so the shape doesn't
+// depend on which rules are set.
+func dumpRulesJSON(w io.Writer, cfg Config) error {
+	dump := rulesDump{
+		Account:    cfg.Account,
+		SocketPath: cfg.SocketPath,
+		Rules:      cfg.Rules.normalized(),
+		Listeners:  []listenerDump{},
+	}
+	for _, l := range cfg.Listeners {
+		dump.Listeners = append(dump.Listeners, listenerDump{Path: l.Path, Mode: l.Mode, Rules: l.Rules.normalized()})
+	}
+
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// normalized returns a copy of r with empty lists and maps in place of nil
+func (r Rules) normalized() Rules {
+	orEmpty := func(rules []Rule) []Rule {
+		if rules == nil {
+			return []Rule{}
+		}
+		return rules
+	}
+	n := Rules{
+		AllowedCommands:    orEmpty(r.AllowedCommands),
+		AllowedPrefixes:    orEmpty(r.AllowedPrefixes),
+		AllowedGlobs:       orEmpty(r.AllowedGlobs),
+		AllowedTemplates:   orEmpty(r.AllowedTemplates),
+		AllowedHashes:      append([]string{}, r.AllowedHashes...),
+		AllowedSubcommands: make(map[string]SubcommandRule, len(r.AllowedSubcommands)),
+		BlockedFlags:       []BlockedFlagRule{},
+	}
+	for cmd, rule := range r.AllowedSubcommands {
+		n.AllowedSubcommands[cmd] = SubcommandRule{
+			Allow: append([]string{}, rule.Allow...),
+			Deny:  append([]string{}, rule.Deny...),
+		}
+	}
+	n.BlockedFlags = append(n.BlockedFlags, r.BlockedFlags...)
+	return n
+}
+
+// printRuleRows writes a table row for each rule served on socket
+func printRuleRows(w io.Writer, socket string, rules Rules) {
+	for _, cmd := range rules.AllowedCommands {
+		fmt.Fprintf(w, "%s\texact\t%s\n", socket, cmd)
+	}
+	for _, prefix := range rules.AllowedPrefixes {
+		fmt.Fprintf(w, "%s\tprefix\t%s\n", socket, prefix)
+	}
+	for _, glob := range rules.AllowedGlobs {
+		fmt.Fprintf(w, "%s\tglob\t%s\n", socket, glob)
+	}
+	for _, tmpl := range rules.AllowedTemplates {
+		fmt.Fprintf(w, "%s\ttemplate\t%s\n", socket, tmpl)
+	}
+	for _, h := range rules.AllowedHashes {
+		fmt.Fprintf(w, "%s\thash\t%s\n", socket, h)
+	}
+
+	cmds := make([]string, 0, len(rules.AllowedSubcommands))
+	for cmd := range rules.AllowedSubcommands {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+	for _, cmd := range cmds {
+		rule := rules.AllowedSubcommands[cmd]
+		if len(rule.Allow) == 0 {
+			fmt.Fprintf(w, "%s\tsubcommand\t%s *\n", socket, cmd)
+		}
+		for _, sub := range rule.Allow {
+			fmt.Fprintf(w, "%s\tsubcommand\t%s %s\n", socket, cmd, sub)
+		}
+		for _, sub := range rule.Deny {
+			fmt.Fprintf(w, "%s\tdeny\t%s %s\n", socket, cmd, sub)
+		}
+	}
+
+	for _, blocked := range rules.BlockedFlags {
+		prefix := blocked.Prefix
+		if prefix == "" {
+			prefix = "*"
+		}
+		fmt.Fprintf(w, "%s\tblocked\t%s %s\n", socket, prefix, strings.Join(blocked.Flags, " "))
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPrintRules tests that the effective rules are printed as a table
+func TestPrintRules(t *testing.T) {
+	path := writeTestConfig(t, `
+account: "test-account"
+socket_path: "/tmp/opfwd-test.sock"
+allowed_commands:
+  - "read op://Employee/CONFIG/operator"
+allowed_prefixes:
+  - "item get"
+`)
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	var buf bytes.Buffer
+	printRules(&buf, cfg)
+	out := buf.String()
+
+	for _, want := range []string{"exact", "read op://Employee/CONFIG/operator", "prefix", "item get"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+// TestDumpRulesJSON tests that the JSON dump of the rules loads back into
+// the same effective rule set
+func TestDumpRulesJSON(t *testing.T) {
+	path := writeTestConfig(t, `
+account: "test-account"
+socket_path: "/tmp/opfwd-test.sock"
+allowed_commands:
+  - "read op://Employee/CONFIG/operator"
+allowed_prefixes:
+  - match: "item get"
+    rate_limit: 5
+    expires_at: 2030-01-02T15:04:05Z
+allowed_globs:
+  - "read op://Employee/*/password"
+allowed_templates:
+  - match: "item get {id} --vault Deploy"
+    charset: "a-z0-9"
+allowed_subcommands:
+  document:
+    allow: [get]
+    deny: [delete]
+blocked_flags:
+  - prefix: "item get"
+    flags: ["--out-file"]
+listeners:
+  - path: "/tmp/opfwd-test-ci.sock"
+    mode: "0660"
+    allowed_prefixes:
+      - "read op://CI/"
+`)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	var dump bytes.Buffer
+	if err := dumpRulesJSON(&dump, cfg); err != nil {
+		t.Fatalf("Failed to dump rules: %v", err)
+	}
+	for _, want := range []string{`"allowed_commands": [`, `"rate_limit": 5`, `"expires_at": "2030-01-02T15:04:05Z"`, `"charset": "a-z0-9"`, `"mode": "0660"`} {
+		if !strings.Contains(dump.String(), want) {
+			t.Errorf("Expected the dump to contain %q, got:\n%s", want, dump.String())
+		}
+	}
+
+	reloaded, err := loadConfig(writeTestConfig(t, dump.String()))
+	if err != nil {
+		t.Fatalf("Failed to load the dumped rules: %v", err)
+	}
+	if !reflect.DeepEqual(reloaded.Rules.normalized(), cfg.Rules.normalized()) {
+		t.Errorf("Expected the same rules after the round trip, got %+v, want %+v", reloaded.Rules, cfg.Rules)
+	}
+	if len(reloaded.Listeners) != 1 || reloaded.Listeners[0].Path != cfg.Listeners[0].Path || reloaded.Listeners[0].Mode != cfg.Listeners[0].Mode ||
+		!reflect.DeepEqual(reloaded.Listeners[0].Rules.normalized(), cfg.Listeners[0].Rules.normalized()) {
+		t.Errorf("Expected the same listener after the round trip, got %+v", reloaded.Listeners)
+	}
+
+	var again bytes.Buffer
+	if err := dumpRulesJSON(&again, reloaded); err != nil {
+		t.Fatalf("Failed to dump rules: %v", err)
+	}
+	if again.String() != dump.String() {
+		t.Errorf("Expected a stable dump, got:\n%s\nthen:\n%s", dump.String(), again.String())
+	}
+}
+
+// TestAllowedGlobs tests glob matching against op:// references
+func TestAllowedGlobs(t *testing.T) {
+	cfg := loadTestConfig(t, `
+allowed_globs:
+  - "read op://Employee/*/password"
+`)
+
+	tests := map[string]bool{
+		"read op://Employee/GitHub/password":                        true,
+		"read op://Employee/AWS Console/password":                   false,
+		"read op://Employee/Other vault item --out-file=f/password": false,
+		"read op://Employee/GitHub/password --out-file=f":           false,
+		"read op://Employee/GitHub/username":                        false,
+		"read op://Employee/GitHub/section/password":                false,
+		"read op://Personal/GitHub/password":                        false,
+	}
+	for input, want := range tests {
+		if got := validateCommand(&cfg.Rules, input); got != want {
+			t.Errorf("validateCommand(%q) = %v, want %v", input, got, want)
+		}
+	}
+}
+
+// TestInvalidAllowedGlob tests that a malformed glob is rejected at load
+func TestInvalidAllowedGlob(t *testing.T) {
+	path := writeTestConfig(t, `
+account: "test-account"
+allowed_globs:
+  - "read op://Employee/[/password"
+`)
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "invalid allowed_globs pattern") {
+		t.Errorf("Expected malformed glob to be rejected, got: %v", err)
+	}
+}
+
+// TestCanonicalizeCommand tests whitespace normalization outside of quotes
+func TestCanonicalizeCommand(t *testing.T) {
+	tests := map[string]string{
+		"item get foo":                       "item get foo",
+		"  item\tget   foo \n":               "item get foo",
+		"item  create --title='Two  Spaces'": "item create --title='Two  Spaces'",
+		"item create \"a\t b\"   'c'":        "item create \"a\t b\" 'c'",
+		"item create \"unterminated   x":     "item create \"unterminated   x",
+	}
+	for input, want := range tests {
+		if got := canonicalizeCommand(input); got != want {
+			t.Errorf("canonicalizeCommand(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+// TestValidateCommandCanonical tests that tab and multi-space separated
+// commands match rules written with single spaces
+func TestValidateCommandCanonical(t *testing.T) {
+	rules := &Rules{
+		AllowedCommands: newRules("read op://Employee/CONFIG/operator"),
+		AllowedPrefixes: newRules("item create"),
+	}
+
+	for _, input := range []string{
+		"item create login",
+		"item\tcreate login",
+		"item   create login",
+		" item \t create\tlogin ",
+		"read\top://Employee/CONFIG/operator",
+		"read   op://Employee/CONFIG/operator  ",
+	} {
+		if !validateCommand(rules, input) {
+			t.Errorf("Expected %q to be allowed", input)
+		}
+	}
+
+	if validateCommand(rules, "itemcreate login") {
+		t.Error("Expected \"itemcreate login\" to be denied")
+	}
+}
+
+// TestAllowedSubcommands tests walking the subcommand tree alongside the flat lists
+func TestAllowedSubcommands(t *testing.T) {
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "item delete old-"
+allowed_subcommands:
+  item:
+    allow: [get, list, create]
+    deny: [delete]
+  vault:
+    deny: [delete]
+`)
+
+	tests := map[string]bool{
+		"item get foo":              true,
+		"item\tlist --format json":  true,
+		"item edit foo":             false,
+		"item delete foo":           false,
+		"item delete old-foo":       false,
+		"item --vault X delete foo": false,
+		"item --vault=X get foo":    false,
+		"vault list":                true,
+		"vault delete Shared":       false,
+		"document get foo":          false,
+		"items get foo":             false,
+	}
+	for input, want := range tests {
+		if got := validateCommand(&cfg.Rules, input); got != want {
+			t.Errorf("validateCommand(%q) = %v, want %v", input, got, want)
+		}
+	}
+
+	var buf bytes.Buffer
+	printRules(&buf, cfg)
+	for _, want := range []string{"subcommand  item get", "deny        item delete", "subcommand  vault *"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected rules to contain %q, got:\n%s", want, buf.String())
+		}
+	}
+}
+
+// TestInvalidAllowedSubcommands tests that multi-word tree entries are rejected
+func TestInvalidAllowedSubcommands(t *testing.T) {
+	path := writeTestConfig(t, `
+account: "test-account"
+allowed_subcommands:
+  item:
+    allow: ["get foo"]
+`)
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "invalid allowed_subcommands entry") {
+		t.Errorf("Expected multi-word subcommand to be rejected, got: %v", err)
+	}
+}
+
+// TestRuleExpiry tests that expired rules are skipped at match time while
+// rules expiring later are honored
+func TestRuleExpiry(t *testing.T) {
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - match: "item get Staging"
+    expires_at: 2026-03-01T12:00:00Z
+  - match: "item get Temp"
+    expires_at: 2026-03-02T12:00:00Z
+`)
+
+	setClock(t, time.Date(2026, 3, 1, 18, 0, 0, 0, time.UTC))
+	if validateCommand(&cfg.Rules, "item get Staging") {
+		t.Error("Expected the expired rule to be ignored")
+	}
+	if !validateCommand(&cfg.Rules, "item get Temp") {
+		t.Error("Expected the unexpired rule to be honored")
+	}
+
+	// Expiry happens without reloading the rules
+	setClock(t, time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC))
+	if validateCommand(&cfg.Rules, "item get Temp") {
+		t.Error("Expected the rule to expire at its expires_at")
+	}
+
+	var buf bytes.Buffer
+	printRules(&buf, cfg)
+	if !strings.Contains(buf.String(), "item get Temp (expires 2026-03-02T12:00:00Z)") {
+		t.Errorf("Expected the expiry in the rule listing, got:\n%s", buf.String())
+	}
+}
+
+// TestRuleExpiryLogged tests that a skipped expired rule is logged by the
+// request it was skipped for, and left out in quiet mode
+func TestRuleExpiryLogged(t *testing.T) {
+	installFakeOp(t, nil)
+	setClock(t, time.Date(2026, 3, 1, 18, 0, 0, 0, time.UTC))
+	for _, quiet := range []bool{false, true} {
+		t.Run(fmt.Sprintf("quiet=%v", quiet), func(t *testing.T) {
+			logs := captureLog(t)
+			cfg := loadTestConfig(t, fmt.Sprintf(`
+quiet: %v
+allowed_prefixes:
+  - match: "item get Staging"
+    expires_at: 2026-03-01T12:00:00Z
+`, quiet))
+			serveConfig(t, cfg)
+
+			if _, err := sendCommand(t, cfg.SocketPath, "item get Staging"); err != nil {
+				t.Fatalf("Failed to send command: %v", err)
+			}
+			logged := regexp.MustCompile(`\[[^\]]+\] Skipping expired prefix rule: item get Staging`).MatchString(logs.String())
+			if logged == quiet {
+				t.Errorf("Expected the skipped rule logged=%v with the request ID, got:\n%s", !quiet, logs.String())
+			}
+		})
+	}
+}
+
+// TestCaseInsensitive tests that exact and prefix rules ignore case only
+// when case_insensitive is set
+func TestCaseInsensitive(t *testing.T) {
+	prev := config
+	t.Cleanup(func() { config = prev })
+
+	for _, insensitive := range []bool{false, true} {
+		config = loadTestConfig(t, fmt.Sprintf(`
+case_insensitive: %v
+allowed_commands:
+  - "read op://Employee/GitHub/password"
+allowed_prefixes:
+  - "item get --vault Prod"
+`, insensitive))
+
+		for _, input := range []string{
+			"read op://employee/github/password",
+			"READ op://EMPLOYEE/GitHub/password",
+			"item get --vault prod db",
+		} {
+			if got := validateCommand(&config.Rules, input); got != insensitive {
+				t.Errorf("case_insensitive %v: validateCommand(%q) = %v", insensitive, input, got)
+			}
+		}
+		if validateCommand(&config.Rules, "read op://Employee/GitHub/username") {
+			t.Errorf("case_insensitive %v: expected a different command to be denied", insensitive)
+		}
+	}
+}
+
+// TestRuleMinArgs tests that a prefix rule with min_args refuses the bare
+// prefix with a usage message, and allows the command once it is complete
+func TestRuleMinArgs(t *testing.T) {
+	fake := installFakeOp(t, nil)
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - match: "item get"
+    min_args: 1
+  - "item list"
+`)
+	serveConfig(t, cfg)
+
+	tests := map[string]bool{
+		"item get GitHub":             true,
+		"item get GitHub --vault Ops": true,
+		"item get":                    false,
+		"  item   get  ":              false,
+		"item getx":                   false,
+		"item list":                   true,
+	}
+	for input, want := range tests {
+		if got := validateCommand(&cfg.Rules, input); got != want {
+			t.Errorf("validateCommand(%q) = %v, want %v", input, got, want)
+		}
+	}
+
+	response, err := sendCommand(t, cfg.SocketPath, "item get")
+	if err != nil || !strings.Contains(response, `"item get" needs at least 1 argument(s) after it`) {
+		t.Errorf("Expected a usage error, got %q: %v", response, err)
+	}
+	if n := fake.callCount("item get"); n != 0 {
+		t.Errorf("Expected op not to run for the bare prefix, ran %d times", n)
+	}
+
+	path := writeTestConfig(t, "account: \"test-account\"\nallowed_commands: [{match: \"item list\", min_args: 1}]\n")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "min_args only applies to allowed_prefixes") {
+		t.Errorf("Expected a min_args error, got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadRulesDir reads every *.yaml file in dir in lexical order and merges its
+// rules into base. Each file holds the same allowed_* keys as the config.
+func loadRulesDir(base Rules, dir string) (Rules, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return Rules{}, fmt.Errorf("reading rules_dir: %w", err)
+	}
+	// Glob returns the matches sorted, which makes the merge deterministic
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return Rules{}, fmt.Errorf("reading rules_dir: %w", err)
+	}
+
+	merged := base
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return Rules{}, fmt.Errorf("reading rules file: %w", err)
+		}
+		var rules Rules
+		if err := yaml.Unmarshal(data, &rules); err != nil {
+			return Rules{}, fmt.Errorf("parsing rules file %s: %w", file, err)
+		}
+		merged = mergeRules(merged, rules)
+	}
+	return merged, nil
+}
+
+// mergeRules returns the union of a and b. Rules matching the same string are
+// kept once, the first one wins.
+func mergeRules(a, b Rules) Rules {
+	merged := Rules{
+		AllowedCommands:  mergeRuleList(a.AllowedCommands, b.AllowedCommands),
+		AllowedPrefixes:  mergeRuleList(a.AllowedPrefixes, b.AllowedPrefixes),
+		AllowedGlobs:     mergeRuleList(a.AllowedGlobs, b.AllowedGlobs),
+		AllowedTemplates: mergeRuleList(a.AllowedTemplates, b.AllowedTemplates),
+		AllowedHashes:    appendMissing(a.AllowedHashes, b.AllowedHashes),
+		BlockedFlags:     slices.Concat(a.BlockedFlags, b.BlockedFlags),
+	}
+
+	if len(a.AllowedSubcommands)+len(b.AllowedSubcommands) > 0 {
+		merged.AllowedSubcommands = make(map[string]SubcommandRule)
+	}
+	for _, tree := range []map[string]SubcommandRule{a.AllowedSubcommands, b.AllowedSubcommands} {
+		for cmd, rule := range tree {
+			prev := merged.AllowedSubcommands[cmd]
+			merged.AllowedSubcommands[cmd] = SubcommandRule{
+				Allow: appendMissing(prev.Allow, rule.Allow),
+				Deny:  appendMissing(prev.Deny, rule.Deny),
+			}
+		}
+	}
+	return merged
+}
+
+// mergeRuleList appends the rules of b whose match isn't in a yet
+func mergeRuleList(a, b []Rule) []Rule {
+	merged := slices.Clone(a)
+	for _, rule := range b {
+		if !slices.ContainsFunc(merged, func(r Rule) bool { return r.Match == rule.Match }) {
+			merged = append(merged, rule)
+		}
+	}
+	return merged
+}
+
+// appendMissing appends the entries of b not in a yet
+func appendMissing(a, b []string) []string {
+	merged := slices.Clone(a)
+	for _, s := range b {
+		if !slices.Contains(merged, s) {
+			merged = append(merged, s)
+		}
+	}
+	return merged
+}
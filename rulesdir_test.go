@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestRulesDir tests that the rule files in rules_dir are merged into the
+// config rules in lexical order, without duplicates
+func TestRulesDir(t *testing.T) {
+	path := writeTestConfig(t, `
+account: "test-account"
+socket_path: "/tmp/opfwd-test.sock"
+rules_dir: "conf.d"
+allowed_prefixes:
+  - "item get"
+`)
+	dir := filepath.Join(filepath.Dir(path), "conf.d")
+	files := map[string]string{
+		"20-deploy.yaml": `
+allowed_prefixes:
+  - "item get"
+  - "read op://Deploy/"
+allowed_subcommands:
+  vault:
+    allow: ["list"]
+`,
+		"10-ci.yaml": `
+allowed_commands:
+  - "whoami"
+allowed_prefixes:
+  - "read op://CI/"
+allowed_subcommands:
+  vault:
+    allow: ["get", "list"]
+    deny: ["delete"]
+`,
+		"notes.txt": `allowed_prefixes: ["read"]`,
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("Failed to create rules dir: %v", err)
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatalf("Failed to write rules file: %v", err)
+		}
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	var prefixes []string
+	for _, rule := range cfg.AllowedPrefixes {
+		prefixes = append(prefixes, rule.Match)
+	}
+	if want := []string{"item get", "read op://CI/", "read op://Deploy/"}; !slices.Equal(prefixes, want) {
+		t.Errorf("Expected prefixes %q, got %q", want, prefixes)
+	}
+	if len(cfg.AllowedCommands) != 1 || cfg.AllowedCommands[0].Match != "whoami" {
+		t.Errorf("Expected the whoami command, got %v", cfg.AllowedCommands)
+	}
+	vault := cfg.AllowedSubcommands["vault"]
+	if !slices.Equal(vault.Allow, []string{"get", "list"}) || !slices.Equal(vault.Deny, []string{"delete"}) {
+		t.Errorf("Expected merged vault subcommands, got %+v", vault)
+	}
+}
+
+// TestRulesDirInvalid tests that a missing directory or a broken rule file
+// fails the config load
+func TestRulesDirInvalid(t *testing.T) {
+	path := writeTestConfig(t, `
+account: "test-account"
+rules_dir: "missing"
+`)
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "rules_dir") {
+		t.Errorf("Expected rules_dir error, got %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bad.yaml"), []byte(`allowed_globs: ["read op://["]`), 0600); err != nil {
+		t.Fatalf("Failed to write rules file: %v", err)
+	}
+	path = writeTestConfig(t, "account: \"test-account\"\nrules_dir: "+dir+"\n")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "invalid allowed_globs pattern") {
+		t.Errorf("Expected invalid glob error, got %v", err)
+	}
+}
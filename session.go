@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// opSession caches the session token returned by `op signin --raw`, so every
+// op run after a sign in reuses the session instead of establishing its own.
+// The token is a credential and must never be logged.
+var opSession struct {
+	mu    sync.Mutex
+	token string
+}
+
+// sessionEnvName returns the environment variable op reads the session token
+// of account from
+func sessionEnvName(account string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, account)
+	return "OP_SESSION_" + name
+}
+
+// sessionEnv returns the environment passing the cached session token to op,
+// nil when there is none
+func sessionEnv() []string {
+	opSession.mu.Lock()
+	defer opSession.mu.Unlock()
+
+	if opSession.token == "" {
+		return nil
+	}
+	return []string{sessionEnvName(config.Account) + "=" + opSession.token}
+}
+
+// opEnv returns the environment op runs with for the server's account: its
+// own config directory when OpConfigDir is set, and the cached session token
+func opEnv() []string {
+	var env []string
+	if config.OpConfigDir != "" {
+		env = append(env, "OP_CONFIG_DIR="+config.OpConfigDir)
+	}
+	return append(env, sessionEnv()...)
+}
+
+// prepareOpConfigDir checks that dir is a directory, creating it readable
+// only by the server's user when it doesn't exist yet
+func prepareOpConfigDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("creating op_config_dir: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("checking op_config_dir: %w", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("op_config_dir %s is not a directory", dir)
+	}
+	return nil
+}
+
+// setSessionToken replaces the cached session token, an empty token clears it
+func setSessionToken(token string) {
+	opSession.mu.Lock()
+	opSession.token = token
+	opSession.mu.Unlock()
+
+	// A new session may be of someone else
+	resetWhoami()
+}
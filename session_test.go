@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestSessionTokenReused tests that the token from `op signin --raw` is passed
+// to later commands, and refreshed once op stops accepting it
+func TestSessionTokenReused(t *testing.T) {
+	var mu sync.Mutex
+	validToken := "tok-1"
+	var commandEnvs [][]string
+
+	fake := installFakeOp(t, func(inv opInvocation) int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		session := sessionEnvName("test-account") + "=" + validToken
+		switch {
+		case slices.Contains(inv.args, "signin"):
+			fmt.Fprintln(inv.stdout, validToken)
+			return 0
+		case slices.Contains(inv.args, "account"):
+			if slices.Contains(inv.env, session) {
+				return 0
+			}
+			fmt.Fprintln(inv.stderr, "session expired")
+			return 1
+		default:
+			commandEnvs = append(commandEnvs, inv.env)
+			fmt.Fprintln(inv.stdout, "ok")
+			return 0
+		}
+	})
+	logs := captureLog(t)
+
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	for i := 0; i < 2; i++ {
+		if response, err := sendCommand(t, cfg.SocketPath, "item get foo"); err != nil || response != "ok\n" {
+			t.Fatalf("Expected command to succeed, got %q: %v", response, err)
+		}
+	}
+	if n := fake.callCount("signin"); n != 1 {
+		t.Errorf("Expected a single sign in for two commands, got %d", n)
+	}
+
+	// The session expires and op asks for a new one
+	mu.Lock()
+	validToken = "tok-2"
+	mu.Unlock()
+	if response, err := sendCommand(t, cfg.SocketPath, "item get foo"); err != nil || response != "ok\n" {
+		t.Fatalf("Expected command to succeed after the session expired, got %q: %v", response, err)
+	}
+	if n := fake.callCount("signin"); n != 2 {
+		t.Errorf("Expected the expired session to be refreshed, got %d sign ins", n)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"tok-1", "tok-1", "tok-2"}
+	if len(commandEnvs) != len(want) {
+		t.Fatalf("Expected %d commands, got %d", len(want), len(commandEnvs))
+	}
+	for i, env := range commandEnvs {
+		if !slices.Equal(env, []string{"OP_SESSION_test_account=" + want[i]}) {
+			t.Errorf("Command %d: expected session %s, got env %v", i, want[i], env)
+		}
+	}
+
+	if strings.Contains(logs.String(), "tok-") {
+		t.Errorf("Session token leaked into the logs:\n%s", logs.String())
+	}
+}
+
+// TestOpConfigDir tests that the configured OP_CONFIG_DIR reaches every op
+// run for the account, and that the directory is created private
+func TestOpConfigDir(t *testing.T) {
+	var mu sync.Mutex
+	envs := make(map[string][]string)
+	fake := installFakeOp(t, func(inv opInvocation) int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		args := strings.Join(inv.args, " ")
+		envs[args] = inv.env
+		if strings.Contains(args, "account get") {
+			// Force a sign in, so every kind of op run is covered
+			return 1
+		}
+		return 0
+	})
+	dir := filepath.Join(t.TempDir(), "op", "test-account")
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+op_config_dir: %q
+allowed_prefixes:
+  - "item get"
+`, dir))
+	if err := prepareOpConfigDir(cfg.OpConfigDir); err != nil {
+		t.Fatalf("Failed to prepare op_config_dir: %v", err)
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() || fi.Mode().Perm() != 0700 {
+		t.Fatalf("Expected op_config_dir to be created with mode 0700, got %v: %v", fi, err)
+	}
+	serveConfig(t, cfg)
+
+	if _, err := sendCommand(t, cfg.SocketPath, "item get foo"); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if n := fake.callCount("signin"); n != 1 {
+		t.Fatalf("Expected one sign in, got %d", n)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := "OP_CONFIG_DIR=" + dir
+	for args, env := range envs {
+		if !slices.Contains(env, want) {
+			t.Errorf("Expected %s in the environment of op %s, got %v", want, args, env)
+		}
+	}
+}
+
+// TestOpConfigDirInvalid tests that op_config_dir must be an absolute path to
+// a directory
+func TestOpConfigDirInvalid(t *testing.T) {
+	path := writeTestConfig(t, "account: \"test-account\"\nop_config_dir: \"op/test-account\"\n")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "op_config_dir must be an absolute path") {
+		t.Errorf("Expected an absolute path error, got %v", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := prepareOpConfigDir(file); err == nil || !strings.Contains(err.Error(), "is not a directory") {
+		t.Errorf("Expected a not a directory error, got %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultShutdownGrace bounds the drain on shutdown when ShutdownGrace is unset
+	defaultShutdownGrace = 10 * time.Second
+
+	// exitShutdownForced is the server exit code when connections were still
+	// running at the end of the grace period and had to be closed
+	exitShutdownForced = 3
+
+	// exitSocketVanished is the server exit code when it shut down because
+	// one of its socket files was removed or replaced
+	exitSocketVanished = 4
+)
+
+// openConns tracks the client connections being handled, so the ones still
+// running when the grace period ends can be closed
+var openConns = struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}{conns: make(map[net.Conn]struct{})}
+
+// trackConn registers a connection being handled
+func trackConn(conn net.Conn) {
+	openConns.mu.Lock()
+	defer openConns.mu.Unlock()
+	openConns.conns[conn] = struct{}{}
+}
+
+// untrackConn removes a connection once its handler is done
+func untrackConn(conn net.Conn) {
+	openConns.mu.Lock()
+	defer openConns.mu.Unlock()
+	delete(openConns.conns, conn)
+}
+
+// drainPollInterval is how often a drain checks for connections still open
+const drainPollInterval = 10 * time.Millisecond
+
+// drainConnections waits up to grace for the open connections to finish,
+// then closes the ones still open. It returns how many it had to close.
+func drainConnections(grace time.Duration) int {
+	deadline := time.Now().Add(grace)
+	for {
+		openConns.mu.Lock()
+		open := len(openConns.conns)
+		if open == 0 || time.Now().After(deadline) {
+			for conn := range openConns.conns {
+				conn.Close()
+			}
+			openConns.mu.Unlock()
+			return open
+		}
+		openConns.mu.Unlock()
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// stopAfterMaxUptime shuts the server down once it has run for maxUptime, so
+// a supervisor restarts it with a fresh op state. It stops accepting like a
+// SIGTERM would, and the connections still running drain as usual. Nothing
+// happens when maxUptime is zero or ctx is cancelled first.
+func stopAfterMaxUptime(ctx context.Context, maxUptime time.Duration, cancel context.CancelFunc, listeners []*serverListener) {
+	if maxUptime <= 0 {
+		return
+	}
+
+	go func() {
+		timer := time.NewTimer(maxUptime)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		log.Printf("Server reached its max_uptime of %s, shutting down for a restart", maxUptime)
+		cancel()
+		cleanupListeners(listeners)
+	}()
+}
+
+// shutdownExitCode drains the connections once the server stopped accepting
+// and returns the exit code of the server: 0 for a clean drain and
+// exitShutdownForced when connections had to be closed
+func shutdownExitCode() int {
+	grace := config.ShutdownGrace
+	if grace <= 0 {
+		grace = defaultShutdownGrace
+	}
+
+	log.Printf("Waiting up to %s for %d connections to finish", grace, metrics.activeConns.Load())
+	if forced := drainConnections(grace); forced > 0 {
+		log.Printf("Shutdown grace period expired, forcibly closed %d connections", forced)
+		return exitShutdownForced
+	}
+	return 0
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestShutdownExitCode tests that a clean drain exits 0 and a shutdown that
+// has to cut off a slow command exits with exitShutdownForced
+func TestShutdownExitCode(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	installFakeOp(t, func(inv opInvocation) int {
+		if strings.Contains(strings.Join(inv.args, " "), "item get slow") {
+			started <- struct{}{}
+			<-release
+		}
+		return 0
+	})
+	cfg := loadTestConfig(t, `
+shutdown_grace: 200ms
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+	defer close(release)
+
+	if _, err := sendCommand(t, cfg.SocketPath, "item get fast"); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if code := shutdownExitCode(); code != 0 {
+		t.Errorf("Expected exit code 0 with nothing in flight, got %d", code)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := sendCommand(t, cfg.SocketPath, "item get slow")
+		result <- err
+	}()
+	<-started
+
+	start := time.Now()
+	if code := shutdownExitCode(); code != exitShutdownForced {
+		t.Errorf("Expected exit code %d with a command in flight, got %d", exitShutdownForced, code)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected to wait for the grace period, took %s", elapsed)
+	}
+
+	// The client sees its connection closed
+	select {
+	case <-result:
+	case <-time.After(5 * time.Second):
+		t.Error("Client was not disconnected by the forced shutdown")
+	}
+}
+
+// TestMaxUptime tests that the server stops accepting on its own once
+// max_uptime has passed, and still lets the command in flight finish
+func TestMaxUptime(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	installFakeOp(t, func(inv opInvocation) int {
+		if strings.Contains(strings.Join(inv.args, " "), "item get slow") {
+			started <- struct{}{}
+			<-release
+		}
+		return 0
+	})
+	cfg := loadTestConfig(t, `
+max_uptime: 300ms
+allowed_prefixes:
+  - "item get"
+`)
+	logs := captureLog(t)
+
+	prev := config
+	config = cfg
+	t.Cleanup(func() { config = prev })
+	listeners, err := setupListeners(&config)
+	if err != nil {
+		t.Fatalf("Failed to set up socket: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startServer(ctx, listeners...)
+	stopAfterMaxUptime(ctx, config.MaxUptime, cancel, listeners)
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := sendCommand(t, cfg.SocketPath, "item get slow")
+		result <- err
+	}()
+	<-started
+
+	// The listener is closed right after ctx is cancelled
+	deadline := time.Now().Add(5 * time.Second)
+	for ctx.Err() == nil || socketAccepts(cfg.SocketPath) {
+		if time.Now().After(deadline) {
+			close(release)
+			t.Fatal("Server did not stop accepting after max_uptime")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+	if code := shutdownExitCode(); code != 0 {
+		t.Errorf("Expected a clean drain, got exit code %d", code)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("Expected the command in flight to finish, got %v", err)
+	}
+	handlers.Wait()
+	if !strings.Contains(logs.String(), "reached its max_uptime of 300ms") {
+		t.Errorf("Expected the shutdown reason to be logged, got %q", logs.String())
+	}
+}
+
+// socketAccepts reports whether a connection to path goes through
+func socketAccepts(path string) bool {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
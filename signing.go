@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultSigningMaxSkew is how far the timestamp of a signed request may be
+// from the server's clock when signing_max_skew is unset
+const defaultSigningMaxSkew = 30 * time.Second
+
+var (
+	errUnsignedRequest = errors.New("request is not signed")
+	errBadSignature    = errors.New("signature does not match")
+	errStaleRequest    = errors.New("timestamp is outside the allowed clock skew")
+	errReplayedNonce   = errors.New("nonce was already used")
+)
+
+// loadSigningKey reads the shared key signed requests are checked against
+func loadSigningKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading signing key: %w", err)
+	}
+	key := []byte(strings.TrimSpace(string(data)))
+	if len(key) == 0 {
+		return nil, fmt.Errorf("signing key file %s is empty", path)
+	}
+	return key, nil
+}
+
+// signingRequired reports whether requests arriving on conn must be signed.
+// Unix sockets are protected by their file permissions and peer credentials,
+// so only other connections, like the ones handed over by inetd, are checked.
+func signingRequired(conn net.Conn) bool {
+	if config.signingKey == nil {
+		return false
+	}
+	_, unix := conn.(*net.UnixConn)
+	return !unix
+}
+
+// signRequest stamps req with the current time and a fresh nonce, and signs
+// it with key
+func signRequest(req *request, key []byte) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("generating nonce: %w", err)
+	}
+	req.Timestamp = now().Unix()
+	req.Nonce = hex.EncodeToString(nonce)
+	req.Signature = requestMAC(*req, key)
+	return nil
+}
+
+// requestMAC returns the hex HMAC-SHA256 of everything in req that affects
+// what the server runs, so none of it can be changed without the key
+func requestMAC(req request, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	// Each field is prefixed with its length, so bytes can't be moved
+	// from one field to the next
+	for _, field := range []string{
+		strconv.FormatInt(req.Timestamp, 10),
+		req.Nonce,
+		req.Command,
+		strings.Join(req.Flags, ","),
+		string(req.stdin),
+	} {
+		fmt.Fprintf(mac, "%d:%s", len(field), field)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyRequest checks that req is signed with key, was sent within maxSkew
+// of now and doesn't reuse a nonce recorded in the nonce file at noncePath
+func verifyRequest(req request, key []byte, maxSkew time.Duration, noncePath string) error {
+	if req.Signature == "" || req.Nonce == "" {
+		return errUnsignedRequest
+	}
+	if !hmac.Equal([]byte(req.Signature), []byte(requestMAC(req, key))) {
+		return errBadSignature
+	}
+
+	skew := now().Sub(time.Unix(req.Timestamp, 0))
+	if skew < -maxSkew || skew > maxSkew {
+		return errStaleRequest
+	}
+
+	// Only signed requests are remembered, so nobody without the key can
+	// fill the nonce file. A nonce is kept until its request is refused on
+	// its timestamp anyway.
+	fresh, err := addNonce(noncePath, req.Nonce, time.Unix(req.Timestamp, 0).Add(maxSkew))
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return errReplayedNonce
+	}
+	return nil
+}
+
+// noncePath returns the file holding the nonces of accepted signed requests,
+// next to the account locks. It is shared by every server process, as under
+// inetd each connection is served by a process of its own.
+func noncePath() (string, error) {
+	dir, err := getLockDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "nonces"), nil
+}
+
+// addNonce records nonce in the nonce file at path, to be kept until expires,
+// and reports whether it was new. The file is locked while it is read and
+// rewritten, so processes checking requests side by side see each other's
+// nonces. Nonces that have expired are dropped on the way.
+func addNonce(path, nonce string, expires time.Time) (bool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return false, fmt.Errorf("creating nonce directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return false, fmt.Errorf("opening nonce file: %w", err)
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return false, fmt.Errorf("locking %s: %w", path, err)
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	// Each line holds when a nonce expires and its hash, which keeps the
+	// lines short whatever the client sent
+	sum := sha256.Sum256([]byte(nonce))
+	hash := hex.EncodeToString(sum[:])
+	cutoff := now().Unix()
+	var kept bytes.Buffer
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		at, seen, ok := strings.Cut(scanner.Text(), " ")
+		until, err := strconv.ParseInt(at, 10, 64)
+		if !ok || err != nil || until < cutoff {
+			continue
+		}
+		if seen == hash {
+			return false, nil
+		}
+		fmt.Fprintf(&kept, "%d %s\n", until, seen)
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("reading nonce file: %w", err)
+	}
+	fmt.Fprintf(&kept, "%d %s\n", expires.Unix(), hash)
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, fmt.Errorf("writing nonce file: %w", err)
+	}
+	if err := file.Truncate(0); err != nil {
+		return false, fmt.Errorf("writing nonce file: %w", err)
+	}
+	if _, err := file.Write(kept.Bytes()); err != nil {
+		return false, fmt.Errorf("writing nonce file: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sendSignedStdio serves a single request over a pipe, the way inetd hands
+// one to the server, and returns the response and exit code
+func sendSignedStdio(t *testing.T, req request) (string, int) {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	if err := writeRequest(w, req); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+	w.Close()
+
+	var out bytes.Buffer
+	code := serveStdio(r, &out)
+	return out.String(), code
+}
+
+// TestSignedRequests tests that a connection other than a Unix socket only
+// accepts fresh signed requests, refusing replayed and stale ones
+func TestSignedRequests(t *testing.T) {
+	installFakeOp(t, nil)
+	prev := config
+	t.Cleanup(func() { config = prev })
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	keyFile := filepath.Join(t.TempDir(), "signing.key")
+	if err := os.WriteFile(keyFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config = loadTestConfig(t, fmt.Sprintf(`
+allowed_prefixes:
+  - "item get"
+signing_key_file: %q
+`, keyFile))
+	key := []byte("s3cret")
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	setClock(t, start)
+
+	fresh := request{Command: "item get foo"}
+	if err := signRequest(&fresh, key); err != nil {
+		t.Fatal(err)
+	}
+	if out, code := sendSignedStdio(t, fresh); code != 0 || out != "op --account test-account item get foo\n" {
+		t.Errorf("Expected the fresh request to run, got %q with exit code %d", out, code)
+	}
+
+	// The same request sent again is refused even within the skew window
+	if out, code := sendSignedStdio(t, fresh); code != exitPolicy || !strings.Contains(out, errReplayedNonce.Error()) {
+		t.Errorf("Expected the replayed request to be refused, got %q with exit code %d", out, code)
+	}
+
+	stale := request{Command: "item get foo"}
+	setClock(t, start.Add(-time.Minute))
+	if err := signRequest(&stale, key); err != nil {
+		t.Fatal(err)
+	}
+	setClock(t, start)
+	if out, code := sendSignedStdio(t, stale); code != exitPolicy || !strings.Contains(out, errStaleRequest.Error()) {
+		t.Errorf("Expected the stale request to be refused, got %q with exit code %d", out, code)
+	}
+
+	if out, code := sendSignedStdio(t, request{Command: "item get foo"}); code != exitPolicy || !strings.Contains(out, errUnsignedRequest.Error()) {
+		t.Errorf("Expected the unsigned request to be refused, got %q with exit code %d", out, code)
+	}
+
+	tampered := request{Command: "item get foo"}
+	if err := signRequest(&tampered, key); err != nil {
+		t.Fatal(err)
+	}
+	tampered.Command = "item get bar"
+	if out, code := sendSignedStdio(t, tampered); code != exitPolicy || !strings.Contains(out, errBadSignature.Error()) {
+		t.Errorf("Expected the tampered request to be refused, got %q with exit code %d", out, code)
+	}
+}
+
+// TestSignedRequestsUnixSocket tests that requests over the Unix socket need
+// no signature even when a signing key is set
+func TestSignedRequestsUnixSocket(t *testing.T) {
+	installFakeOp(t, nil)
+	keyFile := filepath.Join(t.TempDir(), "signing.key")
+	if err := os.WriteFile(keyFile, []byte("s3cret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+allowed_prefixes:
+  - "item get"
+signing_key_file: %q
+`, keyFile))
+	serveConfig(t, cfg)
+
+	got, err := sendCommand(t, cfg.SocketPath, "item get foo")
+	if err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if got != "op --account test-account item get foo\n" {
+		t.Errorf("Expected the unsigned command to run, got %q", got)
+	}
+}
+
+// TestAddNonce tests that the nonce file refuses a nonce seen before, by
+// this or any other process, until it expires
+func TestAddNonce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "opfwd", "nonces")
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	setClock(t, start)
+
+	for _, nonce := range []string{"a", "b"} {
+		if fresh, err := addNonce(path, nonce, start.Add(30*time.Second)); err != nil || !fresh {
+			t.Errorf("Expected %s to be new, got %v, %v", nonce, fresh, err)
+		}
+	}
+	if fresh, err := addNonce(path, "a", start.Add(30*time.Second)); err != nil || fresh {
+		t.Errorf("Expected a to be remembered, got %v, %v", fresh, err)
+	}
+
+	// The file is all a fresh process has to go by
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read the nonce file: %v", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("Expected 2 nonces in the file, got %q", data)
+	}
+
+	// Once expired, nonces are dropped from the file
+	setClock(t, start.Add(time.Minute))
+	if fresh, err := addNonce(path, "c", start.Add(90*time.Second)); err != nil || !fresh {
+		t.Errorf("Expected c to be new, got %v, %v", fresh, err)
+	}
+	data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read the nonce file: %v", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Errorf("Expected the expired nonces to be dropped, got %q", data)
+	}
+}
@@ -0,0 +1,5 @@
+package main
+
+// abstractSocketsSupported reports whether socket paths starting with "@" can
+// be bound in the abstract namespace, which only Linux has
+const abstractSocketsSupported = true
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestAbstractSocket tests serving and connecting on an abstract socket
+func TestAbstractSocket(t *testing.T) {
+	installFakeOp(t, nil)
+	captureLog(t)
+	socket := fmt.Sprintf("@opfwd-test-%d-%d", os.Getpid(), time.Now().UnixNano())
+
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+listeners:
+  - path: %q
+    allowed_prefixes:
+      - "item get"
+`, socket))
+	serveConfig(t, cfg)
+
+	var out bytes.Buffer
+	if _, err := forwardCommand(&out, socket, "item get foo", clientOptions{}); err != nil {
+		t.Fatalf("Expected command over the abstract socket to succeed, got: %v", err)
+	}
+	if want := "op --account test-account item get foo\n"; out.String() != want {
+		t.Errorf("Expected %q, got %q", want, out.String())
+	}
+
+	// Nothing lands on disk
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Expected no file for the abstract socket, stat returned: %v", err)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+// abstractSocketsSupported reports whether socket paths starting with "@" can
+// be bound in the abstract namespace, which only Linux has
+const abstractSocketsSupported = false
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// accountListTimeout bounds how long the startup check waits for op
+// account list
+const accountListTimeout = 10 * time.Second
+
+// checkStartup checks the account is one op knows about when VerifyAccount
+// is set, and signs in to 1Password if needed when StartupCheck is set, so
+// a mistyped account or auth problems show at boot instead of on the first
+// command. A failure is logged as a warning, or returned when
+// RequireStartupCheck is set.
+func checkStartup(cfg Config) error {
+	if cfg.VerifyAccount {
+		if err := verifyAccount(cfg.Account); err != nil {
+			if cfg.RequireStartupCheck {
+				return err
+			}
+			log.Printf("Warning: startup check: %v", err)
+		} else {
+			log.Printf("Startup check found account %s in op account list", maskAccount(cfg.Account))
+		}
+	}
+
+	if !cfg.StartupCheck && !cfg.RequireStartupCheck {
+		return nil
+	}
+
+	if err := ensureLoggedIn(context.Background(), log.Default()); err != nil {
+		if cfg.RequireStartupCheck {
+			return fmt.Errorf("could not sign in to 1Password: %w", err)
+		}
+		log.Printf("Warning: startup check could not sign in to 1Password: %v", err)
+		return nil
+	}
+	log.Println("Startup check passed, 1Password is signed in")
+	return nil
+}
+
+// opAccount is an account listed by `op account list`
+type opAccount struct {
+	URL         string `json:"url"`
+	Shorthand   string `json:"shorthand"`
+	AccountUUID string `json:"account_uuid"`
+	UserUUID    string `json:"user_uuid"`
+}
+
+// names returns the names --account accepts for the account: its shorthand,
+// sign-in address with and without the scheme, the subdomain of the sign-in
+// address, and its account and user IDs
+func (a opAccount) names() []string {
+	host := strings.TrimPrefix(strings.TrimPrefix(a.URL, "https://"), "http://")
+	subdomain, _, _ := strings.Cut(host, ".")
+	return []string{a.Shorthand, a.URL, host, subdomain, a.AccountUUID, a.UserUUID}
+}
+
+// String names the account by its shorthand and sign-in address
+func (a opAccount) String() string {
+	if a.Shorthand == "" {
+		return a.URL
+	}
+	return fmt.Sprintf("%s (%s)", a.Shorthand, a.URL)
+}
+
+// verifyAccount checks that account names one of the accounts op knows
+// about, listing them in the error when it doesn't
+func verifyAccount(account string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), accountListTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	args := []string{"account", "list", "--format", "json"}
+	exitCode, err := opRunner(ctx, opInvocation{args: args, stdout: &stdout, stderr: &stderr, env: opEnv()})
+	if err == nil && exitCode != 0 {
+		err = fmt.Errorf("exit status %d: %s", exitCode, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return fmt.Errorf("could not list the accounts op knows about: %w", err)
+	}
+
+	var accounts []opAccount
+	if err := json.Unmarshal(stdout.Bytes(), &accounts); err != nil {
+		return fmt.Errorf("could not parse op account list: %w", err)
+	}
+	for _, a := range accounts {
+		if slices.ContainsFunc(a.names(), func(name string) bool { return name != "" && strings.EqualFold(name, account) }) {
+			return nil
+		}
+	}
+
+	if len(accounts) == 0 {
+		return fmt.Errorf("account %q is unknown, op knows no accounts on this machine; add it with op account add", account)
+	}
+	known := make([]string, len(accounts))
+	for i, a := range accounts {
+		known[i] = a.String()
+	}
+	return fmt.Errorf("account %q is unknown, op knows about: %s", account, strings.Join(known, ", "))
+}
+
+// ruleCounts is the number of allow rules of each kind
+type ruleCounts struct {
+	Exact      int `json:"exact"`
+	Prefix     int `json:"prefix"`
+	Glob       int `json:"glob"`
+	Template   int `json:"template"`
+	Subcommand int `json:"subcommand"`
+	Hash       int `json:"hash"`
+}
+
+// add counts the rules of r
+func (c *ruleCounts) add(r *Rules) {
+	c.Exact += len(r.AllowedCommands)
+	c.Prefix += len(r.AllowedPrefixes)
+	c.Glob += len(r.AllowedGlobs)
+	c.Template += len(r.AllowedTemplates)
+	c.Subcommand += len(r.AllowedSubcommands)
+	c.Hash += len(r.AllowedHashes)
+}
+
+// startupEvent summarizes the effective config of a server, logged once it
+// is listening so an instance can be checked for what it loaded. It never
+// holds secrets: the account is masked and so are the socket paths when
+// MaskPaths is set.
+type startupEvent struct {
+	Version            string     `json:"version"`
+	Sockets            []string   `json:"sockets"`
+	Account            string     `json:"account"`
+	Rules              ruleCounts `json:"rules"`
+	OpPath             string     `json:"op_path"`
+	OpVersion          string     `json:"op_version"`
+	MaxResponseBytes   int64      `json:"max_response_bytes"`
+	CommandTimeout     string     `json:"command_timeout"`
+	MaxCommandsPerConn int        `json:"max_commands_per_conn"`
+	AutoSignin         bool       `json:"auto_signin"`
+	NoExecute          bool       `json:"no_execute"`
+}
+
+// newStartupEvent builds the startup event for cfg serving on listeners
+func newStartupEvent(cfg *Config, listeners []*serverListener) startupEvent {
+	ev := startupEvent{
+		Version:            version,
+		Account:            maskAccount(cfg.Account),
+		OpPath:             opBinary(),
+		OpVersion:          opVersion,
+		MaxResponseBytes:   cfg.MaxResponseBytes,
+		CommandTimeout:     cfg.CommandTimeout.String(),
+		MaxCommandsPerConn: max(cfg.MaxCommandsPerConn, defaultMaxCommandsPerConn),
+		AutoSignin:         cfg.autoSignin(),
+		NoExecute:          cfg.NoExecute,
+	}
+	if path, err := exec.LookPath(ev.OpPath); err == nil {
+		ev.OpPath = path
+	}
+	for _, l := range listeners {
+		ev.Sockets = append(ev.Sockets, cfg.logPath(l.path))
+		if !l.control {
+			ev.Rules.add(l.rules.Load())
+		}
+	}
+	return ev
+}
+
+// logPath returns path as it should appear in the logs, only its file name
+// when MaskPaths is set
+func (cfg *Config) logPath(path string) string {
+	if !cfg.MaskPaths || isAbstractSocket(path) {
+		return path
+	}
+	return filepath.Join("...", filepath.Base(path))
+}
+
+// maskAccount keeps only the first two characters of an account, enough to
+// tell accounts apart without logging the full shorthand or address
+func maskAccount(account string) string {
+	if len(account) <= 4 {
+		return "***"
+	}
+	return account[:2] + "***"
+}
+
+// format renders the event as a single log line, as JSON when logFormat is
+// "json" and as key=value pairs otherwise
+func (ev startupEvent) format(logFormat string) string {
+	if logFormat == "json" {
+		data, err := json.Marshal(ev)
+		if err == nil {
+			return "Startup: " + string(data)
+		}
+	}
+	return fmt.Sprintf("Startup: version=%s sockets=%s account=%s rules=exact:%d,prefix:%d,glob:%d,template:%d,subcommand:%d,hash:%d "+
+		"op_path=%s op_version=%s max_response_bytes=%d command_timeout=%s max_commands_per_conn=%d auto_signin=%v no_execute=%v",
+		ev.Version, strings.Join(ev.Sockets, ","), ev.Account,
+		ev.Rules.Exact, ev.Rules.Prefix, ev.Rules.Glob, ev.Rules.Template, ev.Rules.Subcommand, ev.Rules.Hash,
+		ev.OpPath, ev.OpVersion, ev.MaxResponseBytes, ev.CommandTimeout, ev.MaxCommandsPerConn, ev.AutoSignin, ev.NoExecute)
+}
+
+// validateLogFormat checks the log_format setting
+func validateLogFormat(format string) error {
+	switch format {
+	case "", "text", "json":
+		return nil
+	default:
+		return fmt.Errorf("invalid log_format %q, expected text or json", format)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// defaultTemplateCharset is the character class placeholder values must
+// come from when a template rule sets no charset. It leaves out `/`, so a
+// value can't reach into another vault or item path.
+const defaultTemplateCharset = `A-Za-z0-9_.-`
+
+// placeholderPattern matches a `{name}` placeholder in a template rule
+var placeholderPattern = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// commandTemplate is a compiled template rule
+type commandTemplate struct {
+	re    *regexp.Regexp
+	names []string
+}
+
+// compileTemplate compiles a template rule like `read op://Employee/{item}/password`
+// into a pattern matching whole commands, where every placeholder matches a
+// non-empty run of the rule's charset
+func compileTemplate(rule Rule) (*commandTemplate, error) {
+	charset := rule.Charset
+	if charset == "" {
+		charset = defaultTemplateCharset
+	}
+	// A negated class or an escape like \S would let a value run across
+	// spaces and carry extra arguments
+	if strings.ContainsAny(charset, "[]\\") || strings.HasPrefix(charset, "^") {
+		return nil, fmt.Errorf("invalid charset %q for template %q, expected the inside of a character class like A-Za-z0-9", charset, rule.Match)
+	}
+	value := "([" + charset + "]+)"
+	class, err := regexp.Compile("^[" + charset + "]$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid charset %q for template %q: %w", charset, rule.Match, err)
+	}
+	if space, ok := matchesSpace(class); ok {
+		return nil, fmt.Errorf("invalid charset %q for template %q, it must not match whitespace like %q", charset, rule.Match, space)
+	}
+
+	t := &commandTemplate{}
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	last := 0
+	for _, loc := range placeholderPattern.FindAllStringSubmatchIndex(rule.Match, -1) {
+		pattern.WriteString(regexp.QuoteMeta(rule.Match[last:loc[0]]))
+		pattern.WriteString(value)
+		t.names = append(t.names, rule.Match[loc[2]:loc[3]])
+		last = loc[1]
+	}
+	pattern.WriteString(regexp.QuoteMeta(rule.Match[last:]))
+	pattern.WriteString("$")
+
+	if len(t.names) == 0 {
+		return nil, fmt.Errorf("template %q has no {placeholder}, use allowed_commands instead", rule.Match)
+	}
+	if rest := placeholderPattern.ReplaceAllString(rule.Match, ""); strings.ContainsAny(rest, "{}") {
+		return nil, fmt.Errorf("template %q has a malformed placeholder, expected {name}", rule.Match)
+	}
+
+	re, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, fmt.Errorf("compiling template %q: %w", rule.Match, err)
+	}
+	t.re = re
+	return t, nil
+}
+
+// matchesSpace returns a whitespace character the compiled charset class
+// matches, as the command splits into arguments on any of them. Ranges like
+// `!-~` are fine, but one starting below the space character isn't.
+func matchesSpace(class *regexp.Regexp) (rune, bool) {
+	for _, r16 := range unicode.White_Space.R16 {
+		for r := rune(r16.Lo); r <= rune(r16.Hi); r += rune(r16.Stride) {
+			if class.MatchString(string(r)) {
+				return r, true
+			}
+		}
+	}
+	for _, r32 := range unicode.White_Space.R32 {
+		for r := rune(r32.Lo); r <= rune(r32.Hi); r += rune(r32.Stride) {
+			if class.MatchString(string(r)) {
+				return r, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// match returns the placeholder values when command fills the template.
+// A placeholder used more than once must get the same value each time.
+func (t *commandTemplate) match(command string) (map[string]string, bool) {
+	groups := t.re.FindStringSubmatch(command)
+	if groups == nil {
+		return nil, false
+	}
+	values := make(map[string]string, len(t.names))
+	for i, name := range t.names {
+		if prev, ok := values[name]; ok && prev != groups[i+1] {
+			return nil, false
+		}
+		values[name] = groups[i+1]
+	}
+	return values, true
+}
+
+// validateTemplates compiles every template rule
+func validateTemplates(templates []Rule) error {
+	for i := range templates {
+		compiled, err := compileTemplate(templates[i])
+		if err != nil {
+			return fmt.Errorf("invalid allowed_templates entry: %w", err)
+		}
+		templates[i].template = compiled
+	}
+	return nil
+}
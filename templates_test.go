@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestAllowedTemplates tests that templated rules only allow commands whose
+// placeholders are all filled with values from the charset
+func TestAllowedTemplates(t *testing.T) {
+	cfg := loadTestConfig(t, `
+allowed_templates:
+  - "read op://Employee/{item}/password"
+  - match: "item get {id} --vault {vault}"
+    charset: "a-z0-9"
+`)
+	for _, rule := range cfg.AllowedTemplates {
+		if rule.template == nil {
+			t.Fatalf("Expected template %q to be compiled at load", rule.Match)
+		}
+	}
+
+	tests := map[string]bool{
+		"read op://Employee/GitHub/password":          true,
+		"read op://Employee/aws-prod.1/password":      true,
+		"read op://Employee/GitHub/section/password":  false,
+		"read op://Employee/../Personal/SSH/password": false,
+		"read op://Employee/Git$Hub/password":         false,
+		"read op://Employee//password":                false,
+		"read op://Employee/GitHub/password --reveal": false,
+		"item get abc123 --vault ops":                 true,
+		"item get ABC123 --vault ops":                 false,
+		"item get abc123":                             false,
+	}
+	for input, want := range tests {
+		if got := validateCommand(&cfg.Rules, input); got != want {
+			t.Errorf("validateCommand(%q) = %v, want %v", input, got, want)
+		}
+	}
+
+	matched, ok := matchRule(&cfg.Rules, "read op://Employee/GitHub/password", nil)
+	if !ok || matched.kind != "template" {
+		t.Errorf("Expected a template match, got %v", matched)
+	}
+}
+
+// TestTemplateRepeatedPlaceholder tests that a placeholder used twice must
+// get the same value both times
+func TestTemplateRepeatedPlaceholder(t *testing.T) {
+	tmpl, err := compileTemplate(Rule{Match: "read op://{vault}/{item}/{vault}-key"})
+	if err != nil {
+		t.Fatalf("Failed to compile template: %v", err)
+	}
+	values, ok := tmpl.match("read op://CI/deploy/CI-key")
+	if !ok || values["vault"] != "CI" || values["item"] != "deploy" {
+		t.Errorf("Expected vault CI and item deploy, got %v (matched %v)", values, ok)
+	}
+	if _, ok := tmpl.match("read op://CI/deploy/Prod-key"); ok {
+		t.Error("Expected different values for the same placeholder to be refused")
+	}
+}
+
+// TestTemplateCharsetNoSpaces tests that even the widest charset allowed
+// can't let a placeholder run across a space into extra arguments
+func TestTemplateCharsetNoSpaces(t *testing.T) {
+	tmpl, err := compileTemplate(Rule{Match: "item get {id}", Charset: "!-~"})
+	if err != nil {
+		t.Fatalf("Failed to compile template: %v", err)
+	}
+	tests := map[string]bool{
+		"item get foo":               true,
+		"item get foo/bar--x":        true,
+		"item get foo --reveal":      false,
+		"item get foo\t--reveal":     false,
+		"item get foo\u00a0--reveal": false,
+	}
+	for command, want := range tests {
+		if _, got := tmpl.match(command); got != want {
+			t.Errorf("match(%q) = %v, want %v", command, got, want)
+		}
+	}
+}
+
+// TestInvalidTemplates tests that malformed templates are rejected at load
+func TestInvalidTemplates(t *testing.T) {
+	tests := map[string]string{
+		"no placeholder":   `["read op://Employee/GitHub/password"]`,
+		"unclosed":         `["read op://Employee/{item/password"]`,
+		"bad name":         `["read op://Employee/{1item}/password"]`,
+		"bad charset":      `[{match: "read op://{vault}/x", charset: "z-a"}]`,
+		"bracket charset":  `[{match: "read op://{vault}/x", charset: "[a-z]"}]`,
+		"negated charset":  `[{match: "read op://{vault}/x", charset: "^/"}]`,
+		"space charset":    `[{match: "read op://{vault}/x", charset: "a-z "}]`,
+		"escape \\s":       `[{match: "read op://{vault}/x", charset: "\\s"}]`,
+		"escape \\S":       `[{match: "read op://{vault}/x", charset: "a-z\\S"}]`,
+		"escape \\W":       `[{match: "read op://{vault}/x", charset: "\\W"}]`,
+		"range over space": `[{match: "read op://{vault}/x", charset: "\x01-~"}]`,
+		"unicode space":    `[{match: "read op://{vault}/x", charset: "a-z\u00a0"}]`,
+	}
+	for name, templates := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := writeTestConfig(t, "account: \"test-account\"\nallowed_templates: "+templates+"\n")
+			if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "allowed_templates") {
+				t.Errorf("Expected allowed_templates error, got %v", err)
+			}
+		})
+	}
+
+	path := writeTestConfig(t, "account: \"test-account\"\nallowed_globs: [{match: \"read *\", charset: \"a-z\"}]\n")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "charset only applies to allowed_templates") {
+		t.Errorf("Expected charset error, got %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// runTestRule implements the test-rule subcommand, which checks a command
+// against the rules of a config without a running server
+func runTestRule(args []string) int {
+	fs := flag.NewFlagSet("test-rule", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to the config file")
+	fs.StringVar(&configProfile, "profile", "", "Use this profile of the config file")
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: opfwd test-rule [-config PATH] [-profile NAME] <op command>")
+		return 1
+	}
+	if *configPath == "" {
+		defaultPath, err := getDefaultConfigPath()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get default config path: %v\n", err)
+			return 1
+		}
+		*configPath = defaultPath
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+	return testRule(os.Stdout, cfg, strings.Join(fs.Args(), " "))
+}
+
+// testRule prints whether the rules of the main socket of cfg allow command,
+// going through the same checks as the server, and which rule allowed it. It
+// returns 0 when the command is allowed and 1 otherwise.
+func testRule(w io.Writer, cfg Config, command string) int {
+	// The checks read the settings of the running server
+	config = cfg
+	rules := &config.Rules
+
+	denied := func(format string, args ...any) int {
+		fmt.Fprintf(w, "DENIED: "+format+"\n", args...)
+		return 1
+	}
+	if rewritten, ok := rewriteCommand(config.Rewrites, command); ok {
+		fmt.Fprintf(w, "REWRITTEN: %s\n", rewritten)
+		command = rewritten
+	}
+	if flag, found := findServerManagedFlag(command); found {
+		return denied("%s is set by the server", flag)
+	}
+	if flag, found := rules.findBlockedFlag(command); found {
+		return denied("%s is blocked", flag)
+	}
+	if field, found := findDeniedField(command, config.DeniedFields); found {
+		return denied("field %s is denied", field)
+	}
+	matched, ok := matchRule(rules, command, nil)
+	if rule, short := rules.findShortPrefix(command); !ok && short {
+		return denied("%q needs at least %d argument(s) after it", rule.Match, rule.MinArgs)
+	}
+	if !ok {
+		return denied("no rule allows %s", canonicalizeCommand(command))
+	}
+	if flag, found := findAppendedFlag(command, matched.appendArgs()); found {
+		return denied("%s is set by the rule %s", flag, matched)
+	}
+
+	// Show the settings of the rule too, like a rate limit or approval
+	desc := matched.String()
+	if matched.rule != nil {
+		desc = matched.kind + " " + matched.rule.String()
+	}
+	fmt.Fprintf(w, "ALLOWED: %s\n", desc)
+	return 0
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestTestRule tests checking sample commands against a config offline
+func TestTestRule(t *testing.T) {
+	cfg := loadTestConfig(t, `
+control_socket_path: "/tmp/opfwd-test-rule-control.sock"
+allowed_prefixes:
+  - match: "item get"
+    vault: Employee
+    require_approval: true
+blocked_flags:
+  - flags: ["--out-file"]
+denied_fields: ["recovery-codes"]
+`)
+	prev := config
+	t.Cleanup(func() { config = prev })
+
+	tests := []struct {
+		command string
+		code    int
+		want    string
+	}{
+		{"item get GitHub --vault Employee --fields password", 0, "ALLOWED: prefix item get (vault Employee) (requires approval)\n"},
+		{"item get GitHub --vault Employee", 1, "DENIED: field recovery-codes is denied\n"},
+		{"read op://Employee/GitHub/password", 1, "DENIED: no rule allows read op://Employee/GitHub/password\n"},
+		{"item get GitHub --vault Personal --fields password", 1, "DENIED: no rule allows item get GitHub --vault Personal --fields password\n"},
+		{"item get GitHub --vault Employee --out-file x", 1, "DENIED: --out-file is blocked\n"},
+		{"item get GitHub --vault Employee --fields recovery-codes", 1, "DENIED: field recovery-codes is denied\n"},
+		{"item get GitHub --vault Employee --account other", 1, "DENIED: --account is set by the server\n"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if code := testRule(&out, cfg, tt.command); code != tt.code || out.String() != tt.want {
+			t.Errorf("testRule(%q) = %d, %q, want %d, %q", tt.command, code, out.String(), tt.code, tt.want)
+		}
+	}
+}
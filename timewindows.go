@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// now returns the current time. It is a variable so tests can fix the clock.
+var now = time.Now
+
+// weekdays maps the day names accepted in time_windows to time.Weekday
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// TimeWindow is a range of the day during which commands are allowed
+type TimeWindow struct {
+	// Days lists the weekdays the window applies to, as "mon" to "sun".
+	// Every day when empty.
+	Days []string `yaml:"days"`
+
+	// Start and End are "HH:MM" times of day, End exclusive
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+
+	// Timezone is an IANA zone name like "Europe/Berlin", the server's local
+	// time zone when empty
+	Timezone string `yaml:"timezone"`
+}
+
+// parseTimeOfDay parses "HH:MM" into minutes since midnight
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether t falls inside the window
+func (w TimeWindow) contains(t time.Time) (bool, error) {
+	loc := time.Local
+	if w.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(w.Timezone); err != nil {
+			return false, fmt.Errorf("invalid timezone %q: %w", w.Timezone, err)
+		}
+	}
+	start, err := parseTimeOfDay(w.Start)
+	if err != nil {
+		return false, err
+	}
+	end, err := parseTimeOfDay(w.End)
+	if err != nil {
+		return false, err
+	}
+	if end <= start {
+		return false, fmt.Errorf("end %s must be after start %s", w.End, w.Start)
+	}
+
+	t = t.In(loc)
+	if len(w.Days) > 0 {
+		matched := false
+		for _, day := range w.Days {
+			wd, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return false, fmt.Errorf("invalid day %q, expected one of mon, tue, wed, thu, fri, sat, sun", day)
+			}
+			matched = matched || wd == t.Weekday()
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	return minute >= start && minute < end, nil
+}
+
+// validateTimeWindows checks that every window is well-formed
+func validateTimeWindows(windows []TimeWindow) error {
+	for i, w := range windows {
+		if _, err := w.contains(time.Time{}); err != nil {
+			return fmt.Errorf("time_windows[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// withinTimeWindows reports whether t falls inside any of the windows. No
+// windows means commands are always allowed.
+func withinTimeWindows(windows []TimeWindow, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for _, w := range windows {
+		// Windows are validated when the config is loaded
+		if ok, err := w.contains(t); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// setClock fixes the server clock to t for the duration of the test
+func setClock(t *testing.T, at time.Time) {
+	t.Helper()
+	prev := now
+	now = func() time.Time { return at }
+	t.Cleanup(func() {
+		now = prev
+	})
+}
+
+const businessHoursConfig = `
+allowed_prefixes:
+  - "item get"
+time_windows:
+  - days: [mon, tue, wed, thu, fri]
+    start: "09:00"
+    end: "18:00"
+    timezone: UTC
+`
+
+// TestTimeWindowInside tests that commands run inside a permitted window
+func TestTimeWindowInside(t *testing.T) {
+	installFakeOp(t, nil)
+	// Wednesday 10:30 UTC
+	setClock(t, time.Date(2024, time.May, 15, 10, 30, 0, 0, time.UTC))
+	cfg := loadTestConfig(t, businessHoursConfig)
+	serveConfig(t, cfg)
+
+	response, err := sendCommand(t, cfg.SocketPath, "item get foo")
+	if err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if want := "op --account test-account item get foo\n"; response != want {
+		t.Errorf("Expected %q, got %q", want, response)
+	}
+}
+
+// TestTimeWindowOutside tests that commands are denied outside every window
+func TestTimeWindowOutside(t *testing.T) {
+	fake := installFakeOp(t, nil)
+	cfg := loadTestConfig(t, businessHoursConfig)
+	serveConfig(t, cfg)
+
+	for name, at := range map[string]time.Time{
+		"after hours": time.Date(2024, time.May, 15, 18, 0, 0, 0, time.UTC),
+		"weekend":     time.Date(2024, time.May, 18, 10, 30, 0, 0, time.UTC),
+		"other zone":  time.Date(2024, time.May, 15, 10, 30, 0, 0, time.FixedZone("UTC-9", -9*60*60)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			setClock(t, at)
+			response, err := sendCommand(t, cfg.SocketPath, "item get foo")
+			if err != nil {
+				t.Fatalf("Failed to send command: %v", err)
+			}
+			if !strings.Contains(response, "outside permitted hours") {
+				t.Errorf("Expected outside permitted hours error, got %q", response)
+			}
+		})
+	}
+
+	if n := fake.callCount("item get"); n != 0 {
+		t.Errorf("Expected op not to run outside permitted hours, ran %d times", n)
+	}
+}
+
+// TestInvalidTimeWindows tests that malformed windows are rejected at load time
+func TestInvalidTimeWindows(t *testing.T) {
+	tests := map[string]string{
+		"bad day":      `[{days: [funday], start: "09:00", end: "18:00"}]`,
+		"bad start":    `[{start: "9am", end: "18:00"}]`,
+		"end first":    `[{start: "18:00", end: "09:00"}]`,
+		"bad timezone": `[{start: "09:00", end: "18:00", timezone: "Mars/Olympus"}]`,
+	}
+
+	for name, windows := range tests {
+		t.Run(name, func(t *testing.T) {
+			env := setupTestEnvironment(t)
+			path := writeTestConfig(t, "account: "+env.account+"\ntime_windows: "+windows+"\n")
+			if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "time_windows") {
+				t.Errorf("Expected time_windows error, got: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// traceEnvVar turns on protocol tracing on the client and the server when
+// set to anything but an empty string
+const traceEnvVar = "OPFWD_TRACE"
+
+// tracing reports whether the requests, response markers and frames crossing
+// the socket should be logged
+func tracing() bool {
+	return os.Getenv(traceEnvVar) != ""
+}
+
+// traceRequest logs a request sent or received. The stdin sent along may be
+// a secret, so only its length is logged.
+func traceRequest(dir string, req request) {
+	if !tracing() {
+		return
+	}
+	log.Printf("Trace: %s request command=%q flags=%v stdin_len=%d", dir, req.Command, req.Flags, len(req.stdin))
+}
+
+// traceHello logs a hello line opening a connection or answering one
+func traceHello(dir, line string) {
+	if !tracing() {
+		return
+	}
+	log.Printf("Trace: %s hello %q", dir, strings.TrimSpace(line))
+}
+
+// traceMarker logs the marker byte starting a response to a gzip client
+func traceMarker(dir string, marker byte) {
+	if !tracing() {
+		return
+	}
+	name := "unknown"
+	switch marker {
+	case responsePlain:
+		name = "plain"
+	case responseGzip:
+		name = "gzip"
+	}
+	log.Printf("Trace: %s response marker=%s", dir, name)
+}
+
+// traceFrame logs a response frame sent or received, as it is before
+// compression. Output frames carry op output, so their payload is redacted.
+func traceFrame(dir string, typ byte, payload []byte) {
+	if !tracing() {
+		return
+	}
+	switch typ {
+	case frameOutput:
+		log.Printf("Trace: %s frame type=output len=%d payload=<redacted>", dir, len(payload))
+	case frameError:
+		log.Printf("Trace: %s frame type=error len=%d payload=%q", dir, len(payload), payload)
+	case frameExit:
+		log.Printf("Trace: %s frame type=exit len=%d payload=%q", dir, len(payload), payload)
+	default:
+		log.Printf("Trace: %s frame type=%#x len=%d payload=<redacted>", dir, typ, len(payload))
+	}
+}
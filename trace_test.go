@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestTrace tests that with OPFWD_TRACE set the client and server log every
+// request and frame crossing the socket, without the op output
+func TestTrace(t *testing.T) {
+	installFakeOp(t, func(inv opInvocation) int {
+		inv.stdout.Write([]byte("s3cr3t\n"))
+		return 0
+	})
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - "read op://App/"
+`)
+	serveConfig(t, cfg)
+	logs := captureLog(t)
+
+	// Tracing is off by default
+	if _, err := forwardCommand(&bytes.Buffer{}, cfg.SocketPath, "read op://App/db/password", clientOptions{}); err != nil {
+		t.Fatalf("Failed to forward command: %v", err)
+	}
+	if strings.Contains(logs.String(), "Trace:") {
+		t.Fatalf("Expected no trace without %s, got %q", traceEnvVar, logs.String())
+	}
+
+	t.Setenv(traceEnvVar, "1")
+	var out bytes.Buffer
+	if _, err := forwardCommand(&out, cfg.SocketPath, "read op://App/db/password", clientOptions{}); err != nil {
+		t.Fatalf("Failed to forward command: %v", err)
+	}
+	if out.String() != "s3cr3t\n" {
+		t.Errorf("Expected tracing not to change the output, got %q", out.String())
+	}
+
+	// Client and server log concurrently, so check each side's sequence.
+	// The hellos of both sides cross, so only count them.
+	trace := regexp.MustCompile(`Trace: (send|recv) (.*)`).FindAllStringSubmatch(logs.String(), -1)
+	var sent, received []string
+	hellos := map[string]int{}
+	for _, m := range trace {
+		if strings.HasPrefix(m[2], "hello ") {
+			hellos[m[1]+" "+m[2]]++
+			continue
+		}
+		if m[1] == "send" {
+			sent = append(sent, m[2])
+		} else {
+			received = append(received, m[2])
+		}
+	}
+	request := `request command="read op://App/db/password" flags=[gzip status] stdin_len=0`
+	output := `frame type=output len=7 payload=<redacted>`
+	exit := `frame type=exit len=1 payload="0"`
+	marker := `response marker=plain`
+
+	// The server traces frames as they are written, and a small response
+	// is only sent with its marker once complete
+	if want := []string{request, output, exit, marker}; strings.Join(sent, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected to send %q, got %q", want, sent)
+	}
+	if want := []string{request, marker, output, exit}; strings.Join(received, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected to receive %q, got %q", want, received)
+	}
+	if hello := `hello "@hello 1"`; hellos["send "+hello] != 2 || hellos["recv "+hello] != 2 {
+		t.Errorf("Expected both sides to send and receive a hello, got %v", hellos)
+	}
+	if strings.Contains(logs.String(), "s3cr3t") {
+		t.Errorf("Expected op output to be redacted from the trace, got %q", logs.String())
+	}
+}
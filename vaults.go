@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+)
+
+// opRefPrefix starts a secret reference, op://vault/item/field
+const opRefPrefix = "op://"
+
+// commandVaults returns the vaults a command names, from the vault segment
+// of its op:// references and the values of its --vault flags
+func commandVaults(command string) []string {
+	var vaults []string
+	args := strings.Fields(command)
+	for i, arg := range args {
+		arg = strings.Trim(arg, `"'`)
+		if _, ref, ok := strings.Cut(arg, opRefPrefix); ok {
+			vault, _, _ := strings.Cut(ref, "/")
+			vault, _, _ = strings.Cut(vault, "?")
+			vaults = append(vaults, vault)
+			continue
+		}
+		if value, ok := strings.CutPrefix(arg, "--vault="); ok {
+			vaults = append(vaults, strings.Trim(value, `"'`))
+		} else if arg == "--vault" && i+1 < len(args) {
+			vaults = append(vaults, strings.Trim(args[i+1], `"'`))
+		}
+	}
+	return vaults
+}
+
+// allowsVaults reports whether a command stays within the vault the rule is
+// restricted to. A command naming no vault at all could reach every vault,
+// so a restricted rule doesn't allow it.
+func (r *Rule) allowsVaults(command string) bool {
+	if r.Vault == "" {
+		return true
+	}
+	vaults := commandVaults(command)
+	if len(vaults) == 0 {
+		return false
+	}
+	for _, vault := range vaults {
+		if vault != r.Vault {
+			return false
+		}
+	}
+	return true
+}
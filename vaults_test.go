@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestRuleVault tests that a rule restricted to a vault only allows commands
+// within it, even under a generic prefix
+func TestRuleVault(t *testing.T) {
+	cfg := loadTestConfig(t, `
+allowed_prefixes:
+  - match: "read "
+    vault: Employee
+  - match: "item get"
+    vault: Employee
+`)
+
+	tests := map[string]bool{
+		"read op://Employee/GitHub/password":                       true,
+		"read 'op://Employee/GitHub/password'":                     true,
+		"read op://Personal/GitHub/password":                       false,
+		"read op://Employee/GitHub/password op://Personal/ssh/key": false,
+		"item get GitHub --vault Employee":                         true,
+		"item get GitHub --vault=Employee":                         true,
+		"item get GitHub --vault Personal":                         false,
+		"item get GitHub":                                          false,
+	}
+	for input, want := range tests {
+		if got := validateCommand(&cfg.Rules, input); got != want {
+			t.Errorf("validateCommand(%q) = %v, want %v", input, got, want)
+		}
+	}
+}
+
+// TestCommandVaults tests extracting the vaults a command names
+func TestCommandVaults(t *testing.T) {
+	tests := map[string][]string{
+		"read op://Employee/GitHub/password":                 {"Employee"},
+		"read op://Employee/GitHub/password?attribute=otp":   {"Employee"},
+		"read op://Employee":                                 {"Employee"},
+		"item get x --vault Ops --fields op://Shared/a/b":    {"Ops", "Shared"},
+		"inject --in-file tpl --reference=op://Infra/db/url": {"Infra"},
+		"vault list": nil,
+	}
+	for command, want := range tests {
+		if got := commandVaults(command); !reflect.DeepEqual(got, want) {
+			t.Errorf("commandVaults(%q) = %q, want %q", command, got, want)
+		}
+	}
+
+	path := writeTestConfig(t, "account: \"test-account\"\nallowed_prefixes: [{match: \"read \", vault: \"Employee/GitHub\"}]\n")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "invalid vault") {
+		t.Errorf("Expected invalid vault error, got %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync"
+)
+
+// authErrorPatterns are fragments of the errors op prints when its session
+// can't authenticate, matched case-insensitively
+var authErrorPatterns = []string{
+	"not currently signed in",
+	"not signed in",
+	"session expired",
+	"invalid session",
+	"authorization prompt dismissed",
+	"unauthorized",
+}
+
+// maxAuthScanBytes is how much of op's error output is searched for auth errors
+const maxAuthScanBytes = 4096
+
+// authErrorScanner records op's error output to look for auth failures and
+// other known errors in it. It keeps the first maxAuthScanBytes written to it and drops the rest.
+type authErrorScanner struct {
+	buf secretBuffer
+}
+
+// Write keeps p for scanning, it never fails
+func (s *authErrorScanner) Write(p []byte) (int, error) {
+	if room := maxAuthScanBytes - s.buf.Len(); room > 0 {
+		s.buf.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+// found reports whether the output seen so far holds an auth error
+func (s *authErrorScanner) found() bool {
+	return s.matches(authErrorPatterns)
+}
+
+// matches reports whether the output seen so far holds any of patterns,
+// ignoring case
+func (s *authErrorScanner) matches(patterns []string) bool {
+	text := bytes.ToLower(s.buf.Bytes())
+	defer wipe(text)
+	for _, pattern := range patterns {
+		if bytes.Contains(text, []byte(strings.ToLower(pattern))) {
+			return true
+		}
+	}
+	return false
+}
+
+// wipe clears the output kept for scanning
+func (s *authErrorScanner) wipe() {
+	s.buf.wipe()
+}
+
+// authWatchdog counts consecutive op auth failures. Once AuthFailureThreshold is
+// reached, the next login check skips the probe and signs in afresh, for op
+// sessions stuck in a state the probe doesn't notice.
+var authWatchdog struct {
+	mu          sync.Mutex
+	failures    int
+	forceSignin bool
+}
+
+// recordAuthFailure counts an op run that failed to authenticate
+func recordAuthFailure(logger *log.Logger) {
+	authWatchdog.mu.Lock()
+	defer authWatchdog.mu.Unlock()
+
+	authWatchdog.failures++
+	if config.AuthFailureThreshold > 0 && authWatchdog.failures >= config.AuthFailureThreshold && !authWatchdog.forceSignin {
+		logger.Printf("op failed to authenticate %d times in a row, forcing a fresh sign in before the next command", authWatchdog.failures)
+		authWatchdog.forceSignin = true
+	}
+}
+
+// resetAuthFailures clears the failure count after a successful op run
+func resetAuthFailures() {
+	authWatchdog.mu.Lock()
+	defer authWatchdog.mu.Unlock()
+	authWatchdog.failures = 0
+}
+
+// takeForcedSignin reports whether a fresh sign in is due, and clears the
+// failure count and the request for it
+func takeForcedSignin() bool {
+	authWatchdog.mu.Lock()
+	defer authWatchdog.mu.Unlock()
+
+	if !authWatchdog.forceSignin {
+		return false
+	}
+	authWatchdog.forceSignin = false
+	authWatchdog.failures = 0
+	return true
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestAuthFailureWatchdog tests that repeated auth failures force a fresh
+// sign in, even while the login probe claims the session is fine
+func TestAuthFailureWatchdog(t *testing.T) {
+	var mu sync.Mutex
+	signedIn := false
+	fake := installFakeOp(t, func(inv opInvocation) int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		args := strings.Join(inv.args, " ")
+		switch {
+		case strings.Contains(args, "account get"):
+			return 0
+		case strings.HasPrefix(args, "signin"):
+			signedIn = true
+			return 0
+		case !signedIn:
+			fmt.Fprintln(inv.stderr, "[ERROR] 2024/01/01 00:00:00 session expired, sign in to create a new session")
+			return 1
+		}
+		fmt.Fprintf(inv.stdout, "op %s\n", args)
+		return 0
+	})
+	t.Cleanup(func() {
+		resetAuthFailures()
+		takeForcedSignin()
+	})
+	cfg := loadTestConfig(t, `
+auth_failure_threshold: 2
+allowed_prefixes:
+  - "item get"
+`)
+	serveConfig(t, cfg)
+
+	for i := 0; i < 2; i++ {
+		response, err := sendCommand(t, cfg.SocketPath, "item get foo")
+		if err != nil || !strings.Contains(response, "session expired") {
+			t.Fatalf("Expected request %d to fail authenticating, got %q: %v", i+1, response, err)
+		}
+	}
+	if n := fake.callCount("signin"); n != 0 {
+		t.Fatalf("Expected no sign in before the threshold, got %d", n)
+	}
+
+	response, err := sendCommand(t, cfg.SocketPath, "item get foo")
+	if err != nil || response != "op --account test-account item get foo\n" {
+		t.Errorf("Expected the command to work after the forced sign in, got %q: %v", response, err)
+	}
+	if n := fake.callCount("signin"); n != 1 {
+		t.Errorf("Expected one forced sign in, got %d", n)
+	}
+
+	// Later commands go back to the usual probe
+	if _, err := sendCommand(t, cfg.SocketPath, "item get foo"); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if n := fake.callCount("signin"); n != 1 {
+		t.Errorf("Expected no further sign in, got %d", n)
+	}
+}
+
+// TestAuthErrorScanner tests which op errors count as auth failures
+func TestAuthErrorScanner(t *testing.T) {
+	tests := map[string]bool{
+		"[ERROR] You are not currently signed in. Please run `op signin --help`": true,
+		"[ERROR] authorization prompt dismissed, please try again":               true,
+		"[ERROR] \"foo\" isn't an item in any vault":                             false,
+	}
+	for output, want := range tests {
+		var s authErrorScanner
+		fmt.Fprint(&s, output)
+		if got := s.found(); got != want {
+			t.Errorf("found() for %q = %v, want %v", output, got, want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// whoamiCacheTTL is how long @status reuses the identity op reported, so
+	// polling the status doesn't run op every time
+	whoamiCacheTTL = time.Minute
+
+	// whoamiTimeout bounds how long @status waits for op whoami
+	whoamiTimeout = 10 * time.Second
+)
+
+// errWhoamiNotSignedIn is returned by opWhoami when op reports that the
+// account isn't signed in
+var errWhoamiNotSignedIn = errors.New("not signed in")
+
+// opIdentity is the identity `op whoami` reports for the server's account
+type opIdentity struct {
+	URL      string `json:"url"`
+	Email    string `json:"email"`
+	UserType string `json:"user_type"`
+}
+
+// String describes the identity with the email masked like the account
+func (id opIdentity) String() string {
+	user := maskEmail(id.Email)
+	if id.Email == "" {
+		user = strings.ToLower(strings.ReplaceAll(id.UserType, "_", " "))
+	}
+	return fmt.Sprintf("%s at %s", user, id.URL)
+}
+
+// maskEmail masks the local part of an email like maskAccount does, keeping
+// the domain
+func maskEmail(email string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok {
+		return maskAccount(email)
+	}
+	return maskAccount(local) + "@" + domain
+}
+
+// whoamiCache holds the last identity op reported, cleared whenever the
+// session changes
+var whoamiCache struct {
+	mu       sync.Mutex
+	identity *opIdentity
+	at       time.Time
+}
+
+// resetWhoami forgets the identity op reported
+func resetWhoami() {
+	whoamiCache.mu.Lock()
+	defer whoamiCache.mu.Unlock()
+	whoamiCache.identity = nil
+}
+
+// opWhoami returns the identity the server's account is signed in as, asking
+// op at most once per whoamiCacheTTL. It never signs in, a failed check is
+// not cached.
+func opWhoami(logger *log.Logger) (opIdentity, error) {
+	whoamiCache.mu.Lock()
+	defer whoamiCache.mu.Unlock()
+	if whoamiCache.identity != nil && now().Sub(whoamiCache.at) < whoamiCacheTTL {
+		return *whoamiCache.identity, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), whoamiTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	args := []string{"--account", config.Account, "whoami", "--format", "json"}
+	exitCode, err := opRunner(ctx, opInvocation{args: args, stdout: &stdout, stderr: &stderr, env: opEnv(), logger: logger})
+	if err != nil {
+		return opIdentity{}, err
+	}
+	if exitCode != 0 {
+		if strings.Contains(strings.ToLower(stderr.String()), "not signed in") {
+			return opIdentity{}, errWhoamiNotSignedIn
+		}
+		return opIdentity{}, fmt.Errorf("op whoami exited with %d: %s", exitCode, strings.TrimSpace(stderr.String()))
+	}
+
+	var id opIdentity
+	if err := json.Unmarshal(stdout.Bytes(), &id); err != nil || id.URL == "" {
+		return opIdentity{}, errors.New("op whoami returned no identity")
+	}
+	whoamiCache.identity = &id
+	whoamiCache.at = now()
+	return id, nil
+}
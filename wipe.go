@@ -0,0 +1,51 @@
+package main
+
+// wipe overwrites b with zeros. Buffers that held op output, which may be a
+// secret, are wiped once they are no longer needed instead of being left for
+// the garbage collector with the secret still in them.
+func wipe(b []byte) {
+	clear(b)
+}
+
+// secretBuffer collects op output like a bytes.Buffer, but wipes its old
+// storage whenever it grows, so only the current storage ever holds the
+// output and a single call to wipe clears it
+type secretBuffer struct {
+	b []byte
+}
+
+// Write appends p to the buffer, it never fails
+func (s *secretBuffer) Write(p []byte) (int, error) {
+	if len(s.b)+len(p) > cap(s.b) {
+		grown := make([]byte, len(s.b), max(2*cap(s.b), len(s.b)+len(p), 512))
+		copy(grown, s.b)
+		wipe(s.b)
+		s.b = grown
+	}
+	s.b = append(s.b, p...)
+	return len(p), nil
+}
+
+// Len returns the number of bytes in the buffer
+func (s *secretBuffer) Len() int {
+	return len(s.b)
+}
+
+// Bytes returns the contents of the buffer, valid until the next write or wipe
+func (s *secretBuffer) Bytes() []byte {
+	return s.b
+}
+
+// wipe zeroes the buffer and empties it
+func (s *secretBuffer) wipe() {
+	wipe(s.b[:cap(s.b)])
+	s.b = s.b[:0]
+}
+
+// withSecretBuffer runs fn with a buffer for op output, and wipes the buffer
+// once fn returns, whatever it did with it
+func withSecretBuffer(fn func(buf *secretBuffer)) {
+	var buf secretBuffer
+	defer buf.wipe()
+	fn(&buf)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestWithSecretBuffer tests that the buffer, including the storage it grew
+// out of, is zeroed once the guarded operation returns
+func TestWithSecretBuffer(t *testing.T) {
+	var first, last []byte
+	withSecretBuffer(func(buf *secretBuffer) {
+		buf.Write([]byte("op://App/db/password=hunter2\n"))
+		first = buf.Bytes()[:cap(buf.Bytes())]
+
+		// Outgrow the first storage
+		buf.Write([]byte(strings.Repeat("s3cr3t", 200)))
+		last = buf.Bytes()[:cap(buf.Bytes())]
+		if !bytes.HasPrefix(buf.Bytes(), []byte("op://App/db/password=hunter2\ns3cr3t")) {
+			t.Errorf("Expected the buffer to hold everything written, got %q", buf.Bytes())
+		}
+	})
+
+	if &first[0] == &last[0] {
+		t.Fatal("Expected the buffer to have grown into new storage")
+	}
+	for name, b := range map[string][]byte{"first": first, "last": last} {
+		if i := bytes.IndexFunc(b, func(r rune) bool { return r != 0 }); i >= 0 {
+			t.Errorf("Expected the %s storage to be zeroed, found %q at %d", name, b[i], i)
+		}
+	}
+}
+
+// TestReadCacheWipes tests that cached outputs are zeroed when dropped, and
+// that callers get a copy they can wipe on their own
+func TestReadCacheWipes(t *testing.T) {
+	prev := config
+	t.Cleanup(func() {
+		config = prev
+		clearReadCache()
+	})
+	config = loadTestConfig(t, "read_cache_ttl: 1m\ncacheable_prefixes: [\"read \"]\n")
+
+	at := now()
+	storeOutput("read op://App/db/password", []byte("hunter2\n"), at)
+	readCache.mu.Lock()
+	stored := readCache.entries["read op://App/db/password"].output
+	readCache.mu.Unlock()
+
+	output, ok := cachedOutput("read op://App/db/password", at)
+	if !ok || string(output) != "hunter2\n" {
+		t.Fatalf("Expected the cached output, got %q", output)
+	}
+	wipe(output)
+	if string(stored) != "hunter2\n" {
+		t.Errorf("Expected wiping the copy to leave the cache alone, got %q", stored)
+	}
+
+	clearReadCache()
+	if !bytes.Equal(stored, make([]byte, len(stored))) {
+		t.Errorf("Expected the dropped output to be zeroed, got %q", stored)
+	}
+}